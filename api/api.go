@@ -1,29 +1,73 @@
 package api
 
 import (
-	"bytes"
-	"crypto/tls"
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/labstack/echo"
 	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	"github.com/pintobikez/brazilian-correios-service/callback"
 	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
 	hand "github.com/pintobikez/brazilian-correios-service/correiosapi"
 	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/trackingcode"
+	"io"
+	"log"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	//DefaultSubscriptionDays days a tracking subscription is polled by default
+	DefaultSubscriptionDays = 30
+	//MaxSubscriptionDays max days a tracking subscription can be polled
+	MaxSubscriptionDays = 90
+	//MaxSubscriptionObjects max number of objects in a subscription request
+	MaxSubscriptionObjects = 1000
+	//DefaultRequestTimeout seconds an api request can take by default
+	DefaultRequestTimeout = 60
+	//MaxRequestPackages max number of packages in a reverse request
+	MaxRequestPackages = 50
+	//MaxRequestProducts max number of packaging products in a reverse request
+	MaxRequestProducts = 10
+	//MaxRequestServices max number of additional services in a reverse request
+	MaxRequestServices = 5
+	//MaxRequestDocuments max number of documents checked in a reverse request
+	MaxRequestDocuments = 10
 )
 
 //Regex to validate date formats
 const DateRegex = "(^(((0[1-9]|1[0-9]|2[0-8])[/](0[1-9]|1[012]))|((29|30|31)[/](0[13578]|1[02]))|((29|30)[/](0[4,6,9]|11)))[/](19|[2-9][0-9])$)|(^29[/]02[/](19|[2-9][0-9])(00|04|08|12|16|20|24|28|32|36|40|44|48|52|56|60|64|68|72|76|80|84|88|92|96)$)"
 
 var (
-	//OperatorValues Values that can be used in the operators
-	OperatorValues = map[string]bool{"LIKE": true, "=": true, ">=": true, "<=": true, "<>": true, "!=": true, "IN": true, "NOT IN": true}
 	//RequestNotFound request not found message
 	RequestNotFound = "Request with ID: %d not found"
+	//TrackingNotFound tracking object not found message
+	TrackingNotFound = "Tracking of object: %s not found"
+	//TrackingJobNotFound tracking job not found message
+	TrackingJobNotFound = "Tracking job with ID: %d not found"
+	//SubscriptionNotFound tracking subscription not found message
+	SubscriptionNotFound = "Subscription with ID: %d not found"
+	//SubscriptionStopOn valid stop conditions of a tracking subscription
+	SubscriptionStopOn = map[string]bool{strut.StopOnDelivered: true, strut.StopOnPosted: true, strut.StopOnFirstEvent: true}
+	//RequestNotEditable request can not be updated message
+	RequestNotEditable = "Request with ID: %d can not be updated in status %s"
+	//RequestNotInCorreios request without a postage code message
+	RequestNotInCorreios = "Request with ID: %d has no postage code in Correios yet"
+	//CallbackNotFound callback not found message
+	CallbackNotFound = "Callback with ID: %d not found"
+	//ClientNotFound client not found message
+	ClientNotFound = "Client with ID: %s not found"
+	//ClientExists client already registered message
+	ClientExists = "Client with ID: %s already exists"
+	//ServiceCodeRegex valid codes of the additional services of Correios
+	ServiceCodeRegex = regexp.MustCompile("^[0-9]{3}$")
+	//ProductCodeRegex valid codes and types of the packaging products of Correios
+	ProductCodeRegex = regexp.MustCompile("^[0-9]{1,20}$")
+	//ClientIDRegex valid client IDs
+	ClientIDRegex = regexp.MustCompile("^[A-Za-z0-9_.-]{1,64}$")
 	//ErrorNotSet field not set message
 	ErrorNotSet = "%s not set"
 	//ErrorIsEmpty field empty message
@@ -41,12 +85,37 @@ type API struct {
 
 //New method to create a new API struct
 func New(r repo.Definition, c *cnf.CorreiosConfig) *API {
-	return &API{Repo: r, Conf: c, Hand: &hand.Handler{Repo: r, Conf: c}}
+	return &API{Repo: r, Conf: c, Hand: hand.New(r, c)}
+}
+
+//SetOutput sets the output file of the errors of the work done in background
+func (a *API) SetOutput(file io.Writer) {
+	log.SetOutput(file)
+}
+
+//Deadline Middleware that sets the deadline of the api requests, their database queries and calls to Correios
+//are cancelled once it passes or the client disconnects
+func (a *API) Deadline() echo.MiddlewareFunc {
+	timeout := time.Duration(DefaultRequestTimeout) * time.Second
+	if a.Conf != nil && a.Conf.RequestTimeout > 0 {
+		timeout = time.Duration(a.Conf.RequestTimeout) * time.Second
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
 }
 
 //GetTracking Handler to retrieve Tracking information
 func (a *API) GetTracking() echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := c.Request().Context()
 
 		o := new(strut.Tracking)
 		// if is an invalid json format
@@ -55,15 +124,15 @@ func (a *API) GetTracking() echo.HandlerFunc {
 		}
 
 		// check if the json is valid
-		if err := a.ValidateTrackingJSON(o); len(err) > 0 {
+		if err := a.ValidateTrackingJSON(ctx, o); len(err) > 0 {
 			return c.JSON(http.StatusBadRequest, buildErrorResponse(err))
 		}
 
 		// Track the objects
 		// If the number of objects is Lower then 5 we run it as a normal function
-		// If not we run it as a go routine
+		// If not we run it as a tracking job and reply with its ID
 		if len(o.Objects) <= 5 {
-			ret, err := a.Hand.TrackObjects(o)
+			ret, err := a.Hand.TrackObjects(ctx, o)
 			if err != nil {
 				return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 			}
@@ -71,20 +140,184 @@ func (a *API) GetTracking() echo.HandlerFunc {
 			return c.JSON(http.StatusOK, ret)
 		}
 
-		// run it as a go routine and reply to the callback url
-		go func() {
-			if ret, _ := a.Hand.TrackObjects(o); ret != nil {
-				doCallbackRequest(ret, o.Callback)
+		// run it as a job that can be polled and reply to the callback url through the outbox
+		j := &strut.TrackingJob{TrackingType: o.TrackingType, Language: o.Language, Callback: o.Callback, ClientID: o.ClientID, Objects: o.Objects}
+		if err := a.Repo.InsertTrackingJob(ctx, j); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		a.Hand.Go(func(ctx context.Context) { a.Hand.RunTrackingJob(ctx, j) })
+
+		return c.JSON(http.StatusAccepted, j)
+	}
+}
+
+//GetTrackingJob Handler to GET a tracking job and its result once it is done
+func (a *API) GetTrackingJob() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		jobID, err := strconv.ParseInt(c.Param("jobId"), 10, 64)
+		// if jobId isn't an int
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		res, err := a.Repo.GetTrackingJobByID(ctx, jobID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if res.JobID == 0 {
+			return c.JSON(http.StatusNotFound, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(TrackingJobNotFound, jobID)}})
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+//GetTrackingObject Handler to GET the stored tracking timeline of an object, refreshed from Correios when it is older than the TTL
+func (a *API) GetTrackingObject() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		parsed, err := trackingcode.Parse(c.Param("code"))
+		// if code isn't a valid tracking code
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, "code " + err.Error()}})
+		}
+		code := parsed.String()
+
+		res, err := a.Hand.GetTrackingTimeline(ctx, code)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if res == nil || res.Object == "" {
+			return c.JSON(http.StatusNotFound, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(TrackingNotFound, code)}})
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+//ValidateTrackingCode Handler to validate a tracking code and get its service
+func (a *API) ValidateTrackingCode() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		res := struct {
+			Code  string             `json:"code"`
+			Valid bool               `json:"valid"`
+			Error string             `json:"error,omitempty"`
+			Parts *trackingcode.Code `json:"parts,omitempty"`
+		}{Code: c.Param("code")}
+
+		parsed, err := trackingcode.Parse(res.Code)
+		if err != nil {
+			res.Error = err.Error()
+			return c.JSON(http.StatusOK, res)
+		}
+		res.Code = parsed.String()
+		res.Valid = true
+		res.Parts = parsed
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+//PostTrackingSubscription Handler to subscribe to the new tracking events of objects
+func (a *API) PostTrackingSubscription() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		o := new(strut.TrackingSubscriptionRequest)
+		// if is an invalid json format
+		if err := c.Bind(&o); err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		// check if the json is valid
+		if err := a.ValidateSubscriptionJSON(ctx, o); len(err) > 0 {
+			return c.JSON(http.StatusBadRequest, buildErrorResponse(err))
+		}
+
+		expiresAt := time.Now().AddDate(0, 0, int(o.Days))
+		res := make([]*strut.TrackingSubscription, 0, len(o.Objects))
+		seen := make(map[string]bool)
+
+		for _, code := range o.Objects {
+			if seen[code] {
+				continue
+			}
+			seen[code] = true
+
+			sub := &strut.TrackingSubscription{Object: code, Callback: o.Callback, ClientID: o.ClientID, StopOn: o.StopOn}
+			if err := a.Repo.InsertTrackingSubscription(ctx, sub, expiresAt); err != nil {
+				return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 			}
-		}()
+			res = append(res, sub)
+		}
+
+		return c.JSON(http.StatusCreated, res)
+	}
+}
+
+//GetTrackingSubscription Handler to GET a tracking subscription
+func (a *API) GetTrackingSubscription() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		res, errResp := a.findSubscription(ctx, c.Param("subscriptionId"))
+		if errResp != nil {
+			return c.JSON(errResp.Error.Code, errResp)
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+//DeleteTrackingSubscription Handler to end a tracking subscription
+func (a *API) DeleteTrackingSubscription() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		res, errResp := a.findSubscription(ctx, c.Param("subscriptionId"))
+		if errResp != nil {
+			return c.JSON(errResp.Error.Code, errResp)
+		}
+
+		if res.Status == strut.SubscriptionActive {
+			res.Status = strut.SubscriptionEnded
+			res.EndedReason = strut.EndedCanceled
+			if err := a.Repo.UpdateTrackingSubscription(ctx, res); err != nil {
+				return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+			}
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
 
-		return c.NoContent(http.StatusOK)
+//findSubscription Finds a tracking subscription by its ID returning the error response if it is not found
+func (a *API) findSubscription(ctx context.Context, param string) (*strut.TrackingSubscription, *ErrResponse) {
+	subscriptionID, err := strconv.ParseInt(param, 10, 64)
+	// if subscriptionId isn't an int
+	if err != nil {
+		return nil, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}}
+	}
+
+	res, err := a.Repo.GetTrackingSubscriptionByID(ctx, subscriptionID)
+	if err != nil {
+		return nil, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}}
+	}
+	if res.SubscriptionID == 0 {
+		return nil, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(SubscriptionNotFound, subscriptionID)}}
 	}
+
+	return res, nil
 }
 
 //GetReverse Handler to GET Reverse information of a request
 func (a *API) GetReverse() echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := c.Request().Context()
 
 		// if requestId doesn't exist
 		if isset := c.Param("requestId"); isset == "" {
@@ -98,7 +331,7 @@ func (a *API) GetReverse() echo.HandlerFunc {
 		}
 
 		// try to find the request
-		res, err := a.Repo.GetRequestByID(requestID)
+		res, err := a.Repo.GetRequestByID(ctx, requestID)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 		}
@@ -107,6 +340,17 @@ func (a *API) GetReverse() echo.HandlerFunc {
 			return c.JSON(http.StatusNotFound, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(RequestNotFound, requestID)}})
 		}
 
+		// the objects and the history replied by Correios
+		if err := a.Hand.LoadCorreiosFollow(ctx, res); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if res.Packages, err = a.Repo.GetRequestPackages(ctx, res.RequestID); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if res.Products, err = a.Repo.GetRequestProducts(ctx, res.RequestID); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+
 		return c.JSON(http.StatusOK, res)
 	}
 }
@@ -114,6 +358,7 @@ func (a *API) GetReverse() echo.HandlerFunc {
 //GetReversesBy Handler to GET Reverse information for N Requests
 func (a *API) GetReversesBy() echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := c.Request().Context()
 
 		s := new(strut.Search)
 		// if is an invalid json format
@@ -127,7 +372,7 @@ func (a *API) GetReversesBy() echo.HandlerFunc {
 		}
 
 		// try to find the requests
-		res, err := a.Repo.GetRequestBy(s)
+		res, err := a.Repo.GetRequestBy(ctx, s)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 		}
@@ -139,6 +384,7 @@ func (a *API) GetReversesBy() echo.HandlerFunc {
 //PostReverse Handler to POST a Correios Reverse request
 func (a *API) PostReverse() echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := c.Request().Context()
 
 		o := new(strut.Request)
 		// if is an invalid json format
@@ -147,17 +393,39 @@ func (a *API) PostReverse() echo.HandlerFunc {
 		}
 
 		// check if the json is valid
-		if err := a.ValidatePutJSON(o); len(err) > 0 {
+		if err := a.ValidatePutJSON(ctx, o); len(err) > 0 {
 			return c.JSON(http.StatusBadRequest, buildErrorResponse(err))
 		}
 
-		// insert the request into the db
-		if err := a.Repo.InsertRequest(o); err != nil {
+		// insert the request, its items, its packages, its products, its first status and the job of the Correios request into the db
+		var job *strut.ReverseJob
+		err := a.Repo.Transaction(ctx, func(tx repo.Definition) error {
+			if err := tx.InsertRequest(ctx, o); err != nil {
+				return err
+			}
+			if len(o.Packages) > 0 {
+				if err := tx.SaveRequestPackages(ctx, o.RequestID, o.Packages); err != nil {
+					return err
+				}
+			}
+			if len(o.Products) > 0 {
+				if err := tx.SaveRequestProducts(ctx, o.RequestID, o.Products); err != nil {
+					return err
+				}
+			}
+			if err := tx.InsertStatusHistory(ctx, &strut.StatusHistory{RequestID: o.RequestID, ToStatus: o.Status, Source: strut.SourceAPI}); err != nil {
+				return err
+			}
+			var err error
+			job, err = hand.QueueReverseJob(ctx, tx, o.RequestID, strut.ActionCreate, strut.SourceAPI)
+			return err
+		})
+		if err != nil {
 			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 		}
 
-		// Create GO routine to perform Correios request
-		go a.Hand.DoReverseLogistic(o)
+		// run the job now, the sweeper of the cronjobs runs it if this process stops first
+		a.Hand.SubmitReverseJob(job)
 
 		return c.JSON(http.StatusOK, struct {
 			RequestID int64 `json:"request_id"`
@@ -165,9 +433,16 @@ func (a *API) PostReverse() echo.HandlerFunc {
 	}
 }
 
-//PutReverse Handler to PUT a Correios Reverse request
+//PutReverse Handler to PUT a Correios Reverse request, only allowed while the request is pending, in error or expired
 func (a *API) PutReverse() echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		requestID, err := strconv.Atoi(c.Param("requestId"))
+		// if requestId isn't an int
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
 
 		o := new(strut.Request)
 		// if is an invalid json format
@@ -176,37 +451,136 @@ func (a *API) PutReverse() echo.HandlerFunc {
 		}
 
 		// check if the json is valid
-		if err := a.ValidatePutJSON(o); len(err) > 0 {
+		if err := a.ValidatePutJSON(ctx, o); len(err) > 0 {
 			return c.JSON(http.StatusBadRequest, buildErrorResponse(err))
 		}
 
 		// try to find the request
-		found, err := a.Repo.FindRequestByID(o.RequestID)
+		found, err := a.Repo.GetRequestByID(ctx, requestID)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 		}
-		if !found {
-			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, fmt.Sprintf(RequestNotFound, o.RequestID)}})
+		if found.RequestID == 0 {
+			return c.JSON(http.StatusNotFound, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(RequestNotFound, requestID)}})
+		}
+		if !strut.EditableStatus[found.Status] {
+			return c.JSON(http.StatusConflict, &ErrResponse{ErrContent{http.StatusConflict, fmt.Sprintf(RequestNotEditable, requestID, found.Status)}})
+		}
+
+		// the status and the codes are only changed by the transitions
+		o.RequestID = found.RequestID
+		o.Status = found.Status
+		o.ErrorMessage = found.ErrorMessage
+		o.Retries = found.Retries
+		o.PostageCode = found.PostageCode
+		o.TrackingCode = found.TrackingCode
+
+		// update the request, its packages and its products, a request without packages or products keeps them
+		err = a.Repo.Transaction(ctx, func(tx repo.Definition) error {
+			if err := tx.UpdateRequest(ctx, o); err != nil {
+				return err
+			}
+			if len(o.Packages) > 0 {
+				if err := tx.SaveRequestPackages(ctx, o.RequestID, o.Packages); err != nil {
+					return err
+				}
+			}
+			if len(o.Products) > 0 {
+				return tx.SaveRequestProducts(ctx, o.RequestID, o.Products)
+			}
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 		}
 
-		// rollback the status to PENDING
+		// rollback the status to PENDING and submit the request again
 		if o.Status == strut.StatusError || o.Status == strut.StatusExpired {
-			o.Status = strut.StatusPending
-			o.ErrorMessage = ""
+			if err := a.Hand.UpdateStatus(ctx, o, strut.StatusPending, "", strut.SourceAPI); err != nil {
+				return c.JSON(http.StatusConflict, &ErrResponse{ErrContent{http.StatusConflict, err.Error()}})
+			}
+			open, err := a.Hand.HasOpenReverseJob(ctx, o.RequestID)
+			if err == nil && !open {
+				var job *strut.ReverseJob
+				if job, err = hand.QueueReverseJob(ctx, a.Repo, o.RequestID, strut.ActionCreate, strut.SourceAPI); err == nil {
+					a.Hand.SubmitReverseJob(job)
+				}
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+			}
 		}
-		// update the request
-		err = a.Repo.UpdateRequest(o)
+
+		return c.JSON(http.StatusOK, o)
+	}
+}
+
+//RefreshReverse Handler to refresh a request with its last status and history in Correios
+func (a *API) RefreshReverse() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		requestID, err := strconv.Atoi(c.Param("requestId"))
+		// if requestId isn't an int
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		// try to find the request
+		res, err := a.Repo.GetRequestByID(ctx, requestID)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 		}
+		if res.RequestID == 0 {
+			return c.JSON(http.StatusNotFound, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(RequestNotFound, requestID)}})
+		}
+		if res.PostageCode == "" {
+			return c.JSON(http.StatusConflict, &ErrResponse{ErrContent{http.StatusConflict, fmt.Sprintf(RequestNotInCorreios, requestID)}})
+		}
 
-		return c.JSON(http.StatusOK, o)
+		ret, err := a.Hand.RefreshReverseLogistic(ctx, res)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+//GetDispatcherStats Handler to GET the number of workers and the running and queued calls to the reverse logistics service
+func (a *API) GetDispatcherStats() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, a.Hand.Dispatcher.Stats())
+	}
+}
+
+//GetHistory Handler to GET the status changes of a request
+func (a *API) GetHistory() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		requestID, err := strconv.ParseInt(c.Param("requestId"), 10, 64)
+		// if requestId isn't an int
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		res, err := a.Repo.GetStatusHistoryByRequestID(ctx, requestID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if len(res) == 0 {
+			return c.JSON(http.StatusNotFound, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(RequestNotFound, requestID)}})
+		}
+
+		return c.JSON(http.StatusOK, res)
 	}
 }
 
 //DeleteReverse Handler to DELETE a Correios Reverse request
 func (a *API) DeleteReverse() echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := c.Request().Context()
 
 		// if requestId doesn't exist
 		if isset := c.Param("requestId"); isset == "" {
@@ -220,7 +594,7 @@ func (a *API) DeleteReverse() echo.HandlerFunc {
 		}
 
 		// try to find the request
-		res, err := a.Repo.GetRequestByID(requestID)
+		res, err := a.Repo.GetRequestByID(ctx, requestID)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
 		}
@@ -229,21 +603,240 @@ func (a *API) DeleteReverse() echo.HandlerFunc {
 			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, fmt.Sprintf(RequestNotFound, requestID)}})
 		}
 
-		// Create GO routine to perform Correios request
-		go a.Hand.CancelReverseLogistic(res)
+		// a request that was used or already ended can not be canceled in Correios
+		if !strut.CanTransition(res.Status, strut.StatusCanceled) {
+			terr := &strut.TransitionError{RequestID: res.RequestID, From: res.Status, To: strut.StatusCanceled}
+			return c.JSON(http.StatusConflict, &ErrResponse{ErrContent{http.StatusConflict, terr.Error()}})
+		}
+
+		// the cancel runs after the jobs already queued for the request
+		job, err := hand.QueueReverseJob(ctx, a.Repo, res.RequestID, strut.ActionCancel, strut.SourceAPI)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		a.Hand.SubmitReverseJob(job)
 
 		return c.JSON(http.StatusOK, res)
 	}
 }
 
-//ValidateTrackingJSON Validates the consistency of the Tracking struct
-func (a *API) ValidateTrackingJSON(s *strut.Tracking) map[string]string {
+//GetCallbacks Handler to GET the callback deliveries of a request
+func (a *API) GetCallbacks() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		requestID, err := strconv.ParseInt(c.Param("requestId"), 10, 64)
+		// if requestId isn't an int
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		res, err := a.Repo.GetCallbackDeliveriesByRequestID(ctx, requestID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+//ReplayCallback Handler to deliver again a callback of a request
+func (a *API) ReplayCallback() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		requestID, err := strconv.ParseInt(c.Param("requestId"), 10, 64)
+		// if requestId isn't an int
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		callbackID, err := strconv.ParseInt(c.Param("callbackId"), 10, 64)
+		// if callbackId isn't an int
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		d, err := a.Repo.GetCallbackDeliveryByID(ctx, callbackID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if d.CallbackDeliveryID == 0 || d.RequestID != requestID {
+			return c.JSON(http.StatusNotFound, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(CallbackNotFound, callbackID)}})
+		}
+
+		res, err := a.Hand.Outbox.Replay(ctx, d)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+
+		return c.JSON(http.StatusAccepted, res)
+	}
+}
+
+//PostClient Handler to register a client and generate its callback secret
+func (a *API) PostClient() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		o := new(strut.Client)
+		// if is an invalid json format
+		if err := c.Bind(&o); err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrResponse{ErrContent{http.StatusBadRequest, err.Error()}})
+		}
+
+		ret := make(map[string]string)
+		if !ClientIDRegex.MatchString(o.ClientID) {
+			ret["client_id"] = fmt.Sprintf(ErrorValidValues, "up to 64 letters, numbers, '.', '_' or '-'")
+		}
+		if o.Name == "" {
+			ret["name"] = ErrorIsEmpty
+		}
+		if len(ret) > 0 {
+			return c.JSON(http.StatusBadRequest, buildErrorResponse(ret))
+		}
+
+		found, err := a.Repo.GetClientByID(ctx, o.ClientID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if found.ClientID != "" {
+			return c.JSON(http.StatusConflict, &ErrResponse{ErrContent{http.StatusConflict, fmt.Sprintf(ClientExists, o.ClientID)}})
+		}
+
+		if o.Secret, err = callback.NewSecret(); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		if err := a.Repo.InsertClient(ctx, o); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+
+		// the secret is only shown when it is generated
+		return c.JSON(http.StatusCreated, o)
+	}
+}
+
+//GetClient Handler to GET a client without its secrets
+func (a *API) GetClient() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		res, err := a.findClient(ctx, c.Param("clientId"))
+		if err != nil {
+			return c.JSON(err.Error.Code, err)
+		}
+		res.Secret = ""
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+//RotateClientSecret Handler to generate a new secret for a client keeping the current one active as the previous secret
+func (a *API) RotateClientSecret() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		res, errResp := a.findClient(ctx, c.Param("clientId"))
+		if errResp != nil {
+			return c.JSON(errResp.Error.Code, errResp)
+		}
+
+		secret, err := callback.NewSecret()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+		res.PreviousSecret = res.Secret
+		res.Secret = secret
+
+		if err := a.Repo.UpdateClientSecrets(ctx, res); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+//DeletePreviousClientSecret Handler to retire the previous secret of a client once the rotation is completed
+func (a *API) DeletePreviousClientSecret() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		res, errResp := a.findClient(ctx, c.Param("clientId"))
+		if errResp != nil {
+			return c.JSON(errResp.Error.Code, errResp)
+		}
+		res.PreviousSecret = ""
+
+		if err := a.Repo.UpdateClientSecrets(ctx, res); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}})
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+//findClient Finds a client by its ID returning the error response if it is not found
+func (a *API) findClient(ctx context.Context, clientID string) (*strut.Client, *ErrResponse) {
+	res, err := a.Repo.GetClientByID(ctx, clientID)
+	if err != nil {
+		return nil, &ErrResponse{ErrContent{http.StatusInternalServerError, err.Error()}}
+	}
+	if res.ClientID == "" {
+		return nil, &ErrResponse{ErrContent{http.StatusNotFound, fmt.Sprintf(ClientNotFound, clientID)}}
+	}
+
+	return res, nil
+}
+
+//validateClient Validates that the client of a request is registered
+func (a *API) validateClient(ctx context.Context, clientID string, ret map[string]string) {
+	if clientID == "" {
+		return
+	}
+	if _, err := a.findClient(ctx, clientID); err != nil {
+		ret["client_id"] = err.Error.Message
+	}
+}
+
+//ValidateSubscriptionJSON Validates the consistency of the TrackingSubscriptionRequest struct
+func (a *API) ValidateSubscriptionJSON(ctx context.Context, s *strut.TrackingSubscriptionRequest) map[string]string {
 
 	ret := make(map[string]string)
 
 	if s.Callback == "" {
 		ret["callback"] = ErrorIsEmpty
 	}
+	if len(s.Objects) == 0 {
+		ret["objects"] = ErrorIsEmpty
+	} else if len(s.Objects) > MaxSubscriptionObjects {
+		ret["objects"] = fmt.Sprintf("has more than %d objects", MaxSubscriptionObjects)
+	}
+	validateObjects(s.Objects, ret)
+
+	s.StopOn = strings.ToLower(s.StopOn)
+	if s.StopOn != "" && !SubscriptionStopOn[s.StopOn] {
+		ret["stop_on"] = fmt.Sprintf(ErrorValidValues, strings.Join([]string{strut.StopOnDelivered, strut.StopOnPosted, strut.StopOnFirstEvent}, " "))
+	}
+
+	if s.Days == 0 {
+		s.Days = DefaultSubscriptionDays
+		if a.Conf.SubscriptionDays > 0 {
+			s.Days = a.Conf.SubscriptionDays
+		}
+	}
+	if s.Days < 0 || s.Days > MaxSubscriptionDays {
+		ret["days"] = fmt.Sprintf("must be between 1 and %d", MaxSubscriptionDays)
+	}
+	a.validateClient(ctx, s.ClientID, ret)
+
+	return ret
+}
+
+//ValidateTrackingJSON Validates the consistency of the Tracking struct
+func (a *API) ValidateTrackingJSON(ctx context.Context, s *strut.Tracking) map[string]string {
+
+	ret := make(map[string]string)
+
 	if s.TrackingType == "" {
 		ret["tracking_type"] = ErrorIsEmpty
 	} else {
@@ -271,12 +864,26 @@ func (a *API) ValidateTrackingJSON(s *strut.Tracking) map[string]string {
 	if len(s.Objects) == 0 {
 		ret["objects"] = ErrorIsEmpty
 	}
+	validateObjects(s.Objects, ret)
+	a.validateClient(ctx, s.ClientID, ret)
 
 	return ret
 }
 
+//validateObjects Validates each tracking code normalizing it, the errors are set per object
+func validateObjects(objects []string, ret map[string]string) {
+	for i, code := range objects {
+		c, err := trackingcode.Parse(code)
+		if err != nil {
+			ret[fmt.Sprintf("objects[%d]", i)] = err.Error()
+			continue
+		}
+		objects[i] = c.String()
+	}
+}
+
 //ValidatePutJSON Validates the consistency of the Request struct
-func (a *API) ValidatePutJSON(s *strut.Request) map[string]string {
+func (a *API) ValidatePutJSON(ctx context.Context, s *strut.Request) map[string]string {
 
 	ret := make(map[string]string)
 
@@ -385,10 +992,113 @@ func (a *API) ValidatePutJSON(s *strut.Request) map[string]string {
 			ret["product_name"] = ErrorIsEmpty
 		}
 	}
+	validatePackages(s.Packages, ret)
+	validateAdditionalServices(s, ret)
+	validateProducts(s.Products, ret)
+	a.validateClient(ctx, s.ClientID, ret)
 
 	return ret
 }
 
+//validatePackages Validates the packages of a Request, the errors are set per package and the codes are only set by Correios
+func validatePackages(packages []*strut.RequestPackage, ret map[string]string) {
+	if len(packages) > MaxRequestPackages {
+		ret["packages"] = fmt.Sprintf("has more than %d packages", MaxRequestPackages)
+	}
+
+	ids := make(map[string]bool)
+	for i, p := range packages {
+		field := fmt.Sprintf("packages[%d]", i)
+		switch {
+		case p.ObjectID == "":
+			ret[field+".object_id"] = ErrorIsEmpty
+		case len(p.ObjectID) > 30:
+			ret[field+".object_id"] = "has more than 30 characters"
+		case ids[p.ObjectID]:
+			ret[field+".object_id"] = "is repeated"
+		}
+		ids[p.ObjectID] = true
+
+		if len(p.Description) > 255 {
+			ret[field+".description"] = "has more than 255 characters"
+		}
+		if p.Coleta < 0 {
+			ret[field+".coleta"] = "must be 0 or greater"
+		}
+		p.PostageCode = ""
+		p.TrackingCode = ""
+	}
+}
+
+//validateAdditionalServices Validates the declared value, the additional services and the checklist of a Request
+func validateAdditionalServices(s *strut.Request, ret map[string]string) {
+	if s.DeclaredValue < 0 || s.DeclaredValue >= 100000000 {
+		ret["declared_value"] = "must be between 0 and 99999999.99"
+	}
+
+	if len(s.AdditionalServices) > MaxRequestServices {
+		ret["additional_services"] = fmt.Sprintf("has more than %d services", MaxRequestServices)
+	}
+	services := make(map[string]bool)
+	for i, code := range s.AdditionalServices {
+		field := fmt.Sprintf("additional_services[%d]", i)
+		switch {
+		case !ServiceCodeRegex.MatchString(code):
+			ret[field] = "must have 3 digits"
+		case services[code]:
+			ret[field] = "is repeated"
+		}
+		services[code] = true
+	}
+
+	s.Checklist = strings.ToUpper(s.Checklist)
+	if _, ok := hand.ChecklistMap[s.Checklist]; s.Checklist != "" && !ok {
+		values := ""
+		for value := range hand.ChecklistMap {
+			values += value + " "
+		}
+		ret["checklist"] = fmt.Sprintf(ErrorValidValues, values)
+	}
+
+	// the documents are only checked by the checklist of documents
+	if len(s.Documents) > 0 && s.Checklist != "DOCUMENT" {
+		ret["documents"] = "only allowed with the DOCUMENT checklist"
+	} else if len(s.Documents) > MaxRequestDocuments {
+		ret["documents"] = fmt.Sprintf("has more than %d documents", MaxRequestDocuments)
+	}
+	for i, d := range s.Documents {
+		field := fmt.Sprintf("documents[%d]", i)
+		switch {
+		case d == "":
+			ret[field] = ErrorIsEmpty
+		case len(d) > 100:
+			ret[field] = "has more than 100 characters"
+		case strings.Contains(d, repo.ListSeparator):
+			ret[field] = "can not have " + repo.ListSeparator
+		}
+	}
+}
+
+//validateProducts Validates the packaging products of a Request, the errors are set per product
+func validateProducts(products []*strut.RequestProduct, ret map[string]string) {
+	if len(products) > MaxRequestProducts {
+		ret["products"] = fmt.Sprintf("has more than %d products", MaxRequestProducts)
+	}
+
+	for i, p := range products {
+		field := fmt.Sprintf("products[%d]", i)
+		if !ProductCodeRegex.MatchString(p.Code) {
+			ret[field+".code"] = fmt.Sprintf(ErrorValidValues, "numeric characters")
+		}
+		if len(p.Type) > 10 || !ProductCodeRegex.MatchString(p.Type) {
+			ret[field+".type"] = fmt.Sprintf(ErrorValidValues, "numeric characters")
+		}
+		if p.Quantity < 1 || p.Quantity > 999 {
+			ret[field+".quantity"] = "must be between 1 and 999"
+		}
+	}
+}
+
 //ValidateSearchJSON Validates the consistency of the Search struct
 func (a *API) ValidateSearchJSON(s *strut.Search) map[string]string {
 
@@ -402,20 +1112,76 @@ func (a *API) ValidateSearchJSON(s *strut.Search) map[string]string {
 		ret["offset"] = "lower than 0"
 	}
 	if s.OrderType != "" && s.OrderType != "ASC" && s.OrderType != "DESC" {
-		ret["order_type"] = "must be ASC or DESC"
+		ret["order_by_type"] = "must be ASC or DESC"
+	}
+	if s.OrderField != "" {
+		if _, ok := repo.SortFields[strings.ToLower(s.OrderField)]; !ok {
+			ret["order_by_field"] = fmt.Sprintf(ErrorValidValues, repo.FieldNames(repo.SortFields))
+		}
 	}
 
-	for _, e := range s.Where {
+	validateSearchWhere(s.Where, s.JoinBy, "where", "joinby", 0, ret)
+
+	return ret
+}
+
+//validateSearchWhere Validates the conditions and nested groups of a where clause
+func validateSearchWhere(where []*strut.SearchWhere, join string, path string, joinPath string, depth int, ret map[string]string) {
+
+	if depth > repo.MaxGroupDepth {
+		ret[path] = fmt.Sprintf("more than %d nested groups", repo.MaxGroupDepth)
+		return
+	}
+	if join != "" && !repo.SearchJoins[strings.ToUpper(join)] {
+		ret[joinPath] = fmt.Sprintf(ErrorValidValues, repo.FieldNames(repo.SearchJoins))
+	}
+
+	for i, e := range where {
+		p := fmt.Sprintf("%s[%d]", path, i)
+
+		if e == nil {
+			ret[p] = ErrorIsEmpty
+			continue
+		}
+
+		// a group only joins its own conditions
+		if e.IsGroup() {
+			if e.Field != "" || e.Operator != "" || e.Value != nil {
+				ret[p] = "a group can only have joinby and where"
+			}
+			if len(e.Where) == 0 {
+				ret[p+".where"] = ErrorIsEmpty
+			}
+			validateSearchWhere(e.Where, e.JoinBy, p+".where", p+".joinby", depth+1, ret)
+			continue
+		}
+
+		field, ok := repo.SearchFields[strings.ToLower(e.Field)]
+		if e.Field == "" {
+			ret[p+".field"] = ErrorIsEmpty
+		} else if !ok {
+			ret[p+".field"] = fmt.Sprintf(ErrorValidValues, repo.FieldNames(repo.SearchFields))
+		}
+
 		e.Operator = strings.ToUpper(e.Operator)
-		e.JoinBy = strings.ToUpper(e.JoinBy)
-		if e.Operator != "" && OperatorValues[e.Operator] {
-			ret["operator"] = fmt.Sprintf(ErrorValidValues, "like, =, >=, <=, <>, IN, NOT IN")
+		if e.Operator != "" && !repo.SearchOperators[e.Operator] {
+			ret[p+".operator"] = fmt.Sprintf(ErrorValidValues, repo.FieldNames(repo.SearchOperators))
+			continue
 		}
-		if e.JoinBy != "" && e.JoinBy != "AND" && e.JoinBy != "OR" {
-			ret["joinby"] = fmt.Sprintf(ErrorValidValues, "AND, OR")
+		if !ok {
+			continue
+		}
+
+		var err error
+		if e.Operator == "IN" || e.Operator == "NOT IN" {
+			_, err = repo.ListValue(e.Value, field.Numeric)
+		} else {
+			_, err = repo.ScalarValue(e.Value, field.Numeric)
+		}
+		if err != nil {
+			ret[p+".value"] = err.Error()
 		}
 	}
-	return ret
 }
 
 //buildErrorResponse creates an Error response object given a map of strings
@@ -429,35 +1195,3 @@ func buildErrorResponse(err map[string]string) *ErrResponseValidation {
 
 	return ret
 }
-
-//doCallbackRequest Performs an Http request to the defined callback
-func doCallbackRequest(e *strut.TrackingResponse, url string) {
-	buffer := new(bytes.Buffer)
-	_ = json.NewEncoder(buffer).Encode(e)
-
-	// Create the POST request to the callback
-	req, err := http.NewRequest("POST", url, buffer)
-	if err != nil {
-		// log error
-		fmt.Println(err.Error())
-		return
-	}
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Close = true
-
-	// check if it is an https request
-	re := regexp.MustCompile("^https://")
-	useTlS := re.MatchString(url)
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: useTlS},
-	}
-	client := &http.Client{Transport: tr}
-	res, err := client.Do(req)
-	if err != nil {
-		// log error
-		fmt.Println(err.Error())
-		return
-	}
-	defer res.Body.Close()
-}
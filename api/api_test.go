@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
+	"github.com/pintobikez/brazilian-correios-service/correiosapi/mockcorreios"
+	"github.com/pintobikez/brazilian-correios-service/repository/memory"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//newTestServer Returns the reverse routes of an API on a memory repository that calls the given fake of Correios
+func newTestServer(correios *httptest.Server) (*API, *echo.Echo) {
+	conf := &cnf.CorreiosConfig{URLReverse: correios.URL, URLTracking: correios.URL, CodAdministrativo: "123", CartaoPostagem: "456"}
+	a := New(memory.New(), conf)
+
+	e := echo.New()
+	e.POST("/reverse", a.PostReverse())
+	e.PUT("/reverse/:requestId", a.PutReverse())
+	e.GET("/reverse/:requestId", a.GetReverse())
+	e.DELETE("/reverse/:requestId", a.DeleteReverse())
+	e.POST("/reversesearch", a.GetReversesBy())
+
+	return a, e
+}
+
+//call Performs an api request and decodes its JSON response into ret
+func call(t *testing.T, e *echo.Echo, method string, path string, body interface{}, ret interface{}) int {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			t.Fatalf("Marshal: %s", err.Error())
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if ret != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), ret); err != nil {
+			t.Fatalf("%s %s replied %d %s: %s", method, path, rec.Code, rec.Body.String(), err.Error())
+		}
+	}
+	return rec.Code
+}
+
+//drain Waits for the calls to Correios started by the api requests
+func drain(t *testing.T, a *API) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := a.Hand.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %s", err.Error())
+	}
+}
+
+//newRequest Returns a valid reverse request without items
+func newRequest() *strut.Request {
+	return &strut.Request{
+		RequestType: "POSTAGE", RequestService: "PAC", SlipNumber: "123",
+		OriginNome: "Origin Name", OriginLogradouro: "Rua Origin", OriginNumero: 10, OriginCep: "01310100", OriginBairro: "Centro",
+		OriginCidade: "Sao Paulo", OriginUf: "SP", OriginEmail: "origin@mail.com",
+		DestinationNome: "Destination Name", DestinationLogradouro: "Rua Destination", DestinationNumero: 20, DestinationCep: "20040002",
+		DestinationBairro: "Centro", DestinationCidade: "Rio de Janeiro", DestinationUf: "RJ", DestinationEmail: "destination@mail.com",
+		Callback: "http://localhost/callback",
+	}
+}
+
+func TestPostReverseWithPackagesOnly(t *testing.T) {
+	correios := httptest.NewServer(mockcorreios.New())
+	defer correios.Close()
+	a, e := newTestServer(correios)
+
+	o := newRequest()
+	o.Packages = []*strut.RequestPackage{{ObjectID: "box-1", Description: "Shoes"}, {ObjectID: "box-2", Description: "Shirt", Coleta: 1}}
+
+	created := new(strut.Request)
+	if code := call(t, e, http.MethodPost, "/reverse", o, created); code != http.StatusOK || created.RequestID == 0 {
+		t.Fatalf("POST /reverse = %d, request %d", code, created.RequestID)
+	}
+	drain(t, a)
+
+	got := new(strut.Request)
+	path := fmt.Sprintf("/reverse/%d", created.RequestID)
+	if code := call(t, e, http.MethodGet, path, nil, got); code != http.StatusOK {
+		t.Fatalf("GET %s = %d", path, code)
+	}
+	if got.Status != strut.StatusGenerated || got.PostageCode == "" || got.ErrorMessage != "" {
+		t.Errorf("request is %s with postage code %q and error %q, want %s", got.Status, got.PostageCode, got.ErrorMessage, strut.StatusGenerated)
+	}
+	if len(got.Items) != 0 || len(got.Packages) != 2 {
+		t.Fatalf("request has %d items and %d packages, want 0 and 2", len(got.Items), len(got.Packages))
+	}
+	for _, p := range got.Packages {
+		if p.PostageCode == "" || p.TrackingCode == "" {
+			t.Errorf("package %s has postage code %q and tracking code %q", p.ObjectID, p.PostageCode, p.TrackingCode)
+		}
+	}
+	if got.Packages[0].PostageCode == got.Packages[1].PostageCode {
+		t.Errorf("the packages of different coletas share the postage code %s", got.Packages[0].PostageCode)
+	}
+}
+
+func TestSearchValueOfTextColumn(t *testing.T) {
+	correios := httptest.NewServer(mockcorreios.New())
+	defer correios.Close()
+	a, e := newTestServer(correios)
+
+	if code := call(t, e, http.MethodPost, "/reverse", newRequest(), new(strut.Request)); code != http.StatusOK {
+		t.Fatalf("POST /reverse = %d", code)
+	}
+	drain(t, a)
+
+	// a number searched on a text column is compared as text
+	var found []*strut.Request
+	search := &strut.Search{Where: []*strut.SearchWhere{{Field: "slip_number", Value: 123}}}
+	if code := call(t, e, http.MethodPost, "/reversesearch", search, &found); code != http.StatusOK || len(found) != 1 {
+		t.Errorf("POST /reversesearch by a numeric slip_number = %d with %d requests, want 200 with 1", code, len(found))
+	}
+
+	search = &strut.Search{Where: []*strut.SearchWhere{{Field: "status", Value: true}}}
+	if code := call(t, e, http.MethodPost, "/reversesearch", search, nil); code != http.StatusBadRequest {
+		t.Errorf("POST /reversesearch by a boolean status = %d, want 400", code)
+	}
+}
+
+func TestDeleteReverse(t *testing.T) {
+	correios := httptest.NewServer(mockcorreios.New())
+	defer correios.Close()
+	a, e := newTestServer(correios)
+
+	created := new(strut.Request)
+	if code := call(t, e, http.MethodPost, "/reverse", newRequest(), created); code != http.StatusOK {
+		t.Fatalf("POST /reverse = %d", code)
+	}
+	drain(t, a)
+	path := fmt.Sprintf("/reverse/%d", created.RequestID)
+
+	if code := call(t, e, http.MethodDelete, path, nil, nil); code != http.StatusOK {
+		t.Fatalf("DELETE %s = %d, want 200", path, code)
+	}
+	drain(t, a)
+
+	got := new(strut.Request)
+	if call(t, e, http.MethodGet, path, nil, got); got.Status != strut.StatusCanceled {
+		t.Fatalf("request is %s, want %s", got.Status, strut.StatusCanceled)
+	}
+
+	// a request in a final status is not canceled again
+	ret := new(ErrResponse)
+	if code := call(t, e, http.MethodDelete, path, nil, ret); code != http.StatusConflict || !strings.Contains(ret.Error.Message, "can not change from status canceled") {
+		t.Errorf("DELETE %s of a canceled request = %d %q, want 409", path, code, ret.Error.Message)
+	}
+
+	jobs, err := a.Repo.GetReverseJobsByRequestID(context.Background(), created.RequestID)
+	if err != nil {
+		t.Fatalf("GetReverseJobsByRequestID: %s", err.Error())
+	}
+	cancels := 0
+	for _, j := range jobs {
+		if j.Action == strut.ActionCancel {
+			cancels++
+		}
+	}
+	if cancels != 1 {
+		t.Errorf("got %d cancel jobs, want only the first one", cancels)
+	}
+}
@@ -19,23 +19,77 @@ const (
 	StatusExpired = "expired"
 	//StatusError code
 	StatusError = "error"
+	//StatusCancelError code of a Request whose cancel failed, it is still generated in Correios and its cancel is retried
+	StatusCancelError = "cancelerror"
+
+	//CallbackPending code of a callback waiting to be delivered
+	CallbackPending = "pending"
+	//CallbackDelivered code of a delivered callback
+	CallbackDelivered = "delivered"
+	//CallbackDead code of a callback that reached the max number of attempts
+	CallbackDead = "dead"
+	//CallbackTypeRequest callback sent when the status of a request changes
+	CallbackTypeRequest = "request"
+	//CallbackTypeTracking callback sent with the result of a tracking
+	CallbackTypeTracking = "tracking"
+
+	//JobPending code of a tracking or reverse job waiting to run
+	JobPending = "pending"
+	//JobRunning code of a tracking or reverse job being run
+	JobRunning = "running"
+	//JobDone code of a finished tracking or reverse job
+	JobDone = "done"
+	//JobFailed code of a tracking or reverse job that could not be run
+	JobFailed = "failed"
+	//ActionCreate reverse job that asks Correios for the postage of a Request
+	ActionCreate = "create"
+	//ActionCancel reverse job that cancels the postage of a Request in Correios
+	ActionCancel = "cancel"
+
+	//SubscriptionActive code of a subscription being polled
+	SubscriptionActive = "active"
+	//SubscriptionEnded code of a subscription that is no longer polled
+	SubscriptionEnded = "ended"
+	//StopOnDelivered ends the subscription when the object is delivered, same as no stop condition
+	StopOnDelivered = "delivered"
+	//StopOnPosted ends the subscription when the object is posted
+	StopOnPosted = "posted"
+	//StopOnFirstEvent ends the subscription after the first callback with new events
+	StopOnFirstEvent = "first_event"
+	//EndedDelivered the object was delivered
+	EndedDelivered = "delivered"
+	//EndedDeliveryFailed the delivery of the object failed
+	EndedDeliveryFailed = "deliveryfailed"
+	//EndedStopCondition the stop condition of the subscription was reached
+	EndedStopCondition = "stop_condition"
+	//EndedExpired the subscription reached its number of days
+	EndedExpired = "expired"
+	//EndedCanceled the subscription was canceled through the api
+	EndedCanceled = "canceled"
 )
 
 //Search structure of how the search request must be
 type Search struct {
 	Where      []*SearchWhere `json:"where"`
+	JoinBy     string         `json:"joinby"`
 	OrderField string         `json:"order_by_field"`
 	OrderType  string         `json:"order_by_type"`
 	From       int            `json:"from"`
 	Offset     int            `json:"offset"`
 }
 
-//SearchWhere structure of how the SearchWhere object must be
+//SearchWhere structure of a condition (field, operator, value) or of a group of conditions (joinby, where)
 type SearchWhere struct {
-	Field    string `json:"field"`
-	Value    string `json:"value"`
-	Operator string `json:"operator"`
-	JoinBy   string `json:"joinby"`
+	Field    string         `json:"field,omitempty"`
+	Value    interface{}    `json:"value,omitempty"`
+	Operator string         `json:"operator,omitempty"`
+	JoinBy   string         `json:"joinby,omitempty"`
+	Where    []*SearchWhere `json:"where,omitempty"`
+}
+
+//IsGroup returns true if the SearchWhere is a group of conditions, the joinby sent with a condition is ignored
+func (w *SearchWhere) IsGroup() bool {
+	return w.Where != nil
 }
 
 //RequestResponse structure of how the response is sent to the client
@@ -47,45 +101,90 @@ type RequestResponse struct {
 	Callback     string `json:"-"`
 }
 
+//CorreiosHistory structure of a status of a request in Correios
+type CorreiosHistory struct {
+	Status      string `json:"status"`
+	Description string `json:"description"`
+	Date        string `json:"date"`
+	Observation string `json:"observation,omitempty"`
+}
+
+//RefreshResponse structure of a request refreshed from Correios, with its last status and history there
+type RefreshResponse struct {
+	Request             *Request           `json:"request"`
+	CorreiosStatus      string             `json:"correios_status"`
+	CorreiosDescription string             `json:"correios_description"`
+	History             []*CorreiosHistory `json:"history"`
+}
+
+//CallbackDelivery structure of a callback written to the outbox and its delivery state
+type CallbackDelivery struct {
+	CallbackDeliveryID int64  `json:"callback_delivery_id"`
+	RequestID          int64  `json:"request_id,omitempty"`
+	ClientID           string `json:"client_id,omitempty"`
+	Type               string `json:"type"`
+	URL                string `json:"url"`
+	Payload            string `json:"payload"`
+	Status             string `json:"status"`
+	Attempts           int64  `json:"attempts"`
+	ResponseCode       int    `json:"response_code,omitempty"`
+	LastError          string `json:"last_error,omitempty"`
+	NextAttemptAt      string `json:"next_attempt_at,omitempty"`
+	DeliveredAt        string `json:"delivered_at,omitempty"`
+	CreatedAt          string `json:"created_at,omitempty"`
+	UpdatedAt          string `json:"updated_at,omitempty"`
+}
+
 //Request structure of how a postage request must be done
 type Request struct {
-	RequestID              int64          `json:"request_id"`
-	OrderNr                int64          `json:"order_nr"`
-	RequestType            string         `json:"request_type"`
-	RequestService         string         `json:"request_service"`
-	ColectDate             string         `json:"colect_date"`
-	SlipNumber             string         `json:"slip_number"`
-	OriginNome             string         `json:"origin_nome"`
-	OriginLogradouro       string         `json:"origin_logradouro"`
-	OriginNumero           int64          `json:"origin_numero"`
-	OriginComplemento      string         `json:"origin_complemento,omitempty"`
-	OriginCep              string         `json:"origin_cep"`
-	OriginBairro           string         `json:"origin_bairro"`
-	OriginCidade           string         `json:"origin_cidade"`
-	OriginUf               string         `json:"origin_uf"`
-	OriginReferencia       string         `json:"origin_referencia,omitempty"`
-	OriginEmail            string         `json:"origin_email"`
-	OriginDdd              string         `json:"origin_ddd"`
-	OriginTelefone         string         `json:"origin_telefone"`
-	DestinationNome        string         `json:"destination_nome"`
-	DestinationLogradouro  string         `json:"destination_logradouro"`
-	DestinationNumero      int64          `json:"destination_numero"`
-	DestinationComplemento string         `json:"destination_complemento,omitempty"`
-	DestinationCep         string         `json:"destination_cep"`
-	DestinationBairro      string         `json:"destination_bairro"`
-	DestinationCidade      string         `json:"destination_cidade"`
-	DestinationUf          string         `json:"destination_uf"`
-	DestinationReferencia  string         `json:"destination_referencia,omitempty"`
-	DestinationEmail       string         `json:"destination_email"`
-	Status                 string         `json:"status,omitempty"`
-	ErrorMessage           string         `json:"error_message,omitempty"`
-	Retries                int64          `json:"retries,omitempty"`
-	PostageCode            string         `json:"postage_code,omitempty"`
-	TrackingCode           string         `json:"tracking_code,omitempty"`
-	CreatedAt              string         `json:"created_at,omitempty"`
-	UpdatedAt              string         `json:"updated_at,omitempty"`
-	Callback               string         `json:"callback"`
-	Items                  []*RequestItem `json:"items"`
+	RequestID              int64             `json:"request_id"`
+	OrderNr                int64             `json:"order_nr"`
+	RequestType            string            `json:"request_type"`
+	RequestService         string            `json:"request_service"`
+	ColectDate             string            `json:"colect_date"`
+	SlipNumber             string            `json:"slip_number"`
+	OriginNome             string            `json:"origin_nome"`
+	OriginLogradouro       string            `json:"origin_logradouro"`
+	OriginNumero           int64             `json:"origin_numero"`
+	OriginComplemento      string            `json:"origin_complemento,omitempty"`
+	OriginCep              string            `json:"origin_cep"`
+	OriginBairro           string            `json:"origin_bairro"`
+	OriginCidade           string            `json:"origin_cidade"`
+	OriginUf               string            `json:"origin_uf"`
+	OriginReferencia       string            `json:"origin_referencia,omitempty"`
+	OriginEmail            string            `json:"origin_email"`
+	OriginDdd              string            `json:"origin_ddd"`
+	OriginTelefone         string            `json:"origin_telefone"`
+	DestinationNome        string            `json:"destination_nome"`
+	DestinationLogradouro  string            `json:"destination_logradouro"`
+	DestinationNumero      int64             `json:"destination_numero"`
+	DestinationComplemento string            `json:"destination_complemento,omitempty"`
+	DestinationCep         string            `json:"destination_cep"`
+	DestinationBairro      string            `json:"destination_bairro"`
+	DestinationCidade      string            `json:"destination_cidade"`
+	DestinationUf          string            `json:"destination_uf"`
+	DestinationReferencia  string            `json:"destination_referencia,omitempty"`
+	DestinationEmail       string            `json:"destination_email"`
+	Status                 string            `json:"status,omitempty"`
+	ErrorMessage           string            `json:"error_message,omitempty"`
+	Retries                int64             `json:"retries,omitempty"`
+	PostageCode            string            `json:"postage_code,omitempty"`
+	TrackingCode           string            `json:"tracking_code,omitempty"`
+	CreatedAt              string            `json:"created_at,omitempty"`
+	UpdatedAt              string            `json:"updated_at,omitempty"`
+	Callback               string            `json:"callback"`
+	ClientID               string            `json:"client_id,omitempty"`
+	DeclaredValue          float64           `json:"declared_value,omitempty"`
+	AdditionalServices     []string          `json:"additional_services,omitempty"`
+	Ar                     bool              `json:"ar,omitempty"`
+	Checklist              string            `json:"checklist,omitempty"`
+	Documents              []string          `json:"documents,omitempty"`
+	Items                  []*RequestItem    `json:"items"`
+	Packages               []*RequestPackage `json:"packages,omitempty"`
+	Products               []*RequestProduct `json:"products,omitempty"`
+	//filled from what Correios replies when the request is followed, they are not read from the api requests
+	Objects         []*RequestObject   `json:"objects,omitempty"`
+	CorreiosHistory []*CorreiosHistory `json:"correios_history,omitempty"`
 }
 
 //RequestItem structure of how a postage requestItem object must be filled
@@ -96,14 +195,116 @@ type RequestItem struct {
 	ProductName   string `json:"product_name"`
 }
 
+//RequestPackage structure of a package of a request, each package is an object in Correios collected in the coleta of its number
+type RequestPackage struct {
+	RequestPackageID int64  `json:"request_package_id"`
+	FkRequestID      int64  `json:"fk_request_id"`
+	ObjectID         string `json:"object_id"`
+	Description      string `json:"description"`
+	Coleta           int64  `json:"coleta"`
+	PostageCode      string `json:"postage_code,omitempty"`
+	TrackingCode     string `json:"tracking_code,omitempty"`
+}
+
+//RequestProduct structure of a packaging product sent by Correios with each coleta of a request
+type RequestProduct struct {
+	RequestProductID int64  `json:"request_product_id"`
+	FkRequestID      int64  `json:"fk_request_id"`
+	Code             string `json:"code"`
+	Type             string `json:"type"`
+	Quantity         int64  `json:"quantity"`
+}
+
+//RequestObject structure of an object of a request in Correios, with its weights in kg and its postage value
+type RequestObject struct {
+	RequestObjectID int64   `json:"request_object_id"`
+	FkRequestID     int64   `json:"fk_request_id"`
+	TrackingCode    string  `json:"tracking_code"`
+	ClientObjectID  string  `json:"client_object_id,omitempty"`
+	Status          string  `json:"status"`
+	Description     string  `json:"description"`
+	RealWeight      float64 `json:"real_weight"`
+	CubicWeight     float64 `json:"cubic_weight"`
+	PostageValue    float64 `json:"postage_value"`
+	LastUpdate      string  `json:"last_update,omitempty"`
+}
+
 //Tracking Request structure of how a tracking request must be called
 type Tracking struct {
 	TrackingType string   `json:"tracking_type"`
 	Callback     string   `json:"callback"`
 	Language     string   `json:"language"`
+	ClientID     string   `json:"client_id,omitempty"`
 	Objects      []string `json:"objects,omitempty"`
 }
 
+//Client structure of a client registered to receive signed callbacks
+type Client struct {
+	ClientID       string `json:"client_id"`
+	Name           string `json:"name"`
+	Secret         string `json:"secret,omitempty"`
+	PreviousSecret string `json:"-"`
+	CreatedAt      string `json:"created_at,omitempty"`
+	RotatedAt      string `json:"rotated_at,omitempty"`
+}
+
+//TrackingJob structure of a tracking performed in background and its result
+type TrackingJob struct {
+	JobID        int64             `json:"job_id"`
+	Status       string            `json:"status"`
+	TrackingType string            `json:"tracking_type"`
+	Language     string            `json:"language"`
+	Callback     string            `json:"callback,omitempty"`
+	ClientID     string            `json:"client_id,omitempty"`
+	Objects      []string          `json:"objects"`
+	Result       *TrackingResponse `json:"result,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Attempts     int64             `json:"attempts"`
+	LeaseOwner   string            `json:"lease_owner,omitempty"`
+	LeaseUntil   string            `json:"lease_until,omitempty"`
+	CreatedAt    string            `json:"created_at,omitempty"`
+	FinishedAt   string            `json:"finished_at,omitempty"`
+}
+
+//ReverseJob structure of a call to the reverse logistics service of a Request, kept in the database until it is done
+type ReverseJob struct {
+	ReverseJobID int64  `json:"reverse_job_id"`
+	RequestID    int64  `json:"request_id"`
+	Action       string `json:"action"`
+	Source       string `json:"source"`
+	Status       string `json:"status"`
+	Attempts     int64  `json:"attempts"`
+	LeaseOwner   string `json:"lease_owner,omitempty"`
+	LeaseUntil   string `json:"lease_until,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	CreatedAt    string `json:"created_at,omitempty"`
+	UpdatedAt    string `json:"updated_at,omitempty"`
+}
+
+//TrackingSubscriptionRequest structure of how a subscription to the new events of objects must be
+type TrackingSubscriptionRequest struct {
+	Objects  []string `json:"objects"`
+	Callback string   `json:"callback"`
+	ClientID string   `json:"client_id,omitempty"`
+	StopOn   string   `json:"stop_on,omitempty"`
+	Days     int64    `json:"days,omitempty"`
+}
+
+//TrackingSubscription structure of a subscription to the new events of an object
+type TrackingSubscription struct {
+	SubscriptionID int64  `json:"subscription_id"`
+	Object         string `json:"object"`
+	Callback       string `json:"callback"`
+	ClientID       string `json:"client_id,omitempty"`
+	StopOn         string `json:"stop_on,omitempty"`
+	Status         string `json:"status"`
+	EndedReason    string `json:"ended_reason,omitempty"`
+	LastEventID    int64  `json:"-"`
+	ExpiresAt      string `json:"expires_at"`
+	CheckedAt      string `json:"checked_at,omitempty"`
+	CreatedAt      string `json:"created_at,omitempty"`
+}
+
 //TrackingResponse structure of how the response of a tracking request is formed
 type TrackingResponse struct {
 	Items []*TrackingHeader `json:"items,omitempty"`
@@ -111,11 +312,12 @@ type TrackingResponse struct {
 
 //TrackingHeader structure of how the Tracking Header is sent
 type TrackingHeader struct {
-	Object   string            `json:"object"`
-	Error    string            `json:"error,omitempty"`
-	Name     string            `json:"name,omitempty"`
-	Category string            `json:"category,omitempty"`
-	Events   []*TrackingEvents `json:"events,omitempty"`
+	Object      string            `json:"object"`
+	Error       string            `json:"error,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Category    string            `json:"category,omitempty"`
+	RefreshedAt string            `json:"refreshed_at,omitempty"`
+	Events      []*TrackingEvents `json:"events,omitempty"`
 }
 
 //TrackingEvents structure of how the Tracking Events are sent
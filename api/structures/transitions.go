@@ -0,0 +1,64 @@
+package structures
+
+import (
+	"fmt"
+)
+
+const (
+	//SourceAPI transition requested through the api
+	SourceAPI = "api"
+	//SourceCron transition performed by a cronjob
+	SourceCron = "cron"
+	//SourceCorreios transition caused by a response of Correios
+	SourceCorreios = "correios"
+)
+
+var (
+	//StatusTransitions statuses a Request can move to from each status
+	StatusTransitions = map[string][]string{
+		StatusPending:        {StatusProcessing, StatusCanceled, StatusError},
+		StatusProcessing:     {StatusGenerated, StatusCanceled, StatusError, StatusCancelError},
+		StatusGenerated:      {StatusProcessing, StatusUsed, StatusCanceled, StatusExpired, StatusError},
+		StatusUsed:           {StatusDelivered, StatusFailedDelivery},
+		StatusError:          {StatusPending, StatusProcessing, StatusCanceled},
+		StatusExpired:        {StatusPending, StatusProcessing, StatusCanceled},
+		StatusCancelError:    {StatusProcessing, StatusUsed, StatusCanceled, StatusExpired},
+		StatusCanceled:       {},
+		StatusDelivered:      {},
+		StatusFailedDelivery: {},
+	}
+	//EditableStatus statuses in which a Request can be updated
+	EditableStatus = map[string]bool{StatusPending: true, StatusError: true, StatusExpired: true}
+)
+
+//TransitionError error returned when a Request can not move to a status
+type TransitionError struct {
+	RequestID int64
+	From      string
+	To        string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("Request %d can not change from status %s to %s", e.RequestID, e.From, e.To)
+}
+
+//CanTransition returns true if a Request can move from a status to the other
+func CanTransition(from string, to string) bool {
+	for _, s := range StatusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//StatusHistory structure of a status change of a Request
+type StatusHistory struct {
+	StatusHistoryID int64  `json:"status_history_id"`
+	RequestID       int64  `json:"request_id"`
+	FromStatus      string `json:"from_status"`
+	ToStatus        string `json:"to_status"`
+	Source          string `json:"source"`
+	Description     string `json:"description"`
+	CreatedAt       string `json:"created_at"`
+}
@@ -0,0 +1,275 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/signature"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultMaxAttempts default number of attempts before a callback is dead
+	DefaultMaxAttempts = 10
+	//DefaultBackoff default seconds to wait before the second attempt, doubled on each failure
+	DefaultBackoff = 60
+	//MaxBackoff max time to wait between two attempts
+	MaxBackoff = 6 * time.Hour
+	//DefaultBatchSize default number of callbacks delivered in each run
+	DefaultBatchSize = 100
+	//requestTimeout timeout of each delivery attempt
+	requestTimeout = 15 * time.Second
+)
+
+//Outbox writes the callbacks to the callback_delivery table and delivers them
+type Outbox struct {
+	Repo        repo.Definition
+	MaxAttempts int64
+	Backoff     time.Duration
+	//Secrets used to sign the callbacks of requests without a client
+	Secrets []string
+	mu      sync.Mutex
+	running bool
+}
+
+//New creates a new Outbox with the attempts and backoff defined in the config
+func New(r repo.Definition, c *cnf.CorreiosConfig) *Outbox {
+	o := &Outbox{Repo: r, MaxAttempts: DefaultMaxAttempts, Backoff: DefaultBackoff * time.Second}
+
+	if c != nil && c.CallbackMaxAttempts > 0 {
+		o.MaxAttempts = c.CallbackMaxAttempts
+	}
+	if c != nil && c.CallbackBackoff > 0 {
+		o.Backoff = time.Duration(c.CallbackBackoff) * time.Second
+	}
+	if c != nil {
+		o.Secrets = []string{c.CallbackSecret, c.CallbackPreviousSecret}
+	}
+
+	return o
+}
+
+//EnqueueRequest Writes the callback of the current status of a Request to the outbox with the given repository,
+//inside a transaction the callback is only written if the change of the status commits
+func (o *Outbox) EnqueueRequest(ctx context.Context, tx repo.Definition, r *strut.Request) error {
+	if r.Callback == "" {
+		return nil
+	}
+
+	payload := &strut.RequestResponse{RequestID: r.RequestID, PostageCode: r.PostageCode, TrackingCode: r.TrackingCode, Status: r.Status}
+
+	return o.enqueue(ctx, tx, strut.CallbackTypeRequest, r.RequestID, r.ClientID, r.Callback, payload)
+}
+
+//EnqueueTracking Writes the callback of a tracking result to the outbox
+func (o *Outbox) EnqueueTracking(ctx context.Context, t *strut.TrackingResponse, url string, clientID string) error {
+	if url == "" {
+		return nil
+	}
+
+	return o.enqueue(ctx, o.Repo, strut.CallbackTypeTracking, 0, clientID, url, t)
+}
+
+//Replay Writes a copy of a previous callback to the outbox so it is delivered again
+func (o *Outbox) Replay(ctx context.Context, d *strut.CallbackDelivery) (*strut.CallbackDelivery, error) {
+	n := &strut.CallbackDelivery{RequestID: d.RequestID, ClientID: d.ClientID, Type: d.Type, URL: d.URL, Payload: d.Payload}
+
+	if err := o.Repo.InsertCallbackDelivery(ctx, n); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+//Deliver Attempts to deliver the pending callbacks, returns the number of delivered callbacks
+func (o *Outbox) Deliver(ctx context.Context, limit int) int {
+	// skip this run if the previous one is still delivering
+	o.mu.Lock()
+	if o.running {
+		o.mu.Unlock()
+		return 0
+	}
+	o.running = true
+	o.mu.Unlock()
+
+	defer func() {
+		o.mu.Lock()
+		o.running = false
+		o.mu.Unlock()
+	}()
+
+	if limit <= 0 {
+		limit = DefaultBatchSize
+	}
+
+	pending, err := o.Repo.GetPendingCallbackDeliveries(ctx, time.Now(), limit)
+	if err != nil {
+		log.Printf("Error getting pending callbacks %s\n", err.Error())
+		return 0
+	}
+
+	delivered := 0
+	for _, d := range pending {
+		// the callbacks left are delivered on the next run
+		if ctx.Err() != nil {
+			break
+		}
+		if o.attempt(ctx, d) {
+			delivered++
+		}
+	}
+
+	return delivered
+}
+
+//attempt Performs one delivery attempt and stores its result
+func (o *Outbox) attempt(ctx context.Context, d *strut.CallbackDelivery) bool {
+	d.Attempts++
+
+	// the secrets are read on each attempt so a rotation applies to the retries
+	code := 0
+	secrets, err := o.secrets(ctx, d.ClientID)
+	if err == nil {
+		code, err = Post(ctx, d.URL, []byte(d.Payload), secrets...)
+	}
+	// an attempt interrupted by a shutdown is not counted
+	if ctx.Err() != nil {
+		d.Attempts--
+		return false
+	}
+
+	d.ResponseCode = code
+	d.LastError = ""
+	next := time.Now()
+
+	switch {
+	case err == nil:
+		d.Status = strut.CallbackDelivered
+	case d.Attempts >= o.MaxAttempts:
+		d.Status = strut.CallbackDead
+		d.LastError = err.Error()
+	default:
+		d.Status = strut.CallbackPending
+		d.LastError = err.Error()
+		next = next.Add(o.backoff(d.Attempts))
+	}
+
+	if err2 := o.Repo.UpdateCallbackDelivery(ctx, d, next); err2 != nil {
+		log.Println(err2.Error())
+	}
+	if err != nil {
+		log.Printf("Callback %d to %s failed on attempt %d: %s\n", d.CallbackDeliveryID, d.URL, d.Attempts, err.Error())
+	}
+
+	return err == nil
+}
+
+//secrets Returns the active secrets of the client or the default ones if there is no client
+func (o *Outbox) secrets(ctx context.Context, clientID string) ([]string, error) {
+	if clientID == "" {
+		return o.Secrets, nil
+	}
+
+	c, err := o.Repo.GetClientByID(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if c.ClientID == "" {
+		return nil, fmt.Errorf("Client %s not found", clientID)
+	}
+
+	return []string{c.Secret, c.PreviousSecret}, nil
+}
+
+//backoff Returns the time to wait after the given number of failed attempts
+func (o *Outbox) backoff(attempts int64) time.Duration {
+	wait := o.Backoff
+	for i := int64(1); i < attempts && wait < MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > MaxBackoff {
+		wait = MaxBackoff
+	}
+
+	return wait
+}
+
+//enqueue Encodes the payload and writes it to the outbox with the given repository
+func (o *Outbox) enqueue(ctx context.Context, r repo.Definition, kind string, requestID int64, clientID string, url string, payload interface{}) error {
+	buffer := new(bytes.Buffer)
+	if err := json.NewEncoder(buffer).Encode(payload); err != nil {
+		return err
+	}
+
+	return r.InsertCallbackDelivery(ctx, &strut.CallbackDelivery{RequestID: requestID, ClientID: clientID, Type: kind, URL: url, Payload: buffer.String()})
+}
+
+//Post Performs the Http request to the callback signed with the secrets, any response other than 2xx is an error, it is cancelled when ctx is done
+func Post(ctx context.Context, url string, payload []byte, secrets ...string) (int, error) {
+
+	// Create the POST request to the callback
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if hasSecret(secrets) {
+		req.Header.Set(signature.Header, signature.Sign(payload, time.Now(), secrets...))
+	}
+	req.Close = true
+
+	// check if it is an https request
+	re := regexp.MustCompile("^https://")
+	useTlS := re.MatchString(url)
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: useTlS},
+	}
+	client := &http.Client{Transport: tr, Timeout: requestTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("Callback responded with status %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+//hasSecret Returns true if any of the secrets is set
+func hasSecret(secrets []string) bool {
+	for _, secret := range secrets {
+		if secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+//NewSecret Generates a random secret to sign the callbacks
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,239 @@
+package callback
+
+import (
+	"context"
+	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	"github.com/pintobikez/brazilian-correios-service/repository/memory"
+	"github.com/pintobikez/brazilian-correios-service/signature"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//dateFormat format of the dates stored by the repository
+const dateFormat = "2006-01-02 15:04:05"
+
+var ctx = context.Background()
+
+//receiver a callback endpoint that replies with the given status codes in order, the last one is repeated
+type receiver struct {
+	mu         sync.Mutex
+	codes      []int
+	calls      int
+	signatures []string
+}
+
+//ServeHTTP Replies with the next status code
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	code := rc.codes[len(rc.codes)-1]
+	if rc.calls < len(rc.codes) {
+		code = rc.codes[rc.calls]
+	}
+	rc.calls++
+	rc.signatures = append(rc.signatures, r.Header.Get(signature.Header))
+	rc.mu.Unlock()
+
+	w.WriteHeader(code)
+}
+
+//count Returns the number of calls received
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.calls
+}
+
+//newOutbox Returns an outbox on a memory repository with a callback written to the outbox for the given url
+func newOutbox(t *testing.T, url string, maxAttempts int64) (*Outbox, *strut.CallbackDelivery) {
+	o := &Outbox{Repo: memory.New(), MaxAttempts: maxAttempts, Backoff: time.Minute}
+
+	d := &strut.CallbackDelivery{Type: strut.CallbackTypeTracking, URL: url, Payload: `{"objects":[]}`}
+	if err := o.Repo.InsertCallbackDelivery(ctx, d); err != nil {
+		t.Fatalf("InsertCallbackDelivery: %s", err.Error())
+	}
+
+	return o, d
+}
+
+//reload Gets the stored state of the callback
+func reload(t *testing.T, o *Outbox, d *strut.CallbackDelivery) *strut.CallbackDelivery {
+	got, err := o.Repo.GetCallbackDeliveryByID(ctx, d.CallbackDeliveryID)
+	if err != nil {
+		t.Fatalf("GetCallbackDeliveryByID: %s", err.Error())
+	}
+	return got
+}
+
+//makeDue Moves the next attempt of the callback to now
+func makeDue(t *testing.T, o *Outbox, d *strut.CallbackDelivery) {
+	if err := o.Repo.UpdateCallbackDelivery(ctx, reload(t, o, d), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("UpdateCallbackDelivery: %s", err.Error())
+	}
+}
+
+//nextAttempt Returns how long until the next attempt of the callback
+func nextAttempt(t *testing.T, d *strut.CallbackDelivery) time.Duration {
+	next, err := time.Parse(dateFormat, d.NextAttemptAt)
+	if err != nil {
+		t.Fatalf("next_attempt_at %q: %s", d.NextAttemptAt, err.Error())
+	}
+	return next.Sub(time.Now())
+}
+
+func TestDeliverRetriesWithBackoff(t *testing.T) {
+	rc := &receiver{codes: []int{http.StatusInternalServerError, http.StatusOK}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	o, d := newOutbox(t, server.URL, 3)
+
+	if n := o.Deliver(ctx, 10); n != 0 {
+		t.Fatalf("Deliver got %d delivered, want 0", n)
+	}
+	got := reload(t, o, d)
+	if got.Status != strut.CallbackPending || got.Attempts != 1 || got.ResponseCode != http.StatusInternalServerError || got.LastError == "" {
+		t.Errorf("after a 500 got %s attempts %d code %d error %q, want a pending callback with 1 attempt", got.Status, got.Attempts, got.ResponseCode, got.LastError)
+	}
+	if wait := nextAttempt(t, got); wait < o.Backoff-2*time.Second || wait > o.Backoff+time.Second {
+		t.Errorf("next attempt in %s, want %s", wait, o.Backoff)
+	}
+
+	// the callback is not attempted before its next attempt
+	o.Deliver(ctx, 10)
+	if rc.count() != 1 {
+		t.Fatalf("got %d calls before the backoff ended, want 1", rc.count())
+	}
+
+	makeDue(t, o, d)
+	if n := o.Deliver(ctx, 10); n != 1 {
+		t.Fatalf("Deliver got %d delivered, want 1", n)
+	}
+	got = reload(t, o, d)
+	if got.Status != strut.CallbackDelivered || got.Attempts != 2 || got.ResponseCode != http.StatusOK || got.LastError != "" || got.DeliveredAt == "" {
+		t.Errorf("after a 200 got %s attempts %d code %d error %q delivered at %q, want a delivered callback with 2 attempts",
+			got.Status, got.Attempts, got.ResponseCode, got.LastError, got.DeliveredAt)
+	}
+}
+
+func TestDeliverMarksDead(t *testing.T) {
+	rc := &receiver{codes: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	o, d := newOutbox(t, server.URL, 2)
+
+	o.Deliver(ctx, 10)
+	makeDue(t, o, d)
+	o.Deliver(ctx, 10)
+
+	got := reload(t, o, d)
+	if got.Status != strut.CallbackDead || got.Attempts != 2 || got.LastError == "" {
+		t.Errorf("got %s attempts %d error %q, want a dead callback after 2 attempts", got.Status, got.Attempts, got.LastError)
+	}
+
+	// a dead callback is not attempted again
+	makeDue(t, o, d)
+	o.Deliver(ctx, 10)
+	if rc.count() != 2 {
+		t.Errorf("got %d calls, want 2", rc.count())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	o := &Outbox{Backoff: time.Minute}
+
+	cases := []struct {
+		attempts int64
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, MaxBackoff},
+		{100, MaxBackoff},
+	}
+
+	for _, c := range cases {
+		if got := o.backoff(c.attempts); got != c.want {
+			t.Errorf("backoff(%d) = %s, want %s", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestShutdownAttemptIsNotCounted(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	o, d := newOutbox(t, server.URL, 1)
+
+	run, cancel := context.WithCancel(ctx)
+	done := make(chan int)
+	go func() { done <- o.Deliver(run, 10) }()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback was not attempted")
+	}
+	cancel()
+
+	select {
+	case n := <-done:
+		if n != 0 {
+			t.Errorf("Deliver got %d delivered, want 0", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deliver did not stop on the shutdown")
+	}
+
+	// with a single attempt allowed a counted attempt would have killed the callback
+	got := reload(t, o, d)
+	if got.Status != strut.CallbackPending || got.Attempts != 0 || got.LastError != "" {
+		t.Errorf("got %s attempts %d error %q, want the callback pending without attempts", got.Status, got.Attempts, got.LastError)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rc := &receiver{codes: []int{http.StatusOK}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	o, d := newOutbox(t, server.URL, 3)
+	o.Secrets = []string{"secret"}
+
+	o.Deliver(ctx, 10)
+	delivered := reload(t, o, d)
+
+	n, err := o.Replay(ctx, delivered)
+	if err != nil {
+		t.Fatalf("Replay: %s", err.Error())
+	}
+	if n.CallbackDeliveryID == d.CallbackDeliveryID || n.Status != strut.CallbackPending || n.Attempts != 0 || n.URL != d.URL || n.Payload != d.Payload {
+		t.Errorf("replay got %+v, want a new pending copy of callback %d", n, d.CallbackDeliveryID)
+	}
+
+	if got := o.Deliver(ctx, 10); got != 1 || rc.count() != 2 {
+		t.Fatalf("Deliver got %d delivered with %d calls, want the copy delivered", got, rc.count())
+	}
+	if got := reload(t, o, n); got.Status != strut.CallbackDelivered || got.Attempts != 1 {
+		t.Errorf("copy got %s attempts %d, want delivered on the first attempt", got.Status, got.Attempts)
+	}
+	if got := reload(t, o, d); got.Status != strut.CallbackDelivered || got.Attempts != 1 {
+		t.Errorf("original got %s attempts %d, want it unchanged", got.Status, got.Attempts)
+	}
+
+	for i, sig := range rc.signatures {
+		if sig == "" {
+			t.Errorf("call %d was not signed", i+1)
+		}
+	}
+}
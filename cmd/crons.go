@@ -8,13 +8,11 @@ import (
 	strut "github.com/pintobikez/brazilian-correios-service/config/structures"
 	cronjob "github.com/pintobikez/brazilian-correios-service/cronjob"
 	lg "github.com/pintobikez/brazilian-correios-service/log"
-	mysql "github.com/pintobikez/brazilian-correios-service/repository/mysql"
 	"github.com/robfig/cron"
 	"gopkg.in/urfave/cli.v1"
 	"log"
 	"os"
 	"os/signal"
-	"time"
 )
 
 //CronController Register a service in the Authentication Service and returns the generated API KEY
@@ -23,19 +21,16 @@ func CronController(c *cli.Context) error {
 	f := lg.File(c.String("log-folder") + "/crons.log")
 	log.SetOutput(f)
 
-	//loads db connection
-	stringConn, err := buildStringConnection(c.String("database-file"))
+	// Database connect
+	repo, err := buildRepository(c.String("database-file"))
 	if err != nil {
 		printErrorAndExit(err)
 	}
+	defer repo.Disconnect()
 
-	// Database connect
-	repo := new(mysql.Client)
-	err = repo.Connect(stringConn)
-	if err != nil {
+	if err := checkSchema(repo); err != nil {
 		printErrorAndExit(err)
 	}
-	defer repo.Disconnect()
 
 	//loads correios config
 	correiosCnf := new(strut.CorreiosConfig)
@@ -47,25 +42,54 @@ func CronController(c *cli.Context) error {
 	cj := cronjob.New(repo, correiosCnf)
 	cj.SetOutput(f)
 
-	// launch a cron to check everyday for posted items
+	schedules, err := cj.Schedules()
+	if err != nil {
+		printErrorAndExit(err)
+	}
+
+	// launch the enabled cronjobs with their schedules
 	cr := cron.New()
-	cr.AddFunc("* 0 */6 * * *", func() { cj.CheckUpdatedReverses("C") })     // checks for Colect updates
-	cr.AddFunc("* 10 */6 * * *", func() { cj.CheckUpdatedReverses("A") })    // checks for Postage updates
-	cr.AddFunc("* */20 * * * *", func() { cj.ReprocessRequestsWithError() }) // checks for Requests with Error and reprocesses them
-	cr.AddFunc("* */60 * * * *", func() { cj.CheckUsedReverses(0, 1000) })   // checks if Requests have been delivered
+	for _, s := range schedules {
+		if !s.Enabled {
+			log.Printf("Cronjob %s disabled\n", s.Name)
+			continue
+		}
+		if err := cr.AddFunc(s.Spec, cj.Job(s)); err != nil {
+			printErrorAndExit(err)
+		}
+	}
+
+	// only the instance that holds the leader lock runs the jobs
+	leader, resign := context.WithCancel(context.Background())
+	campaign := make(chan struct{})
+	go func() {
+		cj.Campaign(leader)
+		close(campaign)
+	}()
+
 	cr.Start()
-	defer cr.Stop()
 
 	fmt.Printf("%s %s\n", color.Green("[RESULT]"), "Cronjobs started.")
 
 	// Graceful Shutdown
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 
-	_, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// no new runs are started, the ones in progress finish or are cancelled after the timeout
+	cr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
 
+	if err := cj.Hand.Drain(ctx); err != nil {
+		log.Printf("Cronjobs cancelled on shutdown: %s\n", err.Error())
+	}
+
+	// the lock is released once the runs in progress are done
+	resign()
+	<-campaign
+
 	return nil
 }
 
@@ -11,9 +11,13 @@ import (
 	uti "github.com/pintobikez/brazilian-correios-service/config"
 	strut "github.com/pintobikez/brazilian-correios-service/config/structures"
 	lg "github.com/pintobikez/brazilian-correios-service/log"
+	"github.com/pintobikez/brazilian-correios-service/repository"
 	mysql "github.com/pintobikez/brazilian-correios-service/repository/mysql"
+	postgres "github.com/pintobikez/brazilian-correios-service/repository/postgres"
+	sqlite "github.com/pintobikez/brazilian-correios-service/repository/sqlite"
 	srv "github.com/pintobikez/brazilian-correios-service/server"
 	"gopkg.in/urfave/cli.v1"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -26,10 +30,11 @@ func Handle(c *cli.Context) error {
 	fmt.Printf("Flags %d %v", c.NumFlags(), c.GlobalFlagNames())
 
 	// Echo instance
-	e := &srv.Server{echo.New()}
+	e := &srv.Server{Echo: echo.New()}
 	e.HTTPErrorHandler = api.Error
 	e.Logger.SetLevel(log.INFO)
-	e.Logger.SetOutput(lg.File(c.String("log-folder") + "/app.log"))
+	appLog := lg.File(c.String("log-folder") + "/app.log")
+	e.Logger.SetOutput(appLog)
 
 	// Middlewares
 	e.Use(lg.LoggerWithOutput(lg.File(c.String("log-folder") + "/access.log")))
@@ -38,19 +43,16 @@ func Handle(c *cli.Context) error {
 	e.Use(mw.RequestID())
 	e.Pre(mw.RemoveTrailingSlash())
 
-	//loads db connection
-	stringConn, err := buildStringConnection(c.String("database-file"))
+	// Database connect
+	repo, err := buildRepository(c.String("database-file"))
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
+	defer repo.Disconnect()
 
-	// Database connect
-	repo := new(mysql.Client)
-	err = repo.Connect(stringConn)
-	if err != nil {
+	if err := checkSchema(repo); err != nil {
 		e.Logger.Fatal(err)
 	}
-	defer repo.Disconnect()
 
 	//loads correios config
 	correiosCnf := new(strut.CorreiosConfig)
@@ -60,14 +62,31 @@ func Handle(c *cli.Context) error {
 	}
 
 	a := api.New(repo, correiosCnf)
+	a.SetOutput(appLog)
+	e.Use(a.Deadline())
 
 	// Routes => api
 	e.POST("/tracking", a.GetTracking())
+	e.GET("/tracking/:code", a.GetTrackingObject())
+	e.GET("/tracking/validate/:code", a.ValidateTrackingCode())
+	e.GET("/tracking/jobs/:jobId", a.GetTrackingJob())
+	e.POST("/tracking/subscriptions", a.PostTrackingSubscription())
+	e.GET("/tracking/subscriptions/:subscriptionId", a.GetTrackingSubscription())
+	e.DELETE("/tracking/subscriptions/:subscriptionId", a.DeleteTrackingSubscription())
 	e.POST("/reverse", a.PostReverse())
 	e.POST("/reversesearch", a.GetReversesBy())
 	e.PUT("/reverse/:requestId", a.PutReverse())
 	e.DELETE("/reverse/:requestId", a.DeleteReverse())
 	e.GET("/reverse/:requestId", a.GetReverse())
+	e.GET("/reverse/:requestId/history", a.GetHistory())
+	e.POST("/reverse/:requestId/refresh", a.RefreshReverse())
+	e.GET("/reverse/:requestId/callbacks", a.GetCallbacks())
+	e.POST("/reverse/:requestId/callbacks/:callbackId/replay", a.ReplayCallback())
+	e.GET("/dispatcher", a.GetDispatcherStats())
+	e.POST("/clients", a.PostClient())
+	e.GET("/clients/:clientId", a.GetClient())
+	e.POST("/clients/:clientId/rotate", a.RotateClientSecret())
+	e.DELETE("/clients/:clientId/previous-secret", a.DeletePreviousClientSecret())
 	e.Use(mw.CORSWithConfig(
 		mw.CORSConfig{
 			AllowOrigins: []string{"*"},
@@ -91,7 +110,7 @@ func Handle(c *cli.Context) error {
 	}()
 
 	// Graceful Shutdown
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 
@@ -102,6 +121,14 @@ func Handle(c *cli.Context) error {
 		e.Logger.Fatal(err)
 	}
 
+	// wait for the calls to Correios started by the requests before closing the database
+	drain, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+
+	if err := a.Hand.Drain(drain); err != nil {
+		e.Logger.Error(err)
+	}
+
 	return nil
 }
 
@@ -119,15 +146,50 @@ func start(e *srv.Server, c *cli.Context) error {
 	return e.Start(c.String("listen"))
 }
 
-func buildStringConnection(filename string) (string, error) {
+//buildRepository Connects to the database backend defined in the driver name of the database config
+func buildRepository(filename string) (repository.Definition, error) {
 	t := new(strut.DbConfig)
 	if err := uti.LoadConfigFile(filename, t); err != nil {
-		return "", err
+		return nil, err
+	}
+
+	var (
+		r          repository.Definition
+		stringConn string
+	)
+
+	switch t.Driver.Name {
+	case "", "mysql":
+		r = new(mysql.Client)
+		// [username[:password]@][protocol[(address)]]/dbname[?param1=value1&...&paramN=valueN]
+		stringConn = t.Driver.User + ":" + t.Driver.Pw
+		stringConn += "@tcp(" + t.Driver.Host + ":" + strconv.Itoa(t.Driver.Port) + ")"
+		// the dates set by now() are in UTC like the ones sent by the service
+		stringConn += "/" + t.Driver.Schema + "?charset=utf8&time_zone=" + url.QueryEscape("'+00:00'")
+	case "postgres":
+		r = new(postgres.Client)
+		sslMode := t.Driver.SSLMode
+		if sslMode == "" {
+			sslMode = "disable"
+		}
+		// postgres://[user[:password]@][host][:port]/dbname[?param1=value1&...]
+		u := url.URL{Scheme: "postgres", User: url.UserPassword(t.Driver.User, t.Driver.Pw), Host: t.Driver.Host + ":" + strconv.Itoa(t.Driver.Port), Path: "/" + t.Driver.Schema}
+		// the dates set by now() are in UTC like the ones sent by the service
+		u.RawQuery = "sslmode=" + sslMode + "&timezone=UTC"
+		stringConn = u.String()
+	case "sqlite":
+		r = new(sqlite.Client)
+		stringConn = t.Driver.File
+		if stringConn == "" {
+			return nil, fmt.Errorf("The sqlite driver requires a database file")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid database driver %s", t.Driver.Name)
+	}
+
+	if err := r.Connect(stringConn); err != nil {
+		return nil, err
 	}
-	// [username[:password]@][protocol[(address)]]/dbname[?param1=value1&...&paramN=valueN]
-	stringConn := t.Driver.User + ":" + t.Driver.Pw
-	stringConn += "@tcp(" + t.Driver.Host + ":" + strconv.Itoa(t.Driver.Port) + ")"
-	stringConn += "/" + t.Driver.Schema + "?charset=utf8"
 
-	return stringConn, nil
+	return r, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"gopkg.in/urfave/cli.v1"
 	"os"
+	"time"
 )
 
 var (
@@ -10,6 +11,9 @@ var (
 	version = "0.0.2"
 )
 
+//drainTimeout time a shutdown waits for the calls to Correios in progress before cancelling them
+const drainTimeout = 60 * time.Second
+
 func main() {
 	app := cli.NewApp()
 	app.Name = appName
@@ -30,6 +34,89 @@ func main() {
 			Usage:  "Runs the crons needed for the service",
 			Action: CronController,
 		},
+		// backfill of the requests changed in correios
+		cli.Command{
+			Name:   "sync",
+			Usage:  "Follows in Correios the requests changed on each day of a date range",
+			Action: Sync,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Value: "",
+					Usage: "First day followed, ex: 2018-01-31",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Value: "",
+					Usage: "Last day followed, today if it is not given",
+				},
+				cli.StringFlag{
+					Name:  "type",
+					Value: "all",
+					Usage: "Requests followed: colect, postage or all",
+				},
+			},
+		},
+		// schema migrations
+		cli.Command{
+			Name:  "migrate",
+			Usage: "Manages the versioned migrations of the database schema",
+			Subcommands: []cli.Command{
+				{
+					Name:   "up",
+					Usage:  "Applies every pending migration",
+					Action: MigrateUp,
+				},
+				{
+					Name:   "down",
+					Usage:  "Reverts the last applied migration",
+					Action: MigrateDown,
+				},
+				{
+					Name:   "status",
+					Usage:  "Lists the migrations and if they were applied",
+					Action: MigrateStatus,
+				},
+				{
+					Name:      "to",
+					Usage:     "Applies or reverts migrations until the schema is at the given version",
+					ArgsUsage: "N",
+					Action:    MigrateTo,
+				},
+			},
+		},
+		// fake correios web-services
+		cli.Command{
+			Name:   "mock-correios",
+			Usage:  "Runs a fake Correios SOAP server for local development",
+			Action: MockCorreios,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "scenario",
+					Value: "success",
+					Usage: "How the fake server replies: success, error or fault",
+				},
+				cli.IntFlag{
+					Name:  "error-code",
+					Value: 0,
+					Usage: "Correios error code used by the error scenario (121 replies as an already made request)",
+				},
+				cli.StringFlag{
+					Name:  "error-message",
+					Value: "",
+					Usage: "Message used by the error and fault scenarios",
+				},
+				cli.DurationFlag{
+					Name:  "delay",
+					Value: 0,
+					Usage: "Delay before replying to each call, ex: 5s",
+				},
+				cli.BoolFlag{
+					Name:  "utf8",
+					Usage: "Reply to the Logistica Reversa operations in UTF-8 instead of ISO-8859-1 like the real service",
+				},
+			},
+		},
 	}
 
 	app.Flags = []cli.Flag{
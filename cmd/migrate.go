@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/gommon/color"
+	"github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/repository/migrate"
+	"gopkg.in/urfave/cli.v1"
+	"strconv"
+)
+
+//MigrateUp Applies every pending migration of the schema
+func MigrateUp(c *cli.Context) error {
+	return withMigrator(c, func(m *migrate.Migrator) error {
+		version, err := m.Up()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s schema at version %d\n", color.Green("[OK]"), version)
+		return nil
+	})
+}
+
+//MigrateDown Reverts the last applied migration of the schema
+func MigrateDown(c *cli.Context) error {
+	return withMigrator(c, func(m *migrate.Migrator) error {
+		version, err := m.Down()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s schema at version %d\n", color.Green("[OK]"), version)
+		return nil
+	})
+}
+
+//MigrateTo Applies or reverts migrations until the schema is at the given version
+func MigrateTo(c *cli.Context) error {
+	version, err := strconv.Atoi(c.Args().First())
+	if err != nil || version < 0 {
+		printErrorAndExit(fmt.Errorf("Invalid version %q, usage: migrate to N", c.Args().First()))
+		return nil
+	}
+
+	return withMigrator(c, func(m *migrate.Migrator) error {
+		if err := m.To(version); err != nil {
+			return err
+		}
+		fmt.Printf("%s schema at version %d\n", color.Green("[OK]"), version)
+		return nil
+	})
+}
+
+//MigrateStatus Prints the migrations of the schema and if they were applied
+func MigrateStatus(c *cli.Context) error {
+	return withMigrator(c, func(m *migrate.Migrator) error {
+		list, err := m.Status()
+		if err != nil {
+			return err
+		}
+
+		for _, st := range list {
+			state := color.Yellow("pending")
+			if st.Applied {
+				state = color.Green("applied " + st.AppliedAt)
+			}
+			fmt.Printf("%4d %-40s %s\n", st.Version, st.Description, state)
+		}
+		return nil
+	})
+}
+
+//withMigrator Connects to the database and runs the function with the migrator of its backend
+func withMigrator(c *cli.Context, fn func(m *migrate.Migrator) error) error {
+	repo, err := buildRepository(c.GlobalString("database-file"))
+	if err != nil {
+		printErrorAndExit(err)
+		return nil
+	}
+	defer repo.Disconnect()
+
+	mr, ok := repo.(repository.Migratable)
+	if !ok {
+		printErrorAndExit(fmt.Errorf("The database driver has no migrations"))
+		return nil
+	}
+
+	if err := fn(mr.Migrator()); err != nil {
+		printErrorAndExit(err)
+	}
+
+	return nil
+}
+
+//checkSchema Returns an error if the schema of the repository is not at the version required by the service
+func checkSchema(repo repository.Definition) error {
+	if mr, ok := repo.(repository.Migratable); ok {
+		return mr.Migrator().Check()
+	}
+	return nil
+}
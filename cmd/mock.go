@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/gommon/color"
+	mock "github.com/pintobikez/brazilian-correios-service/correiosapi/mockcorreios"
+	"gopkg.in/urfave/cli.v1"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+//MockCorreios Starts a fake Correios SOAP server to run the api and the cronjobs locally
+func MockCorreios(c *cli.Context) error {
+
+	sc := mock.Scenario{
+		Kind:         c.String("scenario"),
+		ErrorCode:    c.Int("error-code"),
+		ErrorMessage: c.String("error-message"),
+		Delay:        c.Duration("delay"),
+		UTF8:         c.Bool("utf8"),
+	}
+
+	if sc.Kind != mock.ScenarioSuccess && sc.Kind != mock.ScenarioError && sc.Kind != mock.ScenarioFault {
+		printErrorAndExit(fmt.Errorf("Invalid scenario %s, valid values are: %s %s %s", sc.Kind, mock.ScenarioSuccess, mock.ScenarioError, mock.ScenarioFault))
+		return nil
+	}
+
+	fake := mock.New()
+	fake.SetDefault(sc)
+
+	s := &http.Server{Addr: c.GlobalString("listen"), Handler: fake}
+
+	colorer := color.New()
+	colorer.Printf("⇛ %s mock Correios - %s\n", appName, color.Green(version))
+	colorer.Printf("⇛ Scenario: %s\n", color.Green(sc.Kind))
+	colorer.Printf("⇛ urlReversa: %s\n", color.Green("http://"+s.Addr+"/logisticaReversaWS"))
+	colorer.Printf("⇛ urlTracking: %s\n", color.Green("http://"+s.Addr+"/rastro"))
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			printErrorAndExit(err)
+		}
+	}()
+
+	// Graceful Shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.Shutdown(ctx)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/gommon/color"
+	uti "github.com/pintobikez/brazilian-correios-service/config"
+	strut "github.com/pintobikez/brazilian-correios-service/config/structures"
+	hand "github.com/pintobikez/brazilian-correios-service/correiosapi"
+	"gopkg.in/urfave/cli.v1"
+	"os"
+	"os/signal"
+	"time"
+)
+
+//syncTypes request types followed by each value of the type flag
+var syncTypes = map[string][]string{
+	"colect":  {hand.FollowMap["COLECT"]},
+	"postage": {hand.FollowMap["POSTAGE"]},
+	"all":     {hand.FollowMap["COLECT"], hand.FollowMap["POSTAGE"]},
+}
+
+//Sync Follows in Correios the requests changed on each day of a date range, the sync marks of the cronjobs are not moved
+func Sync(c *cli.Context) error {
+	from, err := time.ParseInLocation(hand.SyncDateFormat, c.String("from"), time.Local)
+	if err != nil {
+		printErrorAndExit(fmt.Errorf("Invalid from date %q, expected %s", c.String("from"), hand.SyncDateFormat))
+		return nil
+	}
+	to := hand.Day(time.Now())
+	if c.String("to") != "" {
+		if to, err = time.ParseInLocation(hand.SyncDateFormat, c.String("to"), time.Local); err != nil {
+			printErrorAndExit(fmt.Errorf("Invalid to date %q, expected %s", c.String("to"), hand.SyncDateFormat))
+			return nil
+		}
+	}
+	if to.Before(from) {
+		printErrorAndExit(fmt.Errorf("The from date %s is after the to date %s", from.Format(hand.SyncDateFormat), to.Format(hand.SyncDateFormat)))
+		return nil
+	}
+	types, ok := syncTypes[c.String("type")]
+	if !ok {
+		printErrorAndExit(fmt.Errorf("Invalid type %q, expected colect, postage or all", c.String("type")))
+		return nil
+	}
+
+	// Database connect
+	repo, err := buildRepository(c.GlobalString("database-file"))
+	if err != nil {
+		printErrorAndExit(err)
+		return nil
+	}
+	defer repo.Disconnect()
+
+	if err := checkSchema(repo); err != nil {
+		printErrorAndExit(err)
+		return nil
+	}
+
+	//loads correios config
+	correiosCnf := new(strut.CorreiosConfig)
+	if err := uti.LoadConfigFile(c.GlobalString("correios-file"), correiosCnf); err != nil {
+		printErrorAndExit(err)
+		return nil
+	}
+
+	// an interrupt cancels the call to Correios in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	h := hand.New(repo, correiosCnf)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, requestType := range types {
+			resp, err := h.FollowReverseLogistic(ctx, requestType, day)
+			if err != nil {
+				printErrorAndExit(err)
+				return nil
+			}
+			fmt.Printf("%s %s %s: %d requests updated\n", color.Green("[RESULT]"), day.Format(hand.SyncDateFormat), requestType, len(resp))
+		}
+	}
+
+	return nil
+}
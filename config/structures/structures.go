@@ -3,11 +3,16 @@ package structures
 //DbConfig contains the database configuration
 type DbConfig struct {
 	Driver struct {
-		Host   string `yaml:"host,omitempty"`
-		User   string `yaml:"user,omitempty"`
-		Pw     string `yaml:"pw,omitempty"`
-		Port   int    `yaml:"port,omitempty"`
-		Schema string `yaml:"schema,omitempty"`
+		//Name database backend, mysql, postgres or sqlite, defaults to mysql
+		Name    string `yaml:"name,omitempty"`
+		Host    string `yaml:"host,omitempty"`
+		User    string `yaml:"user,omitempty"`
+		Pw      string `yaml:"pw,omitempty"`
+		Port    int    `yaml:"port,omitempty"`
+		Schema  string `yaml:"schema,omitempty"`
+		SSLMode string `yaml:"sslmode,omitempty"`
+		//File path of the sqlite database file
+		File string `yaml:"file,omitempty"`
 	}
 }
 
@@ -23,4 +28,38 @@ type CorreiosConfig struct {
 	UserTracking      string `yaml:"userTracking,omitempty"`
 	PwTracking        string `yaml:"pwTracking,omitempty"`
 	URLTracking       string `yaml:"urlTracking,omitempty"`
+	//Max objects sent in each call to the tracking service and number of calls performed in parallel
+	TrackingBatchSize int64 `yaml:"trackingBatchSize,omitempty"`
+	TrackingWorkers   int64 `yaml:"trackingWorkers,omitempty"`
+	//Seconds a stored tracking timeline is served before it is refreshed from Correios
+	TrackingTTL int64 `yaml:"trackingTTL,omitempty"`
+	//Number of requests sent to the reverse logistics service at the same time
+	DispatcherWorkers int64 `yaml:"dispatcherWorkers,omitempty"`
+	//Seconds a worker holds a reverse job before another worker takes it and times a job is taken before it fails
+	JobLease       int64 `yaml:"jobLease,omitempty"`
+	JobMaxAttempts int64 `yaml:"jobMaxAttempts,omitempty"`
+	//Max number of past days followed again when the follow of the requests changed in Correios falls behind
+	SyncLookbackDays int64 `yaml:"syncLookbackDays,omitempty"`
+	//Seconds an api request can take, including its database queries and calls to Correios
+	RequestTimeout int64 `yaml:"requestTimeout,omitempty"`
+	//Days a tracking subscription is polled when the request does not set them
+	SubscriptionDays int64 `yaml:"subscriptionDays,omitempty"`
+	//Callback delivery attempts before it is dead and backoff in seconds before the second attempt
+	CallbackMaxAttempts int64 `yaml:"callbackMaxAttempts,omitempty"`
+	CallbackBackoff     int64 `yaml:"callbackBackoff,omitempty"`
+	//Secrets used to sign the callbacks of requests without a client
+	CallbackSecret         string `yaml:"callbackSecret,omitempty"`
+	CallbackPreviousSecret string `yaml:"callbackPreviousSecret,omitempty"`
+	//Schedules of the cronjobs by name, the cronjobs not listed keep their defaults
+	Crons map[string]*CronConfig `yaml:"crons,omitempty"`
+}
+
+//CronConfig contains the schedule of a cronjob, the values not set keep the defaults of the cronjob
+type CronConfig struct {
+	//Spec six fields starting with the seconds, ex: "0 */20 * * * *", or a descriptor, ex: "@every 20m"
+	Spec    string `yaml:"spec,omitempty"`
+	Enabled *bool  `yaml:"enabled,omitempty"`
+	//Max number of items handled in each run and seconds a run can take
+	BatchSize int64 `yaml:"batchSize,omitempty"`
+	Timeout   int64 `yaml:"timeout,omitempty"`
 }
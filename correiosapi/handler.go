@@ -1,20 +1,32 @@
 package correiosapi
 
 import (
+	"context"
 	"fmt"
 	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	"github.com/pintobikez/brazilian-correios-service/callback"
 	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
 	rever "github.com/pintobikez/brazilian-correios-service/correiosapi/soapreverse"
 	track "github.com/pintobikez/brazilian-correios-service/correiosapi/soaptracking"
+	"github.com/pintobikez/brazilian-correios-service/dispatcher"
 	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/trackingcode"
+	"log"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	//ServiceTypeMap map of service types string to int codes
 	ServiceTypeMap = map[string]string{"PAC": "04677", "SEDEX": "41076", "ESEDEX": "81043"}
+	//FollowStatusMap status of a request for each correios follow code
+	FollowStatusMap = map[string]string{FollowCanceled: strut.StatusCanceled, FollowExpired: strut.StatusExpired, FollowOK: strut.StatusUsed}
+	//ChecklistMap map of checklist types string to correios codes
+	ChecklistMap = map[string]string{"CELLPHONE": "2", "ELECTRONIC": "4", "DOCUMENT": "5", "CONTENT": "7"}
 	//RequestTypeMap map of service types string to correios codes
 	RequestTypeMap = map[string]string{"POSTAGE": "AP", "COLECT": "LR"}
 	//ColectTypeMap map of service types string to correios codes
@@ -25,6 +37,14 @@ var (
 	LanguageMap = map[string]string{"BR": "101", "EN": "102"}
 	//TrackingTypeMap map of service types string to correios codes
 	TrackingTypeMap = map[string]string{"ALL": "T", "LAST": "U"}
+	//PostedTypes tracking event types of a posted object
+	PostedTypes = map[string]bool{"PO": true}
+	//DeliveryTypes tracking event types of a delivery attempt
+	DeliveryTypes = map[string]bool{"BDE": true, "BDI": true, "BDR": true}
+	//DeliveryFailed tracking status codes of a failed delivery and their reason
+	DeliveryFailed = map[string]string{"50": "Stolen", "51": "Stolen", "52": "Stolen", "80": "Lost"}
+	//DeliveryOk tracking status codes of a successful delivery
+	DeliveryOk = map[string]bool{"0": true, "1": true, "00": true, "01": true}
 )
 
 const (
@@ -36,112 +56,509 @@ const (
 	FollowExpired = "57"
 	//FollowOK correios code
 	FollowOK = "0"
+	//DefaultTrackingBatchSize max number of objects accepted by buscaEventosLista
+	DefaultTrackingBatchSize = 50
+	//DefaultTrackingWorkers number of batches tracked in parallel
+	DefaultTrackingWorkers = 4
+	//DefaultTrackingTTL seconds a stored tracking timeline is served before it is refreshed
+	DefaultTrackingTTL = 1800
 )
 
 //Handler struct
 type Handler struct {
-	Repo repo.Definition
-	Conf *cnf.CorreiosConfig
+	Repo   repo.Definition
+	Conf   *cnf.CorreiosConfig
+	Outbox *callback.Outbox
+	//Dispatcher runs the calls to the reverse logistics service of each request in order
+	Dispatcher *dispatcher.Dispatcher
+	//context of the work started with Go, cancelled by Drain
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	//owner of the leases of the reverse jobs run by this handler
+	owner string
 }
 
-//TrackObjects Checks in Correios WebServicethe Tracking status of the given objects
-func (h *Handler) TrackObjects(o *strut.Tracking) (*strut.TrackingResponse, error) {
-	if len(o.Objects) > 0 {
-		client := track.NewRastroWS(h.Conf.URLTracking, true)
+//New creates a new Handler struct
+func New(r repo.Definition, c *cnf.CorreiosConfig) *Handler {
+	h := &Handler{Repo: r, Conf: c, Outbox: callback.New(r, c), owner: leaseOwner()}
+	if c != nil {
+		h.Dispatcher = dispatcher.New(int(c.DispatcherWorkers))
+	} else {
+		h.Dispatcher = dispatcher.New(dispatcher.DefaultWorkers)
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	return h
+}
+
+//Go Runs fn in the background, it outlives the api request or cron run that started it and Drain waits for it
+func (h *Handler) Go(fn func(ctx context.Context)) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		fn(h.ctx)
+	}()
+}
+
+//Drain Waits for the work started with Go and then for the work of the dispatcher, the work still running when ctx is done is cancelled
+func (h *Handler) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		h.cancel()
+		<-done
+	}
+
+	// the work started with Go may have submitted more work
+	return h.Dispatcher.Drain(ctx)
+}
+
+//TrackObjects Checks in Correios WebService the Tracking status of the given objects
+//The objects are split in batches tracked in parallel, the items are returned in the order of the objects
+//and a batch that fails sets the error of its objects, an error is only returned if every batch failed
+func (h *Handler) TrackObjects(ctx context.Context, o *strut.Tracking) (*strut.TrackingResponse, error) {
+	if len(o.Objects) == 0 {
+		return nil, nil
+	}
+
+	size, workers := h.trackingBatchSize(), h.trackingWorkers()
+	batches := make([][]string, 0, len(o.Objects)/size+1)
+	for i := 0; i < len(o.Objects); i += size {
+		end := i + size
+		if end > len(o.Objects) {
+			end = len(o.Objects)
+		}
+		batches = append(batches, o.Objects[i:end])
+	}
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+
+	found := make([]map[string]*strut.TrackingHeader, len(batches))
+	errs := make([]error, len(batches))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				found[i], errs[i] = h.trackBatch(ctx, o, batches[i])
+			}
+		}()
+	}
+	for i := range batches {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// merge the batches in the order of the objects
+	res := &strut.TrackingResponse{Items: make([]*strut.TrackingHeader, 0, len(o.Objects))}
+	failed := 0
+	for i, batch := range batches {
+		if errs[i] != nil {
+			failed++
+			log.Printf("Tracking of %d objects failed: %s\n", len(batch), errs[i].Error())
+		}
+		for _, code := range batch {
+			item, ok := found[i][code]
+			if !ok {
+				msg := "Object not returned by Correios"
+				if errs[i] != nil {
+					msg = errs[i].Error()
+				}
+				item = &strut.TrackingHeader{Object: code, Error: msg}
+			}
+			res.Items = append(res.Items, item)
+		}
+	}
 
-		response, err := client.BuscaEventosLista(&track.BuscaEventosLista{User: h.Conf.UserTracking, Password: h.Conf.PwTracking, Type: "L", Result: TrackingTypeMap[o.TrackingType], Language: LanguageMap[o.Language], Objects: o.Objects})
+	if failed == len(batches) {
+		return nil, errs[0]
+	}
+
+	return res, nil
+}
+
+//RunTrackingJob Takes the lease of a job, tracks its objects, stores its result and writes it to the callback if the job has one,
+//a job whose worker stopped is taken again by the sweeper once its lease ends
+func (h *Handler) RunTrackingJob(ctx context.Context, j *strut.TrackingJob) {
+	lease := h.jobLease()
+	ok, err := h.Repo.ClaimTrackingJob(ctx, j, h.owner, time.Now().Add(lease))
+	if err != nil {
+		log.Printf("Tracking job %d: %s\n", j.JobID, err.Error())
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if j.Attempts > h.jobMaxAttempts() {
+		j.Status = strut.JobFailed
+		j.Error = fmt.Sprintf("Interrupted %d times", j.Attempts-1)
+	} else {
+		// the tracking ends before the lease so the job is not taken while it runs
+		tctx, cancel := context.WithTimeout(ctx, lease)
+		res, err := h.TrackObjects(tctx, &strut.Tracking{TrackingType: j.TrackingType, Language: j.Language, Objects: j.Objects})
+		cancel()
+
+		// a job interrupted by a shutdown keeps its lease and is taken again once the lease ends
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			return nil, err
+			j.Status = strut.JobFailed
+			j.Error = err.Error()
+		} else {
+			j.Status = strut.JobDone
+			j.Result = res
 		}
+	}
 
-		res := new(strut.TrackingResponse)
-		res.Items = make([]*strut.TrackingHeader, 0, response.Result.Quantity)
+	if err := h.Repo.UpdateTrackingJob(ctx, j); err != nil {
+		log.Printf("Tracking job %d: %s\n", j.JobID, err.Error())
+	}
 
-		for i, el := range response.Result.Objects {
-			res.Items = append(res.Items, new(strut.TrackingHeader))
-			res.Items[i].Object = el.TrackingCode
-			if el.Error == "" {
-				res.Items[i].Name = el.Name
-				res.Items[i].Category = el.Category
-				res.Items[i].Events = make([]*strut.TrackingEvents, 0, 1)
+	if j.Result != nil && h.Outbox != nil {
+		if err := h.Outbox.EnqueueTracking(ctx, j.Result, j.Callback, j.ClientID); err != nil {
+			log.Printf("Tracking job %d: %s\n", j.JobID, err.Error())
+		}
+	}
+}
 
-				//Get all events and append them
-				for _, ev := range el.Events {
-					dt := ev.Date + " " + ev.Hour
-					cte := ev.Local + ", " + ev.Code + ", " + ev.City + "(" + ev.FiscalUnit + ")"
-					res.Items[i].Events = append(res.Items[i].Events, &strut.TrackingEvents{Type: ev.Type, StatusCode: ev.StatusCode, DateTime: dt, Description: ev.Description, Details: ev.Detail, CTECorreios: cte})
-				}
+//trackBatch Checks in Correios WebService a batch of objects and stores their timelines, returns the items by object
+func (h *Handler) trackBatch(ctx context.Context, o *strut.Tracking, objects []string) (map[string]*strut.TrackingHeader, error) {
+	client := track.NewRastroWS(h.Conf.URLTracking, true)
 
-			} else {
-				res.Items[i].Error = el.Error
+	response, err := client.BuscaEventosLista(ctx, &track.BuscaEventosLista{User: h.Conf.UserTracking, Password: h.Conf.PwTracking, Type: "L", Result: TrackingTypeMap[o.TrackingType], Language: LanguageMap[o.Language], Objects: objects})
+	if err != nil {
+		return nil, err
+	}
+	if response.Result == nil {
+		return nil, fmt.Errorf("Empty tracking response from Correios")
+	}
+
+	res := make(map[string]*strut.TrackingHeader, len(objects))
+	for _, el := range response.Result.Objects {
+		item := &strut.TrackingHeader{Object: el.TrackingCode}
+		if el.Error == "" {
+			item.Name = el.Name
+			item.Category = el.Category
+			item.Events = make([]*strut.TrackingEvents, 0, len(el.Events))
+
+			//Get all events and append them
+			for _, ev := range el.Events {
+				dt := ev.Date + " " + ev.Hour
+				cte := ev.Local + ", " + ev.Code + ", " + ev.City + "(" + ev.FiscalUnit + ")"
+				item.Events = append(item.Events, &strut.TrackingEvents{Type: ev.Type, StatusCode: ev.StatusCode, DateTime: dt, Description: ev.Description, Details: ev.Detail, CTECorreios: cte})
 			}
+
+		} else {
+			item.Error = el.Error
 		}
 
-		return res, nil
+		// keep the timeline so it can be served without calling Correios
+		if err := h.Repo.SaveTrackingObject(ctx, item); err != nil {
+			log.Printf("Tracking object %s: %s\n", item.Object, err.Error())
+		}
+		res[item.Object] = item
 	}
 
-	return nil, nil
+	return res, nil
+}
+
+//trackingBatchSize Returns the max number of objects sent in each call to Correios
+func (h *Handler) trackingBatchSize() int {
+	if h.Conf.TrackingBatchSize > 0 {
+		return int(h.Conf.TrackingBatchSize)
+	}
+	return DefaultTrackingBatchSize
+}
+
+//trackingWorkers Returns the max number of calls to Correios performed in parallel
+func (h *Handler) trackingWorkers() int {
+	if h.Conf.TrackingWorkers > 0 {
+		return int(h.Conf.TrackingWorkers)
+	}
+	return DefaultTrackingWorkers
 }
 
-//FollowReverseLogistic Checks in Correios WebService which requests have changed
-func (h *Handler) FollowReverseLogistic(requestType string) []*strut.RequestResponse {
+//GetTrackingTimeline Returns the stored timeline of an object, it is refreshed from Correios when it is older than the TTL
+func (h *Handler) GetTrackingTimeline(ctx context.Context, code string) (*strut.TrackingHeader, error) {
+	ttl := int64(DefaultTrackingTTL)
+	if h.Conf.TrackingTTL > 0 {
+		ttl = h.Conf.TrackingTTL
+	}
+	freshSince := time.Now().Add(-time.Duration(ttl) * time.Second)
+
+	stored, fresh, err := h.Repo.GetTrackingObject(ctx, code, freshSince)
+	if err != nil {
+		return nil, err
+	}
+	if fresh {
+		return stored, nil
+	}
+
+	if _, err := h.TrackObjects(ctx, &strut.Tracking{TrackingType: "ALL", Language: "BR", Objects: []string{code}}); err != nil {
+		// serve the stored copy while Correios is not available
+		if stored.Object != "" {
+			log.Printf("Tracking object %s: %s\n", code, err.Error())
+			return stored, nil
+		}
+		return nil, err
+	}
+
+	stored, _, err = h.Repo.GetTrackingObject(ctx, code, freshSince)
+
+	return stored, err
+}
+
+//DeliveryStatus Returns the status and message of a Request given the events of its object, newest first, or an empty status if it has not been delivered yet
+func DeliveryStatus(events []*strut.TrackingEvents) (string, string) {
+	for _, ev := range events {
+		if !DeliveryTypes[ev.Type] {
+			continue
+		}
+		if DeliveryOk[ev.StatusCode] {
+			return strut.StatusDelivered, "Delivered"
+		}
+		if val, ok := DeliveryFailed[ev.StatusCode]; ok {
+			return strut.StatusFailedDelivery, val
+		}
+	}
+
+	return "", ""
+}
+
+//FollowReverseLogistic Checks in Correios WebService which requests have changed on the given day, an error is returned if Correios could not be asked
+func (h *Handler) FollowReverseLogistic(ctx context.Context, requestType string, day time.Time) ([]*strut.RequestResponse, error) {
 	//Init SOAP Client
 	oauth := rever.BasicAuth{Login: h.Conf.UserReverse, Password: h.Conf.PwReverse}
 	client := rever.NewLogisticaReversaWS(h.Conf.URLReverse, true, &oauth)
 
-	// Get the Requests that had updates today in Correios
-	currentTime := time.Now().Local()
-	response, err := client.AcompanharPedidoPorData(&rever.AcompanharPedidoPorData{CodAdministrativo: h.Conf.CodAdministrativo, TipoSolicitacao: requestType, Data: currentTime.Format("02/01/2006")})
+	// Get the Requests that had updates on the day in Correios
+	response, err := client.AcompanharPedidoPorData(ctx, &rever.AcompanharPedidoPorData{CodAdministrativo: h.Conf.CodAdministrativo, TipoSolicitacao: requestType, Data: day.Format("02/01/2006")})
 	if err != nil {
-		fmt.Println(err.Error())
-		return nil
+		return nil, fmt.Errorf("Could not follow the requests of type %s on %s: %s", requestType, day.Format(SyncDateFormat), err.Error())
 	}
 
-	if response.AcompanharPedidoPorData.Coderro != "0" {
-
-		length := len(response.AcompanharPedidoPorData.Coleta)
-		toRet := make([]*strut.RequestResponse, 0, length)
-
-		for _, col := range response.AcompanharPedidoPorData.Coleta {
-			request, err := h.Repo.GetRequestByPostageCode(strconv.Itoa(col.Numeropedido))
-
-			if err == nil && request.RequestID > 0 {
-				switch col.Objeto[0].Ultimostatus {
-				case FollowCanceled:
-					af, err2 := h.Repo.UpdateRequestStatus(request, strut.StatusCanceled, col.Objeto[0].Descricaostatus)
-					if err2 != nil && af > 0 {
-						toRet = append(toRet, &strut.RequestResponse{request.RequestID, request.PostageCode, request.TrackingCode, strut.StatusCanceled, request.Callback})
-					}
-					break
-				case FollowExpired:
-					af, err2 := h.Repo.UpdateRequestStatus(request, strut.StatusExpired, col.Objeto[0].Descricaostatus)
-					if err2 != nil && af > 0 {
-						toRet = append(toRet, &strut.RequestResponse{request.RequestID, request.PostageCode, request.TrackingCode, strut.StatusExpired, request.Callback})
-					}
-					break
-				case FollowOK:
-					err2 := h.Repo.UpdateRequestTracking(request, col.Objeto[0].Numeroetiqueta)
-					if err2 != nil {
-						toRet = append(toRet, &strut.RequestResponse{request.RequestID, request.PostageCode, request.TrackingCode, strut.StatusUsed, request.Callback})
-					}
-					break
-				default:
-					break
-				}
+	ret := response.AcompanharPedidoPorData
+	if ret == nil {
+		return nil, fmt.Errorf("Correios replied without the requests of type %s on %s", requestType, day.Format(SyncDateFormat))
+	}
+
+	// an error reply must not be taken as a day without updates, the sync would move past it
+	if code, _ := strconv.Atoi(ret.Coderro); code != 0 {
+		return nil, fmt.Errorf("Could not follow the requests of type %s on %s: %s - %s", requestType, day.Format(SyncDateFormat), ret.Coderro, ret.Msgerro)
+	}
+
+	toRet := make([]*strut.RequestResponse, 0, len(ret.Coleta))
+	for _, col := range ret.Coleta {
+		request, err := h.Repo.GetRequestByPostageCode(ctx, strconv.Itoa(col.Numeropedido))
+
+		if err == nil && request.RequestID > 0 && len(col.Objeto) > 0 {
+			changed, err := h.applyFollow(ctx, request, col)
+			if err != nil {
+				log.Printf("Request %d: %s\n", request.RequestID, err.Error())
+				continue
+			}
+			if changed {
+				toRet = append(toRet, &strut.RequestResponse{RequestID: request.RequestID, PostageCode: request.PostageCode, TrackingCode: request.TrackingCode, Status: request.Status, Callback: request.Callback})
+			}
+		}
+	}
+
+	return toRet, nil
+}
+
+//RefreshReverseLogistic Asks Correios for the last status and the whole history of the Request and applies the status to it
+func (h *Handler) RefreshReverseLogistic(ctx context.Context, o *strut.Request) (*strut.RefreshResponse, error) {
+	//Init SOAP Client
+	oauth := rever.BasicAuth{Login: h.Conf.UserReverse, Password: h.Conf.PwReverse}
+	client := rever.NewLogisticaReversaWS(h.Conf.URLReverse, true, &oauth)
+
+	codes, err := h.postageCodes(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.AcompanharPedido(ctx, &rever.AcompanharPedido{CodAdministrativo: h.Conf.CodAdministrativo, TipoBusca: rever.BuscaHistorico, TipoSolicitacao: FollowMap[o.RequestType], NumeroPedido: codes})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := response.AcompanharPedido
+	if ret == nil {
+		return nil, fmt.Errorf("Correios replied without the Request %d", o.RequestID)
+	}
+	if code, _ := strconv.Atoi(ret.Coderro); code != 0 {
+		return nil, fmt.Errorf("%s - %s", ret.Coderro, ret.Msgerro)
+	}
+
+	// the status of the request is the one of its first coleta, the history has the statuses of every coleta
+	var first *rever.ObjetoPostal
+	history := make([]*strut.CorreiosHistory, 0)
+	for _, code := range codes {
+		for _, col := range ret.Coleta {
+			if strconv.Itoa(col.Numeropedido) != code || len(col.Objeto) == 0 {
+				continue
+			}
+			if _, err := h.applyFollow(ctx, o, col); err != nil {
+				return nil, err
+			}
+			if first == nil {
+				first = col.Objeto[0]
 			}
+			history = append(history, correiosHistory(col)...)
 		}
+	}
+	if first == nil {
+		return nil, fmt.Errorf("Correios replied without the Request %d", o.RequestID)
+	}
 
-		return toRet
+	if err := h.LoadCorreiosFollow(ctx, o); err != nil {
+		return nil, err
+	}
+
+	return &strut.RefreshResponse{Request: o, CorreiosStatus: first.Ultimostatus, CorreiosDescription: first.Descricaostatus, History: history}, nil
+}
+
+//postageCodes Returns the numbers of the coletas of the Request in Correios, starting with the one of the Request
+func (h *Handler) postageCodes(ctx context.Context, o *strut.Request) ([]string, error) {
+	packages, err := h.Repo.GetRequestPackages(ctx, o.RequestID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, 1)
+	seen := make(map[string]bool)
+	if o.PostageCode != "" {
+		codes = append(codes, o.PostageCode)
+		seen[o.PostageCode] = true
+	}
+	for _, p := range packages {
+		if p.PostageCode != "" && !seen[p.PostageCode] {
+			codes = append(codes, p.PostageCode)
+			seen[p.PostageCode] = true
+		}
+	}
+
+	return codes, nil
+}
+
+//LoadCorreiosFollow Fills the Request with its objects and its history in Correios
+func (h *Handler) LoadCorreiosFollow(ctx context.Context, o *strut.Request) error {
+	objects, err := h.Repo.GetRequestObjects(ctx, o.RequestID)
+	if err != nil {
+		return err
+	}
+	history, err := h.Repo.GetCorreiosHistoryByRequestID(ctx, o.RequestID)
+	if err != nil {
+		return err
 	}
+
+	o.Objects = objects
+	o.CorreiosHistory = history
+
 	return nil
 }
 
-//DoReverseLogistic Performs in Correios WebService a request for a Reverse Postage
-func (h *Handler) DoReverseLogistic(o *strut.Request) {
+//applyFollow Stores the objects and the history of the Request in Correios and applies to it the last status of its object, returns true if the status changed.
+//A status that was already applied or overtaken is not applied again, as a day followed again reports it once more
+func (h *Handler) applyFollow(ctx context.Context, request *strut.Request, col *rever.ColetasSolicitadas) (bool, error) {
+	objects := make([]*strut.RequestObject, 0, len(col.Objeto))
+	for _, obj := range col.Objeto {
+		objects = append(objects, &strut.RequestObject{TrackingCode: obj.Numeroetiqueta, ClientObjectID: obj.Controleobjetocliente, Status: obj.Ultimostatus, Description: obj.Descricaostatus,
+			RealWeight: correiosNumber(obj.Pesoreal), CubicWeight: correiosNumber(obj.Pesocubico), PostageValue: correiosNumber(obj.Valorpostagem), LastUpdate: correiosDate(obj.Dataultimaatualizacao, obj.Horaultimaatualizacao)})
+	}
+	if err := h.Repo.SaveCorreiosFollow(ctx, request.RequestID, objects, correiosHistory(col)); err != nil {
+		return false, err
+	}
+
+	obj := col.Objeto[0]
+	status, ok := FollowStatusMap[obj.Ultimostatus]
+	if !ok || request.Status == status || !strut.CanTransition(request.Status, status) {
+		return false, nil
+	}
+
+	var err error
+	switch obj.Ultimostatus {
+	case FollowOK:
+		if _, err = trackingcode.Parse(obj.Numeroetiqueta); err != nil {
+			return false, fmt.Errorf("Invalid tracking code %s for Request %d: %s", obj.Numeroetiqueta, request.RequestID, err.Error())
+		}
+		err = h.transition(ctx, request, status, obj.Descricaostatus, strut.SourceCorreios, func(tx repo.Definition) error {
+			return tx.UpdateRequestTracking(ctx, request, obj.Numeroetiqueta)
+		})
+	default:
+		err = h.UpdateStatus(ctx, request, status, obj.Descricaostatus, strut.SourceCorreios)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+//correiosHistory Returns the history of a coleta replied by Correios
+func correiosHistory(col *rever.ColetasSolicitadas) []*strut.CorreiosHistory {
+	history := make([]*strut.CorreiosHistory, 0, len(col.Historico))
+	for _, e := range col.Historico {
+		history = append(history, &strut.CorreiosHistory{Status: strconv.Itoa(e.Status), Description: e.Descricaostatus, Date: correiosDate(e.Dataatualizacao, e.Horaatualizacao), Observation: e.Observacao})
+	}
+	return history
+}
+
+//correiosNumber Returns the value of a number replied by Correios with a decimal comma, 0 if it can not be parsed
+func correiosNumber(value string) float64 {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, ",") {
+		value = strings.Replace(strings.Replace(value, ".", "", -1), ",", ".", 1)
+	}
+	n, _ := strconv.ParseFloat(value, 64)
+	return n
+}
+
+//correiosValue Returns a value in the format of the numbers of Correios, empty for 0
+func correiosValue(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return strings.Replace(strconv.FormatFloat(value, 'f', 2, 64), ".", ",", 1)
+}
+
+//correiosDate Returns the date and hour given by Correios in the format of the dates of the service, as given if they can not be parsed
+func correiosDate(date string, hour string) string {
+	if t, err := time.Parse("02/01/2006 15:04:05", date+" "+hour); err == nil {
+		return t.Format("2006-01-02 15:04:05")
+	}
+	return strings.TrimSpace(date + " " + hour)
+}
+
+//DoReverseLogistic Performs in Correios WebService a request for a Reverse Postage, source is who triggered it
+func (h *Handler) DoReverseLogistic(ctx context.Context, o *strut.Request, source string) {
 
 	//Update the status of the items to Processing
-	if _, err := h.Repo.UpdateRequestStatus(o, strut.StatusProcessing, ""); err != nil {
-		h.saveErrorMessage(o, err.Error())
+	if err := h.UpdateStatus(ctx, o, strut.StatusProcessing, "", source); err != nil {
+		log.Printf("Request %d: %s\n", o.RequestID, err.Error())
+		return
+	}
+
+	packages, err := h.requestPackages(ctx, o)
+	if err != nil {
+		h.saveErrorMessage(ctx, o, err.Error(), source)
+		return
+	}
+	if o.Products, err = h.Repo.GetRequestProducts(ctx, o.RequestID); err != nil {
+		h.saveErrorMessage(ctx, o, err.Error(), source)
 		return
 	}
 
@@ -149,51 +566,118 @@ func (h *Handler) DoReverseLogistic(o *strut.Request) {
 	oauth := rever.BasicAuth{Login: h.Conf.UserReverse, Password: h.Conf.PwReverse}
 	client := rever.NewLogisticaReversaWS(h.Conf.URLReverse, true, &oauth)
 
+	// every coleta of the request is sent in the same call
 	dest := buildDestinatario(o)
-	// cc, _ := strconv.Atoi(code)
-	cole := buildColetaReversa(o)
-	coletas := make([]*rever.ColetaReversa, 1)
-	coletas[0] = cole
+	coletas := buildColetasReversas(o, packages)
 
 	req := rever.SolicitarPostagemReversa(rever.SolicitarPostagemReversa{CodAdministrativo: h.Conf.CodAdministrativo, Codigoservico: ServiceTypeMap[o.RequestService], Cartao: h.Conf.CartaoPostagem,
 		Destinatario: dest, Coletassolicitadas: coletas})
-	resp, err := client.SolicitarPostagemReversa(&req)
+	resp, err := client.SolicitarPostagemReversa(ctx, &req)
 
 	if err != nil {
-		h.saveErrorMessage(o, err.Error())
+		h.saveErrorMessage(ctx, o, err.Error(), source)
+		return
+	}
+
+	if resp.SolicitarPostagemReversa == nil {
+		h.saveErrorMessage(ctx, o, "Correios replied without the result of the request", strut.SourceCorreios)
 		return
 	}
 
 	if resp.SolicitarPostagemReversa.Coderro != "00" {
 		// Error in the request
-		h.saveErrorMessage(o, resp.SolicitarPostagemReversa.Msgerro)
+		h.saveErrorMessage(ctx, o, resp.SolicitarPostagemReversa.Msgerro, strut.SourceCorreios)
 		return
 	}
 
-	r := resp.SolicitarPostagemReversa.Resultadosolicitacao[0]
-	// The request has been made before the Numerocoleta is inside the error message
-	if r.Codigoerro == 121 {
-		re := regexp.MustCompile("[0-9]{9}")
-		r.Numerocoleta = re.FindAllString(r.Descricaoerro, 1)[0]
+	// map each result back to its coleta and to the package of its object
+	numbers := coletaNumbers(packages)
+	codes := make(map[int64]string)
+	errs := make([]string, 0)
+	message := ""
+	for _, r := range resp.SolicitarPostagemReversa.Resultadosolicitacao {
+		n, ok := coletaOf(o, r.Idcliente, numbers)
+		if !ok {
+			continue
+		}
+		// The request has been made before the Numerocoleta is inside the error message
+		if r.Codigoerro == 121 {
+			re := regexp.MustCompile("[0-9]{9}")
+			if code := re.FindString(r.Descricaoerro); code != "" {
+				r.Numerocoleta = code
+			}
+		}
+		// Error in the result of the request
+		if r.Codigoerro != 0 && r.Codigoerro != 121 {
+			errs = append(errs, "Error coleta: "+strconv.Itoa(r.Codigoerro)+" - "+r.Descricaoerro)
+			continue
+		}
+		if _, ok := codes[n]; !ok && n == numbers[0] {
+			message = r.Descricaoerro
+		}
+		codes[n] = r.Numerocoleta
+		assignResult(packages, n, r)
 	}
-	// Error in the result of the request
-	if r.Codigoerro != 0 && r.Codigoerro != 121 {
-		h.saveErrorMessage(o, "Error coleta: "+strconv.Itoa(r.Codigoerro)+" - "+r.Descricaoerro)
+	for _, n := range numbers {
+		if _, ok := codes[n]; !ok && len(errs) == 0 {
+			errs = append(errs, "Error coleta: no result for coleta "+coletaClientID(o, n))
+		}
+	}
+	// the coletas already made are replied with their number when the request is sent again
+	if len(errs) > 0 {
+		h.saveErrorMessage(ctx, o, strings.Join(errs, "; "), strut.SourceCorreios)
 		return
 	}
-	//Update the DB with the Numerocoleta
-	if err2 := h.Repo.UpdateRequestPostage(o, r.Numerocoleta); err != nil {
-		fmt.Println(err2.Error())
+
+	//Update the DB with the Numerocoleta of the first coleta and the codes of every package
+	err = h.transition(ctx, o, strut.StatusGenerated, message, strut.SourceCorreios, func(tx repo.Definition) error {
+		for _, p := range packages {
+			if err := tx.UpdateRequestPackage(ctx, p); err != nil {
+				return err
+			}
+		}
+		return tx.UpdateRequestPostage(ctx, o, codes[numbers[0]])
+	})
+	if err != nil {
+		log.Printf("Request %d: %s\n", o.RequestID, err.Error())
 	}
-	return
+}
+
+//requestPackages Returns the packages of the Request, a Request without packages is given one for each of its items or one without items
+func (h *Handler) requestPackages(ctx context.Context, o *strut.Request) ([]*strut.RequestPackage, error) {
+	packages, err := h.Repo.GetRequestPackages(ctx, o.RequestID)
+	if err != nil || len(packages) > 0 {
+		return packages, err
+	}
+
+	for i, item := range o.Items {
+		id := o.SlipNumber
+		if len(o.Items) > 1 {
+			id = fmt.Sprintf("%s-%d", o.SlipNumber, i+1)
+		}
+		packages = append(packages, &strut.RequestPackage{ObjectID: id, Description: item.ProductName})
+	}
+	if len(packages) == 0 {
+		packages = append(packages, &strut.RequestPackage{ObjectID: o.SlipNumber})
+	}
+	if err := h.Repo.SaveRequestPackages(ctx, o.RequestID, packages); err != nil {
+		return nil, err
+	}
+
+	return packages, nil
 }
 
 //CancelReverseLogistic Performs in Correios WebService a request for a Reverse Postage
-func (h *Handler) CancelReverseLogistic(o *strut.Request) {
+func (h *Handler) CancelReverseLogistic(ctx context.Context, o *strut.Request) {
+
+	// the work dispatched before the cancel may have changed the request
+	if cur, err := h.Repo.GetRequestByID(ctx, int(o.RequestID)); err == nil && cur.RequestID != 0 {
+		*o = *cur
+	}
 
 	//Update the status of the items to Processing
-	if _, err := h.Repo.UpdateRequestStatus(o, strut.StatusProcessing, ""); err != nil {
-		h.saveErrorMessage(o, err.Error())
+	if err := h.UpdateStatus(ctx, o, strut.StatusProcessing, "", strut.SourceAPI); err != nil {
+		log.Printf("Request %d: %s\n", o.RequestID, err.Error())
 		return
 	}
 
@@ -201,50 +685,130 @@ func (h *Handler) CancelReverseLogistic(o *strut.Request) {
 	oauth := rever.BasicAuth{Login: h.Conf.UserReverse, Password: h.Conf.PwReverse}
 	client := rever.NewLogisticaReversaWS(h.Conf.URLReverse, true, &oauth)
 
-	// Get the PostalRange from Correios
-	response, err := client.CancelarPedido(&rever.CancelarPedido{CodAdministrativo: h.Conf.CodAdministrativo, NumeroPedido: o.PostageCode, Tipo: FollowMap[o.RequestService]})
+	codes, err := h.postageCodes(ctx, o)
 	if err != nil {
-		h.saveErrorMessage(o, err.Error())
+		h.saveCancelError(ctx, o, err.Error(), strut.SourceAPI)
 		return
 	}
 
-	if response.CancelarPedido.Coderro != "" {
-		h.saveErrorMessage(o, response.CancelarPedido.Coderro+" - "+response.CancelarPedido.Msgerro)
-		return
+	// cancel every coleta of the request
+	for _, code := range codes {
+		response, err := client.CancelarPedido(ctx, &rever.CancelarPedido{CodAdministrativo: h.Conf.CodAdministrativo, NumeroPedido: code, Tipo: FollowMap[o.RequestType]})
+		if err != nil {
+			h.saveCancelError(ctx, o, err.Error(), strut.SourceAPI)
+			return
+		}
+
+		if response.CancelarPedido == nil {
+			h.saveCancelError(ctx, o, "Correios replied without the result of the cancel of "+code, strut.SourceCorreios)
+			return
+		}
+
+		if response.CancelarPedido.Coderro != "" {
+			h.saveCancelError(ctx, o, response.CancelarPedido.Coderro+" - "+response.CancelarPedido.Msgerro, strut.SourceCorreios)
+			return
+		}
 	}
 
-	//Update the status of the items to Processing
-	if _, err := h.Repo.UpdateRequestStatus(o, strut.StatusCanceled, ""); err != nil {
-		h.saveErrorMessage(o, err.Error())
-		return
+	//Update the status of the items to Canceled
+	if err := h.UpdateStatus(ctx, o, strut.StatusCanceled, "", strut.SourceCorreios); err != nil {
+		log.Printf("Request %d: %s\n", o.RequestID, err.Error())
 	}
 }
 
+//UpdateStatus Moves the Request to the given status if the transition is allowed, records it in the history and writes the callback to the outbox
+func (h *Handler) UpdateStatus(ctx context.Context, o *strut.Request, status string, message string, source string) error {
+	return h.transition(ctx, o, status, message, source, func(tx repo.Definition) error {
+		_, err := tx.UpdateRequestStatus(ctx, o, status, message)
+		return err
+	})
+}
+
+//transition Checks the transition table, performs the update, records the change and writes its callback in a single transaction, every status change goes through here
+func (h *Handler) transition(ctx context.Context, o *strut.Request, status string, description string, source string, update func(tx repo.Definition) error) error {
+	from := o.Status
+	if !strut.CanTransition(from, status) {
+		return &strut.TransitionError{RequestID: o.RequestID, From: from, To: status}
+	}
+
+	prev := *o
+	err := h.Repo.Transaction(ctx, func(tx repo.Definition) error {
+		if err := update(tx); err != nil {
+			return err
+		}
+		if err := tx.InsertStatusHistory(ctx, &strut.StatusHistory{RequestID: o.RequestID, FromStatus: from, ToStatus: status, Source: source, Description: description}); err != nil {
+			return err
+		}
+		return h.notify(ctx, tx, o)
+	})
+	if err != nil {
+		// the struct must match the stored request after a rollback
+		*o = prev
+		return err
+	}
+
+	return nil
+}
+
+//notify Writes the callback of the current status of the Request to the outbox in the transaction of its change,
+//so a change is never stored without its callback
+func (h *Handler) notify(ctx context.Context, tx repo.Definition, o *strut.Request) error {
+	if h.Outbox == nil {
+		return nil
+	}
+	return h.Outbox.EnqueueRequest(ctx, tx, o)
+}
+
 //saveErrorMessage Error message
-func (h *Handler) saveErrorMessage(o *strut.Request, message string) {
+func (h *Handler) saveErrorMessage(ctx context.Context, o *strut.Request, message string, source string) {
 	o.Retries++
-	if _, err2 := h.Repo.UpdateRequestStatus(o, strut.StatusError, message); err2 != nil {
-		fmt.Println(err2.Error())
+	if err2 := h.UpdateStatus(ctx, o, strut.StatusError, message, source); err2 != nil {
+		log.Printf("Request %d: %s\n", o.RequestID, err2.Error())
 	}
 	return
 }
 
-//buildColetaReversa Builds the ColectaReversa struct
-func buildColetaReversa(o *strut.Request) *rever.ColetaReversa {
-	r := buildRemetente(o)
+//saveCancelError Moves the Request whose cancel failed to CancelError with the error message, its cancel is retried by the reprocessor
+func (h *Handler) saveCancelError(ctx context.Context, o *strut.Request, message string, source string) {
+	o.Retries++
+	if err2 := h.UpdateStatus(ctx, o, strut.StatusCancelError, message, source); err2 != nil {
+		log.Printf("Request %d: %s\n", o.RequestID, err2.Error())
+	}
+}
 
-	cc := rever.Coleta{Tipo: FollowMap[o.RequestType], Remetente: r}
-	var ob []*rever.Objeto
+//buildColetasReversas Builds a ColetaReversa for each coleta number of the packages, with an object for each of its packages
+func buildColetasReversas(o *strut.Request, packages []*strut.RequestPackage) []*rever.ColetaReversa {
+	numbers := coletaNumbers(packages)
+	coletas := make([]*rever.ColetaReversa, 0, len(numbers))
 
-	for _, i := range o.Items {
-		obj := new(rever.Objeto)
-		obj.ID = o.SlipNumber
-		obj.Desc = i.ProductName
-		obj.Item = "1"
-		ob = append(ob, obj)
+	for _, n := range numbers {
+		c := buildColetaReversa(o, n)
+		for _, p := range packages {
+			if p.Coleta == n {
+				c.Objcol = append(c.Objcol, &rever.Objeto{Item: strconv.Itoa(len(c.Objcol) + 1), Desc: p.Description, ID: p.ObjectID})
+			}
+		}
+		coletas = append(coletas, c)
+	}
+
+	return coletas
+}
+
+//buildColetaReversa Builds the ColetaReversa struct of a coleta of the Request without its objects,
+//every coleta has the declared value, the additional services, the checklist and the products of the Request
+func buildColetaReversa(o *strut.Request, n int64) *rever.ColetaReversa {
+	r := buildRemetente(o)
+
+	cc := rever.Coleta{Tipo: FollowMap[o.RequestType], Idcliente: coletaClientID(o, n), Valordeclarado: correiosValue(o.DeclaredValue),
+		Cklist: ChecklistMap[o.Checklist], Documento: o.Documents, Remetente: r}
+	for _, p := range o.Products {
+		cc.Produto = append(cc.Produto, &rever.Produto{Codigo: p.Code, Tipo: p.Type, Qtd: strconv.FormatInt(p.Quantity, 10)})
 	}
 
-	c := rever.ColetaReversa{Coleta: &cc, Objcol: ob}
+	c := rever.ColetaReversa{Coleta: &cc, Servicoadicional: strings.Join(o.AdditionalServices, ",")}
+	if o.Ar {
+		c.Ar = 1
+	}
 	if FollowMap[o.RequestType] == "C" {
 		c.Ag = o.ColectDate
 	}
@@ -252,12 +816,66 @@ func buildColetaReversa(o *strut.Request) *rever.ColetaReversa {
 	return &c
 }
 
+//coletaNumbers Returns the coleta numbers of the packages in ascending order
+func coletaNumbers(packages []*strut.RequestPackage) []int64 {
+	numbers := make([]int64, 0, 1)
+	seen := make(map[int64]bool)
+	for _, p := range packages {
+		if !seen[p.Coleta] {
+			seen[p.Coleta] = true
+			numbers = append(numbers, p.Coleta)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	return numbers
+}
+
+//coletaClientID Returns the ID sent to Correios for a coleta of the Request, it is the same on every attempt so a coleta already made is replied with its number
+func coletaClientID(o *strut.Request, n int64) string {
+	return fmt.Sprintf("%d-%d", o.RequestID, n)
+}
+
+//coletaOf Returns the coleta number of a result of Correios by its client ID, a result without it belongs to the only coleta sent
+func coletaOf(o *strut.Request, clientID string, numbers []int64) (int64, bool) {
+	for _, n := range numbers {
+		if clientID == coletaClientID(o, n) {
+			return n, true
+		}
+	}
+	if clientID == "" && len(numbers) == 1 {
+		return numbers[0], true
+	}
+	return 0, false
+}
+
+//assignResult Gives the number of a coleta to its packages and the tracking code of the result to the package of its object,
+//a result without the ID of its object is of the only package of the coleta
+func assignResult(packages []*strut.RequestPackage, n int64, r *rever.ResultadoSolicitacao) {
+	count := 0
+	for _, p := range packages {
+		if p.Coleta == n {
+			count++
+		}
+	}
+
+	for _, p := range packages {
+		if p.Coleta != n {
+			continue
+		}
+		p.PostageCode = r.Numerocoleta
+		if r.Idobj == p.ObjectID || (r.Idobj == "" && count == 1) {
+			p.TrackingCode = r.Numeroetiqueta
+		}
+	}
+}
+
 //buildDestinatario Builds the Destinatorio struct
 func buildDestinatario(o *strut.Request) *rever.Pessoa {
 	p := rever.Pessoa{
 		Nome:        o.DestinationNome,
 		Logradouro:  o.DestinationLogradouro,
-		Numero:      string(o.DestinationNumero),
+		Numero:      strconv.FormatInt(o.DestinationNumero, 10),
 		Complemento: o.DestinationComplemento,
 		Bairro:      o.DestinationBairro,
 		Referencia:  o.DestinationReferencia,
@@ -277,7 +895,7 @@ func buildRemetente(o *strut.Request) *rever.Remetente {
 	p := rever.Pessoa{
 		Nome:        o.OriginNome,
 		Logradouro:  o.OriginLogradouro,
-		Numero:      string(o.OriginNumero),
+		Numero:      strconv.FormatInt(o.OriginNumero, 10),
 		Complemento: o.OriginComplemento,
 		Bairro:      o.OriginBairro,
 		Referencia:  o.OriginReferencia,
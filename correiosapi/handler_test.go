@@ -0,0 +1,413 @@
+package correiosapi
+
+import (
+	"context"
+	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
+	"github.com/pintobikez/brazilian-correios-service/correiosapi/mockcorreios"
+	"github.com/pintobikez/brazilian-correios-service/repository/memory"
+	"github.com/pintobikez/brazilian-correios-service/repository/repotest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//emptyReply SOAP envelope without the result of the operation
+const emptyReply = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body></soap:Body></soap:Envelope>`
+
+var ctx = context.Background()
+
+//newTestHandler Returns a Handler on a memory repository that calls the given fake of Correios
+func newTestHandler(correios *httptest.Server) *Handler {
+	return New(memory.New(), &cnf.CorreiosConfig{URLReverse: correios.URL, URLTracking: correios.URL, CodAdministrativo: "123", CartaoPostagem: "456"})
+}
+
+//newEmptyServer Returns a server that replies to every call without its result
+func newEmptyServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(emptyReply))
+	}))
+}
+
+//insertRequest Inserts a pending request with the given items
+func insertRequest(t *testing.T, h *Handler, items ...string) *strut.Request {
+	o := repotest.NewRequest(1, items...)
+	o.RequestService = "PAC"
+	if err := h.Repo.InsertRequest(ctx, o); err != nil {
+		t.Fatalf("InsertRequest: %s", err.Error())
+	}
+	return o
+}
+
+//reload Gets the stored request
+func reload(t *testing.T, h *Handler, o *strut.Request) *strut.Request {
+	got, err := h.Repo.GetRequestByID(ctx, int(o.RequestID))
+	if err != nil || got.RequestID == 0 {
+		t.Fatalf("GetRequestByID(%d) = %d, %v", o.RequestID, got.RequestID, err)
+	}
+	return got
+}
+
+//generate Performs the request in Correios and fails the test if it is not generated
+func generate(t *testing.T, h *Handler, o *strut.Request) *strut.Request {
+	h.DoReverseLogistic(ctx, o, strut.SourceAPI)
+
+	got := reload(t, h, o)
+	if got.Status != strut.StatusGenerated || got.PostageCode == "" {
+		t.Fatalf("request is %s with postage code %q and error %q, want %s", got.Status, got.PostageCode, got.ErrorMessage, strut.StatusGenerated)
+	}
+	return got
+}
+
+func TestDoReverseLogistic(t *testing.T) {
+	mock := mockcorreios.New()
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+
+	o := generate(t, h, insertRequest(t, h, "a", "b"))
+
+	if calls := mock.Calls(mockcorreios.OpSolicitarPostagemReversa); calls != 1 {
+		t.Errorf("solicitarPostagemReversa called %d times, want 1", calls)
+	}
+	packages, err := h.Repo.GetRequestPackages(ctx, o.RequestID)
+	if err != nil || len(packages) != 2 {
+		t.Fatalf("GetRequestPackages = %d packages, %v, want 2", len(packages), err)
+	}
+	for _, p := range packages {
+		if p.PostageCode != o.PostageCode || p.TrackingCode == "" {
+			t.Errorf("package %s has postage code %q and tracking code %q", p.ObjectID, p.PostageCode, p.TrackingCode)
+		}
+	}
+
+	history, err := h.Repo.GetStatusHistoryByRequestID(ctx, o.RequestID)
+	if err != nil || len(history) != 2 || history[1].ToStatus != strut.StatusGenerated || history[1].Source != strut.SourceCorreios {
+		t.Errorf("GetStatusHistoryByRequestID = %d changes, %v", len(history), err)
+	}
+
+	// a callback is written with each change of the status
+	callbacks, err := h.Repo.GetCallbackDeliveriesByRequestID(ctx, o.RequestID)
+	if err != nil || len(callbacks) != 2 || !strings.Contains(callbacks[1].Payload, strut.StatusGenerated) {
+		t.Errorf("GetCallbackDeliveriesByRequestID = %d callbacks, %v", len(callbacks), err)
+	}
+}
+
+func TestDoReverseLogisticAlreadyRequested(t *testing.T) {
+	mock := mockcorreios.New()
+	mock.SetScenario(mockcorreios.OpSolicitarPostagemReversa, mockcorreios.Scenario{Kind: mockcorreios.ScenarioError, ErrorCode: mockcorreios.ErrAlreadyRequested})
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+
+	// the number of the coleta made before is taken from the error message
+	o := generate(t, h, insertRequest(t, h, "a"))
+
+	orders := mock.Orders()
+	if len(orders) != 1 || strconv.Itoa(orders[0].Number) != o.PostageCode {
+		t.Errorf("postage code %s, want the number of the order made before", o.PostageCode)
+	}
+}
+
+func TestDoReverseLogisticErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		scenario mockcorreios.Scenario
+		message  string
+	}{
+		{"error", mockcorreios.Scenario{Kind: mockcorreios.ScenarioError, ErrorCode: 99, ErrorMessage: "CEP inválido"}, "Error coleta: 99 - CEP inválido"},
+		// the client decodes ISO-8859-1 as the real service sends, a reply in UTF-8 is garbled
+		{"utf-8 reply", mockcorreios.Scenario{Kind: mockcorreios.ScenarioError, ErrorCode: 99, ErrorMessage: "CEP inválido", UTF8: true}, "99 - CEP invÃ¡lido"},
+		{"fault", mockcorreios.Scenario{Kind: mockcorreios.ScenarioFault, ErrorMessage: "ComponenteException"}, "ComponenteException"},
+	}
+
+	for _, c := range cases {
+		mock := mockcorreios.New()
+		mock.SetScenario(mockcorreios.OpSolicitarPostagemReversa, c.scenario)
+		correios := httptest.NewServer(mock)
+		h := newTestHandler(correios)
+
+		o := insertRequest(t, h, "a")
+		h.DoReverseLogistic(ctx, o, strut.SourceAPI)
+		correios.Close()
+
+		got := reload(t, h, o)
+		if got.Status != strut.StatusError || got.Retries != 1 || !strings.Contains(got.ErrorMessage, c.message) {
+			t.Errorf("%s: request is %s after %d retries with error %q, want %s with %q", c.name, got.Status, got.Retries, got.ErrorMessage, strut.StatusError, c.message)
+		}
+		if got.PostageCode != "" {
+			t.Errorf("%s: failed request has the postage code %s", c.name, got.PostageCode)
+		}
+	}
+
+	empty := newEmptyServer()
+	defer empty.Close()
+	h := newTestHandler(empty)
+
+	o := insertRequest(t, h, "a")
+	h.DoReverseLogistic(ctx, o, strut.SourceAPI)
+	if got := reload(t, h, o); got.Status != strut.StatusError || got.ErrorMessage == "" {
+		t.Errorf("empty reply: request is %s with error %q, want %s", got.Status, got.ErrorMessage, strut.StatusError)
+	}
+}
+
+func TestCancelReverseLogistic(t *testing.T) {
+	mock := mockcorreios.New()
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+
+	o := generate(t, h, insertRequest(t, h, "a"))
+	h.CancelReverseLogistic(ctx, o)
+
+	if got := reload(t, h, o); got.Status != strut.StatusCanceled {
+		t.Errorf("request is %s with error %q, want %s", got.Status, got.ErrorMessage, strut.StatusCanceled)
+	}
+	if orders := mock.Orders(); len(orders) != 1 || orders[0].Status != mockcorreios.StatusCanceled {
+		t.Errorf("the order was not canceled in Correios")
+	}
+}
+
+func TestCancelReverseLogisticErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		scenario mockcorreios.Scenario
+		message  string
+	}{
+		{"error", mockcorreios.Scenario{Kind: mockcorreios.ScenarioError, ErrorCode: 7, ErrorMessage: "Pedido ja postado"}, "7 - Pedido ja postado"},
+		{"fault", mockcorreios.Scenario{Kind: mockcorreios.ScenarioFault, ErrorMessage: "ComponenteException"}, "ComponenteException"},
+	}
+
+	for _, c := range cases {
+		mock := mockcorreios.New()
+		correios := httptest.NewServer(mock)
+		h := newTestHandler(correios)
+
+		o := generate(t, h, insertRequest(t, h, "a"))
+		mock.SetScenario(mockcorreios.OpCancelarPedido, c.scenario)
+		h.CancelReverseLogistic(ctx, o)
+		correios.Close()
+
+		got := reload(t, h, o)
+		if got.Status != strut.StatusCancelError || !strings.Contains(got.ErrorMessage, c.message) {
+			t.Errorf("%s: request is %s with error %q, want %s with %q", c.name, got.Status, got.ErrorMessage, strut.StatusCancelError, c.message)
+		}
+		if orders := mock.Orders(); len(orders) != 1 || orders[0].Status == mockcorreios.StatusCanceled {
+			t.Errorf("%s: the order was canceled in Correios", c.name)
+		}
+	}
+}
+
+func TestCancelReverseLogisticRetried(t *testing.T) {
+	mock := mockcorreios.New()
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+
+	o := generate(t, h, insertRequest(t, h, "a"))
+	mock.SetScenario(mockcorreios.OpCancelarPedido, mockcorreios.Scenario{Kind: mockcorreios.ScenarioFault, ErrorMessage: "ComponenteException"})
+	h.CancelReverseLogistic(ctx, o)
+	mock.SetScenario(mockcorreios.OpCancelarPedido, mockcorreios.Scenario{Kind: mockcorreios.ScenarioSuccess})
+
+	// the request whose cancel failed is not editable so a create job does not submit it again
+	create, err := QueueReverseJob(ctx, h.Repo, o.RequestID, strut.ActionCreate, strut.SourceCron)
+	if err != nil {
+		t.Fatalf("QueueReverseJob: %s", err.Error())
+	}
+	h.RunReverseJob(ctx, create)
+	if got, n := reload(t, h, o), mock.Calls(mockcorreios.OpSolicitarPostagemReversa); got.Status != strut.StatusCancelError || n != 1 {
+		t.Errorf("create job: request is %s after %d requests to Correios, want %s after 1", got.Status, n, strut.StatusCancelError)
+	}
+
+	cancel, err := QueueReverseJob(ctx, h.Repo, o.RequestID, strut.ActionCancel, strut.SourceCron)
+	if err != nil {
+		t.Fatalf("QueueReverseJob: %s", err.Error())
+	}
+	h.RunReverseJob(ctx, cancel)
+	if got := reload(t, h, o); got.Status != strut.StatusCanceled {
+		t.Errorf("cancel job: request is %s with error %q, want %s", got.Status, got.ErrorMessage, strut.StatusCanceled)
+	}
+	if orders := mock.Orders(); len(orders) != 1 || orders[0].Status != mockcorreios.StatusCanceled {
+		t.Errorf("the order was not canceled in Correios")
+	}
+}
+
+func TestFollowReverseLogistic(t *testing.T) {
+	mock := mockcorreios.New()
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+
+	o := generate(t, h, insertRequest(t, h, "a"))
+	number, _ := strconv.Atoi(o.PostageCode)
+	if err := mock.SetOrderStatus(number, mockcorreios.StatusUsed, "Objeto postado"); err != nil {
+		t.Fatalf("SetOrderStatus: %s", err.Error())
+	}
+
+	ret, err := h.FollowReverseLogistic(ctx, FollowMap[o.RequestType], time.Now())
+	if err != nil || len(ret) != 1 {
+		t.Fatalf("FollowReverseLogistic = %d changes, %v, want 1", len(ret), err)
+	}
+	if ret[0].RequestID != o.RequestID || ret[0].Status != strut.StatusUsed || ret[0].TrackingCode == "" {
+		t.Errorf("changed request %d is %s with tracking code %q, want %d %s", ret[0].RequestID, ret[0].Status, ret[0].TrackingCode, o.RequestID, strut.StatusUsed)
+	}
+
+	// a day followed again reports the same status without changing the request
+	if ret, err := h.FollowReverseLogistic(ctx, FollowMap[o.RequestType], time.Now()); err != nil || len(ret) != 0 {
+		t.Errorf("following the day again = %d changes, %v, want 0", len(ret), err)
+	}
+	objects, err := h.Repo.GetRequestObjects(ctx, o.RequestID)
+	if err != nil || len(objects) != 1 || objects[0].Status != mockcorreios.StatusUsed {
+		t.Errorf("GetRequestObjects = %d objects, %v", len(objects), err)
+	}
+}
+
+func TestFollowReverseLogisticErrors(t *testing.T) {
+	mock := mockcorreios.New()
+	mock.SetScenario(mockcorreios.OpAcompanharPedidoPorData, mockcorreios.Scenario{Kind: mockcorreios.ScenarioFault})
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+
+	if _, err := newTestHandler(correios).FollowReverseLogistic(ctx, "A", time.Now()); err == nil {
+		t.Errorf("fault: FollowReverseLogistic did not fail")
+	}
+
+	mock.SetScenario(mockcorreios.OpAcompanharPedidoPorData, mockcorreios.Scenario{Kind: mockcorreios.ScenarioError, ErrorCode: 99, ErrorMessage: "Erro interno"})
+	if ret, err := newTestHandler(correios).FollowReverseLogistic(ctx, "A", time.Now()); err == nil || !strings.Contains(err.Error(), "99 - Erro interno") {
+		t.Errorf("error: FollowReverseLogistic = %d changes, %v, want the error 99", len(ret), err)
+	}
+
+	empty := newEmptyServer()
+	defer empty.Close()
+
+	if _, err := newTestHandler(empty).FollowReverseLogistic(ctx, "A", time.Now()); err == nil {
+		t.Errorf("empty reply: FollowReverseLogistic did not fail")
+	}
+}
+
+func TestTrackObjects(t *testing.T) {
+	mock := mockcorreios.New()
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+	h.Conf.TrackingBatchSize = 1
+
+	objects := []string{"PO444714015BR", "PO444714029BR"}
+	ret, err := h.TrackObjects(ctx, &strut.Tracking{TrackingType: "ALL", Language: "BR", Objects: objects})
+	if err != nil || len(ret.Items) != 2 {
+		t.Fatalf("TrackObjects = %v, %v", ret, err)
+	}
+	for i, item := range ret.Items {
+		if item.Object != objects[i] || item.Error != "" || len(item.Events) == 0 {
+			t.Errorf("item %d is %s with %d events and error %q, want %s", i, item.Object, len(item.Events), item.Error, objects[i])
+		}
+		if status, _ := DeliveryStatus(item.Events); status != strut.StatusDelivered {
+			t.Errorf("object %s is %q, want %s", item.Object, status, strut.StatusDelivered)
+		}
+	}
+	if calls := mock.Calls(mockcorreios.OpBuscaEventosLista); calls != 2 {
+		t.Errorf("buscaEventosLista called %d times, want one per batch", calls)
+	}
+
+	// the timeline is stored and served without calling Correios
+	if stored, err := h.GetTrackingTimeline(ctx, objects[0]); err != nil || len(stored.Events) != 2 {
+		t.Errorf("GetTrackingTimeline = %v, %v", stored, err)
+	}
+	if calls := mock.Calls(mockcorreios.OpBuscaEventosLista); calls != 2 {
+		t.Errorf("a stored timeline called Correios")
+	}
+}
+
+func TestRunTrackingJob(t *testing.T) {
+	mock := mockcorreios.New()
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+
+	// a job whose worker stopped is run again once its lease ends
+	j := &strut.TrackingJob{TrackingType: "ALL", Language: "BR", Objects: []string{"PO444714015BR"}}
+	if err := h.Repo.InsertTrackingJob(ctx, j); err != nil {
+		t.Fatalf("InsertTrackingJob: %s", err.Error())
+	}
+	if ok, err := h.Repo.ClaimTrackingJob(ctx, j, "stopped-worker", time.Now().Add(-time.Second)); !ok || err != nil {
+		t.Fatalf("ClaimTrackingJob = %v, %v", ok, err)
+	}
+	h.RunTrackingJob(ctx, j)
+
+	got, err := h.Repo.GetTrackingJobByID(ctx, j.JobID)
+	if err != nil || got.Status != strut.JobDone || got.Attempts != 2 || got.Result == nil || len(got.Result.Items) != 1 {
+		t.Fatalf("resumed job = %+v, %v", got, err)
+	}
+
+	// a job taken more times than allowed fails without calling Correios
+	h.Conf.JobMaxAttempts = 1
+	j = &strut.TrackingJob{TrackingType: "ALL", Language: "BR", Objects: []string{"PO444714029BR"}}
+	if err := h.Repo.InsertTrackingJob(ctx, j); err != nil {
+		t.Fatalf("InsertTrackingJob: %s", err.Error())
+	}
+	h.Repo.ClaimTrackingJob(ctx, j, "stopped-worker", time.Now().Add(-time.Second))
+	h.RunTrackingJob(ctx, j)
+
+	got, err = h.Repo.GetTrackingJobByID(ctx, j.JobID)
+	if err != nil || got.Status != strut.JobFailed || got.Error != "Interrupted 1 times" || mock.Calls(mockcorreios.OpBuscaEventosLista) != 1 {
+		t.Errorf("interrupted job = %+v, %v", got, err)
+	}
+}
+
+func TestTrackObjectsErrors(t *testing.T) {
+	mock := mockcorreios.New()
+	mock.SetScenario(mockcorreios.OpBuscaEventosLista, mockcorreios.Scenario{Kind: mockcorreios.ScenarioError, ErrorMessage: "Objeto nao encontrado"})
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+
+	// an object not found by Correios has its error
+	ret, err := h.TrackObjects(ctx, &strut.Tracking{TrackingType: "ALL", Language: "BR", Objects: []string{"PO444714015BR"}})
+	if err != nil || len(ret.Items) != 1 || ret.Items[0].Error != "Objeto nao encontrado" {
+		t.Errorf("TrackObjects = %v, %v", ret, err)
+	}
+
+	// an error is returned when every batch failed
+	mock.SetScenario(mockcorreios.OpBuscaEventosLista, mockcorreios.Scenario{Kind: mockcorreios.ScenarioFault})
+	if _, err := h.TrackObjects(ctx, &strut.Tracking{TrackingType: "ALL", Language: "BR", Objects: []string{"PO444714015BR"}}); err == nil {
+		t.Errorf("fault: TrackObjects did not fail")
+	}
+
+	empty := newEmptyServer()
+	defer empty.Close()
+	if _, err := newTestHandler(empty).TrackObjects(ctx, &strut.Tracking{TrackingType: "ALL", Language: "BR", Objects: []string{"PO444714015BR"}}); err == nil {
+		t.Errorf("empty reply: TrackObjects did not fail")
+	}
+}
+
+func TestSyncReverseLogistic(t *testing.T) {
+	mock := mockcorreios.New()
+	correios := httptest.NewServer(mock)
+	defer correios.Close()
+	h := newTestHandler(correios)
+	name := SyncMarkPrefix + "A"
+	yesterday := Day(time.Now()).AddDate(0, 0, -1).Format(SyncDateFormat)
+
+	// a day Correios replied with an error is followed again by the next sync
+	mock.SetScenario(mockcorreios.OpAcompanharPedidoPorData, mockcorreios.Scenario{Kind: mockcorreios.ScenarioError, ErrorCode: 99, ErrorMessage: "Erro interno"})
+	if _, err := h.SyncReverseLogistic(ctx, "A"); err == nil {
+		t.Errorf("SyncReverseLogistic of an error reply did not fail")
+	}
+	if mark, err := h.Repo.GetSyncMark(ctx, name); err != nil || mark != "" {
+		t.Errorf("sync mark after an error reply = %q, %v, want none", mark, err)
+	}
+
+	mock.SetScenario(mockcorreios.OpAcompanharPedidoPorData, mockcorreios.Scenario{Kind: mockcorreios.ScenarioSuccess})
+	if _, err := h.SyncReverseLogistic(ctx, "A"); err != nil {
+		t.Fatalf("SyncReverseLogistic: %s", err.Error())
+	}
+	if mark, err := h.Repo.GetSyncMark(ctx, name); err != nil || mark != yesterday {
+		t.Errorf("sync mark = %q, %v, want %s", mark, err, yesterday)
+	}
+	if calls := mock.Calls(mockcorreios.OpAcompanharPedidoPorData); calls != 1+DefaultSyncLookback+1 {
+		t.Errorf("acompanharPedidoPorData called %d times, want the failed day and then every day of the lookback and today", calls)
+	}
+}
@@ -0,0 +1,137 @@
+package correiosapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	//DefaultJobLease seconds a worker holds a reverse or tracking job before another worker can take it
+	DefaultJobLease = 300
+	//DefaultJobMaxAttempts times a reverse or tracking job is taken before it fails, an attempt is only repeated when its worker stopped
+	DefaultJobMaxAttempts = 3
+)
+
+//QueueReverseJob Writes a reverse job of the Request with the repository, inside a transaction it is only queued if it commits.
+//The job must be given to SubmitReverseJob once it is written
+func QueueReverseJob(ctx context.Context, r repo.Definition, requestID int64, action string, source string) (*strut.ReverseJob, error) {
+	j := &strut.ReverseJob{RequestID: requestID, Action: action, Source: source}
+	if err := r.InsertReverseJob(ctx, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+//SubmitReverseJob Runs a reverse job on the dispatcher after the work already submitted for its Request
+func (h *Handler) SubmitReverseJob(j *strut.ReverseJob) {
+	h.Dispatcher.Submit(j.RequestID, func(ctx context.Context) { h.RunReverseJob(ctx, j) })
+}
+
+//RunReverseJob Takes the lease of a reverse job and performs its call to Correios,
+//a job leased by another worker or queued after an unfinished job of its Request is left to the next run of the sweeper
+func (h *Handler) RunReverseJob(ctx context.Context, j *strut.ReverseJob) {
+	ok, err := h.Repo.ClaimReverseJob(ctx, j, h.owner, time.Now().Add(h.jobLease()))
+	if err != nil {
+		log.Printf("Reverse job %d of Request %d: %s\n", j.ReverseJobID, j.RequestID, err.Error())
+		return
+	}
+	if !ok {
+		return
+	}
+
+	o, err := h.Repo.GetRequestByID(ctx, int(j.RequestID))
+	if err != nil {
+		log.Printf("Reverse job %d of Request %d: %s\n", j.ReverseJobID, j.RequestID, err.Error())
+		return
+	}
+
+	// the worker of the previous attempt stopped while waiting for Correios
+	if o.RequestID != 0 && o.Status == strut.StatusProcessing {
+		if j.Action == strut.ActionCancel {
+			h.saveCancelError(ctx, o, "Interrupted before Correios replied", strut.SourceCron)
+		} else {
+			h.saveErrorMessage(ctx, o, "Interrupted before Correios replied", strut.SourceCron)
+		}
+	}
+
+	j.Status = strut.JobDone
+	j.LastError = ""
+	switch {
+	case o.RequestID == 0:
+		j.Status = strut.JobFailed
+		j.LastError = fmt.Sprintf("Request %d not found", j.RequestID)
+	case j.Attempts > h.jobMaxAttempts():
+		j.Status = strut.JobFailed
+		j.LastError = fmt.Sprintf("Interrupted %d times", j.Attempts-1)
+	case j.Action == strut.ActionCancel:
+		h.CancelReverseLogistic(ctx, o)
+	case !strut.EditableStatus[o.Status]:
+		// a create queued twice runs once
+		j.LastError = fmt.Sprintf("Request %d is %s", o.RequestID, o.Status)
+	default:
+		h.DoReverseLogistic(ctx, o, j.Source)
+	}
+
+	// a job interrupted by a shutdown keeps its lease and is taken again once the lease ends
+	if ctx.Err() != nil {
+		return
+	}
+	if err := h.Repo.FinishReverseJob(ctx, j); err != nil {
+		log.Printf("Reverse job %d of Request %d: %s\n", j.ReverseJobID, j.RequestID, err.Error())
+	}
+}
+
+//HasOpenReverseJob Returns true if the Request has a reverse job pending or running
+func (h *Handler) HasOpenReverseJob(ctx context.Context, requestID int64) (bool, error) {
+	jobs, err := h.Repo.GetReverseJobsByRequestID(ctx, requestID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, j := range jobs {
+		if j.Status == strut.JobPending || j.Status == strut.JobRunning {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//jobLease Returns the time a worker holds a reverse or tracking job
+func (h *Handler) jobLease() time.Duration {
+	if h.Conf != nil && h.Conf.JobLease > 0 {
+		return time.Duration(h.Conf.JobLease) * time.Second
+	}
+	return DefaultJobLease * time.Second
+}
+
+//jobMaxAttempts Returns the times a reverse or tracking job is taken before it fails
+func (h *Handler) jobMaxAttempts() int64 {
+	if h.Conf != nil && h.Conf.JobMaxAttempts > 0 {
+		return h.Conf.JobMaxAttempts
+	}
+	return DefaultJobMaxAttempts
+}
+
+//Owner Returns the name under which the handler holds its leases and locks
+func (h *Handler) Owner() string {
+	return h.owner
+}
+
+//leaseOwner Returns a name of the handler unique across processes, containers can share the host name and the pid
+func leaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
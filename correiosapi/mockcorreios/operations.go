@@ -0,0 +1,337 @@
+package mockcorreios
+
+import (
+	"encoding/xml"
+	"fmt"
+	rever "github.com/pintobikez/brazilian-correios-service/correiosapi/soapreverse"
+	track "github.com/pintobikez/brazilian-correios-service/correiosapi/soaptracking"
+	"github.com/pintobikez/brazilian-correios-service/trackingcode"
+	"strconv"
+	"time"
+)
+
+const soapNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+
+//requestEnvelope SOAP envelope sent by the clients
+type requestEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Operation operation `xml:",any"`
+	} `xml:"Body"`
+}
+
+//operation holds the fields read from any of the served operations
+type operation struct {
+	XMLName         xml.Name
+	Coletas         []*coleta `xml:"coletas_solicitadas"`
+	NumeroPedido    []string  `xml:"numeroPedido"`
+	TipoBusca       string    `xml:"tipoBusca"`
+	TipoSolicitacao string    `xml:"tipoSolicitacao"`
+	Data            string    `xml:"data"`
+	Objetos         []string  `xml:"objetos"`
+}
+
+//coleta a coleta requested in solicitarPostagemReversa
+type coleta struct {
+	Tipo      string `xml:"tipo"`
+	IDCliente string `xml:"id_cliente"`
+	Objetos   []struct {
+		ID string `xml:"id"`
+	} `xml:"obj_col"`
+}
+
+//responseEnvelope SOAP envelope sent back to the clients
+type responseEnvelope struct {
+	XMLName xml.Name `xml:"soap:Envelope"`
+	Soap    string   `xml:"xmlns:soap,attr"`
+	Body    struct {
+		XMLName xml.Name `xml:"soap:Body"`
+		Content interface{}
+	}
+}
+
+//fault SOAP fault sent back to the clients
+type fault struct {
+	XMLName xml.Name `xml:"soap:Fault"`
+	Code    string   `xml:"faultcode"`
+	String  string   `xml:"faultstring"`
+}
+
+//solicitarPostagemReversa stores an Order per coleta and replies with its number
+func (s *Server) solicitarPostagemReversa(req *operation, sc Scenario) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ret := &rever.RetornoPostagem{
+		Statusprocessamento: "1",
+		Dataprocessamento:   now.Format("02/01/2006"),
+		Horaprocessamento:   now.Format("15:04:05"),
+		Coderro:             "00",
+	}
+
+	for _, c := range req.Coletas {
+		res := &rever.ResultadoSolicitacao{Tipo: c.Tipo, Idcliente: c.IDCliente, Datasolicitacao: ret.Dataprocessamento, Horasolicitacao: ret.Horaprocessamento}
+
+		if sc.Kind == ScenarioError && sc.ErrorCode != ErrAlreadyRequested {
+			res.Codigoerro = errorCode(sc)
+			res.Descricaoerro = errorMessage(sc)
+			ret.Resultadosolicitacao = append(ret.Resultadosolicitacao, res)
+			continue
+		}
+
+		o := s.findOrder(c.IDCliente)
+		if o == nil {
+			o = s.newOrder(c)
+		}
+		res.Numerocoleta = strconv.Itoa(o.Number)
+		res.Numeroetiqueta = o.Label
+		res.Statusobjeto = o.Status
+		res.Prazo = now.AddDate(0, 0, 10).Format("02/01/2006")
+
+		if sc.Kind == ScenarioError {
+			res.Codigoerro = ErrAlreadyRequested
+			res.Descricaoerro = fmt.Sprintf("Já existe uma solicitação com o número %d para este cliente", o.Number)
+		}
+
+		// a coleta with several objects is replied with a result per object
+		if len(o.ObjectIDs) < 2 {
+			ret.Resultadosolicitacao = append(ret.Resultadosolicitacao, res)
+			continue
+		}
+		for i, id := range o.ObjectIDs {
+			r := *res
+			r.Idobj = id
+			r.Numeroetiqueta = o.Labels[i]
+			ret.Resultadosolicitacao = append(ret.Resultadosolicitacao, &r)
+		}
+	}
+
+	return &rever.SolicitarPostagemReversaResponse{SolicitarPostagemReversa: ret}
+}
+
+//cancelarPedido cancels a stored Order
+func (s *Server) cancelarPedido(req *operation, sc Scenario) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ret := &rever.RetornoCancelamento{Data: now.Format("02/01/2006"), Hora: now.Format("15:04:05")}
+
+	if sc.Kind == ScenarioError {
+		ret.Coderro = strconv.Itoa(errorCode(sc))
+		ret.Msgerro = errorMessage(sc)
+		return &rever.CancelarPedidoResponse{CancelarPedido: ret}
+	}
+
+	var number int
+	if len(req.NumeroPedido) > 0 {
+		number, _ = strconv.Atoi(req.NumeroPedido[0])
+	}
+	o, ok := s.orders[number]
+	if !ok {
+		ret.Coderro = "-1"
+		ret.Msgerro = fmt.Sprintf("Pedido %d não encontrado", number)
+		return &rever.CancelarPedidoResponse{CancelarPedido: ret}
+	}
+
+	o.Status = StatusCanceled
+	o.Description = "Desistência do cliente"
+	o.UpdatedAt = now
+	o.record()
+	ret.Objetopostal = &rever.ObjetoSimplificado{Numeropedido: o.Number, Statuspedido: "Desistência", Datahoracancelamento: now.Format("02/01/2006 15:04:05")}
+
+	return &rever.CancelarPedidoResponse{CancelarPedido: ret}
+}
+
+//acompanharPedidoPorData replies with the Orders of the given type updated in the given date
+func (s *Server) acompanharPedidoPorData(req *operation, sc Scenario) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ret := &rever.RetornoAcompanhamento{Tiposolicitacao: req.TipoSolicitacao, Data: now.Format("02/01/2006"), Hora: now.Format("15:04:05"), Coderro: "00"}
+
+	if sc.Kind == ScenarioError {
+		ret.Coderro = strconv.Itoa(errorCode(sc))
+		ret.Msgerro = errorMessage(sc)
+		return &rever.AcompanharPedidoPorDataResponse{AcompanharPedidoPorData: ret}
+	}
+
+	for _, o := range s.orders {
+		if o.Type != req.TipoSolicitacao || o.UpdatedAt.Format("02/01/2006") != req.Data {
+			continue
+		}
+
+		ret.Coleta = append(ret.Coleta, o.coleta(false))
+	}
+
+	return &rever.AcompanharPedidoPorDataResponse{AcompanharPedidoPorData: ret}
+}
+
+//acompanharPedido replies with the given Orders, with their whole history when it is asked for
+func (s *Server) acompanharPedido(req *operation, sc Scenario) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ret := &rever.RetornoAcompanhamento{Tiposolicitacao: req.TipoSolicitacao, Data: now.Format("02/01/2006"), Hora: now.Format("15:04:05"), Coderro: "00"}
+
+	if sc.Kind == ScenarioError {
+		ret.Coderro = strconv.Itoa(errorCode(sc))
+		ret.Msgerro = errorMessage(sc)
+		return &rever.AcompanharPedidoResponse{AcompanharPedido: ret}
+	}
+
+	for _, n := range req.NumeroPedido {
+		number, _ := strconv.Atoi(n)
+		if o, ok := s.orders[number]; ok && o.Type == req.TipoSolicitacao {
+			ret.Coleta = append(ret.Coleta, o.coleta(req.TipoBusca == rever.BuscaHistorico))
+		}
+	}
+	if len(ret.Coleta) == 0 {
+		ret.Coderro = "-1"
+		ret.Msgerro = "Nenhum pedido encontrado"
+	}
+
+	return &rever.AcompanharPedidoResponse{AcompanharPedido: ret}
+}
+
+//buscaEventosLista replies with the stored events of each object or with a delivered timeline
+func (s *Server) buscaEventosLista(req *operation, sc Scenario) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := &track.Return{Version: "2.0", Quantity: len(req.Objetos)}
+
+	for _, code := range req.Objetos {
+		obj := &track.Objeto{TrackingCode: code}
+
+		if sc.Kind == ScenarioError {
+			obj.Error = errorMessage(sc)
+			ret.Objects = append(ret.Objects, obj)
+			continue
+		}
+
+		if len(code) == 13 {
+			obj.Initials = code[0:2]
+		}
+		obj.Name = "ETIQUETA LOGICA PAC"
+		obj.Category = "ENCOMENDA PAC"
+
+		if events, ok := s.events[code]; ok {
+			obj.Events = events
+		} else {
+			obj.Events = deliveredTimeline()
+		}
+		ret.Objects = append(ret.Objects, obj)
+	}
+
+	return &track.BuscaEventosListaResponse{Result: ret}
+}
+
+//findOrder finds an Order by the client ID, must be called with the lock held
+func (s *Server) findOrder(clientID string) *Order {
+	if clientID == "" {
+		return nil
+	}
+	for _, o := range s.orders {
+		if o.ClientID == clientID {
+			return o
+		}
+	}
+	return nil
+}
+
+//newOrder stores a new Order for the coleta with a label for each of its objects, must be called with the lock held
+func (s *Server) newOrder(c *coleta) *Order {
+	s.nextOrder++
+
+	o := &Order{
+		Number:      s.nextOrder,
+		Type:        c.Tipo,
+		ClientID:    c.IDCliente,
+		Status:      StatusPending,
+		Description: "Aguardando Objeto na Agência",
+		UpdatedAt:   time.Now(),
+	}
+	for _, obj := range c.Objetos {
+		o.ObjectIDs = append(o.ObjectIDs, obj.ID)
+	}
+	for i := 0; i == 0 || i < len(o.ObjectIDs); i++ {
+		s.nextLabel++
+		label, _ := trackingcode.Build("LR", s.nextLabel)
+		o.Labels = append(o.Labels, label)
+	}
+	o.Label = o.Labels[0]
+	o.record()
+	s.orders[o.Number] = o
+
+	return o
+}
+
+//record adds the current status of the Order to its history, must be called with the lock held
+func (o *Order) record() {
+	h := &rever.HistoricoColeta{
+		Descricaostatus: o.Description,
+		Dataatualizacao: o.UpdatedAt.Format("02/01/2006"),
+		Horaatualizacao: o.UpdatedAt.Format("15:04:05"),
+	}
+	h.Status, _ = strconv.Atoi(o.Status)
+	o.History = append(o.History, h)
+}
+
+//coleta returns the Order as replied by the follow operations, with its whole history or only its last status
+func (o *Order) coleta(history bool) *rever.ColetasSolicitadas {
+	col := &rever.ColetasSolicitadas{Numeropedido: o.Number, Controlecliente: o.ClientID}
+	if history {
+		col.Historico = append(col.Historico, o.History...)
+	} else if len(o.History) > 0 {
+		col.Historico = append(col.Historico, o.History[len(o.History)-1])
+	}
+	for i, label := range o.Labels {
+		obj := &rever.ObjetoPostal{
+			Numeroetiqueta:        label,
+			Ultimostatus:          o.Status,
+			Descricaostatus:       o.Description,
+			Dataultimaatualizacao: o.UpdatedAt.Format("02/01/2006"),
+			Horaultimaatualizacao: o.UpdatedAt.Format("15:04:05"),
+			Pesoreal:              "0,300",
+			Pesocubico:            "0,500",
+			Valorpostagem:         "21,50",
+		}
+		if i < len(o.ObjectIDs) {
+			obj.Controleobjetocliente = o.ObjectIDs[i]
+		}
+		col.Objeto = append(col.Objeto, obj)
+	}
+
+	return col
+}
+
+//deliveredTimeline returns the events of an object that has been posted and delivered
+func deliveredTimeline() []*track.Evento {
+	now := time.Now()
+	posted := now.AddDate(0, 0, -3)
+
+	return []*track.Evento{
+		&track.Evento{Type: "BDE", StatusCode: "01", Date: now.Format("02/01/2006"), Hour: now.Format("15:04"), Description: "Objeto entregue ao destinatário", Local: "CDD BLUMENAU", Code: "89066970", City: "BLUMENAU", FiscalUnit: "SC"},
+		&track.Evento{Type: "PO", StatusCode: "01", Date: posted.Format("02/01/2006"), Hour: posted.Format("15:04"), Description: "Objeto postado", Local: "AGF VILHENA", Code: "76980970", City: "VILHENA", FiscalUnit: "RO"},
+	}
+}
+
+//errorCode returns the error code of the scenario
+func errorCode(sc Scenario) int {
+	if sc.ErrorCode != 0 {
+		return sc.ErrorCode
+	}
+	return 99
+}
+
+//errorMessage returns the error message of the scenario
+func errorMessage(sc Scenario) string {
+	if sc.ErrorMessage != "" {
+		return sc.ErrorMessage
+	}
+	return "Erro simulado pelo serviço de testes"
+}
@@ -0,0 +1,268 @@
+package mockcorreios
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	rever "github.com/pintobikez/brazilian-correios-service/correiosapi/soapreverse"
+	track "github.com/pintobikez/brazilian-correios-service/correiosapi/soaptracking"
+	"golang.org/x/text/encoding/charmap"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//OpSolicitarPostagemReversa Logistica Reversa operation to create a reverse request
+	OpSolicitarPostagemReversa = "solicitarPostagemReversa"
+	//OpCancelarPedido Logistica Reversa operation to cancel a reverse request
+	OpCancelarPedido = "cancelarPedido"
+	//OpAcompanharPedidoPorData Logistica Reversa operation to follow the requests updated in a date
+	OpAcompanharPedidoPorData = "acompanharPedidoPorData"
+	//OpAcompanharPedido Logistica Reversa operation to follow the given requests
+	OpAcompanharPedido = "acompanharPedido"
+	//OpBuscaEventosLista SRO Rastro operation to track a list of objects
+	OpBuscaEventosLista = "buscaEventosLista"
+
+	//ScenarioSuccess replies with a successful response
+	ScenarioSuccess = "success"
+	//ScenarioError replies with a Correios error code
+	ScenarioError = "error"
+	//ScenarioFault replies with a SOAP fault
+	ScenarioFault = "fault"
+
+	//ErrAlreadyRequested Correios error code returned when the request was already made before
+	ErrAlreadyRequested = 121
+	//StatusPending Correios status of a request waiting to be used
+	StatusPending = "55"
+	//StatusUsed Correios status of a request that has been used
+	StatusUsed = "0"
+	//StatusCanceled Correios status of a canceled request
+	StatusCanceled = "9"
+	//StatusExpired Correios status of an expired request
+	StatusExpired = "57"
+)
+
+//reverseOperations operations of Logistica Reversa, the real service replies to them in ISO-8859-1
+var reverseOperations = map[string]bool{
+	OpSolicitarPostagemReversa: true,
+	OpCancelarPedido:           true,
+	OpAcompanharPedidoPorData:  true,
+	OpAcompanharPedido:         true,
+}
+
+//Scenario defines how the server replies to an operation
+type Scenario struct {
+	Kind         string
+	ErrorCode    int
+	ErrorMessage string
+	Delay        time.Duration
+	//UTF8 replies to an operation of Logistica Reversa in UTF-8 instead of the ISO-8859-1 of the real service
+	UTF8 bool
+}
+
+//Order a reverse request stored by the server
+type Order struct {
+	Number      int
+	Type        string
+	ClientID    string
+	Status      string
+	Description string
+	Label       string
+	ObjectIDs   []string
+	Labels      []string
+	UpdatedAt   time.Time
+	History     []*rever.HistoricoColeta
+}
+
+//Server in-process fake of the Correios Logistica Reversa and SRO Rastro web services
+type Server struct {
+	mu        sync.Mutex
+	def       Scenario
+	scenarios map[string]Scenario
+	orders    map[int]*Order
+	events    map[string][]*track.Evento
+	calls     map[string]int
+	nextOrder int
+	nextLabel int
+}
+
+//New creates a new Server replying with success to every operation
+func New() *Server {
+	return &Server{
+		def:       Scenario{Kind: ScenarioSuccess},
+		scenarios: make(map[string]Scenario),
+		orders:    make(map[int]*Order),
+		events:    make(map[string][]*track.Evento),
+		calls:     make(map[string]int),
+		nextOrder: 100000000,
+		nextLabel: 10000000,
+	}
+}
+
+//SetDefault sets the Scenario used by the operations without a specific one
+func (s *Server) SetDefault(sc Scenario) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.def = sc
+}
+
+//SetScenario sets the Scenario used by the given operation
+func (s *Server) SetScenario(op string, sc Scenario) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scenarios[op] = sc
+}
+
+//SetOrderStatus changes the Correios status of a stored order
+func (s *Server) SetOrderStatus(number int, status string, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[number]
+	if !ok {
+		return fmt.Errorf("Order %d not found", number)
+	}
+	o.Status = status
+	o.Description = description
+	o.UpdatedAt = time.Now()
+	o.record()
+
+	return nil
+}
+
+//SetTrackingEvents sets the events returned for the given tracking code
+func (s *Server) SetTrackingEvents(code string, events []*track.Evento) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[code] = events
+}
+
+//Orders returns a copy of the stored orders
+func (s *Server) Orders() []Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]Order, 0, len(s.orders))
+	for _, o := range s.orders {
+		ret = append(ret, *o)
+	}
+	return ret
+}
+
+//Calls returns the number of calls received for the given operation
+func (s *Server) Calls(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+//ServeHTTP dispatches the SOAP request to the operation found in the envelope body
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	env := new(requestEnvelope)
+	if err := xml.Unmarshal(raw, env); err != nil {
+		s.writeFault(w, false, "soap:Client", err.Error())
+		return
+	}
+
+	op := env.Body.Operation.XMLName.Local
+	sc := s.scenario(op)
+	latin1 := reverseOperations[op] && !sc.UTF8
+
+	if sc.Delay > 0 {
+		select {
+		case <-time.After(sc.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if sc.Kind == ScenarioFault {
+		msg := sc.ErrorMessage
+		if msg == "" {
+			msg = "ComponenteException"
+		}
+		s.writeFault(w, latin1, "soap:Server", msg)
+		return
+	}
+
+	var content interface{}
+	req := &env.Body.Operation
+
+	switch op {
+	case OpSolicitarPostagemReversa:
+		content = s.solicitarPostagemReversa(req, sc)
+	case OpCancelarPedido:
+		content = s.cancelarPedido(req, sc)
+	case OpAcompanharPedidoPorData:
+		content = s.acompanharPedidoPorData(req, sc)
+	case OpAcompanharPedido:
+		content = s.acompanharPedido(req, sc)
+	case OpBuscaEventosLista:
+		content = s.buscaEventosLista(req, sc)
+	default:
+		s.writeFault(w, latin1, "soap:Client", "Unknown operation "+op)
+		return
+	}
+
+	s.writeEnvelope(w, latin1, http.StatusOK, content)
+}
+
+//scenario returns the Scenario of the operation and counts the call
+func (s *Server) scenario(op string) Scenario {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[op]++
+	if sc, ok := s.scenarios[op]; ok {
+		return sc
+	}
+	return s.def
+}
+
+//writeFault writes a SOAP fault
+func (s *Server) writeFault(w http.ResponseWriter, latin1 bool, code string, message string) {
+	s.writeEnvelope(w, latin1, http.StatusInternalServerError, &fault{Code: code, String: message})
+}
+
+//writeEnvelope wraps the content in a SOAP envelope and writes it in ISO-8859-1 or in UTF-8
+func (s *Server) writeEnvelope(w http.ResponseWriter, latin1 bool, status int, content interface{}) {
+	env := responseEnvelope{Soap: soapNamespace}
+	env.Body.Content = content
+
+	buffer := new(bytes.Buffer)
+	if err := xml.NewEncoder(buffer).Encode(env); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body := buffer.Bytes()
+	charset := "utf-8"
+	if latin1 {
+		enc, err := charmap.ISO8859_1.NewEncoder().Bytes(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = enc
+		charset = "ISO-8859-1"
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset="+charset)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -2,6 +2,7 @@ package soapreverse
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/xml"
 	"golang.org/x/text/encoding/charmap"
@@ -13,6 +14,13 @@ import (
 	"time"
 )
 
+const (
+	//BuscaHistorico tipoBusca of acompanharPedido that returns the whole history of the requests
+	BuscaHistorico = "H"
+	//BuscaUltimo tipoBusca of acompanharPedido that returns the last status of the requests
+	BuscaUltimo = "U"
+)
+
 // against "unused imports"
 var _ time.Time
 var _ xml.Name
@@ -33,6 +41,23 @@ type AcompanharPedidoPorDataResponse struct {
 	AcompanharPedidoPorData *RetornoAcompanhamento `xml:"acompanharPedidoPorData,omitempty"`
 }
 
+//AcompanharPedido struct
+type AcompanharPedido struct {
+	XMLName xml.Name `xml:"ns1:acompanharPedido"`
+
+	CodAdministrativo string   `xml:"codAdministrativo,omitempty"`
+	TipoBusca         string   `xml:"tipoBusca,omitempty"`
+	TipoSolicitacao   string   `xml:"tipoSolicitacao,omitempty"`
+	NumeroPedido      []string `xml:"numeroPedido,omitempty"`
+}
+
+//AcompanharPedidoResponse struct
+type AcompanharPedidoResponse struct {
+	XMLName xml.Name `xml:"acompanharPedidoResponse"`
+
+	AcompanharPedido *RetornoAcompanhamento `xml:"acompanharPedido,omitempty"`
+}
+
 //RetornoAcompanhamento struct
 type RetornoAcompanhamento struct {
 	Codigoadministrativo string                `xml:"codigo_administrativo,omitempty"`
@@ -234,9 +259,23 @@ func NewLogisticaReversaWS(url string, tls bool, auth *BasicAuth) *LogisticaReve
 // Error can be either of the following types:
 //
 //   - ComponenteException
-func (service *LogisticaReversaWS) AcompanharPedidoPorData(request *AcompanharPedidoPorData) (*AcompanharPedidoPorDataResponse, error) {
+func (service *LogisticaReversaWS) AcompanharPedidoPorData(ctx context.Context, request *AcompanharPedidoPorData) (*AcompanharPedidoPorDataResponse, error) {
 	response := new(AcompanharPedidoPorDataResponse)
-	err := service.client.Call("", request, response)
+	err := service.client.Call(ctx, "", request, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+//AcompanharPedido checks the status of the given reverse postage requests in Correios, with their whole history when TipoBusca is BuscaHistorico
+// Error can be either of the following types:
+//
+//   - ComponenteException
+func (service *LogisticaReversaWS) AcompanharPedido(ctx context.Context, request *AcompanharPedido) (*AcompanharPedidoResponse, error) {
+	response := new(AcompanharPedidoResponse)
+	err := service.client.Call(ctx, "", request, response)
 	if err != nil {
 		return nil, err
 	}
@@ -248,9 +287,9 @@ func (service *LogisticaReversaWS) AcompanharPedidoPorData(request *AcompanharPe
 // Error can be either of the following types:
 //
 //   - ComponenteException
-func (service *LogisticaReversaWS) SolicitarPostagemReversa(request *SolicitarPostagemReversa) (*SolicitarPostagemReversaResponse, error) {
+func (service *LogisticaReversaWS) SolicitarPostagemReversa(ctx context.Context, request *SolicitarPostagemReversa) (*SolicitarPostagemReversaResponse, error) {
 	response := new(SolicitarPostagemReversaResponse)
-	err := service.client.Call("", request, response)
+	err := service.client.Call(ctx, "", request, response)
 	if err != nil {
 		return nil, err
 	}
@@ -262,9 +301,9 @@ func (service *LogisticaReversaWS) SolicitarPostagemReversa(request *SolicitarPo
 // Error can be either of the following types:
 //
 //   - ComponenteException
-func (service *LogisticaReversaWS) CancelarPedido(request *CancelarPedido) (*CancelarPedidoResponse, error) {
+func (service *LogisticaReversaWS) CancelarPedido(ctx context.Context, request *CancelarPedido) (*CancelarPedidoResponse, error) {
 	response := new(CancelarPedidoResponse)
-	err := service.client.Call("", request, response)
+	err := service.client.Call(ctx, "", request, response)
 	if err != nil {
 		return nil, err
 	}
@@ -414,8 +453,8 @@ func NewSOAPClient(url string, tls bool, auth *BasicAuth) *SOAPClient {
 	}
 }
 
-//Call call SOAP method
-func (s *SOAPClient) Call(soapAction string, request, response interface{}) error {
+//Call call SOAP method, the call is cancelled when ctx is done or after the timeout
+func (s *SOAPClient) Call(ctx context.Context, soapAction string, request, response interface{}) error {
 	envelope := SOAPEnvelope{
 		Tag1: "http://schemas.xmlsoap.org/soap/envelope/",
 		Tag2: "http://service.logisticareversa.correios.com.br/",
@@ -436,10 +475,15 @@ func (s *SOAPClient) Call(soapAction string, request, response interface{}) erro
 
 	log.Println(buffer.String())
 
+	// every call has its own deadline, the one of ctx is kept if it is sooner
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	req, err := http.NewRequest("POST", s.url, buffer)
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	if s.auth != nil {
 		req.SetBasicAuth(s.auth.Login, s.auth.Password)
 	}
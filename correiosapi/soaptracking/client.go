@@ -2,6 +2,7 @@ package soaptracking
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/xml"
 	"io/ioutil"
@@ -84,9 +85,9 @@ func NewRastroWS(url string, tls bool) *RastroWS {
 // Error can be either of the following types:
 //
 //   - ComponenteException
-func (service *RastroWS) BuscaEventosLista(request *BuscaEventosLista) (*BuscaEventosListaResponse, error) {
+func (service *RastroWS) BuscaEventosLista(ctx context.Context, request *BuscaEventosLista) (*BuscaEventosListaResponse, error) {
 	response := new(BuscaEventosListaResponse)
-	err := service.client.Call("", request, response)
+	err := service.client.Call(ctx, "", request, response)
 	if err != nil {
 		return nil, err
 	}
@@ -223,8 +224,8 @@ func NewSOAPClient(url string, tls bool) *SOAPClient {
 	}
 }
 
-//Call call SOAP method
-func (s *SOAPClient) Call(soapAction string, request, response interface{}) error {
+//Call call SOAP method, the call is cancelled when ctx is done or after the timeout
+func (s *SOAPClient) Call(ctx context.Context, soapAction string, request, response interface{}) error {
 	envelope := SOAPEnvelope{
 		Tag1: "http://schemas.xmlsoap.org/soap/envelope/",
 		Tag2: "http://resource.webservice.correios.com.br/",
@@ -243,10 +244,15 @@ func (s *SOAPClient) Call(soapAction string, request, response interface{}) erro
 		return err
 	}
 
+	// every call has its own deadline, the one of ctx is kept if it is sooner
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	req, err := http.NewRequest("POST", s.url, buffer)
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Add("Content-Type", "text/xml; charset=\"utf-8\"")
 	if soapAction != "" {
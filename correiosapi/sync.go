@@ -0,0 +1,66 @@
+package correiosapi
+
+import (
+	"context"
+	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	"time"
+)
+
+const (
+	//DefaultSyncLookback max number of past days followed again when the follow of a request type falls behind
+	DefaultSyncLookback = 7
+	//SyncDateFormat format of the days stored in the sync marks
+	SyncDateFormat = "2006-01-02"
+	//SyncMarkPrefix prefix of the name of the sync mark of each request type
+	SyncMarkPrefix = "follow_"
+)
+
+//SyncReverseLogistic Follows in Correios the days after the sync mark of the request type up to today, at most syncLookbackDays days back.
+//The mark moves to each past day followed without error, today is followed on every run as it is not over yet
+func (h *Handler) SyncReverseLogistic(ctx context.Context, requestType string) ([]*strut.RequestResponse, error) {
+	name := SyncMarkPrefix + requestType
+	mark, err := h.Repo.GetSyncMark(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	today := Day(time.Now())
+	from := today.AddDate(0, 0, -h.syncLookback())
+	if last, err := time.ParseInLocation(SyncDateFormat, mark, time.Local); err == nil && !last.Before(from) {
+		from = last.AddDate(0, 0, 1)
+	}
+	if from.After(today) {
+		from = today
+	}
+
+	toRet := make([]*strut.RequestResponse, 0)
+	for day := from; !day.After(today); day = day.AddDate(0, 0, 1) {
+		resp, err := h.FollowReverseLogistic(ctx, requestType, day)
+		if err != nil {
+			return toRet, err
+		}
+		toRet = append(toRet, resp...)
+
+		if day.Before(today) {
+			if err := h.Repo.SetSyncMark(ctx, name, day.Format(SyncDateFormat)); err != nil {
+				return toRet, err
+			}
+		}
+	}
+
+	return toRet, nil
+}
+
+//Day Returns the start of the local day of t
+func Day(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+//syncLookback Returns the max number of past days followed again by a sync
+func (h *Handler) syncLookback() int {
+	if h.Conf != nil && h.Conf.SyncLookbackDays > 0 {
+		return int(h.Conf.SyncLookbackDays)
+	}
+	return DefaultSyncLookback
+}
@@ -1,24 +1,36 @@
 package api
 
 import (
-	"bytes"
-	"crypto/tls"
-	"encoding/json"
+	"context"
 	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
 	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
 	hand "github.com/pintobikez/brazilian-correios-service/correiosapi"
 	repo "github.com/pintobikez/brazilian-correios-service/repository"
 	"io"
 	"log"
-	"net/http"
-	"regexp"
-	"strconv"
+	"sync"
+	"time"
 )
 
-var (
-	DeliveryTypes  = map[string]bool{"BDE": true, "BDI": true, "BDR": true}
-	DeliveryFailed = map[string]string{"50": "Stolen", "51": "Stolen", "52": "Stolen", "80": "Lost"}
-	DeliveryOk     = map[string]bool{"0": true, "1": true}
+const (
+	//SubscriptionBatchSize default number of subscriptions whose objects are tracked in each call to Correios
+	SubscriptionBatchSize = 50
+	//ReprocessBatchSize default number of requests with error submitted again in each run
+	ReprocessBatchSize = 50
+	//CheckUsedBatchSize default number of used requests tracked in each call to Correios
+	CheckUsedBatchSize = 1000
+	//ReverseJobBatchSize default number of reverse jobs recovered in each run
+	ReverseJobBatchSize = 100
+	//TrackingJobBatchSize default number of tracking jobs recovered in each run
+	TrackingJobBatchSize = 10
+	//JobTimeout default max time a run of a cronjob can take
+	JobTimeout = 15 * time.Minute
+	//LeaderLock name of the lock held by the cronjobs instance that runs the jobs
+	LeaderLock = "cronjobs"
+	//LeaderLease time the leader holds the lock without renewing it
+	LeaderLease = 30 * time.Second
+	//LeaderRenew interval between two renewals of the lock, an instance that is not the leader tries to take it as often
+	LeaderRenew = 10 * time.Second
 )
 
 //Cronjob struct
@@ -26,11 +38,17 @@ type Cronjob struct {
 	Repo repo.Definition
 	Conf *cnf.CorreiosConfig
 	Hand *hand.Handler
+	//time until which this instance holds the leader lock
+	mu          sync.Mutex
+	leaderUntil time.Time
+	//term is done when this instance stops being the leader, it stops the runs started during it
+	term    context.Context
+	endTerm context.CancelFunc
 }
 
 //New Initializes a new Cronjob struct
 func New(r repo.Definition, c *cnf.CorreiosConfig) *Cronjob {
-	return &Cronjob{Repo: r, Conf: c, Hand: &hand.Handler{Repo: r, Conf: c}}
+	return &Cronjob{Repo: r, Conf: c, Hand: hand.New(r, c)}
 }
 
 //SetOutput sets the output file
@@ -38,15 +56,137 @@ func (c *Cronjob) SetOutput(file io.Writer) {
 	log.SetOutput(file)
 }
 
+//Campaign Takes and renews the leader lock until ctx is done and then releases it, only the leader runs the jobs
+func (c *Cronjob) Campaign(ctx context.Context) {
+	ticker := time.NewTicker(LeaderRenew)
+	defer ticker.Stop()
+
+	for {
+		c.elect(ctx)
+
+		select {
+		case <-ctx.Done():
+			c.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//IsLeader Returns true if this instance holds the leader lock
+func (c *Cronjob) IsLeader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Now().Before(c.leaderUntil)
+}
+
+//leaderTerm Returns the term of this instance as the leader, nil if it is not the leader
+func (c *Cronjob) leaderTerm() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !time.Now().Before(c.leaderUntil) {
+		return nil
+	}
+	return c.term
+}
+
+//elect Takes or renews the leader lock, the runs of the jobs are stopped when the leader can not renew it
+func (c *Cronjob) elect(ctx context.Context) {
+	// the lock is held a bit longer in the database so the leader stops before another instance starts
+	start := time.Now()
+	actx, cancel := context.WithTimeout(ctx, LeaderRenew)
+	ok, err := c.Repo.AcquireLock(actx, LeaderLock, c.Hand.Owner(), start.Add(LeaderLease+LeaderRenew))
+	cancel()
+	if err != nil {
+		log.Println(err.Error())
+		// the leader keeps its term if its lease lasts until the next renewal
+		c.mu.Lock()
+		keep := time.Now().Add(LeaderRenew).Before(c.leaderUntil)
+		c.mu.Unlock()
+		if keep {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	leader := time.Now().Before(c.leaderUntil)
+	if ok {
+		if !leader {
+			c.stepDown()
+			c.term, c.endTerm = context.WithCancel(context.Background())
+		}
+		c.leaderUntil = start.Add(LeaderLease)
+	} else {
+		c.leaderUntil = time.Time{}
+		c.stepDown()
+	}
+	c.mu.Unlock()
+
+	if ok != leader {
+		log.Printf("Cronjobs leader: %t (%s)\n", ok, c.Hand.Owner())
+	}
+}
+
+//stepDown Ends the term of the leader and stops the runs started during it, must be called with the lock
+func (c *Cronjob) stepDown() {
+	if c.endTerm != nil {
+		c.endTerm()
+	}
+	c.term, c.endTerm = nil, nil
+}
+
+//resign Releases the leader lock so another instance takes it at once
+func (c *Cronjob) resign() {
+	c.mu.Lock()
+	c.leaderUntil = time.Time{}
+	c.stepDown()
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), LeaderRenew)
+	defer cancel()
+
+	if err := c.Repo.ReleaseLock(ctx, LeaderLock, c.Hand.Owner()); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+//Job Returns the cron function that runs the schedule with its timeout on the leader, the handler tracks the run so a shutdown waits for it,
+//the run is stopped when this instance stops being the leader
+func (c *Cronjob) Job(s *Schedule) func() {
+	return func() {
+		term := c.leaderTerm()
+		if term == nil {
+			return
+		}
+
+		c.Hand.Go(func(ctx context.Context) {
+			ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+			defer cancel()
+
+			go func() {
+				select {
+				case <-term.Done():
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			s.Run(ctx, s.BatchSize)
+		})
+	}
+}
+
 //CheckUpdatedReverses Handler to Check if reverse is completed
-func (c *Cronjob) CheckUsedReverses(from int, offset int) {
+func (c *Cronjob) CheckUsedReverses(ctx context.Context, from int, offset int) {
 
 	where := make([]*strut.SearchWhere, 0, 1)
 	where = append(where, &strut.SearchWhere{Field: "status", Value: strut.StatusUsed, Operator: "="})
 
 	search := &strut.Search{Where: where, From: from, Offset: offset}
 
-	results, err := c.Repo.GetRequestBy(search)
+	results, err := c.Repo.GetRequestBy(ctx, search)
 
 	// something happened
 	if err != nil {
@@ -58,7 +198,7 @@ func (c *Cronjob) CheckUsedReverses(from int, offset int) {
 		els := make(map[string]*strut.Request)
 
 		o := new(strut.Tracking)
-		o.TrackingType = "LAST"
+		o.TrackingType = "ALL"
 		o.Language = "EN"
 		o.Objects = make([]string, 0, s)
 
@@ -71,7 +211,7 @@ func (c *Cronjob) CheckUsedReverses(from int, offset int) {
 		}
 
 		// check the tracking for all
-		r, err := c.Hand.TrackObjects(o)
+		r, err := c.Hand.TrackObjects(ctx, o)
 
 		if err != nil {
 			log.Printf("Error performing tracking %s\n", err.Error())
@@ -81,24 +221,16 @@ func (c *Cronjob) CheckUsedReverses(from int, offset int) {
 			log.Println("Nothing to search for")
 			return
 		} else {
-			// check if there are deliveries or failed delivies
+			// check if there are deliveries or failed delivies in the whole timeline
 			for _, e := range r.Items {
+				req, ok := els[e.Object]
+				if e.Error != "" || !ok {
+					continue
+				}
 
-				if e.Error != "" && DeliveryTypes[e.Events[0].Type] {
-					// delivered
-					if _, ok := DeliveryOk[e.Events[0].StatusCode]; ok == true {
-						el := els[e.Object]
-						go c.Repo.UpdateRequestStatus(&strut.Request{RequestID: el.RequestID, Retries: 0}, strut.StatusDelivered, "Delivered")
-
-						go doRequest(&strut.RequestResponse{el.RequestID, el.PostageCode, el.TrackingCode, strut.StatusDelivered, el.Callback})
-					}
-
-					// delivery failed
-					if val, ok := DeliveryFailed[e.Events[0].StatusCode]; ok == true {
-						el := els[e.Object]
-						go c.Repo.UpdateRequestStatus(&strut.Request{RequestID: el.RequestID, Retries: 0}, strut.StatusFailedDelivery, val)
-
-						go doRequest(&strut.RequestResponse{el.RequestID, el.PostageCode, el.TrackingCode, strut.StatusFailedDelivery, el.Callback})
+				if status, msg := hand.DeliveryStatus(e.Events); status != "" {
+					if err := c.Hand.UpdateStatus(ctx, req, status, msg, strut.SourceCorreios); err != nil {
+						log.Println(err.Error())
 					}
 				}
 			}
@@ -106,78 +238,207 @@ func (c *Cronjob) CheckUsedReverses(from int, offset int) {
 
 		// if we still have more to process
 		if s == offset {
-			c.CheckUsedReverses((from + offset), offset)
+			c.CheckUsedReverses(ctx, (from + offset), offset)
 		}
 	}
 }
 
-//CheckUpdatedReverses Handler to Check if any updates have happened
-func (c *Cronjob) CheckUpdatedReverses(requestType string) {
-	resp := c.Hand.FollowReverseLogistic(requestType)
+//CheckUpdatedReverses Handler to Check if any updates have happened since the last day synced
+func (c *Cronjob) CheckUpdatedReverses(ctx context.Context, requestType string) {
+	resp, err := c.Hand.SyncReverseLogistic(ctx, requestType)
+	if err != nil {
+		log.Println(err.Error())
+	}
 
-	// we have found something to process
-	if resp != nil {
-		for _, e := range resp {
-			go doRequest(e)
-		}
+	// the callbacks of the updated requests are delivered from the outbox
+	if len(resp) > 0 {
+		log.Printf("%d requests of type %s updated\n", len(resp), requestType)
 	}
 }
 
-//ReprocessRequestsWithError Handler to get all Requests with error and retry them again given a Max number of retries
-func (c *Cronjob) ReprocessRequestsWithError() {
+//ReprocessRequestsWithError Handler to get the Requests with error and retry them again given a Max number of retries
+func (c *Cronjob) ReprocessRequestsWithError(ctx context.Context, limit int) {
 
 	where := make([]*strut.SearchWhere, 0, 2)
-	where = append(where, &strut.SearchWhere{Field: "retries", Value: strconv.Itoa(int(c.Conf.MaxRetries)), Operator: "<="})
-	where = append(where, &strut.SearchWhere{Field: "status", Value: strut.StatusError, Operator: "="})
+	where = append(where, &strut.SearchWhere{Field: "retries", Value: c.Conf.MaxRetries, Operator: "<"})
+	where = append(where, &strut.SearchWhere{Field: "status", Value: []string{strut.StatusError, strut.StatusCancelError}, Operator: "IN"})
 
-	search := &strut.Search{Where: where}
+	search := &strut.Search{Where: where, Offset: limit}
 
-	results, err := c.Repo.GetRequestBy(search)
+	results, err := c.Repo.GetRequestBy(ctx, search)
 
 	// something happened
 	if err != nil {
 		log.Printf("Error performing search %s", err.Error())
 	} else {
-		// retry all of the requests
+		// retry all of the requests, the ones that reached MAX retries already had their error callback
 		for _, e := range results {
-			// If we reached MAX retries, do callback to requirer
-			if e.Retries == c.Conf.MaxRetries {
-				go doRequest(&strut.RequestResponse{e.RequestID, e.PostageCode, e.TrackingCode, e.Status, e.Callback})
-			} else {
-				go c.Hand.DoReverseLogistic(e)
+			// a request with a queued job is retried by it
+			if open, err := c.Hand.HasOpenReverseJob(ctx, e.RequestID); err != nil || open {
+				continue
 			}
+			// a request whose cancel failed is still generated in Correios, only its cancel is retried
+			action := strut.ActionCreate
+			if e.Status == strut.StatusCancelError {
+				action = strut.ActionCancel
+			}
+			j, err := hand.QueueReverseJob(ctx, c.Repo, e.RequestID, action, strut.SourceCron)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			c.Hand.SubmitReverseJob(j)
 		}
 	}
 }
 
-//doRequest Performs an Http request
-func doRequest(e *strut.RequestResponse) {
-	buffer := new(bytes.Buffer)
-	_ = json.NewEncoder(buffer).Encode(e)
+//SweepReverseJobs Handler to run the reverse jobs left by a stopped process, the pending ones and the ones whose lease ended
+func (c *Cronjob) SweepReverseJobs(ctx context.Context, limit int) {
+	// skip this run if the jobs of the previous one are still queued
+	if c.Hand.Dispatcher.Stats().Queued > 0 {
+		return
+	}
 
-	// Create the POST request to the callback
-	req, err := http.NewRequest("POST", e.Callback, buffer)
+	jobs, err := c.Repo.GetRunnableReverseJobs(ctx, time.Now(), limit)
 	if err != nil {
-		// log error
-		log.Println(err.Error())
+		log.Printf("Error getting reverse jobs %s\n", err.Error())
+		return
+	}
+
+	for _, j := range jobs {
+		c.Hand.SubmitReverseJob(j)
+	}
+	if len(jobs) > 0 {
+		log.Printf("%d reverse jobs recovered\n", len(jobs))
+	}
+}
+
+//SweepTrackingJobs Handler to run the tracking jobs left by a stopped process, the pending ones and the ones whose lease ended
+func (c *Cronjob) SweepTrackingJobs(ctx context.Context, limit int) {
+	jobs, err := c.Repo.GetRunnableTrackingJobs(ctx, time.Now(), limit)
+	if err != nil {
+		log.Printf("Error getting tracking jobs %s\n", err.Error())
 		return
 	}
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Close = true
 
-	// check if it is an https request
-	re := regexp.MustCompile("^https://")
-	useTlS := re.MatchString(e.Callback)
+	// the jobs run one at a time within the run of the cronjob, a job taken by another worker is skipped
+	for _, j := range jobs {
+		c.Hand.RunTrackingJob(ctx, j)
+	}
+	if len(jobs) > 0 {
+		log.Printf("%d tracking jobs recovered\n", len(jobs))
+	}
+}
+
+//DeliverCallbacks Handler to deliver the pending callbacks of the outbox
+func (c *Cronjob) DeliverCallbacks(ctx context.Context, limit int) {
+	if n := c.Hand.Outbox.Deliver(ctx, limit); n > 0 {
+		log.Printf("%d callbacks delivered\n", n)
+	}
+}
+
+//CheckTrackingSubscriptions Handler to track the objects of the active subscriptions and call back their new events
+func (c *Cronjob) CheckTrackingSubscriptions(ctx context.Context, batchSize int) {
+	if n, err := c.Repo.EndExpiredTrackingSubscriptions(ctx, time.Now()); err != nil {
+		log.Println(err.Error())
+	} else if n > 0 {
+		log.Printf("%d tracking subscriptions expired\n", n)
+	}
+
+	var afterID int64
+	for {
+		subs, err := c.Repo.GetActiveTrackingSubscriptions(ctx, afterID, batchSize)
+		if err != nil {
+			log.Printf("Error getting tracking subscriptions %s\n", err.Error())
+			return
+		}
+		if len(subs) == 0 {
+			return
+		}
+		afterID = subs[len(subs)-1].SubscriptionID
+
+		// track each object once, the new events are stored by TrackObjects
+		o := &strut.Tracking{TrackingType: "ALL", Language: "BR", Objects: make([]string, 0, len(subs))}
+		seen := make(map[string]bool)
+		for _, sub := range subs {
+			if !seen[sub.Object] {
+				seen[sub.Object] = true
+				o.Objects = append(o.Objects, sub.Object)
+			}
+		}
+
+		r, err := c.Hand.TrackObjects(ctx, o)
+		if err != nil {
+			log.Printf("Error performing tracking %s\n", err.Error())
+			return
+		}
+
+		headers := make(map[string]*strut.TrackingHeader)
+		if r != nil {
+			for _, e := range r.Items {
+				headers[e.Object] = e
+			}
+		}
+		for _, sub := range subs {
+			c.notifySubscription(ctx, sub, headers[sub.Object])
+		}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: useTlS},
+		if len(subs) < batchSize {
+			return
+		}
 	}
-	client := &http.Client{Transport: tr}
-	res, err := client.Do(req)
+}
+
+//notifySubscription Calls back the events stored since the last callback of the subscription and ends it when it reached its end
+func (c *Cronjob) notifySubscription(ctx context.Context, sub *strut.TrackingSubscription, h *strut.TrackingHeader) {
+	events, lastID, err := c.Repo.GetTrackingEventsAfter(ctx, sub.Object, sub.LastEventID)
 	if err != nil {
-		// log error
 		log.Println(err.Error())
 		return
 	}
-	defer res.Body.Close()
+
+	if len(events) > 0 {
+		header := &strut.TrackingHeader{Object: sub.Object, Events: events}
+		if h != nil {
+			header.Name = h.Name
+			header.Category = h.Category
+		}
+
+		// the events are sent again on the next run if they can not be written to the outbox
+		if err := c.Hand.Outbox.EnqueueTracking(ctx, &strut.TrackingResponse{Items: []*strut.TrackingHeader{header}}, sub.Callback, sub.ClientID); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		sub.LastEventID = lastID
+
+		// a final delivery event ends every subscription
+		status, _ := hand.DeliveryStatus(events)
+		switch {
+		case status == strut.StatusDelivered:
+			sub.EndedReason = strut.EndedDelivered
+		case status == strut.StatusFailedDelivery:
+			sub.EndedReason = strut.EndedDeliveryFailed
+		case sub.StopOn == strut.StopOnFirstEvent:
+			sub.EndedReason = strut.EndedStopCondition
+		case sub.StopOn == strut.StopOnPosted && hasPostedEvent(events):
+			sub.EndedReason = strut.EndedStopCondition
+		}
+		if sub.EndedReason != "" {
+			sub.Status = strut.SubscriptionEnded
+		}
+	}
+
+	if err := c.Repo.UpdateTrackingSubscription(ctx, sub); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+//hasPostedEvent Returns true if any of the events is of a posted object
+func hasPostedEvent(events []*strut.TrackingEvents) bool {
+	for _, ev := range events {
+		if hand.PostedTypes[ev.Type] {
+			return true
+		}
+	}
+	return false
 }
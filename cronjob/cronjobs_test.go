@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"errors"
+	strut "github.com/pintobikez/brazilian-correios-service/api/structures"
+	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
+	"github.com/pintobikez/brazilian-correios-service/correiosapi/mockcorreios"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/repository/memory"
+	"github.com/pintobikez/brazilian-correios-service/repository/repotest"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//lockRepo a repository whose lock can not be renewed once broken is set
+type lockRepo struct {
+	repo.Definition
+	broken bool
+}
+
+//AcquireLock Fails when the lock is broken
+func (r *lockRepo) AcquireLock(ctx context.Context, name string, owner string, until time.Time) (bool, error) {
+	if r.broken {
+		return false, errors.New("Database is down")
+	}
+	return r.Definition.AcquireLock(ctx, name, owner, until)
+}
+
+//runJob Runs a job that blocks until its context is done and returns the channel closed when it stops
+func runJob(c *Cronjob) chan struct{} {
+	stopped := make(chan struct{})
+	c.Job(&Schedule{Name: "blocking", Timeout: time.Minute, Run: func(ctx context.Context, n int) {
+		<-ctx.Done()
+		close(stopped)
+	}})()
+	return stopped
+}
+
+func TestJobStopsWhenTheLeaseIsLost(t *testing.T) {
+	r := &lockRepo{Definition: memory.New()}
+	c := New(r, nil)
+
+	c.elect(context.Background())
+	if !c.IsLeader() {
+		t.Fatal("the instance did not take the free lock")
+	}
+	stopped := runJob(c)
+
+	// a failed renewal keeps the term while the lease lasts until the next renewal
+	r.broken = true
+	c.elect(context.Background())
+	select {
+	case <-stopped:
+		t.Fatal("the job was stopped while the lease was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.mu.Lock()
+	c.leaderUntil = time.Now().Add(LeaderRenew / 2)
+	c.mu.Unlock()
+	c.elect(context.Background())
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the job kept running after the lease was lost")
+	}
+	if c.IsLeader() {
+		t.Error("the instance is still the leader")
+	}
+}
+
+func TestJobStopsOnResign(t *testing.T) {
+	c := New(memory.New(), nil)
+
+	c.elect(context.Background())
+	stopped := runJob(c)
+	c.resign()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the job kept running after the instance resigned")
+	}
+}
+
+func TestJobDoesNotRunOnFollower(t *testing.T) {
+	r := memory.New()
+	if _, err := r.AcquireLock(context.Background(), LeaderLock, "other", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	c := New(r, nil)
+	c.elect(context.Background())
+
+	ran := false
+	c.Job(&Schedule{Name: "follower", Timeout: time.Minute, Run: func(ctx context.Context, n int) { ran = true }})()
+	c.Hand.Drain(context.Background())
+
+	if ran {
+		t.Error("the job ran on an instance that is not the leader")
+	}
+}
+
+func TestReprocessRetriesTheFailedOperation(t *testing.T) {
+	correios := httptest.NewServer(mockcorreios.New())
+	defer correios.Close()
+	c := New(memory.New(), &cnf.CorreiosConfig{URLReverse: correios.URL, URLTracking: correios.URL, MaxRetries: 3})
+	ctx := context.Background()
+
+	want := map[string]string{strut.StatusError: strut.ActionCreate, strut.StatusCancelError: strut.ActionCancel}
+	ids := make(map[string]int64)
+	for status := range want {
+		o := repotest.NewRequest(1, "a")
+		if err := c.Repo.InsertRequest(ctx, o); err != nil {
+			t.Fatalf("InsertRequest: %s", err.Error())
+		}
+		if _, err := c.Repo.UpdateRequestStatus(ctx, o, status, "Failed"); err != nil {
+			t.Fatalf("UpdateRequestStatus: %s", err.Error())
+		}
+		ids[status] = o.RequestID
+	}
+
+	c.ReprocessRequestsWithError(ctx, ReprocessBatchSize)
+	if err := c.Hand.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %s", err.Error())
+	}
+
+	for status, action := range want {
+		jobs, err := c.Repo.GetReverseJobsByRequestID(ctx, ids[status])
+		if err != nil || len(jobs) != 1 || jobs[0].Action != action {
+			t.Errorf("request %s got %d jobs, %v, want a %s job", status, len(jobs), err, action)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/pintobikez/brazilian-correios-service/callback"
+	cnf "github.com/pintobikez/brazilian-correios-service/config/structures"
+	"github.com/robfig/cron"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//CronFollowColect name of the cronjob that follows the updates of the colects in Correios
+	CronFollowColect = "followColect"
+	//CronFollowPostage name of the cronjob that follows the updates of the postages in Correios
+	CronFollowPostage = "followPostage"
+	//CronReprocessErrors name of the cronjob that submits the requests with error again
+	CronReprocessErrors = "reprocessErrors"
+	//CronCheckUsed name of the cronjob that checks if the used requests were delivered
+	CronCheckUsed = "checkUsed"
+	//CronDeliverCallbacks name of the cronjob that delivers the pending callbacks of the outbox
+	CronDeliverCallbacks = "deliverCallbacks"
+	//CronTrackingSubscriptions name of the cronjob that calls back the new events of the subscribed objects
+	CronTrackingSubscriptions = "trackingSubscriptions"
+	//CronSweepReverseJobs name of the cronjob that runs the reverse jobs left by a stopped process
+	CronSweepReverseJobs = "sweepReverseJobs"
+	//CronSweepTrackingJobs name of the cronjob that runs the tracking jobs left by a stopped process
+	CronSweepTrackingJobs = "sweepTrackingJobs"
+)
+
+//Schedule a cronjob with the configuration of the file applied to its defaults
+type Schedule struct {
+	Name    string
+	Spec    string
+	Enabled bool
+	//BatchSize max number of items handled in each run, 0 when the job does not use it
+	BatchSize int
+	Timeout   time.Duration
+	Run       func(ctx context.Context, batchSize int)
+}
+
+//fieldRanges min and max of each field of a spec: second, minute, hour, day of month, month and day of week
+var fieldRanges = []struct {
+	name     string
+	min, max int
+}{
+	{"second", 0, 59}, {"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 6},
+}
+
+//Schedules Returns every cronjob with its configuration, the error lists every invalid entry of the configuration
+func (c *Cronjob) Schedules() ([]*Schedule, error) {
+	defaults := []*Schedule{
+		{Name: CronFollowColect, Spec: "0 0 */6 * * *", Run: func(ctx context.Context, n int) { c.CheckUpdatedReverses(ctx, "C") }},
+		{Name: CronFollowPostage, Spec: "0 10 */6 * * *", Run: func(ctx context.Context, n int) { c.CheckUpdatedReverses(ctx, "A") }},
+		{Name: CronReprocessErrors, Spec: "0 */20 * * * *", BatchSize: ReprocessBatchSize, Run: c.ReprocessRequestsWithError},
+		{Name: CronCheckUsed, Spec: "0 0 * * * *", BatchSize: CheckUsedBatchSize, Run: func(ctx context.Context, n int) { c.CheckUsedReverses(ctx, 0, n) }},
+		{Name: CronDeliverCallbacks, Spec: "*/30 * * * * *", BatchSize: callback.DefaultBatchSize, Run: c.DeliverCallbacks},
+		{Name: CronTrackingSubscriptions, Spec: "0 */30 * * * *", BatchSize: SubscriptionBatchSize, Run: c.CheckTrackingSubscriptions},
+		{Name: CronSweepReverseJobs, Spec: "0 * * * * *", BatchSize: ReverseJobBatchSize, Run: c.SweepReverseJobs},
+		{Name: CronSweepTrackingJobs, Spec: "30 */5 * * * *", BatchSize: TrackingJobBatchSize, Run: c.SweepTrackingJobs},
+	}
+
+	var conf map[string]*cnf.CronConfig
+	if c.Conf != nil {
+		conf = c.Conf.Crons
+	}
+
+	errs := make([]string, 0)
+	known := make(map[string]bool, len(defaults))
+	for _, s := range defaults {
+		known[s.Name] = true
+		s.Enabled = true
+		s.Timeout = JobTimeout
+
+		if jc := conf[s.Name]; jc != nil {
+			for _, err := range s.apply(jc) {
+				errs = append(errs, fmt.Sprintf("%s: %s", s.Name, err))
+			}
+		}
+		if err := ValidateSpec(s.Spec); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", s.Name, err.Error()))
+		}
+	}
+	for name := range conf {
+		if !known[name] {
+			errs = append(errs, fmt.Sprintf("%s: Unknown cronjob", name))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("Invalid crons configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+
+	return defaults, nil
+}
+
+//apply Applies the configuration of the file to the schedule, returns the invalid values
+func (s *Schedule) apply(jc *cnf.CronConfig) []string {
+	errs := make([]string, 0)
+
+	if jc.Spec != "" {
+		s.Spec = jc.Spec
+	}
+	if jc.Enabled != nil {
+		s.Enabled = *jc.Enabled
+	}
+
+	switch {
+	case jc.BatchSize < 0:
+		errs = append(errs, fmt.Sprintf("batchSize must be positive, got %d", jc.BatchSize))
+	case jc.BatchSize > 0 && s.BatchSize == 0:
+		errs = append(errs, "batchSize is not used by this cronjob")
+	case jc.BatchSize > 0:
+		s.BatchSize = int(jc.BatchSize)
+	}
+
+	switch {
+	case jc.Timeout < 0:
+		errs = append(errs, fmt.Sprintf("timeout must be positive, got %d", jc.Timeout))
+	case jc.Timeout > 0:
+		s.Timeout = time.Duration(jc.Timeout) * time.Second
+	}
+
+	return errs
+}
+
+//ValidateSpec Returns an error if the spec can not be parsed or would not run as intended,
+//a spec has six fields starting with the seconds or is a descriptor such as @hourly or @every 5m
+func ValidateSpec(spec string) error {
+	if _, err := cron.Parse(spec); err != nil {
+		return fmt.Errorf("Invalid spec %q: %s", spec, err.Error())
+	}
+	if strings.HasPrefix(spec, "@") {
+		return nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(fieldRanges) {
+		return fmt.Errorf("Invalid spec %q: expected %d fields, second minute hour day-of-month month day-of-week", spec, len(fieldRanges))
+	}
+	if fields[0] == "*" {
+		return fmt.Errorf("Invalid spec %q: * in the second field runs the job every second, use 0 to run it once a minute", spec)
+	}
+
+	// the parser accepts steps that never repeat, */60 in the minute field runs at minute 0 only
+	for i, field := range fields {
+		r := fieldRanges[i]
+		for _, part := range strings.Split(field, ",") {
+			idx := strings.Index(part, "/")
+			if idx < 0 {
+				continue
+			}
+			step, err := strconv.Atoi(part[idx+1:])
+			if err == nil && step > r.max-r.min {
+				return fmt.Errorf("Invalid spec %q: the step %d of the %s field is not less than its %d values", spec, step, r.name, r.max-r.min+1)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1 @@
+CREATE DATABASE IF NOT EXISTS correios;
@@ -0,0 +1,121 @@
+//Package dispatcher runs the background work sent to Correios with a limited number of workers.
+//The work is submitted with the ID of its request, the work of the same ID runs one at a time in the order it was submitted
+//so a cancel never runs before the creation of its request.
+package dispatcher
+
+import (
+	"context"
+	"sync"
+)
+
+//DefaultWorkers number of requests whose work runs at the same time by default
+const DefaultWorkers = 8
+
+//Stats state of the dispatcher
+type Stats struct {
+	Workers int `json:"workers"`
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+}
+
+//Dispatcher runs the submitted work with at most Workers requests at the same time
+type Dispatcher struct {
+	workers int
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	work    map[int64][]func(ctx context.Context)
+	ready   []int64
+	running int
+	queued  int
+}
+
+//New Creates a Dispatcher with the given number of workers, DefaultWorkers if it is not positive
+func New(workers int) *Dispatcher {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	d := &Dispatcher{workers: workers, work: make(map[int64][]func(ctx context.Context))}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	return d
+}
+
+//Submit Queues fn to run after the work already submitted for the same ID
+func (d *Dispatcher) Submit(id int64, fn func(ctx context.Context)) {
+	d.wg.Add(1)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// an ID with queued work is either running or waiting for a worker already
+	if _, ok := d.work[id]; !ok {
+		d.ready = append(d.ready, id)
+	}
+	d.work[id] = append(d.work[id], fn)
+	d.queued++
+
+	d.schedule()
+}
+
+//Stats Returns the number of workers, of running and of queued works
+func (d *Dispatcher) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return Stats{Workers: d.workers, Running: d.running, Queued: d.queued}
+}
+
+//Drain Waits for the submitted work, the work still queued or running when ctx is done is cancelled
+func (d *Dispatcher) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+//schedule Starts a worker for each ID waiting while there are free workers, must be called with the lock
+func (d *Dispatcher) schedule() {
+	for d.running < d.workers && len(d.ready) > 0 {
+		id := d.ready[0]
+		d.ready = d.ready[1:]
+		d.running++
+
+		go d.run(id)
+	}
+}
+
+//run Runs the work of an ID until there is none left
+func (d *Dispatcher) run(id int64) {
+	for {
+		d.mu.Lock()
+		queue := d.work[id]
+		if len(queue) == 0 {
+			delete(d.work, id)
+			d.running--
+			d.schedule()
+			d.mu.Unlock()
+			return
+		}
+		fn := queue[0]
+		d.work[id] = queue[1:]
+		d.queued--
+		d.mu.Unlock()
+
+		fn(d.ctx)
+		d.wg.Done()
+	}
+}
@@ -0,0 +1,226 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//gauge counts the work running at the same time and keeps the highest count
+type gauge struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+//enter Counts a work that started
+func (g *gauge) enter() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.current++
+	if g.current > g.max {
+		g.max = g.current
+	}
+}
+
+//leave Counts a work that ended
+func (g *gauge) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.current--
+}
+
+//highest Returns the highest number of works that ran at the same time
+func (g *gauge) highest() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+//wait Receives n values from the channel failing the test if they take too long
+func wait(t *testing.T, ch chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d works started", i, n)
+		}
+	}
+}
+
+//drain Waits for the submitted work failing the test on error
+func drain(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := d.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %s", err.Error())
+	}
+}
+
+func TestDefaultWorkers(t *testing.T) {
+	if got := New(0).Stats().Workers; got != DefaultWorkers {
+		t.Errorf("New(0) has %d workers, want %d", got, DefaultWorkers)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	d := New(2)
+	g := new(gauge)
+	started := make(chan struct{}, 5)
+	release := make(chan struct{})
+	var ran int32
+
+	for id := int64(1); id <= 5; id++ {
+		d.Submit(id, func(ctx context.Context) {
+			g.enter()
+			defer g.leave()
+			started <- struct{}{}
+			<-release
+			atomic.AddInt32(&ran, 1)
+		})
+	}
+
+	wait(t, started, 2)
+	if st := d.Stats(); st.Running != 2 || st.Queued != 3 {
+		t.Errorf("Stats = %+v, want 2 running and 3 queued", st)
+	}
+
+	// no other work starts while both workers are busy
+	select {
+	case <-started:
+		t.Fatal("a third work started with 2 workers")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	drain(t, d)
+
+	if g.highest() != 2 || atomic.LoadInt32(&ran) != 5 {
+		t.Errorf("%d works ran with at most %d at the same time, want 5 with at most 2", ran, g.highest())
+	}
+	if st := d.Stats(); st.Running != 0 || st.Queued != 0 {
+		t.Errorf("Stats after Drain = %+v, want nothing running or queued", st)
+	}
+}
+
+func TestSameIDRunsInOrder(t *testing.T) {
+	d := New(4)
+	per := map[int64]*gauge{1: new(gauge), 2: new(gauge)}
+	all := new(gauge)
+
+	var (
+		mu    sync.Mutex
+		order = map[int64][]int{}
+	)
+
+	for i := 0; i < 20; i++ {
+		for id, g := range per {
+			id, g, i := id, g, i
+			d.Submit(id, func(ctx context.Context) {
+				g.enter()
+				all.enter()
+				defer all.leave()
+				defer g.leave()
+
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				order[id] = append(order[id], i)
+				mu.Unlock()
+			})
+		}
+	}
+	drain(t, d)
+
+	for id, g := range per {
+		if g.highest() != 1 {
+			t.Errorf("request %d had %d works running at the same time, want 1", id, g.highest())
+		}
+		for i, n := range order[id] {
+			if n != i {
+				t.Errorf("request %d ran its works in the order %v", id, order[id])
+				break
+			}
+		}
+		if len(order[id]) != 20 {
+			t.Errorf("request %d ran %d works, want 20", id, len(order[id]))
+		}
+	}
+
+	// the work of different requests runs at the same time
+	if all.highest() != 2 {
+		t.Errorf("at most %d works ran at the same time, want the 2 requests in parallel", all.highest())
+	}
+}
+
+func TestSubmitWhileRunning(t *testing.T) {
+	d := New(2)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	g := new(gauge)
+	var ran int32
+
+	d.Submit(1, func(ctx context.Context) {
+		g.enter()
+		defer g.leave()
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&ran, 1)
+	})
+	wait(t, started, 1)
+
+	// the work submitted while the request is running waits for it
+	d.Submit(1, func(ctx context.Context) {
+		g.enter()
+		defer g.leave()
+		if atomic.LoadInt32(&ran) != 1 {
+			t.Error("the second work started before the first one ended")
+		}
+		atomic.AddInt32(&ran, 1)
+	})
+	if st := d.Stats(); st.Running != 1 || st.Queued != 1 {
+		t.Errorf("Stats = %+v, want 1 running and 1 queued", st)
+	}
+
+	close(release)
+	drain(t, d)
+
+	if g.highest() != 1 || atomic.LoadInt32(&ran) != 2 {
+		t.Errorf("%d works ran with at most %d at the same time, want 2 one at a time", ran, g.highest())
+	}
+}
+
+func TestDrainCancelsOnShutdown(t *testing.T) {
+	d := New(2)
+	started := make(chan struct{}, 4)
+	var cancelled int32
+
+	for id := int64(1); id <= 4; id++ {
+		d.Submit(id, func(ctx context.Context) {
+			started <- struct{}{}
+			select {
+			case <-ctx.Done():
+				atomic.AddInt32(&cancelled, 1)
+			case <-time.After(5 * time.Second):
+			}
+		})
+	}
+	wait(t, started, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := d.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(begin) > time.Second {
+		t.Errorf("Drain took %s, the running work was not cancelled", time.Since(begin))
+	}
+
+	// the queued work still runs, with the cancelled context, so it can record that it was interrupted
+	if n := atomic.LoadInt32(&cancelled); n != 4 {
+		t.Errorf("%d works saw the shutdown, want 4", n)
+	}
+}
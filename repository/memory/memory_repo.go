@@ -0,0 +1,1238 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	s "github.com/pintobikez/brazilian-correios-service/api/structures"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"sort"
+	"sync"
+	"time"
+)
+
+//dateFormat format of the dates returned by the repository, the same one returned by mysql
+const dateFormat = "2006-01-02 15:04:05"
+
+//Client in memory repository, it keeps the data of a single process and is the reference of how a repository must behave
+type Client struct {
+	mu            sync.Mutex
+	lastID        int64
+	requests      map[int64]*s.Request
+	callbacks     map[int64]*s.CallbackDelivery
+	clients       map[string]*s.Client
+	history       []*s.StatusHistory
+	objects       map[string]*trackingObject
+	events        []*trackingEvent
+	jobs          map[int64]*s.TrackingJob
+	subscriptions map[int64]*s.TrackingSubscription
+	reverseJobs   map[int64]*s.ReverseJob
+	locks         map[string]*lock
+	marks         map[string]string
+	reqObjects    map[int64]*s.RequestObject
+	packages      map[int64]*s.RequestPackage
+	products      map[int64]*s.RequestProduct
+	correios      []*correiosStatus
+}
+
+//correiosStatus stored status of a request in Correios
+type correiosStatus struct {
+	requestID int64
+	status    s.CorreiosHistory
+}
+
+//lock owner of a lock and the time it holds it
+type lock struct {
+	owner string
+	until time.Time
+}
+
+//trackingObject stored tracking object and the time it was refreshed
+type trackingObject struct {
+	header      s.TrackingHeader
+	refreshedAt time.Time
+}
+
+//trackingEvent stored tracking event of an object
+type trackingEvent struct {
+	id    int64
+	code  string
+	at    *time.Time
+	event s.TrackingEvents
+}
+
+//New Creates an empty in memory repository
+func New() *Client {
+	r := new(Client)
+	r.reset()
+	return r
+}
+
+//Connect Empties the repository, the connection string is ignored
+func (r *Client) Connect(stringConn string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reset()
+	return nil
+}
+
+//Disconnect Nothing to close in memory
+func (r *Client) Disconnect() {
+}
+
+//Transaction Runs fn on a copy of the repository that replaces it if fn returns nil and ctx is not done, the transactions run one at a time
+func (r *Client) Transaction(ctx context.Context, fn func(tx repo.Definition) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := r.clone()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	// a cancelled transaction is not committed, as in the sql repositories
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.lastID = tx.lastID
+	r.requests = tx.requests
+	r.callbacks = tx.callbacks
+	r.clients = tx.clients
+	r.history = tx.history
+	r.objects = tx.objects
+	r.events = tx.events
+	r.jobs = tx.jobs
+	r.subscriptions = tx.subscriptions
+	r.reverseJobs = tx.reverseJobs
+	r.locks = tx.locks
+	r.marks = tx.marks
+	r.reqObjects = tx.reqObjects
+	r.packages = tx.packages
+	r.products = tx.products
+	r.correios = tx.correios
+
+	return nil
+}
+
+//InsertRequest Creates a PostageCode request
+func (r *Client) InsertRequest(ctx context.Context, o *s.Request) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o.RequestID = r.nextID()
+	o.Status = s.StatusPending
+	o.ErrorMessage = ""
+	o.Retries = 0
+	o.PostageCode = ""
+	o.TrackingCode = ""
+	o.CreatedAt = now()
+	o.UpdatedAt = o.CreatedAt
+
+	for _, i := range o.Items {
+		i.RequestItemID = r.nextID()
+		i.FkRequestID = o.RequestID
+	}
+
+	r.requests[o.RequestID] = copyRequest(o)
+
+	return nil
+}
+
+//UpdateRequest Updates the data of a Request and replaces its items if its status is still the one in the struct,
+//a Request without items keeps the stored ones
+func (r *Client) UpdateRequest(ctx context.Context, o *s.Request) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.requests[o.RequestID]
+	if !ok || stored.Status != o.Status {
+		return fmt.Errorf("Could not update Request %d from %s", o.RequestID, o.Status)
+	}
+
+	for _, i := range o.Items {
+		i.RequestItemID = r.nextID()
+		i.FkRequestID = o.RequestID
+	}
+
+	n := copyRequest(o)
+	// the status, the codes and the creation data are kept
+	n.Status = stored.Status
+	n.ErrorMessage = stored.ErrorMessage
+	n.Retries = stored.Retries
+	n.PostageCode = stored.PostageCode
+	n.TrackingCode = stored.TrackingCode
+	n.OrderNr = stored.OrderNr
+	n.SlipNumber = stored.SlipNumber
+	n.Callback = stored.Callback
+	n.ClientID = stored.ClientID
+	n.CreatedAt = stored.CreatedAt
+	n.UpdatedAt = now()
+
+	if len(o.Items) == 0 {
+		n.Items = stored.Items
+	}
+	r.requests[o.RequestID] = n
+
+	return nil
+}
+
+//SaveRequestPackages Replaces the packages of a Request
+func (r *Client) SaveRequestPackages(ctx context.Context, requestID int64, packages []*s.RequestPackage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, p := range r.packages {
+		if p.FkRequestID == requestID {
+			delete(r.packages, id)
+		}
+	}
+	for _, p := range packages {
+		p.RequestPackageID = r.nextID()
+		p.FkRequestID = requestID
+		p.Description = truncate(p.Description, 255)
+		cp := *p
+		r.packages[p.RequestPackageID] = &cp
+	}
+
+	return nil
+}
+
+//GetRequestPackages Gets the packages of a Request by coleta
+func (r *Client) GetRequestPackages(ctx context.Context, requestID int64) ([]*s.RequestPackage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := make([]*s.RequestPackage, 0)
+	for _, p := range r.packages {
+		if p.FkRequestID == requestID {
+			cp := *p
+			resp = append(resp, &cp)
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].Coleta != resp[j].Coleta {
+			return resp[i].Coleta < resp[j].Coleta
+		}
+		return resp[i].RequestPackageID < resp[j].RequestPackageID
+	})
+
+	return resp, nil
+}
+
+//UpdateRequestPackage Stores the codes given by Correios to a package
+func (r *Client) UpdateRequestPackage(ctx context.Context, p *s.RequestPackage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored, ok := r.packages[p.RequestPackageID]; ok {
+		stored.PostageCode = p.PostageCode
+		stored.TrackingCode = p.TrackingCode
+	}
+
+	return nil
+}
+
+//SaveRequestProducts Replaces the products of a Request
+func (r *Client) SaveRequestProducts(ctx context.Context, requestID int64, products []*s.RequestProduct) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, p := range r.products {
+		if p.FkRequestID == requestID {
+			delete(r.products, id)
+		}
+	}
+	for _, p := range products {
+		p.RequestProductID = r.nextID()
+		p.FkRequestID = requestID
+		cp := *p
+		r.products[p.RequestProductID] = &cp
+	}
+
+	return nil
+}
+
+//GetRequestProducts Gets the products of a Request
+func (r *Client) GetRequestProducts(ctx context.Context, requestID int64) ([]*s.RequestProduct, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := make([]*s.RequestProduct, 0)
+	for _, p := range r.products {
+		if p.FkRequestID == requestID {
+			cp := *p
+			resp = append(resp, &cp)
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].RequestProductID < resp[j].RequestProductID })
+
+	return resp, nil
+}
+
+//hasPackagePostage Returns true if a package of the Request has the postage code, must be called with the lock
+func (r *Client) hasPackagePostage(requestID int64, code string) bool {
+	for _, p := range r.packages {
+		if p.FkRequestID == requestID && p.PostageCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+//UpdateRequestStatus Updates the status of a Request if it is still the one in the struct
+func (r *Client) UpdateRequestStatus(ctx context.Context, o *s.Request, status string, message string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.requests[o.RequestID]
+	if !ok || stored.Status != o.Status {
+		return 0, fmt.Errorf("Could not update status for Request %d from %s", o.RequestID, o.Status)
+	}
+
+	stored.Retries = o.Retries
+	stored.Status = status
+	stored.ErrorMessage = message
+	stored.UpdatedAt = now()
+
+	//update struct
+	o.Status = status
+	o.ErrorMessage = message
+
+	return 1, nil
+}
+
+//UpdateRequestPostage Updates an RequestItems PostageCode
+func (r *Client) UpdateRequestPostage(ctx context.Context, o *s.Request, code string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.requests[o.RequestID]
+	if !ok || stored.Status != o.Status {
+		return fmt.Errorf("Could not update postage code for Request %d", o.RequestID)
+	}
+
+	stored.PostageCode = code
+	stored.Status = s.StatusGenerated
+	stored.UpdatedAt = now()
+
+	//update struct
+	o.PostageCode = code
+	o.Status = s.StatusGenerated
+
+	return nil
+}
+
+//UpdateRequestTracking Updates an RequestItems TrackingCode
+func (r *Client) UpdateRequestTracking(ctx context.Context, o *s.Request, code string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.requests[o.RequestID]
+	if !ok || stored.Status != o.Status {
+		return fmt.Errorf("Could not update tracking code for Request %d", o.RequestID)
+	}
+
+	stored.TrackingCode = code
+	stored.Status = s.StatusUsed
+	stored.UpdatedAt = now()
+
+	//update struct
+	o.TrackingCode = code
+	o.Status = s.StatusUsed
+
+	return nil
+}
+
+//FindRequestByID Finds Request by RequestID
+func (r *Client) FindRequestByID(ctx context.Context, requestID int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.requests[requestID]
+	return ok, nil
+}
+
+//GetRequestByID Gets Request info by RequestID
+func (r *Client) GetRequestByID(ctx context.Context, requestID int) (*s.Request, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.requests[int64(requestID)]
+	if !ok {
+		return new(s.Request), nil
+	}
+
+	return copyRequest(stored), nil
+}
+
+//GetRequestByPostageCode Gets Request info by PostageCode
+func (r *Client) GetRequestByPostageCode(ctx context.Context, code string) (*s.Request, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range r.requestIDs() {
+		stored := r.requests[id]
+		if stored.PostageCode == code || r.hasPackagePostage(id, code) {
+			return copyRequest(stored), nil
+		}
+	}
+
+	return new(s.Request), nil
+}
+
+//InsertCallbackDelivery Writes a callback to the outbox
+func (r *Client) InsertCallbackDelivery(ctx context.Context, d *s.CallbackDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d.CallbackDeliveryID = r.nextID()
+	d.Status = s.CallbackPending
+	d.Attempts = 0
+	d.ResponseCode = 0
+	d.LastError = ""
+	d.NextAttemptAt = now()
+	d.DeliveredAt = ""
+	d.CreatedAt = d.NextAttemptAt
+	d.UpdatedAt = ""
+
+	c := *d
+	r.callbacks[d.CallbackDeliveryID] = &c
+
+	return nil
+}
+
+//GetCallbackDeliveryByID Gets a callback delivery by its ID
+func (r *Client) GetCallbackDeliveryByID(ctx context.Context, deliveryID int64) (*s.CallbackDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.callbacks[deliveryID]
+	if !ok {
+		return new(s.CallbackDelivery), nil
+	}
+
+	c := *d
+	return &c, nil
+}
+
+//GetCallbackDeliveriesByRequestID Gets the callback deliveries of a Request
+func (r *Client) GetCallbackDeliveriesByRequestID(ctx context.Context, requestID int64) ([]*s.CallbackDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.filterCallbacks(func(d *s.CallbackDelivery) bool { return d.RequestID == requestID }), nil
+}
+
+//GetPendingCallbackDeliveries Gets the pending callback deliveries that must be attempted until the given time
+func (r *Client) GetPendingCallbackDeliveries(ctx context.Context, until time.Time, limit int) ([]*s.CallbackDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	until = until.Truncate(time.Second)
+	resp := r.filterCallbacks(func(d *s.CallbackDelivery) bool {
+		return d.Status == s.CallbackPending && !parse(d.NextAttemptAt).After(until)
+	})
+
+	sort.SliceStable(resp, func(i, j int) bool { return resp[i].NextAttemptAt < resp[j].NextAttemptAt })
+	if len(resp) > limit {
+		resp = resp[:limit]
+	}
+
+	return resp, nil
+}
+
+//UpdateCallbackDelivery Updates the delivery state of a callback
+func (r *Client) UpdateCallbackDelivery(ctx context.Context, d *s.CallbackDelivery, nextAttempt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.callbacks[d.CallbackDeliveryID]
+	if !ok {
+		return nil
+	}
+
+	stored.Status = d.Status
+	stored.Attempts = d.Attempts
+	stored.ResponseCode = d.ResponseCode
+	stored.LastError = truncate(d.LastError, 255)
+	stored.NextAttemptAt = format(nextAttempt)
+	stored.UpdatedAt = now()
+	if d.Status == s.CallbackDelivered {
+		stored.DeliveredAt = stored.UpdatedAt
+	}
+
+	return nil
+}
+
+//InsertClient Registers a client with its secret
+func (r *Client) InsertClient(ctx context.Context, c *s.Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[c.ClientID]; ok {
+		return fmt.Errorf("Error in insert client %s: duplicated client", c.ClientID)
+	}
+
+	r.clients[c.ClientID] = &s.Client{ClientID: c.ClientID, Name: c.Name, Secret: c.Secret, CreatedAt: now()}
+
+	return nil
+}
+
+//GetClientByID Gets a client and its secrets by its ID
+func (r *Client) GetClientByID(ctx context.Context, clientID string) (*s.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.clients[clientID]
+	if !ok {
+		return new(s.Client), nil
+	}
+
+	cp := *c
+	return &cp, nil
+}
+
+//UpdateClientSecrets Updates the active secrets of a client
+func (r *Client) UpdateClientSecrets(ctx context.Context, c *s.Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.clients[c.ClientID]
+	if !ok {
+		return fmt.Errorf("Could not update secrets of client %s", c.ClientID)
+	}
+
+	stored.Secret = c.Secret
+	stored.PreviousSecret = c.PreviousSecret
+	stored.RotatedAt = now()
+
+	return nil
+}
+
+//InsertStatusHistory Records a status change of a Request
+func (r *Client) InsertStatusHistory(ctx context.Context, h *s.StatusHistory) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h.StatusHistoryID = r.nextID()
+	c := *h
+	c.CreatedAt = now()
+	r.history = append(r.history, &c)
+
+	return nil
+}
+
+//GetStatusHistoryByRequestID Gets the status changes of a Request from the oldest to the newest
+func (r *Client) GetStatusHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.StatusHistory, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := make([]*s.StatusHistory, 0)
+	for _, h := range r.history {
+		if h.RequestID == requestID {
+			c := *h
+			resp = append(resp, &c)
+		}
+	}
+
+	return resp, nil
+}
+
+//SaveTrackingObject Stores a tracking object and the events that are not stored yet
+func (r *Client) SaveTrackingObject(ctx context.Context, t *s.TrackingHeader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	obj, ok := r.objects[t.Object]
+	if !ok {
+		obj = &trackingObject{header: s.TrackingHeader{Object: t.Object}}
+		r.objects[t.Object] = obj
+	}
+	// a failed refresh keeps the data of the last successful one
+	if t.Error == "" {
+		obj.header.Name = t.Name
+		obj.header.Category = t.Category
+	}
+	obj.header.Error = t.Error
+	obj.refreshedAt = time.Now().UTC().Truncate(time.Second)
+
+	for _, ev := range t.Events {
+		if r.hasEvent(t.Object, ev) {
+			continue
+		}
+
+		e := &trackingEvent{id: r.nextID(), code: t.Object, event: *ev}
+		e.event.Description = truncate(ev.Description, 255)
+		e.event.Details = truncate(ev.Details, 255)
+		e.event.CTECorreios = truncate(ev.CTECorreios, 255)
+		if at, err := time.Parse("02/01/2006 15:04", ev.DateTime); err == nil {
+			e.at = &at
+		}
+		r.events = append(r.events, e)
+	}
+
+	return nil
+}
+
+//SaveCorreiosFollow Stores the objects of a Request as replied by Correios and the statuses of its history that are not stored yet
+func (r *Client) SaveCorreiosFollow(ctx context.Context, requestID int64, objects []*s.RequestObject, history []*s.CorreiosHistory) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, o := range objects {
+		o.FkRequestID = requestID
+		o.Description = truncate(o.Description, 255)
+
+		stored := r.findRequestObject(requestID, o.TrackingCode)
+		if stored == nil {
+			o.RequestObjectID = r.nextID()
+		} else {
+			o.RequestObjectID = stored.RequestObjectID
+		}
+		so := *o
+		r.reqObjects[o.RequestObjectID] = &so
+	}
+
+	// the statuses already stored with the same date are ignored
+	for _, h := range history {
+		found := false
+		for _, c := range r.correios {
+			if c.requestID == requestID && c.status.Status == h.Status && c.status.Date == h.Date {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ch := *h
+			ch.Description = truncate(ch.Description, 255)
+			ch.Observation = truncate(ch.Observation, 255)
+			r.correios = append(r.correios, &correiosStatus{requestID: requestID, status: ch})
+		}
+	}
+
+	return nil
+}
+
+//GetRequestObjects Gets the objects of a Request as last replied by Correios
+func (r *Client) GetRequestObjects(ctx context.Context, requestID int64) ([]*s.RequestObject, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := make([]*s.RequestObject, 0)
+	for _, o := range r.reqObjects {
+		if o.FkRequestID == requestID {
+			co := *o
+			resp = append(resp, &co)
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].RequestObjectID < resp[j].RequestObjectID })
+
+	return resp, nil
+}
+
+//GetCorreiosHistoryByRequestID Gets the statuses of a Request in Correios in the order they were stored
+func (r *Client) GetCorreiosHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.CorreiosHistory, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := make([]*s.CorreiosHistory, 0)
+	for _, c := range r.correios {
+		if c.requestID == requestID {
+			ch := c.status
+			resp = append(resp, &ch)
+		}
+	}
+
+	return resp, nil
+}
+
+//findRequestObject Finds the stored object of a Request by its tracking code, must be called with the lock
+func (r *Client) findRequestObject(requestID int64, code string) *s.RequestObject {
+	for _, o := range r.reqObjects {
+		if o.FkRequestID == requestID && o.TrackingCode == code {
+			return o
+		}
+	}
+	return nil
+}
+
+//GetTrackingObject Gets a stored tracking object with its events from the newest to the oldest, returns true if it was refreshed after freshSince
+func (r *Client) GetTrackingObject(ctx context.Context, code string, freshSince time.Time) (*s.TrackingHeader, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	obj, ok := r.objects[code]
+	if !ok {
+		return new(s.TrackingHeader), false, nil
+	}
+
+	resp := obj.header
+	resp.RefreshedAt = format(obj.refreshedAt)
+	resp.Events, _ = r.eventsAfter(code, 0)
+
+	return &resp, !obj.refreshedAt.Before(freshSince.Truncate(time.Second)), nil
+}
+
+//GetTrackingEventsAfter Gets the events of an object stored after the given event, newest first, and the ID of the last stored event
+func (r *Client) GetTrackingEventsAfter(ctx context.Context, code string, eventID int64) ([]*s.TrackingEvents, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp, lastID := r.eventsAfter(code, eventID)
+	return resp, lastID, nil
+}
+
+//InsertTrackingJob Creates a tracking job with its objects
+func (r *Client) InsertTrackingJob(ctx context.Context, j *s.TrackingJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j.JobID = r.nextID()
+	j.Status = s.JobPending
+
+	j.Attempts = 0
+	j.LeaseOwner = ""
+	j.LeaseUntil = ""
+
+	c := *j
+	c.Objects = append([]string{}, j.Objects...)
+	c.Result = nil
+	c.Error = ""
+	c.CreatedAt = now()
+	c.FinishedAt = ""
+	r.jobs[j.JobID] = &c
+
+	return nil
+}
+
+//GetTrackingJobByID Gets a tracking job and its result by its ID
+func (r *Client) GetTrackingJobByID(ctx context.Context, jobID int64) (*s.TrackingJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok := r.jobs[jobID]
+	if !ok {
+		return new(s.TrackingJob), nil
+	}
+
+	c := *j
+	c.Objects = append([]string{}, j.Objects...)
+	return &c, nil
+}
+
+//UpdateTrackingJob Updates the status and the result of a tracking job
+func (r *Client) UpdateTrackingJob(ctx context.Context, j *s.TrackingJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.jobs[j.JobID]
+	if !ok {
+		return nil
+	}
+
+	stored.Status = j.Status
+	stored.Result = j.Result
+	stored.Error = truncate(j.Error, 255)
+	stored.FinishedAt = ""
+	if j.Status == s.JobDone || j.Status == s.JobFailed {
+		stored.FinishedAt = now()
+	}
+
+	return nil
+}
+
+//GetRunnableTrackingJobs Gets the pending tracking jobs and the running ones whose lease ended before now
+func (r *Client) GetRunnableTrackingJobs(ctx context.Context, at time.Time, limit int) ([]*s.TrackingJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]int64, 0)
+	for id, j := range r.jobs {
+		if runnableTracking(j, at) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	resp := make([]*s.TrackingJob, 0, len(ids))
+	for _, id := range ids {
+		c := *r.jobs[id]
+		c.Objects = append([]string{}, c.Objects...)
+		resp = append(resp, &c)
+	}
+
+	return resp, nil
+}
+
+//ClaimTrackingJob Takes the lease of a runnable tracking job until the given time and counts the attempt, returns false if the job is not runnable
+func (r *Client) ClaimTrackingJob(ctx context.Context, j *s.TrackingJob, owner string, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.jobs[j.JobID]
+	if !ok || !runnableTracking(stored, time.Now()) {
+		return false, nil
+	}
+
+	stored.Status = s.JobRunning
+	stored.Attempts++
+	stored.LeaseOwner = owner
+	stored.LeaseUntil = format(until)
+	j.Status = stored.Status
+	j.Attempts = stored.Attempts
+	j.LeaseOwner = owner
+	j.LeaseUntil = stored.LeaseUntil
+
+	return true, nil
+}
+
+//InsertReverseJob Queues a call to the reverse logistics service of a Request
+func (r *Client) InsertReverseJob(ctx context.Context, j *s.ReverseJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j.ReverseJobID = r.nextID()
+	j.Status = s.JobPending
+	j.Attempts = 0
+	j.LeaseOwner = ""
+	j.LeaseUntil = ""
+	j.LastError = ""
+	j.CreatedAt = now()
+	j.UpdatedAt = ""
+
+	c := *j
+	r.reverseJobs[j.ReverseJobID] = &c
+
+	return nil
+}
+
+//GetReverseJobsByRequestID Gets the reverse jobs of a Request
+func (r *Client) GetReverseJobsByRequestID(ctx context.Context, requestID int64) ([]*s.ReverseJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.filterReverseJobs(func(j *s.ReverseJob) bool { return j.RequestID == requestID }), nil
+}
+
+//GetRunnableReverseJobs Gets the pending jobs and the running ones whose lease ended before now,
+//a job is only runnable when the jobs queued before it for the same Request are finished
+func (r *Client) GetRunnableReverseJobs(ctx context.Context, at time.Time, limit int) ([]*s.ReverseJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := r.filterReverseJobs(func(j *s.ReverseJob) bool { return r.runnable(j, at) })
+	if len(resp) > limit {
+		resp = resp[:limit]
+	}
+
+	return resp, nil
+}
+
+//ClaimReverseJob Takes the lease of a runnable job until the given time and counts the attempt, returns false if the job is not runnable
+func (r *Client) ClaimReverseJob(ctx context.Context, j *s.ReverseJob, owner string, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.reverseJobs[j.ReverseJobID]
+	if !ok || !r.runnable(stored, time.Now()) {
+		return false, nil
+	}
+
+	stored.Status = s.JobRunning
+	stored.Attempts++
+	stored.LeaseOwner = owner
+	stored.LeaseUntil = format(until)
+	stored.UpdatedAt = now()
+	*j = *stored
+
+	return true, nil
+}
+
+//FinishReverseJob Stores the status and the error of a job whose lease is still held by its owner
+func (r *Client) FinishReverseJob(ctx context.Context, j *s.ReverseJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.reverseJobs[j.ReverseJobID]
+	if !ok || stored.Status != s.JobRunning || stored.LeaseOwner != j.LeaseOwner {
+		return fmt.Errorf("Could not finish Job %d, its lease was lost", j.ReverseJobID)
+	}
+
+	stored.Status = j.Status
+	stored.LastError = truncate(j.LastError, 255)
+	stored.UpdatedAt = now()
+
+	return nil
+}
+
+//AcquireLock Takes or renews a lock until the given time, returns false if another owner holds it
+func (r *Client) AcquireLock(ctx context.Context, name string, owner string, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.locks[name]
+	if ok && l.owner != owner && l.until.After(time.Now()) {
+		return false, nil
+	}
+	r.locks[name] = &lock{owner: owner, until: until}
+
+	return true, nil
+}
+
+//ReleaseLock Ends a lock held by the owner so another owner can take it at once
+func (r *Client) ReleaseLock(ctx context.Context, name string, owner string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if l, ok := r.locks[name]; ok && l.owner == owner {
+		l.until = time.Now()
+	}
+
+	return nil
+}
+
+//GetSyncMark Gets the last day synced by the given sync, empty if it never ran
+func (r *Client) GetSyncMark(ctx context.Context, name string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.marks[name], nil
+}
+
+//SetSyncMark Stores the last day synced by the given sync
+func (r *Client) SetSyncMark(ctx context.Context, name string, day string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.marks[name] = day
+
+	return nil
+}
+
+//InsertTrackingSubscription Creates a subscription to the new events of an object
+func (r *Client) InsertTrackingSubscription(ctx context.Context, t *s.TrackingSubscription, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t.SubscriptionID = r.nextID()
+	t.Status = s.SubscriptionActive
+	t.ExpiresAt = format(expiresAt)
+
+	c := *t
+	c.EndedReason = ""
+	c.LastEventID = 0
+	c.CheckedAt = ""
+	c.CreatedAt = now()
+	r.subscriptions[t.SubscriptionID] = &c
+
+	return nil
+}
+
+//GetTrackingSubscriptionByID Gets a tracking subscription by its ID
+func (r *Client) GetTrackingSubscriptionByID(ctx context.Context, subscriptionID int64) (*s.TrackingSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.subscriptions[subscriptionID]
+	if !ok {
+		return new(s.TrackingSubscription), nil
+	}
+
+	c := *t
+	return &c, nil
+}
+
+//GetActiveTrackingSubscriptions Gets the active tracking subscriptions after the given ID
+func (r *Client) GetActiveTrackingSubscriptions(ctx context.Context, afterID int64, limit int) ([]*s.TrackingSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]int64, 0, len(r.subscriptions))
+	for id, t := range r.subscriptions {
+		if id > afterID && t.Status == s.SubscriptionActive {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	resp := make([]*s.TrackingSubscription, 0, len(ids))
+	for _, id := range ids {
+		if len(resp) == limit {
+			break
+		}
+		c := *r.subscriptions[id]
+		resp = append(resp, &c)
+	}
+
+	return resp, nil
+}
+
+//UpdateTrackingSubscription Updates the last notified event and the status of a tracking subscription
+func (r *Client) UpdateTrackingSubscription(ctx context.Context, t *s.TrackingSubscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.subscriptions[t.SubscriptionID]
+	if !ok {
+		return nil
+	}
+
+	stored.Status = t.Status
+	stored.EndedReason = t.EndedReason
+	stored.LastEventID = t.LastEventID
+	stored.CheckedAt = now()
+
+	return nil
+}
+
+//EndExpiredTrackingSubscriptions Ends the active subscriptions that expired before now, returns the number of ended subscriptions
+func (r *Client) EndExpiredTrackingSubscriptions(ctx context.Context, at time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ended int64
+	at = at.Truncate(time.Second)
+	for _, t := range r.subscriptions {
+		if t.Status == s.SubscriptionActive && !parse(t.ExpiresAt).After(at) {
+			t.Status = s.SubscriptionEnded
+			t.EndedReason = s.EndedExpired
+			ended++
+		}
+	}
+
+	return ended, nil
+}
+
+//reset Empties every table
+func (r *Client) reset() {
+	r.lastID = 0
+	r.requests = make(map[int64]*s.Request)
+	r.callbacks = make(map[int64]*s.CallbackDelivery)
+	r.clients = make(map[string]*s.Client)
+	r.history = nil
+	r.objects = make(map[string]*trackingObject)
+	r.events = nil
+	r.jobs = make(map[int64]*s.TrackingJob)
+	r.subscriptions = make(map[int64]*s.TrackingSubscription)
+	r.reverseJobs = make(map[int64]*s.ReverseJob)
+	r.locks = make(map[string]*lock)
+	r.marks = make(map[string]string)
+	r.reqObjects = make(map[int64]*s.RequestObject)
+	r.packages = make(map[int64]*s.RequestPackage)
+	r.products = make(map[int64]*s.RequestProduct)
+	r.correios = nil
+}
+
+//clone Returns a copy of the repository whose changes do not affect it
+func (r *Client) clone() *Client {
+	c := new(Client)
+	c.reset()
+	c.lastID = r.lastID
+
+	for id, o := range r.requests {
+		c.requests[id] = copyRequest(o)
+	}
+	for id, d := range r.callbacks {
+		cd := *d
+		c.callbacks[id] = &cd
+	}
+	for id, cl := range r.clients {
+		cc := *cl
+		c.clients[id] = &cc
+	}
+	// the history and the events are only appended to
+	c.history = append(c.history, r.history...)
+	c.events = append(c.events, r.events...)
+	for code, obj := range r.objects {
+		co := *obj
+		c.objects[code] = &co
+	}
+	for id, j := range r.jobs {
+		cj := *j
+		c.jobs[id] = &cj
+	}
+	for id, t := range r.subscriptions {
+		ct := *t
+		c.subscriptions[id] = &ct
+	}
+	for id, j := range r.reverseJobs {
+		cj := *j
+		c.reverseJobs[id] = &cj
+	}
+	for name, l := range r.locks {
+		cl := *l
+		c.locks[name] = &cl
+	}
+	for name, day := range r.marks {
+		c.marks[name] = day
+	}
+	for id, o := range r.reqObjects {
+		co := *o
+		c.reqObjects[id] = &co
+	}
+	c.correios = append(c.correios, r.correios...)
+	for id, p := range r.packages {
+		cp := *p
+		c.packages[id] = &cp
+	}
+	for id, p := range r.products {
+		cp := *p
+		c.products[id] = &cp
+	}
+
+	return c
+}
+
+//nextID Returns a new ID, the IDs are increasing across every table
+func (r *Client) nextID() int64 {
+	r.lastID++
+	return r.lastID
+}
+
+//requestIDs Returns the IDs of the stored requests in ascending order
+func (r *Client) requestIDs() []int64 {
+	ids := make([]int64, 0, len(r.requests))
+	for id := range r.requests {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+//filterCallbacks Returns copies of the callbacks that match in ascending ID order
+func (r *Client) filterCallbacks(match func(d *s.CallbackDelivery) bool) []*s.CallbackDelivery {
+	resp := make([]*s.CallbackDelivery, 0)
+	for _, d := range r.callbacks {
+		if match(d) {
+			c := *d
+			resp = append(resp, &c)
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].CallbackDeliveryID < resp[j].CallbackDeliveryID })
+
+	return resp
+}
+
+//filterReverseJobs Returns copies of the reverse jobs that match in ascending ID order
+func (r *Client) filterReverseJobs(match func(j *s.ReverseJob) bool) []*s.ReverseJob {
+	resp := make([]*s.ReverseJob, 0)
+	for _, j := range r.reverseJobs {
+		if match(j) {
+			c := *j
+			resp = append(resp, &c)
+		}
+	}
+	sort.Slice(resp, func(i, k int) bool { return resp[i].ReverseJobID < resp[k].ReverseJobID })
+
+	return resp
+}
+
+//runnable Returns true if the job is pending or its lease ended and it is the first unfinished job of its Request
+func (r *Client) runnable(j *s.ReverseJob, at time.Time) bool {
+	at = at.Truncate(time.Second)
+	if j.Status != s.JobPending && (j.Status != s.JobRunning || parse(j.LeaseUntil).After(at)) {
+		return false
+	}
+
+	for _, o := range r.reverseJobs {
+		if o.RequestID == j.RequestID && o.ReverseJobID < j.ReverseJobID && (o.Status == s.JobPending || o.Status == s.JobRunning) {
+			return false
+		}
+	}
+	return true
+}
+
+//runnableTracking Returns true if the tracking job is pending or its lease ended at the given time
+func runnableTracking(j *s.TrackingJob, at time.Time) bool {
+	at = at.Truncate(time.Second)
+	return j.Status == s.JobPending || (j.Status == s.JobRunning && j.LeaseUntil != "" && !parse(j.LeaseUntil).After(at))
+}
+
+//hasEvent Returns true if the object already has an event with the same type, status and date
+func (r *Client) hasEvent(code string, ev *s.TrackingEvents) bool {
+	for _, e := range r.events {
+		if e.code == code && e.event.Type == ev.Type && e.event.StatusCode == ev.StatusCode && e.event.DateTime == ev.DateTime {
+			return true
+		}
+	}
+	return false
+}
+
+//eventsAfter Returns the events of an object stored after the given event, newest first, and the ID of the last stored event
+func (r *Client) eventsAfter(code string, eventID int64) ([]*s.TrackingEvents, int64) {
+	found := make([]*trackingEvent, 0)
+	lastID := eventID
+
+	for _, e := range r.events {
+		if e.code == code && e.id > eventID {
+			found = append(found, e)
+			if e.id > lastID {
+				lastID = e.id
+			}
+		}
+	}
+
+	// the events without date go last, as NULLs in a descending order
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		switch {
+		case a.at == nil && b.at == nil:
+			return a.id > b.id
+		case a.at == nil || b.at == nil:
+			return b.at == nil
+		case !a.at.Equal(*b.at):
+			return a.at.After(*b.at)
+		}
+		return a.id > b.id
+	})
+
+	resp := make([]*s.TrackingEvents, 0, len(found))
+	for _, e := range found {
+		c := e.event
+		resp = append(resp, &c)
+	}
+
+	return resp, lastID
+}
+
+//copyRequest Returns a copy of the request, its lists and its items
+func copyRequest(o *s.Request) *s.Request {
+	c := *o
+	c.AdditionalServices = append([]string(nil), o.AdditionalServices...)
+	c.Documents = append([]string(nil), o.Documents...)
+	c.Items = make([]*s.RequestItem, 0, len(o.Items))
+	for _, i := range o.Items {
+		ci := *i
+		c.Items = append(c.Items, &ci)
+	}
+
+	return &c
+}
+
+//now Returns the current time formatted as the stored dates
+func now() string {
+	return format(time.Now())
+}
+
+//format Formats a time as the stored dates
+func format(t time.Time) string {
+	return t.UTC().Format(dateFormat)
+}
+
+//parse Parses a stored date
+func parse(value string) time.Time {
+	t, _ := time.Parse(dateFormat, value)
+	return t
+}
+
+//truncate Truncates a string to the given number of characters
+func truncate(value string, size int) string {
+	if r := []rune(value); len(r) > size {
+		return string(r[:size])
+	}
+	return value
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/repository/repotest"
+	"testing"
+)
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repo.Definition {
+		return New()
+	})
+}
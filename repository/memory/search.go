@@ -0,0 +1,266 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	s "github.com/pintobikez/brazilian-correios-service/api/structures"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"sort"
+	"strings"
+)
+
+//GetRequestBy Gets Request info by the given search, the pagination applies to the requests
+func (r *Client) GetRequestBy(ctx context.Context, req *s.Search) ([]*s.Request, error) {
+	resp := []*s.Request{}
+
+	// validates the search and sets its defaults as the sql repositories do
+	if _, err := repo.BuildSearch(req); err != nil {
+		return resp, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	matched := make([]*s.Request, 0)
+	for _, id := range r.requestIDs() {
+		o := r.requests[id]
+		ok, err := matchGroup(req.Where, req.JoinBy, o)
+		if err != nil {
+			return resp, err
+		}
+		if ok {
+			matched = append(matched, o)
+		}
+	}
+
+	column := repo.SortFields[strings.ToLower(req.OrderField)]
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		c := compare(value(a, nil, column), value(b, nil, column))
+		if c == 0 {
+			return a.RequestID < b.RequestID
+		}
+		if req.OrderType == "DESC" {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	from := req.From
+	if from > len(matched) {
+		from = len(matched)
+	}
+	to := from + req.Offset
+	if to > len(matched) {
+		to = len(matched)
+	}
+
+	for _, o := range matched[from:to] {
+		resp = append(resp, copyRequest(o))
+	}
+
+	return resp, nil
+}
+
+//matchGroup Returns true if the request matches the conditions of a group joined by the given operator
+func matchGroup(where []*s.SearchWhere, join string, o *s.Request) (bool, error) {
+	or := strings.ToUpper(join) == "OR"
+	matched := 0
+
+	for _, e := range where {
+		if e == nil {
+			continue
+		}
+
+		var (
+			ok  bool
+			err error
+		)
+
+		if e.IsGroup() {
+			if len(e.Where) == 0 {
+				continue
+			}
+			ok, err = matchGroup(e.Where, e.JoinBy, o)
+		} else {
+			ok, err = matchCondition(e, o)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if or && ok {
+			return true, nil
+		}
+		if !or && !ok {
+			return false, nil
+		}
+		matched++
+	}
+
+	// an empty group matches every request
+	return !or || matched == 0, nil
+}
+
+//matchCondition Returns true if the request matches a single condition, a condition on the items matches if any item meets it
+func matchCondition(e *s.SearchWhere, o *s.Request) (bool, error) {
+	field := repo.SearchFields[strings.ToLower(e.Field)]
+	if !field.IsItem() {
+		return matchValue(e, field, value(o, nil, field.Column))
+	}
+
+	for _, i := range o.Items {
+		ok, err := matchValue(e, field, value(o, i, field.Column))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+//matchValue Returns true if the value meets a single condition
+func matchValue(e *s.SearchWhere, field repo.Field, v interface{}) (bool, error) {
+	op := strings.ToUpper(e.Operator)
+	if op == "" {
+		op = "="
+	}
+
+	if op == "IN" || op == "NOT IN" {
+		values, err := repo.ListValue(e.Value, field.Numeric)
+		if err != nil {
+			return false, err
+		}
+		found := false
+		for _, x := range values {
+			if compare(v, x) == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (op == "IN"), nil
+	}
+
+	x, err := repo.ScalarValue(e.Value, field.Numeric)
+	if err != nil {
+		return false, err
+	}
+
+	c := compare(v, x)
+	switch op {
+	case "=":
+		return c == 0, nil
+	case "!=", "<>":
+		return c != 0, nil
+	case ">":
+		return c > 0, nil
+	case "<":
+		return c < 0, nil
+	case ">=":
+		return c >= 0, nil
+	case "<=":
+		return c <= 0, nil
+	case "LIKE":
+		return like(fmt.Sprint(v), fmt.Sprint(x)), nil
+	case "NOT LIKE":
+		return !like(fmt.Sprint(v), fmt.Sprint(x)), nil
+	}
+
+	return false, fmt.Errorf("Invalid operator %s", e.Operator)
+}
+
+//value Returns the value of a search column of the row
+func value(o *s.Request, i *s.RequestItem, column string) interface{} {
+	switch column {
+	case "o.request_id":
+		return o.RequestID
+	case "o.order_nr":
+		return o.OrderNr
+	case "o.retries":
+		return o.Retries
+	case "o.request_type":
+		return o.RequestType
+	case "o.request_service":
+		return o.RequestService
+	case "o.colect_date":
+		return o.ColectDate
+	case "o.slip_number":
+		return o.SlipNumber
+	case "o.origin_nome":
+		return o.OriginNome
+	case "o.origin_cep":
+		return o.OriginCep
+	case "o.origin_cidade":
+		return o.OriginCidade
+	case "o.origin_uf":
+		return o.OriginUf
+	case "o.origin_email":
+		return o.OriginEmail
+	case "o.destination_nome":
+		return o.DestinationNome
+	case "o.destination_cep":
+		return o.DestinationCep
+	case "o.destination_cidade":
+		return o.DestinationCidade
+	case "o.destination_uf":
+		return o.DestinationUf
+	case "o.destination_email":
+		return o.DestinationEmail
+	case "o.status":
+		return o.Status
+	case "o.postage_code":
+		return o.PostageCode
+	case "o.tracking_code":
+		return o.TrackingCode
+	case "o.created_at":
+		return o.CreatedAt
+	case "o.updated_at":
+		return o.UpdatedAt
+	case "o.client_id":
+		return o.ClientID
+	}
+	if i == nil {
+		return nil
+	}
+
+	switch column {
+	case "items.item":
+		return i.Item
+	case "items.product_name":
+		return i.ProductName
+	}
+
+	return nil
+}
+
+//compare Compares two values as numbers if both are numbers or as strings otherwise
+func compare(a interface{}, b interface{}) int {
+	x, aok := number(a)
+	y, bok := number(b)
+	if aok && bok {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+//number Converts a numeric value to float64
+func number(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+//like Returns true if the value contains the given one ignoring the case, as the escaped LIKE of the sql repositories
+func like(v string, contained string) bool {
+	return strings.Contains(strings.ToLower(v), strings.ToLower(contained))
+}
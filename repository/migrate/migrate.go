@@ -0,0 +1,246 @@
+//Package migrate applies the versioned schema migrations of a backend, the applied versions are kept in the schema_version table.
+//
+//Each migration runs in a transaction, but mysql commits every DDL statement on its own: a migration that fails in the middle
+//keeps its first changes and is not recorded. The backends without transactional DDL give a done function that tells the errors
+//of a statement whose change is already in the schema, so running the migration again skips those statements.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//Table name of the table that keeps the applied migrations
+const Table = "schema_version"
+
+//Migration a versioned change of the schema with the statements to apply and to revert it
+type Migration struct {
+	Version     int
+	Description string
+	Up          []string
+	Down        []string
+}
+
+//Status a migration and when it was applied
+type Status struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Applied     bool   `json:"applied"`
+	AppliedAt   string `json:"applied_at,omitempty"`
+}
+
+//Migrator applies the migrations of a backend to its database
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	bind       func(query string) string
+	done       func(err error) bool
+}
+
+//New Creates a Migrator for the migrations, bind converts the ? placeholders to the ones of the database and done tells the errors
+//of a statement whose change is already in the schema, both can be nil
+func New(db *sql.DB, migrations []Migration, bind func(query string) string, done func(err error) bool) *Migrator {
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	if bind == nil {
+		bind = func(query string) string { return query }
+	}
+	if done == nil {
+		done = func(err error) bool { return false }
+	}
+
+	return &Migrator{db: db, migrations: sorted, bind: bind, done: done}
+}
+
+//Latest Returns the version of the last migration
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+//Version Returns the version of the last applied migration, 0 if none was applied
+func (m *Migrator) Version() (int, error) {
+	if err := m.createTable(); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := m.db.QueryRow("SELECT MAX(version) FROM " + Table).Scan(&version); err != nil {
+		return 0, fmt.Errorf("Error reading the schema version: %s", err.Error())
+	}
+
+	return int(version.Int64), nil
+}
+
+//Check Returns an error if the schema is not at the latest version
+func (m *Migrator) Check() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case version < m.Latest():
+		return fmt.Errorf("The schema is at version %d and %d is required, run the migrate up command", version, m.Latest())
+	case version > m.Latest():
+		return fmt.Errorf("The schema is at version %d which is newer than %d, upgrade the service", version, m.Latest())
+	}
+
+	return nil
+}
+
+//Up Applies every pending migration, returns the version reached
+func (m *Migrator) Up() (int, error) {
+	return m.Latest(), m.To(m.Latest())
+}
+
+//Down Reverts the last applied migration, returns the version reached
+func (m *Migrator) Down() (int, error) {
+	version, err := m.Version()
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, nil
+	}
+
+	target := 0
+	for _, mig := range m.migrations {
+		if mig.Version < version {
+			target = mig.Version
+		}
+	}
+
+	return target, m.To(target)
+}
+
+//To Applies or reverts migrations one at a time until the schema is at the given version
+func (m *Migrator) To(version int) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("Unknown schema version %d", version)
+	}
+
+	current, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if current != 0 && m.find(current) == nil {
+		return fmt.Errorf("The schema is at version %d which is unknown to this service", current)
+	}
+
+	// apply the pending migrations in ascending order
+	for _, mig := range m.migrations {
+		if mig.Version > current && mig.Version <= version {
+			if err := m.apply(mig, mig.Up, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	// revert the applied migrations in descending order
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version <= current && mig.Version > version {
+			if err := m.apply(mig, mig.Down, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//Status Returns every migration and if it was applied
+func (m *Migrator) Status() ([]*Status, error) {
+	if err := m.createTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query("SELECT version, applied_at FROM " + Table)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the schema version: %s", err.Error())
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var (
+			version int
+			at      string
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	resp := make([]*Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		at, ok := applied[mig.Version]
+		resp = append(resp, &Status{Version: mig.Version, Description: mig.Description, Applied: ok, AppliedAt: at})
+	}
+
+	return resp, nil
+}
+
+//apply Runs the statements of a migration and records it in a single transaction
+func (m *Migrator) apply(mig Migration, statements []string, up bool) error {
+	direction := "down"
+	if up {
+		direction = "up"
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			if m.done(err) {
+				continue
+			}
+			tx.Rollback()
+			return fmt.Errorf("Error in migration %d %s: %s", mig.Version, direction, err.Error())
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(m.bind("INSERT INTO "+Table+" (version, description, applied_at) VALUES (?,?,?)"), mig.Version, mig.Description, time.Now().UTC().Format("2006-01-02 15:04:05"))
+	} else {
+		_, err = tx.Exec(m.bind("DELETE FROM "+Table+" WHERE version=?"), mig.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error recording migration %d %s: %s", mig.Version, direction, err.Error())
+	}
+
+	return tx.Commit()
+}
+
+//createTable Creates the table of the applied migrations if it does not exist
+func (m *Migrator) createTable() error {
+	_, err := m.db.Exec("CREATE TABLE IF NOT EXISTS " + Table + " (version integer NOT NULL PRIMARY KEY, description varchar(255) NOT NULL, applied_at varchar(19) NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("Error creating the %s table: %s", Table, err.Error())
+	}
+	return nil
+}
+
+//find Returns the migration of the given version
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
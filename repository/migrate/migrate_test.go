@@ -0,0 +1,196 @@
+package migrate
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	//Use sqlite to run the migrations
+	_ "modernc.org/sqlite"
+)
+
+//migrations a schema of two tables and a column added later
+var migrations = []Migration{
+	{
+		Version: 1, Description: "Table a",
+		Up:   []string{"CREATE TABLE a (id INTEGER PRIMARY KEY)"},
+		Down: []string{"DROP TABLE a"},
+	},
+	{
+		Version: 2, Description: "Table b",
+		Up:   []string{"CREATE TABLE b (id INTEGER PRIMARY KEY)"},
+		Down: []string{"DROP TABLE b"},
+	},
+	{
+		Version: 3, Description: "Column name of a",
+		Up:   []string{"ALTER TABLE a ADD COLUMN name TEXT NOT NULL DEFAULT ''", "CREATE INDEX a_name ON a (name)"},
+		Down: []string{"DROP INDEX a_name", "ALTER TABLE a DROP COLUMN name"},
+	},
+}
+
+//open Opens an empty in memory database
+func open(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err.Error())
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+//exists Tells if the table exists
+func exists(t *testing.T, db *sql.DB, table string) bool {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&n); err != nil {
+		t.Fatalf("Reading the tables: %s", err.Error())
+	}
+	return n == 1
+}
+
+//version Returns the version of the schema failing the test on error
+func version(t *testing.T, m *Migrator) int {
+	v, err := m.Version()
+	if err != nil {
+		t.Fatalf("Version: %s", err.Error())
+	}
+	return v
+}
+
+func TestUpAndDown(t *testing.T) {
+	db := open(t)
+	defer db.Close()
+	m := New(db, migrations, nil, nil)
+
+	if err := m.Check(); err == nil || !strings.Contains(err.Error(), "migrate up") {
+		t.Errorf("Check on an empty schema got %v, want an error asking to migrate up", err)
+	}
+
+	if v, err := m.Up(); err != nil || v != 3 {
+		t.Fatalf("Up got %d, %v, want 3", v, err)
+	}
+	if err := m.Check(); err != nil {
+		t.Errorf("Check at the latest version: %s", err.Error())
+	}
+	if _, err := db.Exec("INSERT INTO a (id, name) VALUES (1, 'x')"); err != nil {
+		t.Errorf("the column of version 3 is missing: %s", err.Error())
+	}
+
+	// a second up has nothing to apply
+	if v, err := m.Up(); err != nil || v != 3 {
+		t.Errorf("second Up got %d, %v, want 3", v, err)
+	}
+
+	if v, err := m.Down(); err != nil || v != 2 {
+		t.Fatalf("Down got %d, %v, want 2", v, err)
+	}
+	if version(t, m) != 2 {
+		t.Errorf("the schema is at %d after Down, want 2", version(t, m))
+	}
+	if _, err := db.Exec("INSERT INTO a (id, name) VALUES (2, 'y')"); err == nil {
+		t.Error("the column of version 3 was not dropped")
+	}
+
+	if err := m.To(0); err != nil {
+		t.Fatalf("To(0): %s", err.Error())
+	}
+	if version(t, m) != 0 || exists(t, db, "a") || exists(t, db, "b") {
+		t.Error("To(0) did not revert every migration")
+	}
+	if v, err := m.Down(); err != nil || v != 0 {
+		t.Errorf("Down on an empty schema got %d, %v, want 0", v, err)
+	}
+}
+
+func TestTo(t *testing.T) {
+	db := open(t)
+	defer db.Close()
+	m := New(db, migrations, nil, nil)
+
+	if err := m.To(1); err != nil {
+		t.Fatalf("To(1): %s", err.Error())
+	}
+	if version(t, m) != 1 || !exists(t, db, "a") || exists(t, db, "b") {
+		t.Error("To(1) applied more than the first migration")
+	}
+
+	if err := m.To(4); err == nil || !strings.Contains(err.Error(), "Unknown schema version 4") {
+		t.Errorf("To(4) got %v, want an unknown version error", err)
+	}
+
+	list, err := m.Status()
+	if err != nil {
+		t.Fatalf("Status: %s", err.Error())
+	}
+	for _, st := range list {
+		if st.Applied != (st.Version == 1) || st.Applied != (st.AppliedAt != "") {
+			t.Errorf("migration %d got applied %v at %q", st.Version, st.Applied, st.AppliedAt)
+		}
+	}
+}
+
+func TestNewerSchema(t *testing.T) {
+	db := open(t)
+	defer db.Close()
+	if _, err := New(db, migrations, nil, nil).Up(); err != nil {
+		t.Fatalf("Up: %s", err.Error())
+	}
+
+	// a service that only knows the first two migrations
+	m := New(db, migrations[:2], nil, nil)
+	if err := m.Check(); err == nil || !strings.Contains(err.Error(), "upgrade the service") {
+		t.Errorf("Check got %v, want an error asking to upgrade the service", err)
+	}
+	if err := m.To(1); err == nil || !strings.Contains(err.Error(), "unknown to this service") {
+		t.Errorf("To(1) got %v, want an unknown current version error", err)
+	}
+}
+
+func TestFailedMigrationIsNotRecorded(t *testing.T) {
+	db := open(t)
+	defer db.Close()
+	broken := append([]Migration{}, migrations[:2]...)
+	broken[1].Up = []string{"CREATE TABLE b (id INTEGER PRIMARY KEY)", "CREATE TABLE a (id INTEGER PRIMARY KEY)"}
+	m := New(db, broken, nil, nil)
+
+	if _, err := m.Up(); err == nil || !strings.Contains(err.Error(), "Error in migration 2 up") {
+		t.Fatalf("Up got %v, want the error of migration 2", err)
+	}
+	if version(t, m) != 1 {
+		t.Errorf("the schema is at %d, want 1", version(t, m))
+	}
+	if exists(t, db, "b") {
+		t.Error("the first statement of the failed migration was not rolled back")
+	}
+}
+
+func TestDoneStatementsAreSkipped(t *testing.T) {
+	db := open(t)
+	defer db.Close()
+	if err := New(db, migrations, nil, nil).To(2); err != nil {
+		t.Fatalf("To(2): %s", err.Error())
+	}
+
+	// a database without transactional DDL kept the column of a migration 3 that failed on its index
+	if _, err := db.Exec("ALTER TABLE a ADD COLUMN name TEXT NOT NULL DEFAULT ''"); err != nil {
+		t.Fatalf("Adding the column: %s", err.Error())
+	}
+
+	if _, err := New(db, migrations, nil, nil).Up(); err == nil {
+		t.Fatal("Up applied the column twice")
+	}
+
+	done := func(err error) bool { return strings.Contains(err.Error(), "duplicate column name") }
+	m := New(db, migrations, nil, done)
+	if v, err := m.Up(); err != nil || v != 3 {
+		t.Fatalf("Up with done got %d, %v, want 3", v, err)
+	}
+	if version(t, m) != 3 {
+		t.Errorf("the schema is at %d, want 3", version(t, m))
+	}
+
+	// the index of the migration was created
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name='a_name'").Scan(&n); err != nil || n != 1 {
+		t.Errorf("the index of migration 3 is missing: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,370 @@
+package mysql
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/pintobikez/brazilian-correios-service/repository/migrate"
+)
+
+//the mysql errors of a DDL statement whose change is already in the schema
+const (
+	errTableExists = 1050
+	errDupColumn   = 1060
+	errDupKey      = 1061
+	errCantDrop    = 1091
+)
+
+//Migrations versioned changes of the mysql schema, a new change is always a new migration.
+//mysql commits each DDL statement, so every ALTER changes a single column or key and a migration stopped in the middle can run again.
+var Migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "Requests and their items",
+		Up: []string{
+			// the schema of the first release, a database created before the migrations is taken as this version
+			`CREATE TABLE IF NOT EXISTS request (
+			  request_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  request_type varchar(10) NOT NULL,
+			  request_service varchar(10) NOT NULL,
+			  colect_date varchar(10) NULL,
+			  order_nr int(11) unsigned NOT NULL,
+			  slip_number varchar(12) NOT NULL,
+			  origin_nome varchar(60) NOT NULL,
+			  origin_logradouro varchar(72) NOT NULL,
+			  origin_numero int(11) NOT NULL,
+			  origin_complemento varchar(30) DEFAULT NULL,
+			  origin_cep varchar(8) NOT NULL,
+			  origin_bairro varchar(80) NOT NULL,
+			  origin_cidade varchar(40) NOT NULL,
+			  origin_uf varchar(2) NOT NULL,
+			  origin_referencia varchar(60) DEFAULT NULL,
+			  origin_email varchar(72) NOT NULL,
+			  origin_ddd varchar(4) DEFAULT '',
+			  origin_telefone varchar(12) DEFAULT '',
+			  destination_nome varchar(60) NOT NULL,
+			  destination_logradouro varchar(72) NOT NULL,
+			  destination_numero int(11) NOT NULL,
+			  destination_complemento varchar(30) DEFAULT NULL,
+			  destination_cep varchar(8) NOT NULL,
+			  destination_bairro varchar(80) NOT NULL,
+			  destination_cidade varchar(40) NOT NULL,
+			  destination_uf varchar(2) NOT NULL,
+			  destination_referencia varchar(60) DEFAULT NULL,
+			  destination_email varchar(72) NOT NULL,
+			  callback varchar(255) NOT NULL,
+			  status varchar(20) NOT NULL,
+			  error_message varchar(255) DEFAULT NULL,
+			  retries int(2) DEFAULT 0,
+			  postage_code varchar(10) DEFAULT NULL,
+			  tracking_code varchar(16) DEFAULT NULL,
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  PRIMARY KEY (request_id),
+			  KEY order_nr (order_nr) USING BTREE,
+			  KEY idx_postage_code (postage_code) USING BTREE,
+			  KEY idx_created_at (created_at) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS request_item (
+			  order_item_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL,
+			  item varchar(64) NOT NULL,
+			  product_name varchar(255) NOT NULL,
+			  PRIMARY KEY (order_item_id),
+			  KEY idx_request_id (fk_request_id) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_item",
+			"DROP TABLE IF EXISTS request",
+		},
+	},
+	{
+		Version:     2,
+		Description: "Clients, callbacks, status history and tracking",
+		Up: []string{
+			"ALTER TABLE `request` ADD COLUMN client_id varchar(64) NOT NULL DEFAULT ''",
+			`CREATE TABLE IF NOT EXISTS callback_delivery (
+			  callback_delivery_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL DEFAULT 0,
+			  client_id varchar(64) NOT NULL DEFAULT '',
+			  callback_type varchar(20) NOT NULL,
+			  url varchar(255) NOT NULL,
+			  payload mediumtext NOT NULL,
+			  status varchar(20) NOT NULL,
+			  attempts int(11) NOT NULL DEFAULT 0,
+			  response_code int(11) NOT NULL DEFAULT 0,
+			  last_error varchar(255) NOT NULL DEFAULT '',
+			  next_attempt_at datetime NOT NULL,
+			  delivered_at datetime DEFAULT NULL,
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  PRIMARY KEY (callback_delivery_id),
+			  KEY idx_request_id (fk_request_id) USING BTREE,
+			  KEY idx_status_next_attempt (status,next_attempt_at) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS client (
+			  client_id varchar(64) NOT NULL,
+			  name varchar(255) NOT NULL,
+			  secret varchar(128) NOT NULL,
+			  previous_secret varchar(128) NOT NULL DEFAULT '',
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  rotated_at datetime DEFAULT NULL,
+			  PRIMARY KEY (client_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS request_status_history (
+			  status_history_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL,
+			  from_status varchar(20) NOT NULL DEFAULT '',
+			  to_status varchar(20) NOT NULL,
+			  source varchar(20) NOT NULL,
+			  description text,
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  PRIMARY KEY (status_history_id),
+			  KEY idx_request_id (fk_request_id) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS tracking_object (
+			  tracking_code varchar(16) NOT NULL,
+			  name varchar(255) NOT NULL DEFAULT '',
+			  category varchar(255) NOT NULL DEFAULT '',
+			  error varchar(255) NOT NULL DEFAULT '',
+			  refreshed_at datetime NOT NULL,
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  PRIMARY KEY (tracking_code)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS tracking_event (
+			  tracking_event_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  tracking_code varchar(16) NOT NULL,
+			  event_type varchar(10) NOT NULL,
+			  status_code varchar(10) NOT NULL,
+			  event_date varchar(16) NOT NULL,
+			  event_at datetime DEFAULT NULL,
+			  description varchar(255) NOT NULL DEFAULT '',
+			  details varchar(255) NOT NULL DEFAULT '',
+			  responsible_unit varchar(255) NOT NULL DEFAULT '',
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  PRIMARY KEY (tracking_event_id),
+			  UNIQUE KEY idx_object_event (tracking_code,event_type,status_code,event_date),
+			  KEY idx_object_event_at (tracking_code,event_at) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS tracking_subscription (
+			  subscription_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  tracking_code varchar(16) NOT NULL,
+			  callback varchar(255) NOT NULL,
+			  client_id varchar(64) NOT NULL DEFAULT '',
+			  stop_on varchar(20) NOT NULL DEFAULT '',
+			  status varchar(20) NOT NULL,
+			  ended_reason varchar(20) NOT NULL DEFAULT '',
+			  last_event_id int(11) unsigned NOT NULL DEFAULT 0,
+			  expires_at datetime NOT NULL,
+			  checked_at datetime DEFAULT NULL,
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  PRIMARY KEY (subscription_id),
+			  KEY idx_status_subscription (status,subscription_id) USING BTREE,
+			  KEY idx_tracking_code (tracking_code) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS tracking_job (
+			  job_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  status varchar(20) NOT NULL,
+			  tracking_type varchar(10) NOT NULL,
+			  language varchar(10) NOT NULL,
+			  callback varchar(255) NOT NULL DEFAULT '',
+			  client_id varchar(64) NOT NULL DEFAULT '',
+			  objects mediumtext NOT NULL,
+			  result mediumtext,
+			  error varchar(255) NOT NULL DEFAULT '',
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  finished_at datetime DEFAULT NULL,
+			  PRIMARY KEY (job_id),
+			  KEY idx_status (status) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS tracking_job",
+			"DROP TABLE IF EXISTS tracking_subscription",
+			"DROP TABLE IF EXISTS tracking_event",
+			"DROP TABLE IF EXISTS tracking_object",
+			"DROP TABLE IF EXISTS request_status_history",
+			"DROP TABLE IF EXISTS client",
+			"DROP TABLE IF EXISTS callback_delivery",
+			"ALTER TABLE `request` DROP COLUMN client_id",
+		},
+	},
+	{
+		Version:     3,
+		Description: "Reverse job queue",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS reverse_job (
+			  reverse_job_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL,
+			  action varchar(20) NOT NULL,
+			  source varchar(20) NOT NULL,
+			  status varchar(20) NOT NULL,
+			  attempts int(11) NOT NULL DEFAULT 0,
+			  lease_owner varchar(128) NOT NULL DEFAULT '',
+			  lease_until datetime DEFAULT NULL,
+			  last_error varchar(255) NOT NULL DEFAULT '',
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  PRIMARY KEY (reverse_job_id),
+			  KEY idx_request_id_status (fk_request_id,status) USING BTREE,
+			  KEY idx_status_lease_until (status,lease_until) USING BTREE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			// the requests left pending or processing before the queue existed are submitted again
+			`INSERT INTO reverse_job (fk_request_id, action, source, status, created_at)
+			  SELECT request_id, 'create', 'cron', 'pending', now() FROM request WHERE status IN ('pending', 'processing')`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS reverse_job",
+		},
+	},
+	{
+		Version:     4,
+		Description: "Cron locks",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS cron_lock (
+			  name varchar(64) NOT NULL,
+			  owner varchar(128) NOT NULL DEFAULT '',
+			  locked_until datetime NOT NULL,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  PRIMARY KEY (name)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS cron_lock",
+		},
+	},
+	{
+		Version:     5,
+		Description: "Sync marks",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS sync_mark (
+			  name varchar(64) NOT NULL,
+			  synced_until varchar(10) NOT NULL,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  PRIMARY KEY (name)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS sync_mark",
+		},
+	},
+	{
+		Version:     6,
+		Description: "Request objects and Correios history",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request_object (
+			  request_object_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL,
+			  tracking_code varchar(16) NOT NULL DEFAULT '',
+			  client_object_id varchar(64) NOT NULL DEFAULT '',
+			  status varchar(10) NOT NULL DEFAULT '',
+			  description varchar(255) NOT NULL DEFAULT '',
+			  real_weight decimal(10,3) NOT NULL DEFAULT 0,
+			  cubic_weight decimal(10,3) NOT NULL DEFAULT 0,
+			  postage_value decimal(10,2) NOT NULL DEFAULT 0,
+			  last_update varchar(19) NOT NULL DEFAULT '',
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  updated_at datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+			  PRIMARY KEY (request_object_id),
+			  UNIQUE KEY idx_request_object (fk_request_id,tracking_code)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+			`CREATE TABLE IF NOT EXISTS request_correios_history (
+			  correios_history_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL,
+			  status varchar(10) NOT NULL,
+			  description varchar(255) NOT NULL DEFAULT '',
+			  observation varchar(255) NOT NULL DEFAULT '',
+			  event_date varchar(19) NOT NULL,
+			  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+			  PRIMARY KEY (correios_history_id),
+			  UNIQUE KEY idx_request_history (fk_request_id,status,event_date)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_correios_history",
+			"DROP TABLE IF EXISTS request_object",
+		},
+	},
+	{
+		Version:     7,
+		Description: "Request packages",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request_package (
+			  request_package_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL,
+			  object_id varchar(30) NOT NULL,
+			  description varchar(255) NOT NULL DEFAULT '',
+			  coleta int(11) unsigned NOT NULL DEFAULT 0,
+			  postage_code varchar(20) NOT NULL DEFAULT '',
+			  tracking_code varchar(16) NOT NULL DEFAULT '',
+			  PRIMARY KEY (request_package_id),
+			  KEY idx_request (fk_request_id),
+			  KEY idx_postage_code (postage_code)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_package",
+		},
+	},
+	{
+		Version:     8,
+		Description: "Declared value, additional services, AR, checklist and products of the requests",
+		Up: []string{
+			"ALTER TABLE `request` ADD COLUMN declared_value decimal(10,2) NOT NULL DEFAULT 0",
+			"ALTER TABLE `request` ADD COLUMN additional_services varchar(50) NOT NULL DEFAULT ''",
+			"ALTER TABLE `request` ADD COLUMN ar tinyint(1) NOT NULL DEFAULT 0",
+			"ALTER TABLE `request` ADD COLUMN checklist varchar(20) NOT NULL DEFAULT ''",
+			"ALTER TABLE `request` ADD COLUMN documents varchar(1024) NOT NULL DEFAULT ''",
+			`CREATE TABLE IF NOT EXISTS request_product (
+			  request_product_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+			  fk_request_id int(11) unsigned NOT NULL,
+			  code varchar(20) NOT NULL,
+			  type varchar(10) NOT NULL,
+			  quantity int(11) unsigned NOT NULL DEFAULT 1,
+			  PRIMARY KEY (request_product_id),
+			  KEY idx_request (fk_request_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_product",
+			"ALTER TABLE `request` DROP COLUMN declared_value",
+			"ALTER TABLE `request` DROP COLUMN additional_services",
+			"ALTER TABLE `request` DROP COLUMN ar",
+			"ALTER TABLE `request` DROP COLUMN checklist",
+			"ALTER TABLE `request` DROP COLUMN documents",
+		},
+	},
+	{
+		Version:     9,
+		Description: "Leases of the tracking jobs",
+		Up: []string{
+			"ALTER TABLE `tracking_job` ADD COLUMN attempts int(11) unsigned NOT NULL DEFAULT 0",
+			"ALTER TABLE `tracking_job` ADD COLUMN lease_owner varchar(128) NOT NULL DEFAULT ''",
+			"ALTER TABLE `tracking_job` ADD COLUMN lease_until datetime DEFAULT NULL",
+			"ALTER TABLE `tracking_job` ADD KEY idx_status_lease_until (status,lease_until)",
+		},
+		Down: []string{
+			"ALTER TABLE `tracking_job` DROP KEY idx_status_lease_until",
+			"ALTER TABLE `tracking_job` DROP COLUMN attempts",
+			"ALTER TABLE `tracking_job` DROP COLUMN lease_owner",
+			"ALTER TABLE `tracking_job` DROP COLUMN lease_until",
+		},
+	},
+}
+
+//Migrator Returns the migrator of the mysql schema
+func (r *Client) Migrator() *migrate.Migrator {
+	return migrate.New(r.db, Migrations, nil, schemaDone)
+}
+
+//schemaDone Tells the errors of a statement whose table, column or key already exists or was already dropped
+func schemaDone(err error) bool {
+	if e, ok := err.(*mysql.MySQLError); ok {
+		switch e.Number {
+		case errTableExists, errDupColumn, errDupKey, errCantDrop:
+			return true
+		}
+	}
+	return false
+}
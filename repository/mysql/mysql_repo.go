@@ -1,21 +1,49 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	//Use mysql as main package
 	_ "github.com/go-sql-driver/mysql"
 	s "github.com/pintobikez/brazilian-correios-service/api/structures"
-	"strconv"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"time"
 )
 
-//DefaultOffset the default offset to be used in pagination
-const DefaultOffset = 50
+//requestColumns columns of the request table in the order they are scanned
+const requestColumns = "o.request_id, o.request_type, o.request_service, o.colect_date, o.order_nr, o.slip_number, o.origin_nome, o.origin_logradouro, o.origin_numero, o.origin_complemento, " +
+	"o.origin_cep, o.origin_bairro, o.origin_cidade, o.origin_uf, o.origin_referencia, o.origin_email, o.origin_ddd, o.origin_telefone, o.destination_nome, o.destination_logradouro, " +
+	"o.destination_numero, o.destination_complemento, o.destination_cep, o.destination_bairro, o.destination_cidade, o.destination_uf, o.destination_referencia, o.destination_email, " +
+	"o.callback, o.status, o.error_message, o.retries, o.postage_code, o.tracking_code, o.created_at, o.updated_at, o.client_id, o.declared_value, o.additional_services, o.ar, o.checklist, o.documents"
+
+//itemColumns columns of the request_item table in the order they are scanned
+const itemColumns = "order_item_id, fk_request_id, item, product_name"
+
+//subscriptionColumns columns of the tracking_subscription table in the order they are scanned
+const subscriptionColumns = "subscription_id, tracking_code, callback, client_id, stop_on, status, ended_reason, last_event_id, expires_at, checked_at, created_at"
+
+//callbackColumns columns of the callback_delivery table in the order they are scanned
+const callbackColumns = "callback_delivery_id, fk_request_id, client_id, callback_type, url, payload, status, attempts, response_code, last_error, next_attempt_at, delivered_at, created_at, updated_at"
+
+//reverseJobColumns columns of the reverse_job table in the order they are scanned
+const reverseJobColumns = "j.reverse_job_id, j.fk_request_id, j.action, j.source, j.status, j.attempts, j.lease_owner, j.lease_until, j.last_error, j.created_at, j.updated_at"
+
+//runnableReverseJob condition of a job that is pending or whose lease ended
+const runnableReverseJob = "(j.status=? OR (j.status=? AND j.lease_until<=?))"
+
+//trackingJobColumns columns of the tracking_job table in the order they are scanned
+const trackingJobColumns = "job_id, status, tracking_type, language, callback, client_id, objects, result, error, attempts, lease_owner, lease_until, created_at, finished_at"
+
+//runnableTrackingJob condition of a tracking job that is pending or whose lease ended
+const runnableTrackingJob = "(status=? OR (status=? AND lease_until<=?))"
 
 //Client Mysql Client handler
 type Client struct {
 	//props
 	db *sql.DB
+	tx *sql.Tx
 }
 
 //Connect Connects to the mysql database
@@ -33,84 +61,280 @@ func (r *Client) Disconnect() {
 	r.db.Close()
 }
 
-//InsertRequest Creates a PostageCode request in the database
-func (r *Client) InsertRequest(o *s.Request) error {
+//Transaction Runs fn in a transaction that is committed if fn returns nil and rolled back otherwise, a transaction started inside another one joins it
+func (r *Client) Transaction(ctx context.Context, fn func(tx repo.Definition) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error starting transaction: %s", err.Error())
+	}
+	defer func() {
+		// a panic in fn must not leave the transaction open
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&Client{db: r.db, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Error committing transaction: %s", err.Error())
+	}
+
+	return nil
+}
+
+//conn Returns the transaction of the client if it has one or the database otherwise
+func (r *Client) conn() repo.Executor {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+//InsertRequest Creates a PostageCode request and its items in the database in a single transaction
+func (r *Client) InsertRequest(ctx context.Context, o *s.Request) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).insertRequest(ctx, o)
+	})
+}
+
+//insertRequest Inserts the request and its items
+func (r *Client) insertRequest(ctx context.Context, o *s.Request) error {
 
-	stmt, err := r.db.Prepare("INSERT INTO `request` VALUES (null,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,'',0,'','',now(),now())")
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `request` (request_type, request_service, colect_date, order_nr, slip_number, origin_nome, origin_logradouro, origin_numero, origin_complemento, origin_cep, "+
+		"origin_bairro, origin_cidade, origin_uf, origin_referencia, origin_email, origin_ddd, origin_telefone, destination_nome, destination_logradouro, destination_numero, destination_complemento, "+
+		"destination_cep, destination_bairro, destination_cidade, destination_uf, destination_referencia, destination_email, callback, status, error_message, retries, postage_code, tracking_code, "+
+		"created_at, updated_at, client_id, declared_value, additional_services, ar, checklist, documents) "+
+		"VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,'',0,'','',now(),now(),?,?,?,?,?,?)")
 	if err != nil {
 		return fmt.Errorf("Error in insert request prepared statement: %s", err.Error())
 	}
+	defer stmt.Close()
 
-	res, err := stmt.Exec(o.RequestType, o.RequestService, o.ColectDate, o.OrderNr, o.SlipNumber, o.OriginNome, o.OriginLogradouro, o.OriginNumero, o.OriginComplemento, o.OriginCep, o.OriginBairro,
+	res, err := stmt.ExecContext(ctx, o.RequestType, o.RequestService, o.ColectDate, o.OrderNr, o.SlipNumber, o.OriginNome, o.OriginLogradouro, o.OriginNumero, o.OriginComplemento, o.OriginCep, o.OriginBairro,
 		o.OriginCidade, o.OriginUf, o.OriginReferencia, o.OriginEmail, o.OriginDdd, o.OriginTelefone, o.DestinationNome, o.DestinationLogradouro, o.DestinationNumero, o.DestinationComplemento,
-		o.DestinationCep, o.DestinationBairro, o.DestinationCidade, o.DestinationUf, o.DestinationReferencia, o.DestinationEmail, o.Callback, s.StatusPending)
+		o.DestinationCep, o.DestinationBairro, o.DestinationCidade, o.DestinationUf, o.DestinationReferencia, o.DestinationEmail, o.Callback, s.StatusPending, o.ClientID, o.DeclaredValue, repo.JoinList(o.AdditionalServices), o.Ar, o.Checklist, repo.JoinList(o.Documents))
 
 	if err != nil {
 		return fmt.Errorf("Error in insert request: %d %s", o.OrderNr, err.Error())
 	}
 	o.RequestID, _ = res.LastInsertId()
-	stmt.Close()
+	o.Status = s.StatusPending
 
-	// INSERT THE ITEMS NOW
-	for _, i := range o.Items {
-		stmt, err := r.db.Prepare("INSERT INTO `request_item` VALUES (null,?,?,?)")
-		if err != nil {
-			return fmt.Errorf("Error in insert request_item prepared statement: %s", err.Error())
-		}
+	return r.insertItems(ctx, o)
+}
+
+//insertItems Inserts the items of a request
+func (r *Client) insertItems(ctx context.Context, o *s.Request) error {
 
-		res, err := stmt.Exec(o.RequestID, i.Item, i.ProductName)
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `request_item` (fk_request_id, item, product_name) VALUES (?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error in insert request_item prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	for _, i := range o.Items {
+		res, err := stmt.ExecContext(ctx, o.RequestID, i.Item, i.ProductName)
 		if err != nil {
 			return fmt.Errorf("Error in insert request item: %d %s: %s", o.OrderNr, i.Item, err.Error())
 		}
 		i.RequestItemID, _ = res.LastInsertId()
+		i.FkRequestID = o.RequestID
 	}
 
-	defer stmt.Close()
-
 	return nil
 }
 
-//UpdateRequest Updates an RequestItems PostageCode
-func (r *Client) UpdateRequest(o *s.Request) error {
+//UpdateRequest Updates the data of a Request and replaces its items in a single transaction if its status is still the one in the struct,
+//a Request without items keeps the stored ones
+func (r *Client) UpdateRequest(ctx context.Context, o *s.Request) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).updateRequest(ctx, o)
+	})
+}
+
+//updateRequest Updates the data and the items of a Request
+func (r *Client) updateRequest(ctx context.Context, o *s.Request) error {
+
+	// the status is checked on the locked row, mysql does not count the rows whose data did not change as affected
+	var status string
+	err := r.conn().QueryRowContext(ctx, "SELECT status FROM `request` WHERE request_id=? FOR UPDATE", o.RequestID).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("Could not update Request %d", o.RequestID)
+	}
+	if err == sql.ErrNoRows || status != o.Status {
+		return fmt.Errorf("Could not update Request %d from %s", o.RequestID, o.Status)
+	}
 
-	stmt, err := r.db.Prepare("UPDATE `request` SET request_type=?, request_service=?, colect_date=?, origin_nome=?, origin_logradouro=?, origin_numero=?, origin_complemento=?, " +
-		"origin_cep=?, origin_bairro=?, origin_cidade=?, origin_uf=?, origin_referencia=?, origin_email=?, origin_ddd=?, origin_telefone=?, destination_nome=?, destination_logradouro=?, destination_numero=?, " +
-		"destination_complemento=?, destination_cep=?, destination_bairro=?, destination_cidade=?, destination_uf=?, destination_referencia=?," +
-		" destination_email=?, status=?, error_message=? WHERE fk_request_id=?")
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `request` SET request_type=?, request_service=?, colect_date=?, origin_nome=?, origin_logradouro=?, origin_numero=?, origin_complemento=?, "+
+		"origin_cep=?, origin_bairro=?, origin_cidade=?, origin_uf=?, origin_referencia=?, origin_email=?, origin_ddd=?, origin_telefone=?, destination_nome=?, destination_logradouro=?, destination_numero=?, "+
+		"destination_complemento=?, destination_cep=?, destination_bairro=?, destination_cidade=?, destination_uf=?, destination_referencia=?,"+
+		" destination_email=?, declared_value=?, additional_services=?, ar=?, checklist=?, documents=? WHERE request_id=? AND status=?")
 
 	if err != nil {
 		return fmt.Errorf("Error in update request prepared statement: %s", err.Error())
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(o.RequestType, o.RequestService, o.ColectDate, o.OriginNome, o.OriginLogradouro, o.OriginNumero, o.OriginComplemento, o.OriginCep, o.OriginBairro, o.OriginCidade, o.OriginUf, o.OriginReferencia, o.OriginEmail, o.OriginDdd, o.OriginTelefone,
-		o.DestinationNome, o.DestinationLogradouro, o.DestinationNumero, o.DestinationComplemento, o.DestinationCep, o.DestinationBairro, o.DestinationCidade, o.DestinationUf, o.DestinationReferencia, o.DestinationEmail,
-		o.Status, o.ErrorMessage, o.RequestID)
+	_, err = stmt.ExecContext(ctx, o.RequestType, o.RequestService, o.ColectDate, o.OriginNome, o.OriginLogradouro, o.OriginNumero, o.OriginComplemento, o.OriginCep, o.OriginBairro, o.OriginCidade, o.OriginUf, o.OriginReferencia, o.OriginEmail, o.OriginDdd, o.OriginTelefone,
+		o.DestinationNome, o.DestinationLogradouro, o.DestinationNumero, o.DestinationComplemento, o.DestinationCep, o.DestinationBairro, o.DestinationCidade, o.DestinationUf, o.DestinationReferencia, o.DestinationEmail, o.DeclaredValue, repo.JoinList(o.AdditionalServices), o.Ar, o.Checklist, repo.JoinList(o.Documents),
+		o.RequestID, o.Status)
 	if err != nil {
 		return fmt.Errorf("Could not update Request %d", o.RequestID)
 	}
 
+	if len(o.Items) == 0 {
+		return nil
+	}
+	if _, err := r.conn().ExecContext(ctx, "DELETE FROM `request_item` WHERE fk_request_id=?", o.RequestID); err != nil {
+		return fmt.Errorf("Could not replace the items of Request %d", o.RequestID)
+	}
+
+	return r.insertItems(ctx, o)
+}
+
+//SaveRequestPackages Replaces the packages of a Request in a single transaction
+func (r *Client) SaveRequestPackages(ctx context.Context, requestID int64, packages []*s.RequestPackage) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).saveRequestPackages(ctx, requestID, packages)
+	})
+}
+
+//saveRequestPackages Replaces the packages of a Request
+func (r *Client) saveRequestPackages(ctx context.Context, requestID int64, packages []*s.RequestPackage) error {
+
+	if _, err := r.conn().ExecContext(ctx, "DELETE FROM `request_package` WHERE fk_request_id=?", requestID); err != nil {
+		return fmt.Errorf("Could not replace the packages of Request %d", requestID)
+	}
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `request_package` (fk_request_id, object_id, description, coleta, postage_code, tracking_code) VALUES (?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error in insert request_package prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	for _, p := range packages {
+		res, err := stmt.ExecContext(ctx, requestID, p.ObjectID, truncate(p.Description, 255), p.Coleta, p.PostageCode, p.TrackingCode)
+		if err != nil {
+			return fmt.Errorf("Error in insert request package: %d %s: %s", requestID, p.ObjectID, err.Error())
+		}
+		p.RequestPackageID, _ = res.LastInsertId()
+		p.FkRequestID = requestID
+	}
+
+	return nil
+}
+
+//GetRequestPackages Gets the packages of a Request by coleta
+func (r *Client) GetRequestPackages(ctx context.Context, requestID int64) ([]*s.RequestPackage, error) {
+	resp := make([]*s.RequestPackage, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT request_package_id, fk_request_id, object_id, description, coleta, postage_code, tracking_code FROM `request_package` WHERE fk_request_id=? ORDER BY coleta, request_package_id", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := new(s.RequestPackage)
+		if err := rows.Scan(&p.RequestPackageID, &p.FkRequestID, &p.ObjectID, &p.Description, &p.Coleta, &p.PostageCode, &p.TrackingCode); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, p)
+	}
+
+	return resp, rows.Err()
+}
+
+//UpdateRequestPackage Stores the codes given by Correios to a package
+func (r *Client) UpdateRequestPackage(ctx context.Context, p *s.RequestPackage) error {
+
+	if _, err := r.conn().ExecContext(ctx, "UPDATE `request_package` SET postage_code=?, tracking_code=? WHERE request_package_id=?", p.PostageCode, p.TrackingCode, p.RequestPackageID); err != nil {
+		return fmt.Errorf("Could not update package %s of Request %d: %s", p.ObjectID, p.FkRequestID, err.Error())
+	}
+
+	return nil
+}
+
+//SaveRequestProducts Replaces the products of a Request in a single transaction
+func (r *Client) SaveRequestProducts(ctx context.Context, requestID int64, products []*s.RequestProduct) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).saveRequestProducts(ctx, requestID, products)
+	})
+}
+
+//saveRequestProducts Replaces the products of a Request
+func (r *Client) saveRequestProducts(ctx context.Context, requestID int64, products []*s.RequestProduct) error {
+
+	if _, err := r.conn().ExecContext(ctx, "DELETE FROM `request_product` WHERE fk_request_id=?", requestID); err != nil {
+		return fmt.Errorf("Could not replace the products of Request %d", requestID)
+	}
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `request_product` (fk_request_id, code, type, quantity) VALUES (?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error in insert request_product prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	for _, p := range products {
+		res, err := stmt.ExecContext(ctx, requestID, p.Code, p.Type, p.Quantity)
+		if err != nil {
+			return fmt.Errorf("Error in insert request product: %d %s: %s", requestID, p.Code, err.Error())
+		}
+		p.RequestProductID, _ = res.LastInsertId()
+		p.FkRequestID = requestID
+	}
+
 	return nil
 }
 
-//UpdateRequestStatus Updates an RequestItems status
-func (r *Client) UpdateRequestStatus(o *s.Request, status string, message string) (int64, error) {
+//GetRequestProducts Gets the products of a Request
+func (r *Client) GetRequestProducts(ctx context.Context, requestID int64) ([]*s.RequestProduct, error) {
+	resp := make([]*s.RequestProduct, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT request_product_id, fk_request_id, code, type, quantity FROM `request_product` WHERE fk_request_id=? ORDER BY request_product_id", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := new(s.RequestProduct)
+		if err := rows.Scan(&p.RequestProductID, &p.FkRequestID, &p.Code, &p.Type, &p.Quantity); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, p)
+	}
+
+	return resp, rows.Err()
+}
+
+//UpdateRequestStatus Updates the status of a Request if it is still the one in the struct
+func (r *Client) UpdateRequestStatus(ctx context.Context, o *s.Request, status string, message string) (int64, error) {
 
-	stmt, err := r.db.Prepare("UPDATE `request` SET retries=?, status=?, error_message=? WHERE request_id=?")
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `request` SET retries=?, status=?, error_message=? WHERE request_id=? AND status=?")
 	if err != nil {
 		return 0, fmt.Errorf("Error in update status prepared statement: %s", err.Error())
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(o.Retries, status, message, o.RequestID)
+	res, err := stmt.ExecContext(ctx, o.Retries, status, message, o.RequestID, o.Status)
 
 	if err != nil {
 		return 0, fmt.Errorf("Could not update status for Request %d", o.RequestID)
 	}
 
 	affect, err := res.RowsAffected()
-	if err != nil {
-		return 0, fmt.Errorf("Could not update status for Request %d", o.RequestID)
+	if err != nil || affect <= 0 {
+		return 0, fmt.Errorf("Could not update status for Request %d from %s", o.RequestID, o.Status)
 	}
 
 	//update struct
@@ -121,15 +345,15 @@ func (r *Client) UpdateRequestStatus(o *s.Request, status string, message string
 }
 
 //UpdateRequestPostage Updates an RequestItems PostageCode
-func (r *Client) UpdateRequestPostage(o *s.Request, code string) error {
+func (r *Client) UpdateRequestPostage(ctx context.Context, o *s.Request, code string) error {
 
-	stmt, err := r.db.Prepare("UPDATE `request` SET postage_code=?,status=? WHERE request_id=?")
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `request` SET postage_code=?,status=? WHERE request_id=? AND status=?")
 	if err != nil {
 		return fmt.Errorf("Error in update postage code prepared statement: %s", err.Error())
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(code, s.StatusGenerated, o.RequestID)
+	res, err := stmt.ExecContext(ctx, code, s.StatusGenerated, o.RequestID, o.Status)
 
 	if err != nil {
 		return fmt.Errorf("Could not update postage code for Request %d", o.RequestID)
@@ -147,45 +371,38 @@ func (r *Client) UpdateRequestPostage(o *s.Request, code string) error {
 	return nil
 }
 
-//UpdateRequestTracking Updates an RequestItems PostageCode
-func (r *Client) UpdateRequestTracking(o *s.Request, code string) error {
+//UpdateRequestTracking Updates an RequestItems TrackingCode
+func (r *Client) UpdateRequestTracking(ctx context.Context, o *s.Request, code string) error {
 
-	stmt, err := r.db.Prepare("UPDATE `request` SET tracking_code=?,status=? WHERE request_id=?")
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `request` SET tracking_code=?,status=? WHERE request_id=? AND status=?")
 	if err != nil {
-		return fmt.Errorf("Error in update postage code prepared statement: %s", err.Error())
+		return fmt.Errorf("Error in update tracking code prepared statement: %s", err.Error())
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(code, s.StatusUsed, o.RequestID)
+	res, err := stmt.ExecContext(ctx, code, s.StatusUsed, o.RequestID, o.Status)
 
 	if err != nil {
-		return fmt.Errorf("Could not update postage code for Request %d", o.RequestID)
+		return fmt.Errorf("Could not update tracking code for Request %d", o.RequestID)
 	}
 
 	affect, err := res.RowsAffected()
 	if err != nil || affect <= 0 {
-		return fmt.Errorf("Could not update postage code for Request %d", o.RequestID)
+		return fmt.Errorf("Could not update tracking code for Request %d", o.RequestID)
 	}
 
 	//update struct
-	o.PostageCode = code
+	o.TrackingCode = code
 	o.Status = s.StatusUsed
 
 	return nil
 }
 
 //FindRequestByID Finds Request by RequestID
-func (r *Client) FindRequestByID(requestID int64) (bool, error) {
+func (r *Client) FindRequestByID(ctx context.Context, requestID int64) (bool, error) {
 	exists := false
 
-	rows, err := r.db.Query("SELECT EXISTS(SELECT * as counter FROM `request` request_id=?) as exist", requestID)
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-
-	err = rows.Scan(&exists)
-	if err != nil {
+	if err := r.conn().QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM `request` WHERE request_id=?)", requestID).Scan(&exists); err != nil {
 		return false, err
 	}
 
@@ -193,169 +410,915 @@ func (r *Client) FindRequestByID(requestID int64) (bool, error) {
 }
 
 //GetRequestByID Gets Request info by RequestID
-func (r *Client) GetRequestByID(requestID int) (*s.Request, error) {
+func (r *Client) GetRequestByID(ctx context.Context, requestID int) (*s.Request, error) {
 	var resp = new(s.Request)
 
-	rows, err := r.db.Query("SELECT * FROM `request` as o INNER JOIN `request_item` as items on items.fk_request_id=o.request_id WHERE o.request_id=?", requestID)
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+requestColumns+" FROM `request` as o WHERE o.request_id=?", requestID)
 	if err != nil {
 		return resp, err
 	}
 	defer rows.Close()
 
-	err = r.processRows(resp, rows)
-	if err != nil {
+	reqs, err := r.processRows(ctx, rows)
+	if err != nil || len(reqs) == 0 {
 		return resp, err
 	}
 
-	return resp, nil
+	return reqs[0], nil
 }
 
 //GetRequestByPostageCode Gets Request info by PostageCode
-func (r *Client) GetRequestByPostageCode(code string) (*s.Request, error) {
+func (r *Client) GetRequestByPostageCode(ctx context.Context, code string) (*s.Request, error) {
 	var resp = new(s.Request)
 
-	rows, err := r.db.Query("SELECT * FROM `request` as o INNER JOIN `request_item` as oi on oi.fk_request_id=o.request_id WHERE oi.postage_code=?", code)
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+requestColumns+" FROM `request` as o WHERE o.postage_code=? OR o.request_id IN (SELECT fk_request_id FROM `request_package` WHERE postage_code=?) ORDER BY o.request_id LIMIT 1", code, code)
 	if err != nil {
 		return resp, err
 	}
 	defer rows.Close()
 
-	err = r.processRows(resp, rows)
-	if err != nil {
+	reqs, err := r.processRows(ctx, rows)
+	if err != nil || len(reqs) == 0 {
 		return resp, err
 	}
 
-	return resp, nil
+	return reqs[0], nil
 }
 
-//GetRequestBy Gets Request info by ?
-func (r *Client) GetRequestBy(req *s.Search) ([]*s.Request, error) {
+//GetRequestBy Gets Request info by the given search, the pagination applies to the requests
+func (r *Client) GetRequestBy(ctx context.Context, req *s.Search) ([]*s.Request, error) {
 	var resp = []*s.Request{}
 
-	query := "SELECT * FROM `request` as o INNER JOIN `request_item` as items on items.fk_request_id=o.request_id %s ORDER BY %s %s LIMIT %d,%d"
-	q := ""
+	q, err := repo.BuildSearch(req)
+	if err != nil {
+		return resp, err
+	}
 
-	if len(req.Where) > 0 {
-		for _, e := range req.Where {
-			if e.Operator == "LIKE" {
-				e.Value = "%" + e.Value + "%"
-			}
-			if e.Operator == "IN" || e.Operator == "NOT IN" {
-				e.Value = "(" + e.Value + ")"
-			}
+	query := fmt.Sprintf("SELECT "+requestColumns+" FROM `request` as o %s %s LIMIT ?,?", q.Where, q.OrderBy)
+	args := append(q.Args, req.From, req.Offset)
 
-			// build the where bits
-			if e.Field != "" && e.Value != "" && e.Operator != "" {
-				// check if search value is not int
-				if _, err := strconv.Atoi(e.Value); err != nil {
-					e.Value = "'" + e.Value + "'"
-				}
-
-				if q == "" {
-					q = "WHERE " + e.Field + " " + e.Operator + " " + e.Value
-				} else {
-					j := "AND"
-					if e.JoinBy != "" {
-						j = e.JoinBy
-					}
-					q += " " + j + " " + e.Field + " " + e.Operator + " " + e.Value
-				}
-			}
-		}
+	rows, err := r.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return resp, err
 	}
+	defer rows.Close()
 
-	// set the default order field
-	if req.OrderField == "" {
-		req.OrderField = "request_id"
+	resp, err = r.processRows(ctx, rows)
+	if err != nil {
+		return resp, err
 	}
 
-	// set the default order value
-	if req.OrderType == "" {
-		req.OrderType = "DESC"
+	return resp, nil
+}
+
+//InsertCallbackDelivery Writes a callback to the outbox
+func (r *Client) InsertCallbackDelivery(ctx context.Context, d *s.CallbackDelivery) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `callback_delivery` (fk_request_id, client_id, callback_type, url, payload, status, attempts, next_attempt_at, created_at) VALUES (?,?,?,?,?,?,0,?,now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert callback delivery prepared statement: %s", err.Error())
 	}
+	defer stmt.Close()
 
-	// set the default offset
-	if req.Offset == 0 {
-		req.Offset = DefaultOffset
+	res, err := stmt.ExecContext(ctx, d.RequestID, d.ClientID, d.Type, d.URL, d.Payload, s.CallbackPending, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("Error in insert callback delivery for Request %d: %s", d.RequestID, err.Error())
 	}
 
-	query = fmt.Sprintf(query, q, req.OrderField, req.OrderType, req.From, req.Offset)
-	rows, err := r.db.Query(query)
+	d.CallbackDeliveryID, _ = res.LastInsertId()
+	d.Status = s.CallbackPending
+
+	return nil
+}
 
+//GetCallbackDeliveryByID Gets a callback delivery by its ID
+func (r *Client) GetCallbackDeliveryByID(ctx context.Context, deliveryID int64) (*s.CallbackDelivery, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+callbackColumns+" FROM `callback_delivery` WHERE callback_delivery_id=?", deliveryID)
 	if err != nil {
-		return resp, err
+		return nil, err
 	}
 	defer rows.Close()
 
-	resp, err = r.processMultipleRows(resp, rows)
+	resp, err := r.processCallbackRows(rows)
 	if err != nil {
-		return resp, err
+		return nil, err
+	}
+	if len(resp) == 0 {
+		return new(s.CallbackDelivery), nil
 	}
 
-	return resp, nil
+	return resp[0], nil
 }
 
-//processRows Processes a Row result into a Request struct
-func (r *Client) processRows(resp *s.Request, rows *sql.Rows) error {
-	var arr []*s.RequestItem
+//GetCallbackDeliveriesByRequestID Gets the callback deliveries of a Request
+func (r *Client) GetCallbackDeliveriesByRequestID(ctx context.Context, requestID int64) ([]*s.CallbackDelivery, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+callbackColumns+" FROM `callback_delivery` WHERE fk_request_id=? ORDER BY callback_delivery_id ASC", requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processCallbackRows(rows)
+}
 
-	for rows.Next() {
-		aux := new(s.RequestItem)
+//GetPendingCallbackDeliveries Gets the pending callback deliveries that must be attempted until the given time
+func (r *Client) GetPendingCallbackDeliveries(ctx context.Context, until time.Time, limit int) ([]*s.CallbackDelivery, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+callbackColumns+" FROM `callback_delivery` WHERE status=? AND next_attempt_at<=? ORDER BY next_attempt_at ASC, callback_delivery_id ASC LIMIT ?", s.CallbackPending, until.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processCallbackRows(rows)
+}
 
-		err := rows.Scan(&resp.RequestID, &resp.RequestType, &resp.RequestService, &resp.ColectDate, &resp.OrderNr, &resp.SlipNumber, &resp.OriginNome, &resp.OriginLogradouro, &resp.OriginNumero, &resp.OriginComplemento, &resp.OriginCep, &resp.OriginBairro, &resp.OriginCidade,
-			&resp.OriginUf, &resp.OriginReferencia, &resp.OriginEmail, &resp.OriginDdd, &resp.OriginTelefone, &resp.DestinationNome, &resp.DestinationLogradouro, &resp.DestinationNumero, &resp.DestinationComplemento,
-			&resp.DestinationCep, &resp.DestinationBairro, &resp.DestinationCidade, &resp.DestinationUf, &resp.DestinationReferencia, &resp.DestinationEmail, &resp.Callback, &resp.Status, &resp.ErrorMessage,
-			&resp.Retries, &resp.PostageCode, &resp.TrackingCode, &resp.CreatedAt, &resp.UpdatedAt, &aux.RequestItemID, &aux.FkRequestID, &aux.Item, &aux.ProductName)
+//UpdateCallbackDelivery Updates the delivery state of a callback
+func (r *Client) UpdateCallbackDelivery(ctx context.Context, d *s.CallbackDelivery, nextAttempt time.Time) error {
 
-		if err != nil {
-			return fmt.Errorf("Error reading rows: %s", err.Error())
-		}
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `callback_delivery` SET status=?, attempts=?, response_code=?, last_error=?, next_attempt_at=?, delivered_at=COALESCE(?, delivered_at) WHERE callback_delivery_id=?")
+	if err != nil {
+		return fmt.Errorf("Error in update callback delivery prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	var delivered interface{}
+	if d.Status == s.CallbackDelivered {
+		delivered = time.Now().UTC()
+	}
+
+	if _, err := stmt.ExecContext(ctx, d.Status, d.Attempts, d.ResponseCode, truncate(d.LastError, 255), nextAttempt.UTC(), delivered, d.CallbackDeliveryID); err != nil {
+		return fmt.Errorf("Could not update callback delivery %d", d.CallbackDeliveryID)
+	}
+
+	return nil
+}
+
+//InsertClient Registers a client with its secret
+func (r *Client) InsertClient(ctx context.Context, c *s.Client) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `client` (client_id, name, secret, previous_secret, created_at) VALUES (?,?,?,'',now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert client prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
 
-		arr = append(arr, aux)
-		resp.Items = arr
+	if _, err := stmt.ExecContext(ctx, c.ClientID, c.Name, c.Secret); err != nil {
+		return fmt.Errorf("Error in insert client %s: %s", c.ClientID, err.Error())
 	}
 
 	return nil
 }
 
-//processMultipleRows Processes a Row result into a Request struct
-func (r *Client) processMultipleRows(resp []*s.Request, rows *sql.Rows) ([]*s.Request, error) {
-	var (
-		arr    []*s.RequestItem
-		prevID int64
-	)
+//GetClientByID Gets a client and its secrets by its ID
+func (r *Client) GetClientByID(ctx context.Context, clientID string) (*s.Client, error) {
+	resp := new(s.Client)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT client_id, name, secret, previous_secret, created_at, rotated_at FROM `client` WHERE client_id=?", clientID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
 
 	for rows.Next() {
-		req := new(s.Request)
-		aux := new(s.RequestItem)
+		var rotatedAt sql.NullString
+		if err := rows.Scan(&resp.ClientID, &resp.Name, &resp.Secret, &resp.PreviousSecret, &resp.CreatedAt, &rotatedAt); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp.RotatedAt = rotatedAt.String
+	}
 
-		err := rows.Scan(&req.RequestID, &req.RequestType, &req.RequestService, &req.ColectDate, &req.OrderNr, &req.SlipNumber, &req.OriginNome, &req.OriginLogradouro, &req.OriginNumero, &req.OriginComplemento, &req.OriginCep, &req.OriginBairro, &req.OriginCidade,
-			&req.OriginUf, &req.OriginReferencia, &req.OriginEmail, &req.OriginDdd, &req.OriginTelefone, &req.DestinationNome, &req.DestinationLogradouro, &req.DestinationNumero, &req.DestinationComplemento,
-			&req.DestinationCep, &req.DestinationBairro, &req.DestinationCidade, &req.DestinationUf, &req.DestinationReferencia, &req.DestinationEmail, &req.Callback, &req.Status, &req.ErrorMessage,
-			&req.Retries, &req.PostageCode, &req.TrackingCode, &req.CreatedAt, &req.UpdatedAt, &aux.RequestItemID, &aux.FkRequestID, &aux.Item, &aux.ProductName)
+	return resp, rows.Err()
+}
 
-		if err != nil {
+//UpdateClientSecrets Updates the active secrets of a client
+func (r *Client) UpdateClientSecrets(ctx context.Context, c *s.Client) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `client` SET secret=?, previous_secret=?, rotated_at=now() WHERE client_id=?")
+	if err != nil {
+		return fmt.Errorf("Error in update client prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, c.Secret, c.PreviousSecret, c.ClientID)
+	if err != nil {
+		return fmt.Errorf("Could not update secrets of client %s", c.ClientID)
+	}
+
+	affect, err := res.RowsAffected()
+	if err != nil || affect <= 0 {
+		return fmt.Errorf("Could not update secrets of client %s", c.ClientID)
+	}
+
+	return nil
+}
+
+//InsertStatusHistory Records a status change of a Request
+func (r *Client) InsertStatusHistory(ctx context.Context, h *s.StatusHistory) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `request_status_history` (fk_request_id, from_status, to_status, source, description, created_at) VALUES (?,?,?,?,?,now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert status history prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, h.RequestID, h.FromStatus, h.ToStatus, h.Source, h.Description)
+	if err != nil {
+		return fmt.Errorf("Error in insert status history for Request %d: %s", h.RequestID, err.Error())
+	}
+	h.StatusHistoryID, _ = res.LastInsertId()
+
+	return nil
+}
+
+//GetStatusHistoryByRequestID Gets the status changes of a Request from the oldest to the newest
+func (r *Client) GetStatusHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.StatusHistory, error) {
+	resp := make([]*s.StatusHistory, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT status_history_id, fk_request_id, from_status, to_status, source, description, created_at FROM `request_status_history` WHERE fk_request_id=? ORDER BY status_history_id ASC", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := new(s.StatusHistory)
+		var description sql.NullString
+		if err := rows.Scan(&h.StatusHistoryID, &h.RequestID, &h.FromStatus, &h.ToStatus, &h.Source, &description, &h.CreatedAt); err != nil {
 			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
 		}
+		h.Description = description.String
+		resp = append(resp, h)
+	}
+
+	return resp, rows.Err()
+}
+
+//SaveTrackingObject Stores a tracking object and the events that are not stored yet
+func (r *Client) SaveTrackingObject(ctx context.Context, t *s.TrackingHeader) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `tracking_object` (tracking_code, name, category, error, refreshed_at, created_at) VALUES (?,?,?,?,?,now()) "+
+		"ON DUPLICATE KEY UPDATE name=IF(VALUES(error)='', VALUES(name), name), category=IF(VALUES(error)='', VALUES(category), category), error=VALUES(error), refreshed_at=VALUES(refreshed_at)")
+	if err != nil {
+		return fmt.Errorf("Error in save tracking object prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.ExecContext(ctx, t.Object, t.Name, t.Category, t.Error, time.Now().UTC()); err != nil {
+		return fmt.Errorf("Error in save tracking object %s: %s", t.Object, err.Error())
+	}
+
+	if len(t.Events) == 0 {
+		return nil
+	}
+
+	// the events already stored with the same type, status and date are ignored
+	evStmt, err := r.conn().PrepareContext(ctx, "INSERT IGNORE INTO `tracking_event` (tracking_code, event_type, status_code, event_date, event_at, description, details, responsible_unit, created_at) VALUES (?,?,?,?,?,?,?,?,now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking event prepared statement: %s", err.Error())
+	}
+	defer evStmt.Close()
+
+	for _, ev := range t.Events {
+		var eventAt interface{}
+		if at, err := time.Parse("02/01/2006 15:04", ev.DateTime); err == nil {
+			eventAt = at
+		}
 
-		// new element
-		if prevID != req.RequestID {
-			//cleanup the items array
-			var arr = []*s.RequestItem{}
-			arr = append(arr, aux)
-			req.Items = arr
-			//append the item
-			resp = append(resp, req)
+		if _, err := evStmt.ExecContext(ctx, t.Object, ev.Type, ev.StatusCode, ev.DateTime, eventAt, truncate(ev.Description, 255), truncate(ev.Details, 255), truncate(ev.CTECorreios, 255)); err != nil {
+			return fmt.Errorf("Error in insert tracking event of %s: %s", t.Object, err.Error())
 		}
-		if prevID == req.RequestID {
-			//append the items to the previous item
-			l := len(resp)
-			arr = resp[l-1].Items
-			resp[l-1].Items = append(arr, aux)
+	}
+
+	return nil
+}
+
+//SaveCorreiosFollow Stores the objects of a Request as replied by Correios and the statuses of its history that are not stored yet
+func (r *Client) SaveCorreiosFollow(ctx context.Context, requestID int64, objects []*s.RequestObject, history []*s.CorreiosHistory) error {
+
+	if len(objects) > 0 {
+		stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `request_object` (fk_request_id, tracking_code, client_object_id, status, description, real_weight, cubic_weight, postage_value, last_update, created_at) VALUES (?,?,?,?,?,?,?,?,?,now()) "+
+			"ON DUPLICATE KEY UPDATE status=VALUES(status), description=VALUES(description), real_weight=VALUES(real_weight), cubic_weight=VALUES(cubic_weight), postage_value=VALUES(postage_value), last_update=VALUES(last_update), client_object_id=VALUES(client_object_id)")
+		if err != nil {
+			return fmt.Errorf("Error in save request object prepared statement: %s", err.Error())
 		}
+		defer stmt.Close()
 
-		prevID = req.RequestID
+		for _, o := range objects {
+			o.FkRequestID = requestID
+			if _, err := stmt.ExecContext(ctx, requestID, o.TrackingCode, o.ClientObjectID, o.Status, truncate(o.Description, 255), o.RealWeight, o.CubicWeight, o.PostageValue, o.LastUpdate); err != nil {
+				return fmt.Errorf("Error in save object %s of Request %d: %s", o.TrackingCode, requestID, err.Error())
+			}
+		}
 	}
 
-	return resp, nil
+	if len(history) == 0 {
+		return nil
+	}
+
+	// the statuses already stored with the same date are ignored
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT IGNORE INTO `request_correios_history` (fk_request_id, status, description, observation, event_date, created_at) VALUES (?,?,?,?,?,now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert correios history prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	for _, h := range history {
+		if _, err := stmt.ExecContext(ctx, requestID, h.Status, truncate(h.Description, 255), truncate(h.Observation, 255), h.Date); err != nil {
+			return fmt.Errorf("Error in insert correios history of Request %d: %s", requestID, err.Error())
+		}
+	}
+
+	return nil
+}
+
+//GetRequestObjects Gets the objects of a Request as last replied by Correios
+func (r *Client) GetRequestObjects(ctx context.Context, requestID int64) ([]*s.RequestObject, error) {
+	resp := make([]*s.RequestObject, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT request_object_id, fk_request_id, tracking_code, client_object_id, status, description, real_weight, cubic_weight, postage_value, last_update FROM `request_object` WHERE fk_request_id=? ORDER BY request_object_id ASC", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o := new(s.RequestObject)
+		if err := rows.Scan(&o.RequestObjectID, &o.FkRequestID, &o.TrackingCode, &o.ClientObjectID, &o.Status, &o.Description, &o.RealWeight, &o.CubicWeight, &o.PostageValue, &o.LastUpdate); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, o)
+	}
+
+	return resp, rows.Err()
+}
+
+//GetCorreiosHistoryByRequestID Gets the statuses of a Request in Correios in the order they were stored
+func (r *Client) GetCorreiosHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.CorreiosHistory, error) {
+	resp := make([]*s.CorreiosHistory, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT status, description, observation, event_date FROM `request_correios_history` WHERE fk_request_id=? ORDER BY correios_history_id ASC", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := new(s.CorreiosHistory)
+		if err := rows.Scan(&h.Status, &h.Description, &h.Observation, &h.Date); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, h)
+	}
+
+	return resp, rows.Err()
+}
+
+//GetTrackingObject Gets a stored tracking object with its events from the newest to the oldest, returns true if it was refreshed after freshSince
+func (r *Client) GetTrackingObject(ctx context.Context, code string, freshSince time.Time) (*s.TrackingHeader, bool, error) {
+	resp := new(s.TrackingHeader)
+	fresh := false
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT tracking_code, name, category, error, refreshed_at, refreshed_at>=? FROM `tracking_object` WHERE tracking_code=?", freshSince.UTC(), code)
+	if err != nil {
+		return resp, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&resp.Object, &resp.Name, &resp.Category, &resp.Error, &resp.RefreshedAt, &fresh); err != nil {
+			return resp, false, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+	}
+	if err := rows.Err(); err != nil || resp.Object == "" {
+		return resp, false, err
+	}
+
+	evRows, err := r.conn().QueryContext(ctx, "SELECT event_type, status_code, event_date, description, details, responsible_unit FROM `tracking_event` WHERE tracking_code=? ORDER BY event_at DESC, tracking_event_id DESC", code)
+	if err != nil {
+		return resp, false, err
+	}
+	defer evRows.Close()
+
+	resp.Events = make([]*s.TrackingEvents, 0)
+	for evRows.Next() {
+		ev := new(s.TrackingEvents)
+		if err := evRows.Scan(&ev.Type, &ev.StatusCode, &ev.DateTime, &ev.Description, &ev.Details, &ev.CTECorreios); err != nil {
+			return resp, false, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp.Events = append(resp.Events, ev)
+	}
+
+	return resp, fresh, evRows.Err()
+}
+
+//GetTrackingEventsAfter Gets the events of an object stored after the given event, newest first, and the ID of the last stored event
+func (r *Client) GetTrackingEventsAfter(ctx context.Context, code string, eventID int64) ([]*s.TrackingEvents, int64, error) {
+	resp := make([]*s.TrackingEvents, 0)
+	lastID := eventID
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT tracking_event_id, event_type, status_code, event_date, description, details, responsible_unit FROM `tracking_event` WHERE tracking_code=? AND tracking_event_id>? ORDER BY event_at DESC, tracking_event_id DESC", code, eventID)
+	if err != nil {
+		return resp, lastID, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		ev := new(s.TrackingEvents)
+		if err := rows.Scan(&id, &ev.Type, &ev.StatusCode, &ev.DateTime, &ev.Description, &ev.Details, &ev.CTECorreios); err != nil {
+			return resp, eventID, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		if id > lastID {
+			lastID = id
+		}
+		resp = append(resp, ev)
+	}
+
+	return resp, lastID, rows.Err()
+}
+
+//InsertTrackingJob Creates a tracking job with its objects
+func (r *Client) InsertTrackingJob(ctx context.Context, j *s.TrackingJob) error {
+
+	objects, err := json.Marshal(j.Objects)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `tracking_job` (status, tracking_type, language, callback, client_id, objects, created_at) VALUES (?,?,?,?,?,?,now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking job prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, s.JobPending, j.TrackingType, j.Language, j.Callback, j.ClientID, string(objects))
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking job: %s", err.Error())
+	}
+	j.JobID, _ = res.LastInsertId()
+	j.Status = s.JobPending
+	j.Attempts = 0
+	j.LeaseOwner = ""
+	j.LeaseUntil = ""
+
+	return nil
+}
+
+//GetTrackingJobByID Gets a tracking job and its result by its ID
+func (r *Client) GetTrackingJobByID(ctx context.Context, jobID int64) (*s.TrackingJob, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+trackingJobColumns+" FROM `tracking_job` WHERE job_id=?", jobID)
+	if err != nil {
+		return new(s.TrackingJob), err
+	}
+	defer rows.Close()
+
+	jobs, err := r.processTrackingJobRows(rows)
+	if err != nil || len(jobs) == 0 {
+		return new(s.TrackingJob), err
+	}
+
+	return jobs[0], nil
+}
+
+//UpdateTrackingJob Updates the status and the result of a tracking job
+func (r *Client) UpdateTrackingJob(ctx context.Context, j *s.TrackingJob) error {
+
+	var result interface{}
+	if j.Result != nil {
+		b, err := json.Marshal(j.Result)
+		if err != nil {
+			return err
+		}
+		result = string(b)
+	}
+
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `tracking_job` SET status=?, result=?, error=?, finished_at=IF(? IN (?,?), now(), NULL) WHERE job_id=?")
+	if err != nil {
+		return fmt.Errorf("Error in update tracking job prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.ExecContext(ctx, j.Status, result, truncate(j.Error, 255), j.Status, s.JobDone, s.JobFailed, j.JobID); err != nil {
+		return fmt.Errorf("Could not update tracking job %d", j.JobID)
+	}
+
+	return nil
+}
+
+//GetRunnableTrackingJobs Gets the pending tracking jobs and the running ones whose lease ended before now
+func (r *Client) GetRunnableTrackingJobs(ctx context.Context, now time.Time, limit int) ([]*s.TrackingJob, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+trackingJobColumns+" FROM `tracking_job` WHERE "+runnableTrackingJob+" ORDER BY job_id ASC LIMIT ?", s.JobPending, s.JobRunning, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processTrackingJobRows(rows)
+}
+
+//ClaimTrackingJob Takes the lease of a runnable tracking job until the given time and counts the attempt, returns false if the job is not runnable
+func (r *Client) ClaimTrackingJob(ctx context.Context, j *s.TrackingJob, owner string, until time.Time) (bool, error) {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE `tracking_job` SET status=?, attempts=attempts+1, lease_owner=?, lease_until=? WHERE job_id=? AND "+runnableTrackingJob,
+		s.JobRunning, owner, until.UTC(), j.JobID, s.JobPending, s.JobRunning, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("Could not claim tracking job %d: %s", j.JobID, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if err := r.conn().QueryRowContext(ctx, "SELECT attempts FROM `tracking_job` WHERE job_id=?", j.JobID).Scan(&j.Attempts); err != nil {
+		return false, fmt.Errorf("Could not claim tracking job %d: %s", j.JobID, err.Error())
+	}
+	j.Status = s.JobRunning
+	j.LeaseOwner = owner
+	j.LeaseUntil = until.UTC().Format("2006-01-02 15:04:05")
+
+	return true, nil
+}
+
+//InsertReverseJob Queues a call to the reverse logistics service of a Request
+func (r *Client) InsertReverseJob(ctx context.Context, j *s.ReverseJob) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `reverse_job` (fk_request_id, action, source, status, attempts, created_at) VALUES (?,?,?,?,0,now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert reverse job prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, j.RequestID, j.Action, j.Source, s.JobPending)
+	if err != nil {
+		return fmt.Errorf("Error in insert reverse job for Request %d: %s", j.RequestID, err.Error())
+	}
+	j.ReverseJobID, _ = res.LastInsertId()
+	j.Status = s.JobPending
+	j.Attempts = 0
+	j.LeaseOwner = ""
+	j.LeaseUntil = ""
+	j.LastError = ""
+
+	return nil
+}
+
+//GetReverseJobsByRequestID Gets the reverse jobs of a Request
+func (r *Client) GetReverseJobsByRequestID(ctx context.Context, requestID int64) ([]*s.ReverseJob, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+reverseJobColumns+" FROM `reverse_job` j WHERE j.fk_request_id=? ORDER BY j.reverse_job_id ASC", requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processReverseJobRows(rows)
+}
+
+//GetRunnableReverseJobs Gets the pending jobs and the running ones whose lease ended before now,
+//a job is only runnable when the jobs queued before it for the same Request are finished
+func (r *Client) GetRunnableReverseJobs(ctx context.Context, now time.Time, limit int) ([]*s.ReverseJob, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+reverseJobColumns+" FROM `reverse_job` j WHERE "+runnableReverseJob+
+		" AND j.reverse_job_id=(SELECT MIN(p.reverse_job_id) FROM `reverse_job` p WHERE p.fk_request_id=j.fk_request_id AND p.status IN (?,?)) ORDER BY j.reverse_job_id ASC LIMIT ?",
+		s.JobPending, s.JobRunning, now.UTC(), s.JobPending, s.JobRunning, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processReverseJobRows(rows)
+}
+
+//ClaimReverseJob Takes the lease of a runnable job until the given time and counts the attempt, returns false if the job is not runnable
+func (r *Client) ClaimReverseJob(ctx context.Context, j *s.ReverseJob, owner string, until time.Time) (bool, error) {
+
+	// mysql can not read the updated table in a subquery, the first unfinished job is read from a derived table
+	res, err := r.conn().ExecContext(ctx, "UPDATE `reverse_job` j, (SELECT MIN(reverse_job_id) AS reverse_job_id FROM `reverse_job` WHERE fk_request_id=? AND status IN (?,?)) f "+
+		"SET j.status=?, j.attempts=j.attempts+1, j.lease_owner=?, j.lease_until=? WHERE j.reverse_job_id=? AND j.reverse_job_id=f.reverse_job_id AND "+runnableReverseJob,
+		j.RequestID, s.JobPending, s.JobRunning, s.JobRunning, owner, until.UTC(), j.ReverseJobID, s.JobPending, s.JobRunning, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("Could not claim Job %d: %s", j.ReverseJobID, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if err := r.conn().QueryRowContext(ctx, "SELECT attempts FROM `reverse_job` WHERE reverse_job_id=?", j.ReverseJobID).Scan(&j.Attempts); err != nil {
+		return false, fmt.Errorf("Could not claim Job %d: %s", j.ReverseJobID, err.Error())
+	}
+	j.Status = s.JobRunning
+	j.LeaseOwner = owner
+	j.LeaseUntil = until.UTC().Format("2006-01-02 15:04:05")
+
+	return true, nil
+}
+
+//FinishReverseJob Stores the status and the error of a job whose lease is still held by its owner
+func (r *Client) FinishReverseJob(ctx context.Context, j *s.ReverseJob) error {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE `reverse_job` SET status=?, last_error=? WHERE reverse_job_id=? AND status=? AND lease_owner=?",
+		j.Status, truncate(j.LastError, 255), j.ReverseJobID, s.JobRunning, j.LeaseOwner)
+	if err != nil {
+		return fmt.Errorf("Could not finish Job %d: %s", j.ReverseJobID, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("Could not finish Job %d, its lease was lost", j.ReverseJobID)
+	}
+
+	return nil
+}
+
+//AcquireLock Takes or renews a lock until the given time, returns false if another owner holds it
+func (r *Client) AcquireLock(ctx context.Context, name string, owner string, until time.Time) (bool, error) {
+	now := time.Now().UTC()
+
+	if _, err := r.conn().ExecContext(ctx, "INSERT IGNORE INTO `cron_lock` (name, owner, locked_until) VALUES (?,'',?)", name, now); err != nil {
+		return false, fmt.Errorf("Could not acquire lock %s: %s", name, err.Error())
+	}
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE `cron_lock` SET owner=?, locked_until=? WHERE name=? AND (owner=? OR locked_until<=?)", owner, until.UTC(), name, owner, now)
+	if err != nil {
+		return false, fmt.Errorf("Could not acquire lock %s: %s", name, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, nil
+	}
+
+	// mysql counts the changed rows, a renewal to the same second changes nothing
+	var holder string
+	if err := r.conn().QueryRowContext(ctx, "SELECT owner FROM `cron_lock` WHERE name=?", name).Scan(&holder); err != nil {
+		return false, fmt.Errorf("Could not acquire lock %s: %s", name, err.Error())
+	}
+
+	return holder == owner, nil
+}
+
+//ReleaseLock Ends a lock held by the owner so another owner can take it at once
+func (r *Client) ReleaseLock(ctx context.Context, name string, owner string) error {
+
+	if _, err := r.conn().ExecContext(ctx, "UPDATE `cron_lock` SET locked_until=? WHERE name=? AND owner=?", time.Now().UTC(), name, owner); err != nil {
+		return fmt.Errorf("Could not release lock %s: %s", name, err.Error())
+	}
+
+	return nil
+}
+
+//GetSyncMark Gets the last day synced by the given sync, empty if it never ran
+func (r *Client) GetSyncMark(ctx context.Context, name string) (string, error) {
+	var day string
+
+	err := r.conn().QueryRowContext(ctx, "SELECT synced_until FROM `sync_mark` WHERE name=?", name).Scan(&day)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("Could not read sync mark %s: %s", name, err.Error())
+	}
+
+	return day, nil
+}
+
+//SetSyncMark Stores the last day synced by the given sync
+func (r *Client) SetSyncMark(ctx context.Context, name string, day string) error {
+
+	_, err := r.conn().ExecContext(ctx, "INSERT INTO `sync_mark` (name, synced_until) VALUES (?,?) ON DUPLICATE KEY UPDATE synced_until=VALUES(synced_until)", name, day)
+	if err != nil {
+		return fmt.Errorf("Could not store sync mark %s: %s", name, err.Error())
+	}
+
+	return nil
+}
+
+//InsertTrackingSubscription Creates a subscription to the new events of an object
+func (r *Client) InsertTrackingSubscription(ctx context.Context, t *s.TrackingSubscription, expiresAt time.Time) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO `tracking_subscription` (tracking_code, callback, client_id, stop_on, status, last_event_id, expires_at, created_at) VALUES (?,?,?,?,?,0,?,now())")
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking subscription prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, t.Object, t.Callback, t.ClientID, t.StopOn, s.SubscriptionActive, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking subscription for %s: %s", t.Object, err.Error())
+	}
+	t.SubscriptionID, _ = res.LastInsertId()
+	t.Status = s.SubscriptionActive
+	t.ExpiresAt = expiresAt.UTC().Format("2006-01-02 15:04:05")
+
+	return nil
+}
+
+//GetTrackingSubscriptionByID Gets a tracking subscription by its ID
+func (r *Client) GetTrackingSubscriptionByID(ctx context.Context, subscriptionID int64) (*s.TrackingSubscription, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+subscriptionColumns+" FROM `tracking_subscription` WHERE subscription_id=?", subscriptionID)
+	if err != nil {
+		return new(s.TrackingSubscription), err
+	}
+	defer rows.Close()
+
+	resp, err := r.processSubscriptionRows(rows)
+	if err != nil || len(resp) == 0 {
+		return new(s.TrackingSubscription), err
+	}
+
+	return resp[0], nil
+}
+
+//GetActiveTrackingSubscriptions Gets the active tracking subscriptions after the given ID
+func (r *Client) GetActiveTrackingSubscriptions(ctx context.Context, afterID int64, limit int) ([]*s.TrackingSubscription, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+subscriptionColumns+" FROM `tracking_subscription` WHERE status=? AND subscription_id>? ORDER BY subscription_id ASC LIMIT ?", s.SubscriptionActive, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processSubscriptionRows(rows)
+}
+
+//UpdateTrackingSubscription Updates the last notified event and the status of a tracking subscription
+func (r *Client) UpdateTrackingSubscription(ctx context.Context, t *s.TrackingSubscription) error {
+
+	stmt, err := r.conn().PrepareContext(ctx, "UPDATE `tracking_subscription` SET status=?, ended_reason=?, last_event_id=?, checked_at=? WHERE subscription_id=?")
+	if err != nil {
+		return fmt.Errorf("Error in update tracking subscription prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.ExecContext(ctx, t.Status, t.EndedReason, t.LastEventID, time.Now().UTC(), t.SubscriptionID); err != nil {
+		return fmt.Errorf("Could not update tracking subscription %d", t.SubscriptionID)
+	}
+
+	return nil
+}
+
+//EndExpiredTrackingSubscriptions Ends the active subscriptions that expired before now, returns the number of ended subscriptions
+func (r *Client) EndExpiredTrackingSubscriptions(ctx context.Context, now time.Time) (int64, error) {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE `tracking_subscription` SET status=?, ended_reason=? WHERE status=? AND expires_at<=?", s.SubscriptionEnded, s.EndedExpired, s.SubscriptionActive, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("Could not end expired tracking subscriptions: %s", err.Error())
+	}
+
+	return res.RowsAffected()
+}
+
+//processSubscriptionRows Processes a Row result into TrackingSubscription structs
+func (r *Client) processSubscriptionRows(rows *sql.Rows) ([]*s.TrackingSubscription, error) {
+	resp := make([]*s.TrackingSubscription, 0)
+
+	for rows.Next() {
+		t := new(s.TrackingSubscription)
+		var checkedAt sql.NullString
+
+		err := rows.Scan(&t.SubscriptionID, &t.Object, &t.Callback, &t.ClientID, &t.StopOn, &t.Status, &t.EndedReason, &t.LastEventID, &t.ExpiresAt, &checkedAt, &t.CreatedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		t.CheckedAt = checkedAt.String
+
+		resp = append(resp, t)
+	}
+
+	return resp, rows.Err()
+}
+
+//processReverseJobRows Processes a Row result into ReverseJob structs
+func (r *Client) processReverseJobRows(rows *sql.Rows) ([]*s.ReverseJob, error) {
+	resp := make([]*s.ReverseJob, 0)
+
+	for rows.Next() {
+		j := new(s.ReverseJob)
+		var leaseUntil, updatedAt sql.NullString
+
+		err := rows.Scan(&j.ReverseJobID, &j.RequestID, &j.Action, &j.Source, &j.Status, &j.Attempts, &j.LeaseOwner, &leaseUntil, &j.LastError, &j.CreatedAt, &updatedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		j.LeaseUntil = leaseUntil.String
+		j.UpdatedAt = updatedAt.String
+
+		resp = append(resp, j)
+	}
+
+	return resp, rows.Err()
+}
+
+//processTrackingJobRows Processes a Row result into TrackingJob structs with their objects and results
+func (r *Client) processTrackingJobRows(rows *sql.Rows) ([]*s.TrackingJob, error) {
+	resp := make([]*s.TrackingJob, 0)
+
+	for rows.Next() {
+		j := new(s.TrackingJob)
+		var objects string
+		var result, leaseUntil, finishedAt sql.NullString
+
+		err := rows.Scan(&j.JobID, &j.Status, &j.TrackingType, &j.Language, &j.Callback, &j.ClientID, &objects, &result, &j.Error, &j.Attempts, &j.LeaseOwner, &leaseUntil, &j.CreatedAt, &finishedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		j.LeaseUntil = leaseUntil.String
+		j.FinishedAt = finishedAt.String
+
+		if err := json.Unmarshal([]byte(objects), &j.Objects); err != nil {
+			return resp, fmt.Errorf("Error reading objects of tracking job %d: %s", j.JobID, err.Error())
+		}
+		if result.Valid && result.String != "" {
+			j.Result = new(s.TrackingResponse)
+			if err := json.Unmarshal([]byte(result.String), j.Result); err != nil {
+				return resp, fmt.Errorf("Error reading result of tracking job %d: %s", j.JobID, err.Error())
+			}
+		}
+
+		resp = append(resp, j)
+	}
+
+	return resp, rows.Err()
+}
+
+//processCallbackRows Processes a Row result into CallbackDelivery structs
+func (r *Client) processCallbackRows(rows *sql.Rows) ([]*s.CallbackDelivery, error) {
+	resp := make([]*s.CallbackDelivery, 0)
+
+	for rows.Next() {
+		d := new(s.CallbackDelivery)
+		var deliveredAt, updatedAt sql.NullString
+
+		err := rows.Scan(&d.CallbackDeliveryID, &d.RequestID, &d.ClientID, &d.Type, &d.URL, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.LastError,
+			&d.NextAttemptAt, &deliveredAt, &d.CreatedAt, &updatedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		d.DeliveredAt = deliveredAt.String
+		d.UpdatedAt = updatedAt.String
+
+		resp = append(resp, d)
+	}
+
+	return resp, rows.Err()
+}
+
+//processRows Processes a Row result into Request structs and loads their items
+func (r *Client) processRows(ctx context.Context, rows *sql.Rows) ([]*s.Request, error) {
+	resp := make([]*s.Request, 0)
+
+	for rows.Next() {
+		req := new(s.Request)
+		var services, documents string
+
+		err := rows.Scan(&req.RequestID, &req.RequestType, &req.RequestService, &req.ColectDate, &req.OrderNr, &req.SlipNumber, &req.OriginNome, &req.OriginLogradouro, &req.OriginNumero, &req.OriginComplemento, &req.OriginCep, &req.OriginBairro, &req.OriginCidade,
+			&req.OriginUf, &req.OriginReferencia, &req.OriginEmail, &req.OriginDdd, &req.OriginTelefone, &req.DestinationNome, &req.DestinationLogradouro, &req.DestinationNumero, &req.DestinationComplemento,
+			&req.DestinationCep, &req.DestinationBairro, &req.DestinationCidade, &req.DestinationUf, &req.DestinationReferencia, &req.DestinationEmail, &req.Callback, &req.Status, &req.ErrorMessage,
+			&req.Retries, &req.PostageCode, &req.TrackingCode, &req.CreatedAt, &req.UpdatedAt, &req.ClientID, &req.DeclaredValue, &services, &req.Ar, &req.Checklist, &documents)
+
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		req.AdditionalServices = repo.SplitList(services)
+		req.Documents = repo.SplitList(documents)
+
+		resp = append(resp, req)
+	}
+	if err := rows.Err(); err != nil {
+		return resp, err
+	}
+	// the items are read once the rows are closed as a transaction runs one query at a time
+	rows.Close()
+
+	return resp, r.loadItems(ctx, resp)
+}
+
+//loadItems Loads the items of the requests with a single query
+func (r *Client) loadItems(ctx context.Context, reqs []*s.Request) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	byID := make(map[int64]*s.Request, len(reqs))
+	args := make([]interface{}, 0, len(reqs))
+	for _, o := range reqs {
+		o.Items = make([]*s.RequestItem, 0)
+		byID[o.RequestID] = o
+		args = append(args, o.RequestID)
+	}
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+itemColumns+" FROM `request_item` WHERE fk_request_id IN ("+repo.Placeholders(len(args))+") ORDER BY order_item_id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := new(s.RequestItem)
+		if err := rows.Scan(&item.RequestItemID, &item.FkRequestID, &item.Item, &item.ProductName); err != nil {
+			return fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		if o, ok := byID[item.FkRequestID]; ok {
+			o.Items = append(o.Items, item)
+		}
+	}
+
+	return rows.Err()
+}
+
+//truncate Truncates a string to the given size
+func truncate(value string, size int) string {
+	if r := []rune(value); len(r) > size {
+		return string(r[:size])
+	}
+	return value
 }
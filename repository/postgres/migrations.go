@@ -0,0 +1,322 @@
+package postgres
+
+import (
+	"github.com/pintobikez/brazilian-correios-service/repository/migrate"
+)
+
+//Migrations versioned changes of the postgres schema, a new change is always a new migration
+var Migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "Requests and their items",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request (
+			  request_id serial PRIMARY KEY,
+			  request_type varchar(10) NOT NULL,
+			  request_service varchar(10) NOT NULL,
+			  colect_date varchar(10) NOT NULL DEFAULT '',
+			  order_nr integer NOT NULL,
+			  slip_number varchar(12) NOT NULL,
+			  origin_nome varchar(60) NOT NULL,
+			  origin_logradouro varchar(72) NOT NULL,
+			  origin_numero integer NOT NULL,
+			  origin_complemento varchar(30) NOT NULL DEFAULT '',
+			  origin_cep varchar(8) NOT NULL,
+			  origin_bairro varchar(80) NOT NULL,
+			  origin_cidade varchar(40) NOT NULL,
+			  origin_uf varchar(2) NOT NULL,
+			  origin_referencia varchar(60) NOT NULL DEFAULT '',
+			  origin_email varchar(72) NOT NULL,
+			  origin_ddd varchar(4) NOT NULL DEFAULT '',
+			  origin_telefone varchar(12) NOT NULL DEFAULT '',
+			  destination_nome varchar(60) NOT NULL,
+			  destination_logradouro varchar(72) NOT NULL,
+			  destination_numero integer NOT NULL,
+			  destination_complemento varchar(30) NOT NULL DEFAULT '',
+			  destination_cep varchar(8) NOT NULL,
+			  destination_bairro varchar(80) NOT NULL,
+			  destination_cidade varchar(40) NOT NULL,
+			  destination_uf varchar(2) NOT NULL,
+			  destination_referencia varchar(60) NOT NULL DEFAULT '',
+			  destination_email varchar(72) NOT NULL,
+			  callback varchar(255) NOT NULL,
+			  status varchar(20) NOT NULL,
+			  error_message varchar(255) NOT NULL DEFAULT '',
+			  retries integer NOT NULL DEFAULT 0,
+			  postage_code varchar(10) NOT NULL DEFAULT '',
+			  tracking_code varchar(16) NOT NULL DEFAULT '',
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  updated_at timestamp DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_order_nr ON request (order_nr)`,
+			`CREATE INDEX IF NOT EXISTS request_postage_code ON request (postage_code)`,
+			`CREATE INDEX IF NOT EXISTS request_created_at ON request (created_at)`,
+			`CREATE TABLE IF NOT EXISTS request_item (
+			  order_item_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL,
+			  item varchar(64) NOT NULL,
+			  product_name varchar(255) NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_item_request_id ON request_item (fk_request_id)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_item",
+			"DROP TABLE IF EXISTS request",
+		},
+	},
+	{
+		Version:     2,
+		Description: "Clients, callbacks, status history and tracking",
+		Up: []string{
+			"ALTER TABLE request ADD COLUMN IF NOT EXISTS client_id varchar(64) NOT NULL DEFAULT ''",
+			`CREATE TABLE IF NOT EXISTS callback_delivery (
+			  callback_delivery_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL DEFAULT 0,
+			  client_id varchar(64) NOT NULL DEFAULT '',
+			  callback_type varchar(20) NOT NULL,
+			  url varchar(255) NOT NULL,
+			  payload text NOT NULL,
+			  status varchar(20) NOT NULL,
+			  attempts integer NOT NULL DEFAULT 0,
+			  response_code integer NOT NULL DEFAULT 0,
+			  last_error varchar(255) NOT NULL DEFAULT '',
+			  next_attempt_at timestamp NOT NULL,
+			  delivered_at timestamp DEFAULT NULL,
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  updated_at timestamp DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS callback_delivery_request_id ON callback_delivery (fk_request_id)`,
+			`CREATE INDEX IF NOT EXISTS callback_delivery_status_next_attempt ON callback_delivery (status, next_attempt_at)`,
+			`CREATE TABLE IF NOT EXISTS client (
+			  client_id varchar(64) PRIMARY KEY,
+			  name varchar(255) NOT NULL,
+			  secret varchar(128) NOT NULL,
+			  previous_secret varchar(128) NOT NULL DEFAULT '',
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  rotated_at timestamp DEFAULT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS request_status_history (
+			  status_history_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL,
+			  from_status varchar(20) NOT NULL DEFAULT '',
+			  to_status varchar(20) NOT NULL,
+			  source varchar(20) NOT NULL,
+			  description text NOT NULL DEFAULT '',
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_status_history_request_id ON request_status_history (fk_request_id)`,
+			`CREATE TABLE IF NOT EXISTS tracking_object (
+			  tracking_code varchar(16) PRIMARY KEY,
+			  name varchar(255) NOT NULL DEFAULT '',
+			  category varchar(255) NOT NULL DEFAULT '',
+			  error varchar(255) NOT NULL DEFAULT '',
+			  refreshed_at timestamp NOT NULL,
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS tracking_event (
+			  tracking_event_id serial PRIMARY KEY,
+			  tracking_code varchar(16) NOT NULL,
+			  event_type varchar(10) NOT NULL,
+			  status_code varchar(10) NOT NULL,
+			  event_date varchar(16) NOT NULL,
+			  event_at timestamp DEFAULT NULL,
+			  description varchar(255) NOT NULL DEFAULT '',
+			  details varchar(255) NOT NULL DEFAULT '',
+			  responsible_unit varchar(255) NOT NULL DEFAULT '',
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  UNIQUE (tracking_code, event_type, status_code, event_date)
+			)`,
+			`CREATE INDEX IF NOT EXISTS tracking_event_object_event_at ON tracking_event (tracking_code, event_at)`,
+			`CREATE TABLE IF NOT EXISTS tracking_subscription (
+			  subscription_id serial PRIMARY KEY,
+			  tracking_code varchar(16) NOT NULL,
+			  callback varchar(255) NOT NULL,
+			  client_id varchar(64) NOT NULL DEFAULT '',
+			  stop_on varchar(20) NOT NULL DEFAULT '',
+			  status varchar(20) NOT NULL,
+			  ended_reason varchar(20) NOT NULL DEFAULT '',
+			  last_event_id integer NOT NULL DEFAULT 0,
+			  expires_at timestamp NOT NULL,
+			  checked_at timestamp DEFAULT NULL,
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  updated_at timestamp DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS tracking_subscription_status ON tracking_subscription (status, subscription_id)`,
+			`CREATE INDEX IF NOT EXISTS tracking_subscription_tracking_code ON tracking_subscription (tracking_code)`,
+			`CREATE TABLE IF NOT EXISTS tracking_job (
+			  job_id serial PRIMARY KEY,
+			  status varchar(20) NOT NULL,
+			  tracking_type varchar(10) NOT NULL,
+			  language varchar(10) NOT NULL,
+			  callback varchar(255) NOT NULL DEFAULT '',
+			  client_id varchar(64) NOT NULL DEFAULT '',
+			  objects text NOT NULL,
+			  result text,
+			  error varchar(255) NOT NULL DEFAULT '',
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  updated_at timestamp DEFAULT NULL,
+			  finished_at timestamp DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS tracking_job_status ON tracking_job (status)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS tracking_job",
+			"DROP TABLE IF EXISTS tracking_subscription",
+			"DROP TABLE IF EXISTS tracking_event",
+			"DROP TABLE IF EXISTS tracking_object",
+			"DROP TABLE IF EXISTS request_status_history",
+			"DROP TABLE IF EXISTS client",
+			"DROP TABLE IF EXISTS callback_delivery",
+			"ALTER TABLE request DROP COLUMN IF EXISTS client_id",
+		},
+	},
+	{
+		Version:     3,
+		Description: "Reverse job queue",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS reverse_job (
+			  reverse_job_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL,
+			  action varchar(20) NOT NULL,
+			  source varchar(20) NOT NULL,
+			  status varchar(20) NOT NULL,
+			  attempts integer NOT NULL DEFAULT 0,
+			  lease_owner varchar(128) NOT NULL DEFAULT '',
+			  lease_until timestamp DEFAULT NULL,
+			  last_error varchar(255) NOT NULL DEFAULT '',
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  updated_at timestamp DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS reverse_job_request_id ON reverse_job (fk_request_id, status)`,
+			`CREATE INDEX IF NOT EXISTS reverse_job_status ON reverse_job (status, lease_until)`,
+			// the requests left pending or processing before the queue existed are submitted again
+			`INSERT INTO reverse_job (fk_request_id, action, source, status, created_at)
+			  SELECT request_id, 'create', 'cron', 'pending', now() FROM request WHERE status IN ('pending', 'processing')`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS reverse_job",
+		},
+	},
+	{
+		Version:     4,
+		Description: "Cron locks",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS cron_lock (
+			  name varchar(64) PRIMARY KEY,
+			  owner varchar(128) NOT NULL DEFAULT '',
+			  locked_until timestamp NOT NULL,
+			  updated_at timestamp DEFAULT NULL
+			)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS cron_lock",
+		},
+	},
+	{
+		Version:     5,
+		Description: "Sync marks",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS sync_mark (
+			  name varchar(64) PRIMARY KEY,
+			  synced_until varchar(10) NOT NULL,
+			  updated_at timestamp DEFAULT NULL
+			)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS sync_mark",
+		},
+	},
+	{
+		Version:     6,
+		Description: "Request objects and Correios history",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request_object (
+			  request_object_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL,
+			  tracking_code varchar(16) NOT NULL DEFAULT '',
+			  client_object_id varchar(64) NOT NULL DEFAULT '',
+			  status varchar(10) NOT NULL DEFAULT '',
+			  description varchar(255) NOT NULL DEFAULT '',
+			  real_weight numeric(10,3) NOT NULL DEFAULT 0,
+			  cubic_weight numeric(10,3) NOT NULL DEFAULT 0,
+			  postage_value numeric(10,2) NOT NULL DEFAULT 0,
+			  last_update varchar(19) NOT NULL DEFAULT '',
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  updated_at timestamp DEFAULT NULL,
+			  UNIQUE (fk_request_id, tracking_code)
+			)`,
+			`CREATE TABLE IF NOT EXISTS request_correios_history (
+			  correios_history_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL,
+			  status varchar(10) NOT NULL,
+			  description varchar(255) NOT NULL DEFAULT '',
+			  observation varchar(255) NOT NULL DEFAULT '',
+			  event_date varchar(19) NOT NULL,
+			  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+			  UNIQUE (fk_request_id, status, event_date)
+			)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_correios_history",
+			"DROP TABLE IF EXISTS request_object",
+		},
+	},
+	{
+		Version:     7,
+		Description: "Request packages",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request_package (
+			  request_package_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL,
+			  object_id varchar(30) NOT NULL,
+			  description varchar(255) NOT NULL DEFAULT '',
+			  coleta integer NOT NULL DEFAULT 0,
+			  postage_code varchar(20) NOT NULL DEFAULT '',
+			  tracking_code varchar(16) NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_package_request_id ON request_package (fk_request_id)`,
+			`CREATE INDEX IF NOT EXISTS request_package_postage_code ON request_package (postage_code)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_package",
+		},
+	},
+	{
+		Version:     8,
+		Description: "Declared value, additional services, AR, checklist and products of the requests",
+		Up: []string{
+			"ALTER TABLE request ADD COLUMN IF NOT EXISTS declared_value numeric(10,2) NOT NULL DEFAULT 0, ADD COLUMN IF NOT EXISTS additional_services varchar(50) NOT NULL DEFAULT '', " +
+				"ADD COLUMN IF NOT EXISTS ar boolean NOT NULL DEFAULT false, ADD COLUMN IF NOT EXISTS checklist varchar(20) NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS documents varchar(1024) NOT NULL DEFAULT ''",
+			`CREATE TABLE IF NOT EXISTS request_product (
+			  request_product_id serial PRIMARY KEY,
+			  fk_request_id integer NOT NULL,
+			  code varchar(20) NOT NULL,
+			  type varchar(10) NOT NULL,
+			  quantity integer NOT NULL DEFAULT 1
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_product_request_id ON request_product (fk_request_id)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_product",
+			"ALTER TABLE request DROP COLUMN IF EXISTS declared_value, DROP COLUMN IF EXISTS additional_services, DROP COLUMN IF EXISTS ar, DROP COLUMN IF EXISTS checklist, DROP COLUMN IF EXISTS documents",
+		},
+	},
+	{
+		Version:     9,
+		Description: "Leases of the tracking jobs",
+		Up: []string{
+			"ALTER TABLE tracking_job ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0, ADD COLUMN IF NOT EXISTS lease_owner varchar(128) NOT NULL DEFAULT '', " +
+				"ADD COLUMN IF NOT EXISTS lease_until timestamp DEFAULT NULL",
+			`CREATE INDEX IF NOT EXISTS tracking_job_status_lease_until ON tracking_job (status, lease_until)`,
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS tracking_job_status_lease_until",
+			"ALTER TABLE tracking_job DROP COLUMN IF EXISTS attempts, DROP COLUMN IF EXISTS lease_owner, DROP COLUMN IF EXISTS lease_until",
+		},
+	},
+}
+
+//Migrator Returns the migrator of the postgres schema
+func (r *Client) Migrator() *migrate.Migrator {
+	return migrate.New(r.db, Migrations, rebind, nil)
+}
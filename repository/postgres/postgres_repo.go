@@ -0,0 +1,1200 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	//Use postgres as main package
+	_ "github.com/lib/pq"
+	s "github.com/pintobikez/brazilian-correios-service/api/structures"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//dateFormat format of the dates returned by the queries, the same one returned by mysql
+const dateFormat = "'YYYY-MM-DD HH24:MI:SS'"
+
+var (
+	//requestColumns columns of the request table in the order they are scanned
+	requestColumns = "o.request_id, o.request_type, o.request_service, o.colect_date, o.order_nr, o.slip_number, o.origin_nome, o.origin_logradouro, o.origin_numero, o.origin_complemento, " +
+		"o.origin_cep, o.origin_bairro, o.origin_cidade, o.origin_uf, o.origin_referencia, o.origin_email, o.origin_ddd, o.origin_telefone, o.destination_nome, o.destination_logradouro, " +
+		"o.destination_numero, o.destination_complemento, o.destination_cep, o.destination_bairro, o.destination_cidade, o.destination_uf, o.destination_referencia, o.destination_email, " +
+		"o.callback, o.status, o.error_message, o.retries, o.postage_code, o.tracking_code, " + date("o.created_at") + ", " + date("o.updated_at") + ", o.client_id, o.declared_value, o.additional_services, o.ar, o.checklist, o.documents"
+	//itemColumns columns of the request_item table in the order they are scanned
+	itemColumns = "order_item_id, fk_request_id, item, product_name"
+	//callbackColumns columns of the callback_delivery table in the order they are scanned
+	callbackColumns = "callback_delivery_id, fk_request_id, client_id, callback_type, url, payload, status, attempts, response_code, last_error, " +
+		date("next_attempt_at") + ", " + date("delivered_at") + ", " + date("created_at") + ", " + date("updated_at")
+	//subscriptionColumns columns of the tracking_subscription table in the order they are scanned
+	subscriptionColumns = "subscription_id, tracking_code, callback, client_id, stop_on, status, ended_reason, last_event_id, " +
+		date("expires_at") + ", " + date("checked_at") + ", " + date("created_at")
+	//reverseJobColumns columns of the reverse_job table in the order they are scanned
+	reverseJobColumns = "reverse_job_id, fk_request_id, action, source, status, attempts, lease_owner, " + date("lease_until") + ", last_error, " + date("created_at") + ", " + date("updated_at")
+	//trackingJobColumns columns of the tracking_job table in the order they are scanned
+	trackingJobColumns = "job_id, status, tracking_type, language, callback, client_id, objects, result, error, attempts, lease_owner, " + date("lease_until") + ", " + date("created_at") + ", " + date("finished_at")
+)
+
+//runnableReverseJob condition of a job that is pending or whose lease ended and that is the first unfinished job of its Request
+const runnableReverseJob = "(status=? OR (status=? AND lease_until<=?)) AND reverse_job_id=(SELECT MIN(p.reverse_job_id) FROM reverse_job p WHERE p.fk_request_id=reverse_job.fk_request_id AND p.status IN (?,?))"
+
+//runnableTrackingJob condition of a tracking job that is pending or whose lease ended
+const runnableTrackingJob = "(status=? OR (status=? AND lease_until<=?))"
+
+//Client Postgres Client handler
+type Client struct {
+	//props
+	db *sql.DB
+	tx *sql.Tx
+}
+
+//Connect Connects to the postgres database
+func (r *Client) Connect(stringConn string) error {
+	var err error
+	r.db, err = sql.Open("postgres", stringConn)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//Disconnect Disconnects from the postgres database
+func (r *Client) Disconnect() {
+	r.db.Close()
+}
+
+//Transaction Runs fn in a transaction that is committed if fn returns nil and rolled back otherwise, a transaction started inside another one joins it
+func (r *Client) Transaction(ctx context.Context, fn func(tx repo.Definition) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error starting transaction: %s", err.Error())
+	}
+	defer func() {
+		// a panic in fn must not leave the transaction open
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&Client{db: r.db, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Error committing transaction: %s", err.Error())
+	}
+
+	return nil
+}
+
+//conn Returns the transaction of the client if it has one or the database otherwise
+func (r *Client) conn() repo.Executor {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+//InsertRequest Creates a PostageCode request and its items in the database in a single transaction
+func (r *Client) InsertRequest(ctx context.Context, o *s.Request) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).insertRequest(ctx, o)
+	})
+}
+
+//insertRequest Inserts the request and its items
+func (r *Client) insertRequest(ctx context.Context, o *s.Request) error {
+
+	err := r.conn().QueryRowContext(ctx, "INSERT INTO request (request_type, request_service, colect_date, order_nr, slip_number, origin_nome, origin_logradouro, origin_numero, origin_complemento, origin_cep, "+
+		"origin_bairro, origin_cidade, origin_uf, origin_referencia, origin_email, origin_ddd, origin_telefone, destination_nome, destination_logradouro, destination_numero, destination_complemento, "+
+		"destination_cep, destination_bairro, destination_cidade, destination_uf, destination_referencia, destination_email, callback, status, client_id, declared_value, additional_services, ar, checklist, documents, created_at, updated_at) "+
+		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,now(),now()) RETURNING request_id",
+		o.RequestType, o.RequestService, o.ColectDate, o.OrderNr, o.SlipNumber, o.OriginNome, o.OriginLogradouro, o.OriginNumero, o.OriginComplemento, o.OriginCep, o.OriginBairro,
+		o.OriginCidade, o.OriginUf, o.OriginReferencia, o.OriginEmail, o.OriginDdd, o.OriginTelefone, o.DestinationNome, o.DestinationLogradouro, o.DestinationNumero, o.DestinationComplemento,
+		o.DestinationCep, o.DestinationBairro, o.DestinationCidade, o.DestinationUf, o.DestinationReferencia, o.DestinationEmail, o.Callback, s.StatusPending, o.ClientID, o.DeclaredValue, repo.JoinList(o.AdditionalServices), o.Ar, o.Checklist, repo.JoinList(o.Documents)).Scan(&o.RequestID)
+
+	if err != nil {
+		return fmt.Errorf("Error in insert request: %d %s", o.OrderNr, err.Error())
+	}
+	o.Status = s.StatusPending
+
+	return r.insertItems(ctx, o)
+}
+
+//insertItems Inserts the items of a request
+func (r *Client) insertItems(ctx context.Context, o *s.Request) error {
+	for _, i := range o.Items {
+		err := r.conn().QueryRowContext(ctx, "INSERT INTO request_item (fk_request_id, item, product_name) VALUES ($1,$2,$3) RETURNING order_item_id", o.RequestID, i.Item, i.ProductName).Scan(&i.RequestItemID)
+		if err != nil {
+			return fmt.Errorf("Error in insert request item: %d %s: %s", o.OrderNr, i.Item, err.Error())
+		}
+		i.FkRequestID = o.RequestID
+	}
+
+	return nil
+}
+
+//UpdateRequest Updates the data of a Request and replaces its items in a single transaction if its status is still the one in the struct,
+//a Request without items keeps the stored ones
+func (r *Client) UpdateRequest(ctx context.Context, o *s.Request) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).updateRequest(ctx, o)
+	})
+}
+
+//updateRequest Updates the data and the items of a Request
+func (r *Client) updateRequest(ctx context.Context, o *s.Request) error {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE request SET request_type=$1, request_service=$2, colect_date=$3, origin_nome=$4, origin_logradouro=$5, origin_numero=$6, origin_complemento=$7, "+
+		"origin_cep=$8, origin_bairro=$9, origin_cidade=$10, origin_uf=$11, origin_referencia=$12, origin_email=$13, origin_ddd=$14, origin_telefone=$15, destination_nome=$16, destination_logradouro=$17, "+
+		"destination_numero=$18, destination_complemento=$19, destination_cep=$20, destination_bairro=$21, destination_cidade=$22, destination_uf=$23, destination_referencia=$24, "+
+		"destination_email=$25, declared_value=$26, additional_services=$27, ar=$28, checklist=$29, documents=$30, updated_at=now() WHERE request_id=$31 AND status=$32",
+		o.RequestType, o.RequestService, o.ColectDate, o.OriginNome, o.OriginLogradouro, o.OriginNumero, o.OriginComplemento, o.OriginCep, o.OriginBairro, o.OriginCidade, o.OriginUf, o.OriginReferencia, o.OriginEmail, o.OriginDdd, o.OriginTelefone,
+		o.DestinationNome, o.DestinationLogradouro, o.DestinationNumero, o.DestinationComplemento, o.DestinationCep, o.DestinationBairro, o.DestinationCidade, o.DestinationUf, o.DestinationReferencia, o.DestinationEmail, o.DeclaredValue, repo.JoinList(o.AdditionalServices), o.Ar, o.Checklist, repo.JoinList(o.Documents),
+		o.RequestID, o.Status)
+	if err != nil {
+		return fmt.Errorf("Could not update Request %d", o.RequestID)
+	}
+	if affect, err := res.RowsAffected(); err != nil || affect <= 0 {
+		return fmt.Errorf("Could not update Request %d from %s", o.RequestID, o.Status)
+	}
+
+	if len(o.Items) == 0 {
+		return nil
+	}
+	if _, err := r.conn().ExecContext(ctx, "DELETE FROM request_item WHERE fk_request_id=$1", o.RequestID); err != nil {
+		return fmt.Errorf("Could not replace the items of Request %d", o.RequestID)
+	}
+
+	return r.insertItems(ctx, o)
+}
+
+//SaveRequestPackages Replaces the packages of a Request in a single transaction
+func (r *Client) SaveRequestPackages(ctx context.Context, requestID int64, packages []*s.RequestPackage) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).saveRequestPackages(ctx, requestID, packages)
+	})
+}
+
+//saveRequestPackages Replaces the packages of a Request
+func (r *Client) saveRequestPackages(ctx context.Context, requestID int64, packages []*s.RequestPackage) error {
+
+	if _, err := r.conn().ExecContext(ctx, "DELETE FROM request_package WHERE fk_request_id=$1", requestID); err != nil {
+		return fmt.Errorf("Could not replace the packages of Request %d", requestID)
+	}
+
+	for _, p := range packages {
+		err := r.conn().QueryRowContext(ctx, "INSERT INTO request_package (fk_request_id, object_id, description, coleta, postage_code, tracking_code) VALUES ($1,$2,$3,$4,$5,$6) RETURNING request_package_id",
+			requestID, p.ObjectID, truncate(p.Description, 255), p.Coleta, p.PostageCode, p.TrackingCode).Scan(&p.RequestPackageID)
+		if err != nil {
+			return fmt.Errorf("Error in insert request package: %d %s: %s", requestID, p.ObjectID, err.Error())
+		}
+		p.FkRequestID = requestID
+	}
+
+	return nil
+}
+
+//GetRequestPackages Gets the packages of a Request by coleta
+func (r *Client) GetRequestPackages(ctx context.Context, requestID int64) ([]*s.RequestPackage, error) {
+	resp := make([]*s.RequestPackage, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT request_package_id, fk_request_id, object_id, description, coleta, postage_code, tracking_code FROM request_package WHERE fk_request_id=$1 ORDER BY coleta, request_package_id", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := new(s.RequestPackage)
+		if err := rows.Scan(&p.RequestPackageID, &p.FkRequestID, &p.ObjectID, &p.Description, &p.Coleta, &p.PostageCode, &p.TrackingCode); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, p)
+	}
+
+	return resp, rows.Err()
+}
+
+//UpdateRequestPackage Stores the codes given by Correios to a package
+func (r *Client) UpdateRequestPackage(ctx context.Context, p *s.RequestPackage) error {
+
+	if _, err := r.conn().ExecContext(ctx, "UPDATE request_package SET postage_code=$1, tracking_code=$2 WHERE request_package_id=$3", p.PostageCode, p.TrackingCode, p.RequestPackageID); err != nil {
+		return fmt.Errorf("Could not update package %s of Request %d: %s", p.ObjectID, p.FkRequestID, err.Error())
+	}
+
+	return nil
+}
+
+//SaveRequestProducts Replaces the products of a Request in a single transaction
+func (r *Client) SaveRequestProducts(ctx context.Context, requestID int64, products []*s.RequestProduct) error {
+	return r.Transaction(ctx, func(tx repo.Definition) error {
+		return tx.(*Client).saveRequestProducts(ctx, requestID, products)
+	})
+}
+
+//saveRequestProducts Replaces the products of a Request
+func (r *Client) saveRequestProducts(ctx context.Context, requestID int64, products []*s.RequestProduct) error {
+
+	if _, err := r.conn().ExecContext(ctx, "DELETE FROM request_product WHERE fk_request_id=$1", requestID); err != nil {
+		return fmt.Errorf("Could not replace the products of Request %d", requestID)
+	}
+
+	for _, p := range products {
+		err := r.conn().QueryRowContext(ctx, "INSERT INTO request_product (fk_request_id, code, type, quantity) VALUES ($1,$2,$3,$4) RETURNING request_product_id",
+			requestID, p.Code, p.Type, p.Quantity).Scan(&p.RequestProductID)
+		if err != nil {
+			return fmt.Errorf("Error in insert request product: %d %s: %s", requestID, p.Code, err.Error())
+		}
+		p.FkRequestID = requestID
+	}
+
+	return nil
+}
+
+//GetRequestProducts Gets the products of a Request
+func (r *Client) GetRequestProducts(ctx context.Context, requestID int64) ([]*s.RequestProduct, error) {
+	resp := make([]*s.RequestProduct, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT request_product_id, fk_request_id, code, type, quantity FROM request_product WHERE fk_request_id=$1 ORDER BY request_product_id", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := new(s.RequestProduct)
+		if err := rows.Scan(&p.RequestProductID, &p.FkRequestID, &p.Code, &p.Type, &p.Quantity); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, p)
+	}
+
+	return resp, rows.Err()
+}
+
+//UpdateRequestStatus Updates the status of a Request if it is still the one in the struct
+func (r *Client) UpdateRequestStatus(ctx context.Context, o *s.Request, status string, message string) (int64, error) {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE request SET retries=$1, status=$2, error_message=$3, updated_at=now() WHERE request_id=$4 AND status=$5", o.Retries, status, message, o.RequestID, o.Status)
+	if err != nil {
+		return 0, fmt.Errorf("Could not update status for Request %d", o.RequestID)
+	}
+
+	affect, err := res.RowsAffected()
+	if err != nil || affect <= 0 {
+		return 0, fmt.Errorf("Could not update status for Request %d from %s", o.RequestID, o.Status)
+	}
+
+	//update struct
+	o.Status = status
+	o.ErrorMessage = message
+
+	return affect, nil
+}
+
+//UpdateRequestPostage Updates an RequestItems PostageCode
+func (r *Client) UpdateRequestPostage(ctx context.Context, o *s.Request, code string) error {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE request SET postage_code=$1, status=$2, updated_at=now() WHERE request_id=$3 AND status=$4", code, s.StatusGenerated, o.RequestID, o.Status)
+	if err != nil {
+		return fmt.Errorf("Could not update postage code for Request %d", o.RequestID)
+	}
+
+	affect, err := res.RowsAffected()
+	if err != nil || affect <= 0 {
+		return fmt.Errorf("Could not update postage code for Request %d", o.RequestID)
+	}
+
+	//update struct
+	o.PostageCode = code
+	o.Status = s.StatusGenerated
+
+	return nil
+}
+
+//UpdateRequestTracking Updates an RequestItems TrackingCode
+func (r *Client) UpdateRequestTracking(ctx context.Context, o *s.Request, code string) error {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE request SET tracking_code=$1, status=$2, updated_at=now() WHERE request_id=$3 AND status=$4", code, s.StatusUsed, o.RequestID, o.Status)
+	if err != nil {
+		return fmt.Errorf("Could not update tracking code for Request %d", o.RequestID)
+	}
+
+	affect, err := res.RowsAffected()
+	if err != nil || affect <= 0 {
+		return fmt.Errorf("Could not update tracking code for Request %d", o.RequestID)
+	}
+
+	//update struct
+	o.TrackingCode = code
+	o.Status = s.StatusUsed
+
+	return nil
+}
+
+//FindRequestByID Finds Request by RequestID
+func (r *Client) FindRequestByID(ctx context.Context, requestID int64) (bool, error) {
+	exists := false
+
+	if err := r.conn().QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM request WHERE request_id=$1)", requestID).Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+//GetRequestByID Gets Request info by RequestID
+func (r *Client) GetRequestByID(ctx context.Context, requestID int) (*s.Request, error) {
+	var resp = new(s.Request)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+requestColumns+" FROM request AS o WHERE o.request_id=$1", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	reqs, err := r.processRows(ctx, rows)
+	if err != nil || len(reqs) == 0 {
+		return resp, err
+	}
+
+	return reqs[0], nil
+}
+
+//GetRequestByPostageCode Gets Request info by PostageCode
+func (r *Client) GetRequestByPostageCode(ctx context.Context, code string) (*s.Request, error) {
+	var resp = new(s.Request)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+requestColumns+" FROM request AS o WHERE o.postage_code=$1 OR o.request_id IN (SELECT fk_request_id FROM request_package WHERE postage_code=$1) ORDER BY o.request_id LIMIT 1", code)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	reqs, err := r.processRows(ctx, rows)
+	if err != nil || len(reqs) == 0 {
+		return resp, err
+	}
+
+	return reqs[0], nil
+}
+
+//GetRequestBy Gets Request info by the given search, the pagination applies to the requests
+func (r *Client) GetRequestBy(ctx context.Context, req *s.Search) ([]*s.Request, error) {
+	var resp = []*s.Request{}
+
+	q, err := repo.BuildSearch(req)
+	if err != nil {
+		return resp, err
+	}
+
+	// LIKE is case insensitive in mysql
+	where := strings.Replace(q.Where, " LIKE ?", " ILIKE ?", -1)
+	query := fmt.Sprintf("SELECT "+requestColumns+" FROM request AS o %s %s LIMIT ? OFFSET ?", where, q.OrderBy)
+	args := append(q.Args, req.Offset, req.From)
+
+	rows, err := r.conn().QueryContext(ctx, rebind(query), args...)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	return r.processRows(ctx, rows)
+}
+
+//InsertCallbackDelivery Writes a callback to the outbox
+func (r *Client) InsertCallbackDelivery(ctx context.Context, d *s.CallbackDelivery) error {
+
+	err := r.conn().QueryRowContext(ctx, "INSERT INTO callback_delivery (fk_request_id, client_id, callback_type, url, payload, status, attempts, next_attempt_at, created_at) VALUES ($1,$2,$3,$4,$5,$6,0,$7,now()) RETURNING callback_delivery_id",
+		d.RequestID, d.ClientID, d.Type, d.URL, d.Payload, s.CallbackPending, time.Now().UTC()).Scan(&d.CallbackDeliveryID)
+	if err != nil {
+		return fmt.Errorf("Error in insert callback delivery for Request %d: %s", d.RequestID, err.Error())
+	}
+	d.Status = s.CallbackPending
+
+	return nil
+}
+
+//GetCallbackDeliveryByID Gets a callback delivery by its ID
+func (r *Client) GetCallbackDeliveryByID(ctx context.Context, deliveryID int64) (*s.CallbackDelivery, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+callbackColumns+" FROM callback_delivery WHERE callback_delivery_id=$1", deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp, err := r.processCallbackRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 {
+		return new(s.CallbackDelivery), nil
+	}
+
+	return resp[0], nil
+}
+
+//GetCallbackDeliveriesByRequestID Gets the callback deliveries of a Request
+func (r *Client) GetCallbackDeliveriesByRequestID(ctx context.Context, requestID int64) ([]*s.CallbackDelivery, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+callbackColumns+" FROM callback_delivery WHERE fk_request_id=$1 ORDER BY callback_delivery_id ASC", requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processCallbackRows(rows)
+}
+
+//GetPendingCallbackDeliveries Gets the pending callback deliveries that must be attempted until the given time
+func (r *Client) GetPendingCallbackDeliveries(ctx context.Context, until time.Time, limit int) ([]*s.CallbackDelivery, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+callbackColumns+" FROM callback_delivery WHERE status=$1 AND next_attempt_at<=$2 ORDER BY next_attempt_at ASC, callback_delivery_id ASC LIMIT $3", s.CallbackPending, until.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processCallbackRows(rows)
+}
+
+//UpdateCallbackDelivery Updates the delivery state of a callback
+func (r *Client) UpdateCallbackDelivery(ctx context.Context, d *s.CallbackDelivery, nextAttempt time.Time) error {
+
+	var delivered interface{}
+	if d.Status == s.CallbackDelivered {
+		delivered = time.Now().UTC()
+	}
+
+	_, err := r.conn().ExecContext(ctx, "UPDATE callback_delivery SET status=$1, attempts=$2, response_code=$3, last_error=$4, next_attempt_at=$5, delivered_at=COALESCE($6, delivered_at), updated_at=now() WHERE callback_delivery_id=$7",
+		d.Status, d.Attempts, d.ResponseCode, truncate(d.LastError, 255), nextAttempt.UTC(), delivered, d.CallbackDeliveryID)
+	if err != nil {
+		return fmt.Errorf("Could not update callback delivery %d", d.CallbackDeliveryID)
+	}
+
+	return nil
+}
+
+//InsertClient Registers a client with its secret
+func (r *Client) InsertClient(ctx context.Context, c *s.Client) error {
+
+	if _, err := r.conn().ExecContext(ctx, "INSERT INTO client (client_id, name, secret, previous_secret, created_at) VALUES ($1,$2,$3,'',now())", c.ClientID, c.Name, c.Secret); err != nil {
+		return fmt.Errorf("Error in insert client %s: %s", c.ClientID, err.Error())
+	}
+
+	return nil
+}
+
+//GetClientByID Gets a client and its secrets by its ID
+func (r *Client) GetClientByID(ctx context.Context, clientID string) (*s.Client, error) {
+	resp := new(s.Client)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT client_id, name, secret, previous_secret, "+date("created_at")+", "+date("rotated_at")+" FROM client WHERE client_id=$1", clientID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rotatedAt sql.NullString
+		if err := rows.Scan(&resp.ClientID, &resp.Name, &resp.Secret, &resp.PreviousSecret, &resp.CreatedAt, &rotatedAt); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp.RotatedAt = rotatedAt.String
+	}
+
+	return resp, rows.Err()
+}
+
+//UpdateClientSecrets Updates the active secrets of a client
+func (r *Client) UpdateClientSecrets(ctx context.Context, c *s.Client) error {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE client SET secret=$1, previous_secret=$2, rotated_at=now() WHERE client_id=$3", c.Secret, c.PreviousSecret, c.ClientID)
+	if err != nil {
+		return fmt.Errorf("Could not update secrets of client %s", c.ClientID)
+	}
+
+	affect, err := res.RowsAffected()
+	if err != nil || affect <= 0 {
+		return fmt.Errorf("Could not update secrets of client %s", c.ClientID)
+	}
+
+	return nil
+}
+
+//InsertStatusHistory Records a status change of a Request
+func (r *Client) InsertStatusHistory(ctx context.Context, h *s.StatusHistory) error {
+
+	err := r.conn().QueryRowContext(ctx, "INSERT INTO request_status_history (fk_request_id, from_status, to_status, source, description, created_at) VALUES ($1,$2,$3,$4,$5,now()) RETURNING status_history_id",
+		h.RequestID, h.FromStatus, h.ToStatus, h.Source, h.Description).Scan(&h.StatusHistoryID)
+	if err != nil {
+		return fmt.Errorf("Error in insert status history for Request %d: %s", h.RequestID, err.Error())
+	}
+
+	return nil
+}
+
+//GetStatusHistoryByRequestID Gets the status changes of a Request from the oldest to the newest
+func (r *Client) GetStatusHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.StatusHistory, error) {
+	resp := make([]*s.StatusHistory, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT status_history_id, fk_request_id, from_status, to_status, source, description, "+date("created_at")+" FROM request_status_history WHERE fk_request_id=$1 ORDER BY status_history_id ASC", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := new(s.StatusHistory)
+		if err := rows.Scan(&h.StatusHistoryID, &h.RequestID, &h.FromStatus, &h.ToStatus, &h.Source, &h.Description, &h.CreatedAt); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, h)
+	}
+
+	return resp, rows.Err()
+}
+
+//SaveTrackingObject Stores a tracking object and the events that are not stored yet
+func (r *Client) SaveTrackingObject(ctx context.Context, t *s.TrackingHeader) error {
+
+	_, err := r.conn().ExecContext(ctx, "INSERT INTO tracking_object (tracking_code, name, category, error, refreshed_at, created_at) VALUES ($1,$2,$3,$4,$5,now()) "+
+		"ON CONFLICT (tracking_code) DO UPDATE SET name=CASE WHEN EXCLUDED.error='' THEN EXCLUDED.name ELSE tracking_object.name END, "+
+		"category=CASE WHEN EXCLUDED.error='' THEN EXCLUDED.category ELSE tracking_object.category END, error=EXCLUDED.error, refreshed_at=EXCLUDED.refreshed_at",
+		t.Object, t.Name, t.Category, t.Error, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("Error in save tracking object %s: %s", t.Object, err.Error())
+	}
+
+	if len(t.Events) == 0 {
+		return nil
+	}
+
+	// the events already stored with the same type, status and date are ignored
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO tracking_event (tracking_code, event_type, status_code, event_date, event_at, description, details, responsible_unit, created_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,now()) "+
+		"ON CONFLICT (tracking_code, event_type, status_code, event_date) DO NOTHING")
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking event prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	for _, ev := range t.Events {
+		var eventAt interface{}
+		if at, err := time.Parse("02/01/2006 15:04", ev.DateTime); err == nil {
+			eventAt = at
+		}
+
+		if _, err := stmt.ExecContext(ctx, t.Object, ev.Type, ev.StatusCode, ev.DateTime, eventAt, truncate(ev.Description, 255), truncate(ev.Details, 255), truncate(ev.CTECorreios, 255)); err != nil {
+			return fmt.Errorf("Error in insert tracking event of %s: %s", t.Object, err.Error())
+		}
+	}
+
+	return nil
+}
+
+//SaveCorreiosFollow Stores the objects of a Request as replied by Correios and the statuses of its history that are not stored yet
+func (r *Client) SaveCorreiosFollow(ctx context.Context, requestID int64, objects []*s.RequestObject, history []*s.CorreiosHistory) error {
+
+	if len(objects) > 0 {
+		stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO request_object (fk_request_id, tracking_code, client_object_id, status, description, real_weight, cubic_weight, postage_value, last_update, created_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,now()) "+
+			"ON CONFLICT (fk_request_id, tracking_code) DO UPDATE SET status=EXCLUDED.status, description=EXCLUDED.description, real_weight=EXCLUDED.real_weight, cubic_weight=EXCLUDED.cubic_weight, postage_value=EXCLUDED.postage_value, last_update=EXCLUDED.last_update, client_object_id=EXCLUDED.client_object_id, updated_at=now()")
+		if err != nil {
+			return fmt.Errorf("Error in save request object prepared statement: %s", err.Error())
+		}
+		defer stmt.Close()
+
+		for _, o := range objects {
+			o.FkRequestID = requestID
+			if _, err := stmt.ExecContext(ctx, requestID, o.TrackingCode, o.ClientObjectID, o.Status, truncate(o.Description, 255), o.RealWeight, o.CubicWeight, o.PostageValue, o.LastUpdate); err != nil {
+				return fmt.Errorf("Error in save object %s of Request %d: %s", o.TrackingCode, requestID, err.Error())
+			}
+		}
+	}
+
+	if len(history) == 0 {
+		return nil
+	}
+
+	// the statuses already stored with the same date are ignored
+	stmt, err := r.conn().PrepareContext(ctx, "INSERT INTO request_correios_history (fk_request_id, status, description, observation, event_date, created_at) VALUES ($1,$2,$3,$4,$5,now()) "+
+		"ON CONFLICT (fk_request_id, status, event_date) DO NOTHING")
+	if err != nil {
+		return fmt.Errorf("Error in insert correios history prepared statement: %s", err.Error())
+	}
+	defer stmt.Close()
+
+	for _, h := range history {
+		if _, err := stmt.ExecContext(ctx, requestID, h.Status, truncate(h.Description, 255), truncate(h.Observation, 255), h.Date); err != nil {
+			return fmt.Errorf("Error in insert correios history of Request %d: %s", requestID, err.Error())
+		}
+	}
+
+	return nil
+}
+
+//GetRequestObjects Gets the objects of a Request as last replied by Correios
+func (r *Client) GetRequestObjects(ctx context.Context, requestID int64) ([]*s.RequestObject, error) {
+	resp := make([]*s.RequestObject, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT request_object_id, fk_request_id, tracking_code, client_object_id, status, description, real_weight, cubic_weight, postage_value, last_update FROM request_object WHERE fk_request_id=$1 ORDER BY request_object_id ASC", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o := new(s.RequestObject)
+		if err := rows.Scan(&o.RequestObjectID, &o.FkRequestID, &o.TrackingCode, &o.ClientObjectID, &o.Status, &o.Description, &o.RealWeight, &o.CubicWeight, &o.PostageValue, &o.LastUpdate); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, o)
+	}
+
+	return resp, rows.Err()
+}
+
+//GetCorreiosHistoryByRequestID Gets the statuses of a Request in Correios in the order they were stored
+func (r *Client) GetCorreiosHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.CorreiosHistory, error) {
+	resp := make([]*s.CorreiosHistory, 0)
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT status, description, observation, event_date FROM request_correios_history WHERE fk_request_id=$1 ORDER BY correios_history_id ASC", requestID)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := new(s.CorreiosHistory)
+		if err := rows.Scan(&h.Status, &h.Description, &h.Observation, &h.Date); err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		resp = append(resp, h)
+	}
+
+	return resp, rows.Err()
+}
+
+//GetTrackingObject Gets a stored tracking object with its events from the newest to the oldest, returns true if it was refreshed after freshSince
+func (r *Client) GetTrackingObject(ctx context.Context, code string, freshSince time.Time) (*s.TrackingHeader, bool, error) {
+	resp := new(s.TrackingHeader)
+	fresh := false
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT tracking_code, name, category, error, "+date("refreshed_at")+", refreshed_at>=$1 FROM tracking_object WHERE tracking_code=$2", freshSince.UTC(), code)
+	if err != nil {
+		return resp, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&resp.Object, &resp.Name, &resp.Category, &resp.Error, &resp.RefreshedAt, &fresh); err != nil {
+			return resp, false, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+	}
+	if err := rows.Err(); err != nil || resp.Object == "" {
+		return resp, false, err
+	}
+
+	events, _, err := r.GetTrackingEventsAfter(ctx, code, 0)
+	resp.Events = events
+
+	return resp, fresh, err
+}
+
+//GetTrackingEventsAfter Gets the events of an object stored after the given event, newest first, and the ID of the last stored event
+func (r *Client) GetTrackingEventsAfter(ctx context.Context, code string, eventID int64) ([]*s.TrackingEvents, int64, error) {
+	resp := make([]*s.TrackingEvents, 0)
+	lastID := eventID
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT tracking_event_id, event_type, status_code, event_date, description, details, responsible_unit FROM tracking_event WHERE tracking_code=$1 AND tracking_event_id>$2 ORDER BY event_at DESC NULLS LAST, tracking_event_id DESC", code, eventID)
+	if err != nil {
+		return resp, lastID, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		ev := new(s.TrackingEvents)
+		if err := rows.Scan(&id, &ev.Type, &ev.StatusCode, &ev.DateTime, &ev.Description, &ev.Details, &ev.CTECorreios); err != nil {
+			return resp, eventID, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		if id > lastID {
+			lastID = id
+		}
+		resp = append(resp, ev)
+	}
+
+	return resp, lastID, rows.Err()
+}
+
+//InsertTrackingJob Creates a tracking job with its objects
+func (r *Client) InsertTrackingJob(ctx context.Context, j *s.TrackingJob) error {
+
+	objects, err := json.Marshal(j.Objects)
+	if err != nil {
+		return err
+	}
+
+	err = r.conn().QueryRowContext(ctx, "INSERT INTO tracking_job (status, tracking_type, language, callback, client_id, objects, created_at) VALUES ($1,$2,$3,$4,$5,$6,now()) RETURNING job_id",
+		s.JobPending, j.TrackingType, j.Language, j.Callback, j.ClientID, string(objects)).Scan(&j.JobID)
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking job: %s", err.Error())
+	}
+	j.Status = s.JobPending
+	j.Attempts = 0
+	j.LeaseOwner = ""
+	j.LeaseUntil = ""
+
+	return nil
+}
+
+//GetTrackingJobByID Gets a tracking job and its result by its ID
+func (r *Client) GetTrackingJobByID(ctx context.Context, jobID int64) (*s.TrackingJob, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+trackingJobColumns+" FROM tracking_job WHERE job_id=$1", jobID)
+	if err != nil {
+		return new(s.TrackingJob), err
+	}
+	defer rows.Close()
+
+	jobs, err := r.processTrackingJobRows(rows)
+	if err != nil || len(jobs) == 0 {
+		return new(s.TrackingJob), err
+	}
+
+	return jobs[0], nil
+}
+
+//UpdateTrackingJob Updates the status and the result of a tracking job
+func (r *Client) UpdateTrackingJob(ctx context.Context, j *s.TrackingJob) error {
+
+	var result interface{}
+	if j.Result != nil {
+		b, err := json.Marshal(j.Result)
+		if err != nil {
+			return err
+		}
+		result = string(b)
+	}
+	finished := j.Status == s.JobDone || j.Status == s.JobFailed
+
+	_, err := r.conn().ExecContext(ctx, "UPDATE tracking_job SET status=$1, result=$2, error=$3, finished_at=CASE WHEN $4 THEN now() ELSE NULL END, updated_at=now() WHERE job_id=$5",
+		j.Status, result, truncate(j.Error, 255), finished, j.JobID)
+	if err != nil {
+		return fmt.Errorf("Could not update tracking job %d", j.JobID)
+	}
+
+	return nil
+}
+
+//GetRunnableTrackingJobs Gets the pending tracking jobs and the running ones whose lease ended before now
+func (r *Client) GetRunnableTrackingJobs(ctx context.Context, now time.Time, limit int) ([]*s.TrackingJob, error) {
+	rows, err := r.conn().QueryContext(ctx, rebind("SELECT "+trackingJobColumns+" FROM tracking_job WHERE "+runnableTrackingJob+" ORDER BY job_id ASC LIMIT ?"), s.JobPending, s.JobRunning, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processTrackingJobRows(rows)
+}
+
+//ClaimTrackingJob Takes the lease of a runnable tracking job until the given time and counts the attempt, returns false if the job is not runnable
+func (r *Client) ClaimTrackingJob(ctx context.Context, j *s.TrackingJob, owner string, until time.Time) (bool, error) {
+
+	err := r.conn().QueryRowContext(ctx, rebind("UPDATE tracking_job SET status=?, attempts=attempts+1, lease_owner=?, lease_until=?, updated_at=now() WHERE job_id=? AND "+runnableTrackingJob+" RETURNING attempts"),
+		s.JobRunning, owner, until.UTC(), j.JobID, s.JobPending, s.JobRunning, time.Now().UTC()).Scan(&j.Attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Could not claim tracking job %d: %s", j.JobID, err.Error())
+	}
+	j.Status = s.JobRunning
+	j.LeaseOwner = owner
+	j.LeaseUntil = until.UTC().Format("2006-01-02 15:04:05")
+
+	return true, nil
+}
+
+//InsertReverseJob Queues a call to the reverse logistics service of a Request
+func (r *Client) InsertReverseJob(ctx context.Context, j *s.ReverseJob) error {
+
+	err := r.conn().QueryRowContext(ctx, "INSERT INTO reverse_job (fk_request_id, action, source, status, attempts, created_at) VALUES ($1,$2,$3,$4,0,now()) RETURNING reverse_job_id",
+		j.RequestID, j.Action, j.Source, s.JobPending).Scan(&j.ReverseJobID)
+	if err != nil {
+		return fmt.Errorf("Error in insert reverse job for Request %d: %s", j.RequestID, err.Error())
+	}
+	j.Status = s.JobPending
+	j.Attempts = 0
+	j.LeaseOwner = ""
+	j.LeaseUntil = ""
+	j.LastError = ""
+
+	return nil
+}
+
+//GetReverseJobsByRequestID Gets the reverse jobs of a Request
+func (r *Client) GetReverseJobsByRequestID(ctx context.Context, requestID int64) ([]*s.ReverseJob, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+reverseJobColumns+" FROM reverse_job WHERE fk_request_id=$1 ORDER BY reverse_job_id ASC", requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processReverseJobRows(rows)
+}
+
+//GetRunnableReverseJobs Gets the pending jobs and the running ones whose lease ended before now,
+//a job is only runnable when the jobs queued before it for the same Request are finished
+func (r *Client) GetRunnableReverseJobs(ctx context.Context, now time.Time, limit int) ([]*s.ReverseJob, error) {
+	rows, err := r.conn().QueryContext(ctx, rebind("SELECT "+reverseJobColumns+" FROM reverse_job WHERE "+runnableReverseJob+" ORDER BY reverse_job_id ASC LIMIT ?"),
+		s.JobPending, s.JobRunning, now.UTC(), s.JobPending, s.JobRunning, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processReverseJobRows(rows)
+}
+
+//ClaimReverseJob Takes the lease of a runnable job until the given time and counts the attempt, returns false if the job is not runnable
+func (r *Client) ClaimReverseJob(ctx context.Context, j *s.ReverseJob, owner string, until time.Time) (bool, error) {
+
+	err := r.conn().QueryRowContext(ctx, rebind("UPDATE reverse_job SET status=?, attempts=attempts+1, lease_owner=?, lease_until=?, updated_at=now() WHERE reverse_job_id=? AND "+runnableReverseJob+" RETURNING attempts"),
+		s.JobRunning, owner, until.UTC(), j.ReverseJobID, s.JobPending, s.JobRunning, time.Now().UTC(), s.JobPending, s.JobRunning).Scan(&j.Attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Could not claim Job %d: %s", j.ReverseJobID, err.Error())
+	}
+	j.Status = s.JobRunning
+	j.LeaseOwner = owner
+	j.LeaseUntil = until.UTC().Format("2006-01-02 15:04:05")
+
+	return true, nil
+}
+
+//FinishReverseJob Stores the status and the error of a job whose lease is still held by its owner
+func (r *Client) FinishReverseJob(ctx context.Context, j *s.ReverseJob) error {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE reverse_job SET status=$1, last_error=$2, updated_at=now() WHERE reverse_job_id=$3 AND status=$4 AND lease_owner=$5",
+		j.Status, truncate(j.LastError, 255), j.ReverseJobID, s.JobRunning, j.LeaseOwner)
+	if err != nil {
+		return fmt.Errorf("Could not finish Job %d: %s", j.ReverseJobID, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("Could not finish Job %d, its lease was lost", j.ReverseJobID)
+	}
+
+	return nil
+}
+
+//AcquireLock Takes or renews a lock until the given time, returns false if another owner holds it
+func (r *Client) AcquireLock(ctx context.Context, name string, owner string, until time.Time) (bool, error) {
+	now := time.Now().UTC()
+
+	if _, err := r.conn().ExecContext(ctx, "INSERT INTO cron_lock (name, owner, locked_until) VALUES ($1,'',$2) ON CONFLICT (name) DO NOTHING", name, now); err != nil {
+		return false, fmt.Errorf("Could not acquire lock %s: %s", name, err.Error())
+	}
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE cron_lock SET owner=$1, locked_until=$2, updated_at=now() WHERE name=$3 AND (owner=$4 OR locked_until<=$5)", owner, until.UTC(), name, owner, now)
+	if err != nil {
+		return false, fmt.Errorf("Could not acquire lock %s: %s", name, err.Error())
+	}
+	n, _ := res.RowsAffected()
+
+	return n > 0, nil
+}
+
+//ReleaseLock Ends a lock held by the owner so another owner can take it at once
+func (r *Client) ReleaseLock(ctx context.Context, name string, owner string) error {
+
+	if _, err := r.conn().ExecContext(ctx, "UPDATE cron_lock SET locked_until=$1, updated_at=now() WHERE name=$2 AND owner=$3", time.Now().UTC(), name, owner); err != nil {
+		return fmt.Errorf("Could not release lock %s: %s", name, err.Error())
+	}
+
+	return nil
+}
+
+//GetSyncMark Gets the last day synced by the given sync, empty if it never ran
+func (r *Client) GetSyncMark(ctx context.Context, name string) (string, error) {
+	var day string
+
+	err := r.conn().QueryRowContext(ctx, "SELECT synced_until FROM sync_mark WHERE name=$1", name).Scan(&day)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("Could not read sync mark %s: %s", name, err.Error())
+	}
+
+	return day, nil
+}
+
+//SetSyncMark Stores the last day synced by the given sync
+func (r *Client) SetSyncMark(ctx context.Context, name string, day string) error {
+
+	_, err := r.conn().ExecContext(ctx, "INSERT INTO sync_mark (name, synced_until, updated_at) VALUES ($1,$2,now()) ON CONFLICT (name) DO UPDATE SET synced_until=excluded.synced_until, updated_at=excluded.updated_at", name, day)
+	if err != nil {
+		return fmt.Errorf("Could not store sync mark %s: %s", name, err.Error())
+	}
+
+	return nil
+}
+
+//InsertTrackingSubscription Creates a subscription to the new events of an object
+func (r *Client) InsertTrackingSubscription(ctx context.Context, t *s.TrackingSubscription, expiresAt time.Time) error {
+
+	err := r.conn().QueryRowContext(ctx, "INSERT INTO tracking_subscription (tracking_code, callback, client_id, stop_on, status, last_event_id, expires_at, created_at) VALUES ($1,$2,$3,$4,$5,0,$6,now()) RETURNING subscription_id",
+		t.Object, t.Callback, t.ClientID, t.StopOn, s.SubscriptionActive, expiresAt.UTC()).Scan(&t.SubscriptionID)
+	if err != nil {
+		return fmt.Errorf("Error in insert tracking subscription for %s: %s", t.Object, err.Error())
+	}
+	t.Status = s.SubscriptionActive
+	t.ExpiresAt = expiresAt.UTC().Format("2006-01-02 15:04:05")
+
+	return nil
+}
+
+//GetTrackingSubscriptionByID Gets a tracking subscription by its ID
+func (r *Client) GetTrackingSubscriptionByID(ctx context.Context, subscriptionID int64) (*s.TrackingSubscription, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+subscriptionColumns+" FROM tracking_subscription WHERE subscription_id=$1", subscriptionID)
+	if err != nil {
+		return new(s.TrackingSubscription), err
+	}
+	defer rows.Close()
+
+	resp, err := r.processSubscriptionRows(rows)
+	if err != nil || len(resp) == 0 {
+		return new(s.TrackingSubscription), err
+	}
+
+	return resp[0], nil
+}
+
+//GetActiveTrackingSubscriptions Gets the active tracking subscriptions after the given ID
+func (r *Client) GetActiveTrackingSubscriptions(ctx context.Context, afterID int64, limit int) ([]*s.TrackingSubscription, error) {
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+subscriptionColumns+" FROM tracking_subscription WHERE status=$1 AND subscription_id>$2 ORDER BY subscription_id ASC LIMIT $3", s.SubscriptionActive, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.processSubscriptionRows(rows)
+}
+
+//UpdateTrackingSubscription Updates the last notified event and the status of a tracking subscription
+func (r *Client) UpdateTrackingSubscription(ctx context.Context, t *s.TrackingSubscription) error {
+
+	_, err := r.conn().ExecContext(ctx, "UPDATE tracking_subscription SET status=$1, ended_reason=$2, last_event_id=$3, checked_at=$4, updated_at=now() WHERE subscription_id=$5",
+		t.Status, t.EndedReason, t.LastEventID, time.Now().UTC(), t.SubscriptionID)
+	if err != nil {
+		return fmt.Errorf("Could not update tracking subscription %d", t.SubscriptionID)
+	}
+
+	return nil
+}
+
+//EndExpiredTrackingSubscriptions Ends the active subscriptions that expired before now, returns the number of ended subscriptions
+func (r *Client) EndExpiredTrackingSubscriptions(ctx context.Context, now time.Time) (int64, error) {
+
+	res, err := r.conn().ExecContext(ctx, "UPDATE tracking_subscription SET status=$1, ended_reason=$2, updated_at=now() WHERE status=$3 AND expires_at<=$4", s.SubscriptionEnded, s.EndedExpired, s.SubscriptionActive, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("Could not end expired tracking subscriptions: %s", err.Error())
+	}
+
+	return res.RowsAffected()
+}
+
+//processSubscriptionRows Processes a Row result into TrackingSubscription structs
+func (r *Client) processSubscriptionRows(rows *sql.Rows) ([]*s.TrackingSubscription, error) {
+	resp := make([]*s.TrackingSubscription, 0)
+
+	for rows.Next() {
+		t := new(s.TrackingSubscription)
+		var checkedAt sql.NullString
+
+		err := rows.Scan(&t.SubscriptionID, &t.Object, &t.Callback, &t.ClientID, &t.StopOn, &t.Status, &t.EndedReason, &t.LastEventID, &t.ExpiresAt, &checkedAt, &t.CreatedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		t.CheckedAt = checkedAt.String
+
+		resp = append(resp, t)
+	}
+
+	return resp, rows.Err()
+}
+
+//processReverseJobRows Processes a Row result into ReverseJob structs
+func (r *Client) processReverseJobRows(rows *sql.Rows) ([]*s.ReverseJob, error) {
+	resp := make([]*s.ReverseJob, 0)
+
+	for rows.Next() {
+		j := new(s.ReverseJob)
+		var leaseUntil, updatedAt sql.NullString
+
+		err := rows.Scan(&j.ReverseJobID, &j.RequestID, &j.Action, &j.Source, &j.Status, &j.Attempts, &j.LeaseOwner, &leaseUntil, &j.LastError, &j.CreatedAt, &updatedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		j.LeaseUntil = leaseUntil.String
+		j.UpdatedAt = updatedAt.String
+
+		resp = append(resp, j)
+	}
+
+	return resp, rows.Err()
+}
+
+//processTrackingJobRows Processes a Row result into TrackingJob structs with their objects and results
+func (r *Client) processTrackingJobRows(rows *sql.Rows) ([]*s.TrackingJob, error) {
+	resp := make([]*s.TrackingJob, 0)
+
+	for rows.Next() {
+		j := new(s.TrackingJob)
+		var objects string
+		var result, leaseUntil, finishedAt sql.NullString
+
+		err := rows.Scan(&j.JobID, &j.Status, &j.TrackingType, &j.Language, &j.Callback, &j.ClientID, &objects, &result, &j.Error, &j.Attempts, &j.LeaseOwner, &leaseUntil, &j.CreatedAt, &finishedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		j.LeaseUntil = leaseUntil.String
+		j.FinishedAt = finishedAt.String
+
+		if err := json.Unmarshal([]byte(objects), &j.Objects); err != nil {
+			return resp, fmt.Errorf("Error reading objects of tracking job %d: %s", j.JobID, err.Error())
+		}
+		if result.Valid && result.String != "" {
+			j.Result = new(s.TrackingResponse)
+			if err := json.Unmarshal([]byte(result.String), j.Result); err != nil {
+				return resp, fmt.Errorf("Error reading result of tracking job %d: %s", j.JobID, err.Error())
+			}
+		}
+
+		resp = append(resp, j)
+	}
+
+	return resp, rows.Err()
+}
+
+//processCallbackRows Processes a Row result into CallbackDelivery structs
+func (r *Client) processCallbackRows(rows *sql.Rows) ([]*s.CallbackDelivery, error) {
+	resp := make([]*s.CallbackDelivery, 0)
+
+	for rows.Next() {
+		d := new(s.CallbackDelivery)
+		var deliveredAt, updatedAt sql.NullString
+
+		err := rows.Scan(&d.CallbackDeliveryID, &d.RequestID, &d.ClientID, &d.Type, &d.URL, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.LastError,
+			&d.NextAttemptAt, &deliveredAt, &d.CreatedAt, &updatedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		d.DeliveredAt = deliveredAt.String
+		d.UpdatedAt = updatedAt.String
+
+		resp = append(resp, d)
+	}
+
+	return resp, rows.Err()
+}
+
+//processRows Processes a Row result into Request structs and loads their items
+func (r *Client) processRows(ctx context.Context, rows *sql.Rows) ([]*s.Request, error) {
+	resp := make([]*s.Request, 0)
+
+	for rows.Next() {
+		req := new(s.Request)
+		var updatedAt sql.NullString
+		var services, documents string
+
+		err := rows.Scan(&req.RequestID, &req.RequestType, &req.RequestService, &req.ColectDate, &req.OrderNr, &req.SlipNumber, &req.OriginNome, &req.OriginLogradouro, &req.OriginNumero, &req.OriginComplemento, &req.OriginCep, &req.OriginBairro, &req.OriginCidade,
+			&req.OriginUf, &req.OriginReferencia, &req.OriginEmail, &req.OriginDdd, &req.OriginTelefone, &req.DestinationNome, &req.DestinationLogradouro, &req.DestinationNumero, &req.DestinationComplemento,
+			&req.DestinationCep, &req.DestinationBairro, &req.DestinationCidade, &req.DestinationUf, &req.DestinationReferencia, &req.DestinationEmail, &req.Callback, &req.Status, &req.ErrorMessage,
+			&req.Retries, &req.PostageCode, &req.TrackingCode, &req.CreatedAt, &updatedAt, &req.ClientID, &req.DeclaredValue, &services, &req.Ar, &req.Checklist, &documents)
+		if err != nil {
+			return resp, fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		req.UpdatedAt = updatedAt.String
+		req.AdditionalServices = repo.SplitList(services)
+		req.Documents = repo.SplitList(documents)
+
+		resp = append(resp, req)
+	}
+	if err := rows.Err(); err != nil {
+		return resp, err
+	}
+	// the items are read once the rows are closed as a transaction runs one query at a time
+	rows.Close()
+
+	return resp, r.loadItems(ctx, resp)
+}
+
+//loadItems Loads the items of the requests with a single query
+func (r *Client) loadItems(ctx context.Context, reqs []*s.Request) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	byID := make(map[int64]*s.Request, len(reqs))
+	args := make([]interface{}, 0, len(reqs))
+	for _, o := range reqs {
+		o.Items = make([]*s.RequestItem, 0)
+		byID[o.RequestID] = o
+		args = append(args, o.RequestID)
+	}
+
+	rows, err := r.conn().QueryContext(ctx, rebind("SELECT "+itemColumns+" FROM request_item WHERE fk_request_id IN ("+repo.Placeholders(len(args))+") ORDER BY order_item_id"), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := new(s.RequestItem)
+		if err := rows.Scan(&item.RequestItemID, &item.FkRequestID, &item.Item, &item.ProductName); err != nil {
+			return fmt.Errorf("Error reading rows: %s", err.Error())
+		}
+		if o, ok := byID[item.FkRequestID]; ok {
+			o.Items = append(o.Items, item)
+		}
+	}
+
+	return rows.Err()
+}
+
+//date Returns the column formatted as the dates returned by mysql
+func date(column string) string {
+	return "to_char(" + column + ", " + dateFormat + ")"
+}
+
+//rebind Replaces the ? placeholders of a query by the numbered postgres ones
+func rebind(query string) string {
+	var b bytes.Buffer
+	n := 0
+
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+//truncate Truncates a string to the given number of characters
+func truncate(value string, size int) string {
+	if r := []rune(value); len(r) > size {
+		return string(r[:size])
+	}
+	return value
+}
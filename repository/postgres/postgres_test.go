@@ -0,0 +1,34 @@
+package postgres
+
+import (
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/repository/repotest"
+	"os"
+	"testing"
+)
+
+//TestRepository Runs the conformance suite against the database of POSTGRES_TEST_DSN, every table of that database is dropped
+func TestRepository(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	repotest.Run(t, func(t *testing.T) repo.Definition {
+		r := new(Client)
+		if err := r.Connect(dsn); err != nil {
+			t.Fatalf("Connect: %s", err.Error())
+		}
+
+		// each test starts with an empty schema
+		m := r.Migrator()
+		if err := m.To(0); err != nil {
+			t.Fatalf("Reverting the migrations: %s", err.Error())
+		}
+		if _, err := m.Up(); err != nil {
+			t.Fatalf("Applying the migrations: %s", err.Error())
+		}
+
+		return r
+	})
+}
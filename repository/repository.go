@@ -1,18 +1,100 @@
 package repository
 
-import s "github.com/pintobikez/brazilian-correios-service/api/structures"
+import (
+	"context"
+	"database/sql"
+	s "github.com/pintobikez/brazilian-correios-service/api/structures"
+	"github.com/pintobikez/brazilian-correios-service/repository/migrate"
+	"strings"
+	"time"
+)
+
+//ListSeparator separator of the values of the list columns, the values can not have it
+const ListSeparator = "|"
 
 //Definition Interface definition for this api
 type Definition interface {
 	Connect(stringConn string) error
 	Disconnect()
-	InsertRequest(object *s.Request) error
-	FindRequestByID(requestID int64) (bool, error)
-	GetRequestBy(req *s.Search) ([]*s.Request, error)
-	GetRequestByID(requestID int) (*s.Request, error)
-	GetRequestByPostageCode(code string) (*s.Request, error)
-	UpdateRequest(object *s.Request) error
-	UpdateRequestStatus(object *s.Request, status string, message string) (int64, error)
-	UpdateRequestPostage(object *s.Request, code string) error
-	UpdateRequestTracking(o *s.Request, code string) error
+	Transaction(ctx context.Context, fn func(tx Definition) error) error
+	InsertRequest(ctx context.Context, object *s.Request) error
+	FindRequestByID(ctx context.Context, requestID int64) (bool, error)
+	GetRequestBy(ctx context.Context, req *s.Search) ([]*s.Request, error)
+	GetRequestByID(ctx context.Context, requestID int) (*s.Request, error)
+	GetRequestByPostageCode(ctx context.Context, code string) (*s.Request, error)
+	UpdateRequest(ctx context.Context, object *s.Request) error
+	SaveRequestPackages(ctx context.Context, requestID int64, packages []*s.RequestPackage) error
+	GetRequestPackages(ctx context.Context, requestID int64) ([]*s.RequestPackage, error)
+	UpdateRequestPackage(ctx context.Context, p *s.RequestPackage) error
+	SaveRequestProducts(ctx context.Context, requestID int64, products []*s.RequestProduct) error
+	GetRequestProducts(ctx context.Context, requestID int64) ([]*s.RequestProduct, error)
+	UpdateRequestStatus(ctx context.Context, object *s.Request, status string, message string) (int64, error)
+	UpdateRequestPostage(ctx context.Context, object *s.Request, code string) error
+	UpdateRequestTracking(ctx context.Context, o *s.Request, code string) error
+	InsertCallbackDelivery(ctx context.Context, d *s.CallbackDelivery) error
+	GetCallbackDeliveryByID(ctx context.Context, deliveryID int64) (*s.CallbackDelivery, error)
+	GetCallbackDeliveriesByRequestID(ctx context.Context, requestID int64) ([]*s.CallbackDelivery, error)
+	GetPendingCallbackDeliveries(ctx context.Context, until time.Time, limit int) ([]*s.CallbackDelivery, error)
+	UpdateCallbackDelivery(ctx context.Context, d *s.CallbackDelivery, nextAttempt time.Time) error
+	InsertClient(ctx context.Context, c *s.Client) error
+	GetClientByID(ctx context.Context, clientID string) (*s.Client, error)
+	UpdateClientSecrets(ctx context.Context, c *s.Client) error
+	InsertStatusHistory(ctx context.Context, h *s.StatusHistory) error
+	GetStatusHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.StatusHistory, error)
+	SaveCorreiosFollow(ctx context.Context, requestID int64, objects []*s.RequestObject, history []*s.CorreiosHistory) error
+	GetRequestObjects(ctx context.Context, requestID int64) ([]*s.RequestObject, error)
+	GetCorreiosHistoryByRequestID(ctx context.Context, requestID int64) ([]*s.CorreiosHistory, error)
+	SaveTrackingObject(ctx context.Context, t *s.TrackingHeader) error
+	GetTrackingObject(ctx context.Context, code string, freshSince time.Time) (*s.TrackingHeader, bool, error)
+	GetTrackingEventsAfter(ctx context.Context, code string, eventID int64) ([]*s.TrackingEvents, int64, error)
+	InsertTrackingJob(ctx context.Context, j *s.TrackingJob) error
+	GetTrackingJobByID(ctx context.Context, jobID int64) (*s.TrackingJob, error)
+	UpdateTrackingJob(ctx context.Context, j *s.TrackingJob) error
+	GetRunnableTrackingJobs(ctx context.Context, now time.Time, limit int) ([]*s.TrackingJob, error)
+	ClaimTrackingJob(ctx context.Context, j *s.TrackingJob, owner string, until time.Time) (bool, error)
+	InsertReverseJob(ctx context.Context, j *s.ReverseJob) error
+	GetReverseJobsByRequestID(ctx context.Context, requestID int64) ([]*s.ReverseJob, error)
+	GetRunnableReverseJobs(ctx context.Context, now time.Time, limit int) ([]*s.ReverseJob, error)
+	ClaimReverseJob(ctx context.Context, j *s.ReverseJob, owner string, until time.Time) (bool, error)
+	FinishReverseJob(ctx context.Context, j *s.ReverseJob) error
+	AcquireLock(ctx context.Context, name string, owner string, until time.Time) (bool, error)
+	ReleaseLock(ctx context.Context, name string, owner string) error
+	GetSyncMark(ctx context.Context, name string) (string, error)
+	SetSyncMark(ctx context.Context, name string, day string) error
+	InsertTrackingSubscription(ctx context.Context, t *s.TrackingSubscription, expiresAt time.Time) error
+	GetTrackingSubscriptionByID(ctx context.Context, subscriptionID int64) (*s.TrackingSubscription, error)
+	GetActiveTrackingSubscriptions(ctx context.Context, afterID int64, limit int) ([]*s.TrackingSubscription, error)
+	UpdateTrackingSubscription(ctx context.Context, t *s.TrackingSubscription) error
+	EndExpiredTrackingSubscriptions(ctx context.Context, now time.Time) (int64, error)
+}
+
+//Migratable a repository whose schema is versioned by migrations
+type Migratable interface {
+	Migrator() *migrate.Migrator
+}
+
+//Executor the methods shared by *sql.DB and *sql.Tx, the sql repositories run every statement through it
+type Executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+//JoinList Joins the values of a list column
+func JoinList(values []string) string {
+	return strings.Join(values, ListSeparator)
+}
+
+//SplitList Splits the value of a list column, an empty value has no values
+func SplitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ListSeparator)
+}
+
+//Placeholders Returns the placeholders of a list of n values
+func Placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
 }
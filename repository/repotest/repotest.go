@@ -0,0 +1,1223 @@
+//Package repotest checks that an implementation of repository.Definition keeps the contract the api,
+//the handler and the cronjobs rely on. Every backend runs the same suite from its own tests:
+//
+//	func TestRepository(t *testing.T) {
+//		repotest.Run(t, func(t *testing.T) repository.Definition {
+//			return memory.New()
+//		})
+//	}
+//
+//The factory must return a connected and empty repository, it is disconnected at the end of each test.
+package repotest
+
+import (
+	"context"
+	"errors"
+	s "github.com/pintobikez/brazilian-correios-service/api/structures"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"strings"
+	"testing"
+	"time"
+)
+
+//ctx context of every call of the tests
+var ctx = context.Background()
+
+//Factory returns a connected and empty repository
+type Factory func(t *testing.T) repo.Definition
+
+//Test a conformance test of a repository
+type Test struct {
+	Name string
+	Run  func(t *testing.T, r repo.Definition)
+}
+
+//Tests conformance tests of repository.Definition
+var Tests = []Test{
+	{"InsertRequest", testInsertRequest},
+	{"GetUnknownRequest", testGetUnknownRequest},
+	{"RequestWithoutItems", testRequestWithoutItems},
+	{"UpdateRequest", testUpdateRequest},
+	{"UpdateRequestItems", testUpdateRequestItems},
+	{"UpdateRequestStatus", testUpdateRequestStatus},
+	{"UpdateRequestPostage", testUpdateRequestPostage},
+	{"UpdateRequestTracking", testUpdateRequestTracking},
+	{"GetRequestBy", testGetRequestBy},
+	{"GetRequestByPagination", testGetRequestByPagination},
+	{"CallbackDeliveries", testCallbackDeliveries},
+	{"Clients", testClients},
+	{"StatusHistory", testStatusHistory},
+	{"TrackingObjects", testTrackingObjects},
+	{"TrackingJobs", testTrackingJobs},
+	{"TrackingJobLeases", testTrackingJobLeases},
+	{"TrackingSubscriptions", testTrackingSubscriptions},
+	{"ReverseJobs", testReverseJobs},
+	{"Locks", testLocks},
+	{"SyncMarks", testSyncMarks},
+	{"CorreiosFollow", testCorreiosFollow},
+	{"Packages", testPackages},
+	{"AdditionalServices", testAdditionalServices},
+	{"Transaction", testTransaction},
+}
+
+//Run Runs every conformance test against a new repository returned by the factory
+func Run(t *testing.T, factory Factory) {
+	for _, test := range Tests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			r := factory(t)
+			defer r.Disconnect()
+
+			test.Run(t, r)
+		})
+	}
+}
+
+//NewRequest Returns a valid request with the given order number and items
+func NewRequest(orderNr int64, items ...string) *s.Request {
+	o := &s.Request{
+		OrderNr: orderNr, RequestType: "POSTAGE", RequestService: "04677", SlipNumber: "123",
+		OriginNome: "Origin Name", OriginLogradouro: "Rua Origin", OriginNumero: 10, OriginCep: "01310100", OriginBairro: "Centro",
+		OriginCidade: "Sao Paulo", OriginUf: "SP", OriginEmail: "origin@mail.com", OriginDdd: "11", OriginTelefone: "999999999",
+		DestinationNome: "Destination Name", DestinationLogradouro: "Rua Destination", DestinationNumero: 20, DestinationCep: "20040002",
+		DestinationBairro: "Centro", DestinationCidade: "Rio de Janeiro", DestinationUf: "RJ", DestinationEmail: "destination@mail.com",
+		Callback: "http://localhost/callback", ClientID: "client",
+	}
+
+	for _, item := range items {
+		o.Items = append(o.Items, &s.RequestItem{Item: item, ProductName: "Product " + item})
+	}
+
+	return o
+}
+
+//insert Inserts the request failing the test on error
+func insert(t *testing.T, r repo.Definition, o *s.Request) *s.Request {
+	if err := r.InsertRequest(ctx, o); err != nil {
+		t.Fatalf("InsertRequest: %s", err.Error())
+	}
+	return o
+}
+
+//get Gets the request by its ID failing the test on error
+func get(t *testing.T, r repo.Definition, requestID int64) *s.Request {
+	o, err := r.GetRequestByID(ctx, int(requestID))
+	if err != nil {
+		t.Fatalf("GetRequestByID(%d): %s", requestID, err.Error())
+	}
+	return o
+}
+
+//moveTo Updates the status of the request failing the test on error
+func moveTo(t *testing.T, r repo.Definition, o *s.Request, status string) {
+	if _, err := r.UpdateRequestStatus(ctx, o, status, ""); err != nil {
+		t.Fatalf("UpdateRequestStatus(%s): %s", status, err.Error())
+	}
+}
+
+func testInsertRequest(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a", "b"))
+
+	if o.RequestID <= 0 {
+		t.Fatalf("RequestID not set: %d", o.RequestID)
+	}
+	if o.Status != s.StatusPending {
+		t.Errorf("Status = %q, want %q", o.Status, s.StatusPending)
+	}
+	for _, i := range o.Items {
+		if i.RequestItemID <= 0 || i.FkRequestID != o.RequestID {
+			t.Errorf("item %s: RequestItemID = %d, FkRequestID = %d", i.Item, i.RequestItemID, i.FkRequestID)
+		}
+	}
+	if o.Items[0].RequestItemID == o.Items[1].RequestItemID {
+		t.Errorf("items share the ID %d", o.Items[0].RequestItemID)
+	}
+
+	got := get(t, r, o.RequestID)
+	want := NewRequest(1, "a", "b")
+
+	if got.RequestID != o.RequestID || got.Status != s.StatusPending || got.CreatedAt == "" {
+		t.Errorf("got RequestID %d, Status %q, CreatedAt %q", got.RequestID, got.Status, got.CreatedAt)
+	}
+	if got.OrderNr != want.OrderNr || got.RequestType != want.RequestType || got.RequestService != want.RequestService || got.SlipNumber != want.SlipNumber ||
+		got.OriginNome != want.OriginNome || got.OriginNumero != want.OriginNumero || got.OriginCep != want.OriginCep || got.OriginUf != want.OriginUf ||
+		got.OriginTelefone != want.OriginTelefone || got.DestinationNome != want.DestinationNome || got.DestinationNumero != want.DestinationNumero ||
+		got.DestinationCidade != want.DestinationCidade || got.DestinationEmail != want.DestinationEmail || got.Callback != want.Callback || got.ClientID != want.ClientID {
+		t.Errorf("stored request differs: %+v", got)
+	}
+	if got.PostageCode != "" || got.TrackingCode != "" || got.ErrorMessage != "" || got.Retries != 0 {
+		t.Errorf("new request has PostageCode %q, TrackingCode %q, ErrorMessage %q, Retries %d", got.PostageCode, got.TrackingCode, got.ErrorMessage, got.Retries)
+	}
+
+	if len(got.Items) != 2 {
+		t.Fatalf("got %d items, want 2", len(got.Items))
+	}
+	for n, i := range got.Items {
+		if *i != *o.Items[n] {
+			t.Errorf("item %d = %+v, want %+v", n, i, o.Items[n])
+		}
+	}
+}
+
+func testGetUnknownRequest(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a"))
+
+	if got := get(t, r, o.RequestID+1000); got.RequestID != 0 {
+		t.Errorf("GetRequestByID of an unknown request returned %d", got.RequestID)
+	}
+
+	exists, err := r.FindRequestByID(ctx, o.RequestID)
+	if err != nil || !exists {
+		t.Errorf("FindRequestByID(%d) = %v, %v, want true", o.RequestID, exists, err)
+	}
+	exists, err = r.FindRequestByID(ctx, o.RequestID+1000)
+	if err != nil || exists {
+		t.Errorf("FindRequestByID of an unknown request = %v, %v, want false", exists, err)
+	}
+
+	got, err := r.GetRequestByPostageCode(ctx, "000000000")
+	if err != nil || got.RequestID != 0 {
+		t.Errorf("GetRequestByPostageCode of an unknown code = %d, %v", got.RequestID, err)
+	}
+}
+
+func testRequestWithoutItems(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1))
+	insert(t, r, NewRequest(2, "a"))
+
+	got := get(t, r, o.RequestID)
+	if got.RequestID != o.RequestID || got.Items == nil || len(got.Items) != 0 {
+		t.Fatalf("GetRequestByID = %d with items %v, want %d without items", got.RequestID, got.Items, o.RequestID)
+	}
+
+	if err := r.UpdateRequestPostage(ctx, got, "123456789"); err != nil {
+		t.Fatalf("UpdateRequestPostage: %s", err.Error())
+	}
+	got, err := r.GetRequestByPostageCode(ctx, "123456789")
+	if err != nil || got.RequestID != o.RequestID || len(got.Items) != 0 {
+		t.Errorf("GetRequestByPostageCode = %d, %v, want %d", got.RequestID, err, o.RequestID)
+	}
+
+	if orders := search(t, r, &s.Search{OrderField: "order_nr", OrderType: "ASC"}); !equal(orders, []int64{1, 2}) {
+		t.Errorf("GetRequestBy = %v, want [1 2]", orders)
+	}
+	if orders := search(t, r, &s.Search{Where: []*s.SearchWhere{{Field: "item", Operator: "!=", Value: "a"}}}); len(orders) != 0 {
+		t.Errorf("item search returned the requests %v", orders)
+	}
+}
+
+func testUpdateRequest(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a"))
+
+	o.OriginNome = "New Origin"
+	o.DestinationCep = "30130010"
+	if err := r.UpdateRequest(ctx, o); err != nil {
+		t.Fatalf("UpdateRequest: %s", err.Error())
+	}
+
+	got := get(t, r, o.RequestID)
+	if got.OriginNome != "New Origin" || got.DestinationCep != "30130010" {
+		t.Errorf("UpdateRequest not stored: OriginNome %q, DestinationCep %q", got.OriginNome, got.DestinationCep)
+	}
+	if got.Status != s.StatusPending || len(got.Items) != 1 {
+		t.Errorf("UpdateRequest changed Status %q or items %d", got.Status, len(got.Items))
+	}
+
+	// a request whose status changed meanwhile is not updated
+	stale := get(t, r, o.RequestID)
+	moveTo(t, r, o, s.StatusProcessing)
+	stale.OriginNome = "Stale Origin"
+	if err := r.UpdateRequest(ctx, stale); err == nil {
+		t.Errorf("UpdateRequest with a stale status did not fail")
+	}
+
+	if got := get(t, r, o.RequestID); got.OriginNome != "New Origin" || got.Status != s.StatusProcessing {
+		t.Errorf("UpdateRequest with a stale status stored OriginNome %q, Status %q", got.OriginNome, got.Status)
+	}
+}
+
+func testUpdateRequestItems(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a", "b"))
+
+	// a request without items keeps the stored ones
+	noItems := get(t, r, o.RequestID)
+	noItems.Items = nil
+	if err := r.UpdateRequest(ctx, noItems); err != nil {
+		t.Fatalf("UpdateRequest: %s", err.Error())
+	}
+	if got := get(t, r, o.RequestID); len(got.Items) != 2 {
+		t.Fatalf("UpdateRequest without items left %d items, want 2", len(got.Items))
+	}
+
+	n := get(t, r, o.RequestID)
+	n.Items = NewRequest(1, "c").Items
+	if err := r.UpdateRequest(ctx, n); err != nil {
+		t.Fatalf("UpdateRequest: %s", err.Error())
+	}
+	if n.Items[0].RequestItemID <= 0 || n.Items[0].FkRequestID != o.RequestID {
+		t.Errorf("new item: RequestItemID = %d, FkRequestID = %d", n.Items[0].RequestItemID, n.Items[0].FkRequestID)
+	}
+
+	got := get(t, r, o.RequestID)
+	if len(got.Items) != 1 || *got.Items[0] != *n.Items[0] {
+		t.Fatalf("items were not replaced: %d items", len(got.Items))
+	}
+}
+
+func testUpdateRequestStatus(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a"))
+	stale := get(t, r, o.RequestID)
+
+	o.Retries = 2
+	affected, err := r.UpdateRequestStatus(ctx, o, s.StatusError, "failed")
+	if err != nil || affected != 1 {
+		t.Fatalf("UpdateRequestStatus = %d, %v, want 1", affected, err)
+	}
+	if o.Status != s.StatusError || o.ErrorMessage != "failed" {
+		t.Errorf("struct not updated: Status %q, ErrorMessage %q", o.Status, o.ErrorMessage)
+	}
+
+	got := get(t, r, o.RequestID)
+	if got.Status != s.StatusError || got.ErrorMessage != "failed" || got.Retries != 2 {
+		t.Errorf("stored Status %q, ErrorMessage %q, Retries %d", got.Status, got.ErrorMessage, got.Retries)
+	}
+
+	// the struct still has the pending status
+	if _, err := r.UpdateRequestStatus(ctx, stale, s.StatusProcessing, ""); err == nil {
+		t.Errorf("UpdateRequestStatus with a stale status did not fail")
+	}
+	if stale.Status != s.StatusPending {
+		t.Errorf("failed UpdateRequestStatus changed the struct to %q", stale.Status)
+	}
+	if got := get(t, r, o.RequestID); got.Status != s.StatusError {
+		t.Errorf("UpdateRequestStatus with a stale status stored %q", got.Status)
+	}
+}
+
+func testUpdateRequestPostage(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a", "b"))
+	insert(t, r, NewRequest(2, "c"))
+	moveTo(t, r, o, s.StatusProcessing)
+	stale := get(t, r, o.RequestID)
+
+	if err := r.UpdateRequestPostage(ctx, o, "123456789"); err != nil {
+		t.Fatalf("UpdateRequestPostage: %s", err.Error())
+	}
+	if o.Status != s.StatusGenerated || o.PostageCode != "123456789" {
+		t.Errorf("struct not updated: Status %q, PostageCode %q", o.Status, o.PostageCode)
+	}
+
+	got, err := r.GetRequestByPostageCode(ctx, "123456789")
+	if err != nil {
+		t.Fatalf("GetRequestByPostageCode: %s", err.Error())
+	}
+	if got.RequestID != o.RequestID || got.Status != s.StatusGenerated || got.PostageCode != "123456789" || len(got.Items) != 2 {
+		t.Errorf("GetRequestByPostageCode = %d, %q, %q, %d items", got.RequestID, got.Status, got.PostageCode, len(got.Items))
+	}
+
+	if err := r.UpdateRequestPostage(ctx, stale, "987654321"); err == nil {
+		t.Errorf("UpdateRequestPostage with a stale status did not fail")
+	}
+	if got := get(t, r, o.RequestID); got.PostageCode != "123456789" {
+		t.Errorf("UpdateRequestPostage with a stale status stored %q", got.PostageCode)
+	}
+}
+
+func testUpdateRequestTracking(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a"))
+	moveTo(t, r, o, s.StatusProcessing)
+	if err := r.UpdateRequestPostage(ctx, o, "123456789"); err != nil {
+		t.Fatalf("UpdateRequestPostage: %s", err.Error())
+	}
+	stale := get(t, r, o.RequestID)
+
+	if err := r.UpdateRequestTracking(ctx, o, "PO444714015BR"); err != nil {
+		t.Fatalf("UpdateRequestTracking: %s", err.Error())
+	}
+	if o.Status != s.StatusUsed || o.TrackingCode != "PO444714015BR" {
+		t.Errorf("struct not updated: Status %q, TrackingCode %q", o.Status, o.TrackingCode)
+	}
+
+	got := get(t, r, o.RequestID)
+	if got.Status != s.StatusUsed || got.TrackingCode != "PO444714015BR" || got.PostageCode != "123456789" {
+		t.Errorf("stored Status %q, TrackingCode %q, PostageCode %q", got.Status, got.TrackingCode, got.PostageCode)
+	}
+
+	stale.Status = s.StatusGenerated
+	if err := r.UpdateRequestTracking(ctx, stale, "PO444714029BR"); err == nil {
+		t.Errorf("UpdateRequestTracking with a stale status did not fail")
+	}
+}
+
+//search Runs a search failing the test on error and returns the order numbers found
+func search(t *testing.T, r repo.Definition, req *s.Search) []int64 {
+	res, err := r.GetRequestBy(ctx, req)
+	if err != nil {
+		t.Fatalf("GetRequestBy: %s", err.Error())
+	}
+
+	orders := make([]int64, 0, len(res))
+	for _, o := range res {
+		orders = append(orders, o.OrderNr)
+	}
+	return orders
+}
+
+//equal Returns true if both lists have the same values in the same order
+func equal(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testGetRequestBy(t *testing.T, r repo.Definition) {
+	first := NewRequest(1, "a", "b")
+	first.OriginNome = "Maria Silva"
+	insert(t, r, first)
+
+	second := insert(t, r, NewRequest(2, "c"))
+	second.Retries = 1
+	moveTo(t, r, second, s.StatusError)
+
+	third := NewRequest(3, "d")
+	third.OriginNome = "Joao Souza"
+	insert(t, r, third)
+
+	asc := func(where []*s.SearchWhere, join string) *s.Search {
+		return &s.Search{Where: where, JoinBy: join, OrderField: "order_nr", OrderType: "ASC"}
+	}
+
+	cases := []struct {
+		name   string
+		search *s.Search
+		want   []int64
+	}{
+		{"all", asc(nil, ""), []int64{1, 2, 3}},
+		{"default order", &s.Search{}, []int64{3, 2, 1}},
+		{"equal", asc([]*s.SearchWhere{{Field: "status", Operator: "=", Value: s.StatusError}}, ""), []int64{2}},
+		{"numeric", asc([]*s.SearchWhere{{Field: "retries", Operator: "<", Value: float64(1)}}, ""), []int64{1, 3}},
+		{"in", asc([]*s.SearchWhere{{Field: "order_nr", Operator: "IN", Value: []interface{}{float64(1), float64(3)}}}, ""), []int64{1, 3}},
+		{"not in", asc([]*s.SearchWhere{{Field: "order_nr", Operator: "NOT IN", Value: []interface{}{float64(1), float64(3)}}}, ""), []int64{2}},
+		{"number on a text column", asc([]*s.SearchWhere{{Field: "slip_number", Operator: "=", Value: float64(123)}}, ""), []int64{1, 2, 3}},
+		{"numbers in a text column", asc([]*s.SearchWhere{{Field: "request_service", Operator: "IN", Value: []interface{}{float64(4677)}}}, ""), []int64{}},
+		{"like ignores case", asc([]*s.SearchWhere{{Field: "origin_nome", Operator: "LIKE", Value: "silva"}}, ""), []int64{1}},
+		{"like percent", asc([]*s.SearchWhere{{Field: "origin_nome", Operator: "LIKE", Value: "%"}}, ""), []int64{}},
+		{"like underscore", asc([]*s.SearchWhere{{Field: "origin_nome", Operator: "LIKE", Value: "a_s"}}, ""), []int64{}},
+		{"not like", asc([]*s.SearchWhere{{Field: "origin_nome", Operator: "NOT LIKE", Value: "a!s"}}, ""), []int64{1, 2, 3}},
+		{"item", asc([]*s.SearchWhere{{Field: "item", Operator: "=", Value: "d"}}, ""), []int64{3}},
+		{"any item", asc([]*s.SearchWhere{{Field: "item", Operator: "IN", Value: []interface{}{"a", "b", "c"}}}, ""), []int64{1, 2}},
+		{"items and request", asc([]*s.SearchWhere{{Field: "product_name", Operator: "LIKE", Value: "product"}, {Field: "order_nr", Operator: ">", Value: float64(1)}}, "AND"), []int64{2, 3}},
+		{"condition with joinby", asc([]*s.SearchWhere{{Field: "order_nr", Value: float64(1), JoinBy: "OR"}, {Field: "status", Value: s.StatusPending}}, "AND"), []int64{1}},
+		{"and", asc([]*s.SearchWhere{{Field: "status", Value: s.StatusPending}, {Field: "origin_nome", Operator: "LIKE", Value: "Joao"}}, "AND"), []int64{3}},
+		{"or group", asc([]*s.SearchWhere{
+			{Field: "status", Value: s.StatusPending},
+			{JoinBy: "OR", Where: []*s.SearchWhere{{Field: "order_nr", Value: float64(2)}, {Field: "order_nr", Value: float64(3)}}},
+		}, "AND"), []int64{3}},
+		{"or", asc([]*s.SearchWhere{{Field: "order_nr", Value: float64(1)}, {Field: "status", Value: s.StatusError}}, "OR"), []int64{1, 2}},
+	}
+
+	for _, c := range cases {
+		if got := search(t, r, c.search); !equal(got, c.want) {
+			t.Errorf("%s: got orders %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	res, err := r.GetRequestBy(ctx, asc([]*s.SearchWhere{{Field: "order_nr", Value: float64(1)}}, ""))
+	if err != nil || len(res) != 1 || len(res[0].Items) != 2 || res[0].Items[0].Item != "a" || res[0].Items[1].Item != "b" {
+		t.Errorf("search did not return the request with both items: %v", err)
+	}
+
+	// a condition on the items returns the request with all of its items
+	res, err = r.GetRequestBy(ctx, asc([]*s.SearchWhere{{Field: "item", Value: "b"}}, ""))
+	if err != nil || len(res) != 1 || len(res[0].Items) != 2 || res[0].Items[0].Item != "a" || res[0].Items[1].Item != "b" {
+		t.Errorf("item search did not return the request with both items: %v", err)
+	}
+
+	invalid := []*s.Search{
+		{Where: []*s.SearchWhere{{Field: "unknown", Value: "x"}}},
+		{Where: []*s.SearchWhere{{Field: "status", Operator: "REGEXP", Value: "x"}}},
+		{Where: []*s.SearchWhere{{Field: "order_nr", Value: "x"}}},
+		{Where: []*s.SearchWhere{{Field: "status", Value: true}}},
+		{OrderField: "origin_nome"},
+	}
+	for _, req := range invalid {
+		if _, err := r.GetRequestBy(ctx, req); err == nil {
+			t.Errorf("invalid search %+v did not fail", req)
+		}
+	}
+}
+
+func testGetRequestByPagination(t *testing.T, r repo.Definition) {
+	// the requests have a different number of items, or none, so the pages can not be counted by items
+	items := [][]string{{"a", "b", "c"}, {}, {"a", "b"}, {"a"}, {"a", "b", "c"}}
+	for n, names := range items {
+		insert(t, r, NewRequest(int64(n+1), names...))
+	}
+
+	req := func(field string, from int, offset int) *s.Search {
+		return &s.Search{OrderField: field, OrderType: "ASC", From: from, Offset: offset}
+	}
+
+	for _, field := range []string{"order_nr", "status"} {
+		if got := search(t, r, req(field, 0, 2)); !equal(got, []int64{1, 2}) {
+			t.Errorf("%s: first page = %v", field, got)
+		}
+		if got := search(t, r, req(field, 2, 2)); !equal(got, []int64{3, 4}) {
+			t.Errorf("%s: second page = %v", field, got)
+		}
+		if got := search(t, r, req(field, 4, 2)); !equal(got, []int64{5}) {
+			t.Errorf("%s: last page = %v", field, got)
+		}
+		if got := search(t, r, req(field, 10, 2)); len(got) != 0 {
+			t.Errorf("%s: page after the end = %v", field, got)
+		}
+	}
+
+	res, err := r.GetRequestBy(ctx, req("order_nr", 0, 3))
+	if err != nil || len(res) != 3 {
+		t.Fatalf("GetRequestBy = %d requests, %v", len(res), err)
+	}
+	for n, o := range res {
+		if len(o.Items) != len(items[n]) {
+			t.Errorf("request %d has %d items, want %d", o.OrderNr, len(o.Items), len(items[n]))
+		}
+	}
+}
+
+func testCallbackDeliveries(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a"))
+
+	first := &s.CallbackDelivery{RequestID: o.RequestID, ClientID: "client", Type: s.CallbackTypeRequest, URL: "http://localhost/a", Payload: `{"a":1}`}
+	second := &s.CallbackDelivery{RequestID: o.RequestID, Type: s.CallbackTypeRequest, URL: "http://localhost/b", Payload: `{"b":2}`}
+	other := &s.CallbackDelivery{Type: s.CallbackTypeTracking, URL: "http://localhost/c", Payload: `{}`}
+
+	for _, d := range []*s.CallbackDelivery{first, second, other} {
+		if err := r.InsertCallbackDelivery(ctx, d); err != nil {
+			t.Fatalf("InsertCallbackDelivery: %s", err.Error())
+		}
+		if d.CallbackDeliveryID <= 0 || d.Status != s.CallbackPending {
+			t.Errorf("InsertCallbackDelivery set ID %d, Status %q", d.CallbackDeliveryID, d.Status)
+		}
+	}
+
+	list, err := r.GetCallbackDeliveriesByRequestID(ctx, o.RequestID)
+	if err != nil || len(list) != 2 || list[0].CallbackDeliveryID != first.CallbackDeliveryID || list[1].CallbackDeliveryID != second.CallbackDeliveryID {
+		t.Fatalf("GetCallbackDeliveriesByRequestID returned %d deliveries, %v", len(list), err)
+	}
+	if list[0].URL != first.URL || list[0].Payload != first.Payload || list[0].ClientID != "client" || list[0].Type != s.CallbackTypeRequest || list[0].CreatedAt == "" {
+		t.Errorf("stored delivery differs: %+v", list[0])
+	}
+
+	soon := time.Now().Add(time.Minute)
+	if pending, err := r.GetPendingCallbackDeliveries(ctx, soon, 10); err != nil || len(pending) != 3 {
+		t.Errorf("GetPendingCallbackDeliveries returned %d deliveries, %v, want 3", len(pending), err)
+	}
+	if pending, err := r.GetPendingCallbackDeliveries(ctx, soon, 2); err != nil || len(pending) != 2 {
+		t.Errorf("GetPendingCallbackDeliveries with limit 2 returned %d deliveries, %v", len(pending), err)
+	}
+	if pending, err := r.GetPendingCallbackDeliveries(ctx, time.Now().Add(-time.Hour), 10); err != nil || len(pending) != 0 {
+		t.Errorf("GetPendingCallbackDeliveries before the first attempt returned %d deliveries, %v", len(pending), err)
+	}
+
+	first.Status = s.CallbackDelivered
+	first.Attempts = 1
+	first.ResponseCode = 200
+	if err := r.UpdateCallbackDelivery(ctx, first, time.Now()); err != nil {
+		t.Fatalf("UpdateCallbackDelivery: %s", err.Error())
+	}
+
+	second.Attempts = 1
+	second.ResponseCode = 500
+	second.LastError = "Callback responded with status 500"
+	if err := r.UpdateCallbackDelivery(ctx, second, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("UpdateCallbackDelivery: %s", err.Error())
+	}
+
+	pending, err := r.GetPendingCallbackDeliveries(ctx, soon, 10)
+	if err != nil || len(pending) != 1 || pending[0].CallbackDeliveryID != other.CallbackDeliveryID {
+		t.Errorf("GetPendingCallbackDeliveries after the updates returned %d deliveries, %v, want only %d", len(pending), err, other.CallbackDeliveryID)
+	}
+
+	got, err := r.GetCallbackDeliveryByID(ctx, first.CallbackDeliveryID)
+	if err != nil || got.Status != s.CallbackDelivered || got.Attempts != 1 || got.ResponseCode != 200 || got.DeliveredAt == "" {
+		t.Errorf("delivered callback = %+v, %v", got, err)
+	}
+	got, err = r.GetCallbackDeliveryByID(ctx, second.CallbackDeliveryID)
+	if err != nil || got.Status != s.CallbackPending || got.LastError != second.LastError || got.ResponseCode != 500 || got.DeliveredAt != "" {
+		t.Errorf("failed callback = %+v, %v", got, err)
+	}
+
+	if got, err := r.GetCallbackDeliveryByID(ctx, other.CallbackDeliveryID+1000); err != nil || got.CallbackDeliveryID != 0 {
+		t.Errorf("GetCallbackDeliveryByID of an unknown delivery = %d, %v", got.CallbackDeliveryID, err)
+	}
+}
+
+func testClients(t *testing.T, r repo.Definition) {
+	c := &s.Client{ClientID: "shop", Name: "Shop", Secret: "first"}
+	if err := r.InsertClient(ctx, c); err != nil {
+		t.Fatalf("InsertClient: %s", err.Error())
+	}
+	if err := r.InsertClient(ctx, &s.Client{ClientID: "shop", Name: "Other", Secret: "x"}); err == nil {
+		t.Errorf("InsertClient of a duplicated client did not fail")
+	}
+
+	got, err := r.GetClientByID(ctx, "shop")
+	if err != nil || got.ClientID != "shop" || got.Name != "Shop" || got.Secret != "first" || got.PreviousSecret != "" || got.CreatedAt == "" || got.RotatedAt != "" {
+		t.Errorf("GetClientByID = %+v, %v", got, err)
+	}
+
+	c.PreviousSecret = c.Secret
+	c.Secret = "second"
+	if err := r.UpdateClientSecrets(ctx, c); err != nil {
+		t.Fatalf("UpdateClientSecrets: %s", err.Error())
+	}
+	got, err = r.GetClientByID(ctx, "shop")
+	if err != nil || got.Secret != "second" || got.PreviousSecret != "first" || got.RotatedAt == "" {
+		t.Errorf("rotated client = %+v, %v", got, err)
+	}
+
+	if err := r.UpdateClientSecrets(ctx, &s.Client{ClientID: "unknown", Secret: "x"}); err == nil {
+		t.Errorf("UpdateClientSecrets of an unknown client did not fail")
+	}
+	if got, err := r.GetClientByID(ctx, "unknown"); err != nil || got.ClientID != "" {
+		t.Errorf("GetClientByID of an unknown client = %+v, %v", got, err)
+	}
+}
+
+func testStatusHistory(t *testing.T, r repo.Definition) {
+	changes := []*s.StatusHistory{
+		{RequestID: 1, FromStatus: "", ToStatus: s.StatusPending, Source: s.SourceAPI},
+		{RequestID: 2, FromStatus: "", ToStatus: s.StatusPending, Source: s.SourceAPI},
+		{RequestID: 1, FromStatus: s.StatusPending, ToStatus: s.StatusProcessing, Source: s.SourceCron, Description: "retry"},
+	}
+	for _, h := range changes {
+		if err := r.InsertStatusHistory(ctx, h); err != nil {
+			t.Fatalf("InsertStatusHistory: %s", err.Error())
+		}
+		if h.StatusHistoryID <= 0 {
+			t.Errorf("InsertStatusHistory did not set the ID")
+		}
+	}
+
+	got, err := r.GetStatusHistoryByRequestID(ctx, 1)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("GetStatusHistoryByRequestID returned %d changes, %v, want 2", len(got), err)
+	}
+	if got[0].ToStatus != s.StatusPending || got[1].FromStatus != s.StatusPending || got[1].ToStatus != s.StatusProcessing ||
+		got[1].Source != s.SourceCron || got[1].Description != "retry" || got[1].CreatedAt == "" {
+		t.Errorf("GetStatusHistoryByRequestID = %+v, %+v", got[0], got[1])
+	}
+
+	if got, err := r.GetStatusHistoryByRequestID(ctx, 3); err != nil || len(got) != 0 {
+		t.Errorf("GetStatusHistoryByRequestID of a request without changes returned %d changes, %v", len(got), err)
+	}
+}
+
+func testTrackingObjects(t *testing.T, r repo.Definition) {
+	code := "PO444714015BR"
+	before := time.Now().Add(-time.Minute)
+
+	posted := &s.TrackingEvents{Type: "PO", StatusCode: "01", DateTime: "01/02/2018 10:00", Description: "Objeto postado"}
+	moving := &s.TrackingEvents{Type: "RO", StatusCode: "01", DateTime: "02/02/2018 09:30", Description: "Objeto encaminhado"}
+	delivered := &s.TrackingEvents{Type: "BDE", StatusCode: "01", DateTime: "03/02/2018 15:45", Description: "Objeto entregue"}
+
+	if err := r.SaveTrackingObject(ctx, &s.TrackingHeader{Object: code, Name: "Encomenda", Category: "SEDEX", Events: []*s.TrackingEvents{moving, posted}}); err != nil {
+		t.Fatalf("SaveTrackingObject: %s", err.Error())
+	}
+
+	got, fresh, err := r.GetTrackingObject(ctx, code, before)
+	if err != nil || got.Object != code || got.Name != "Encomenda" || got.Category != "SEDEX" || got.RefreshedAt == "" || !fresh {
+		t.Fatalf("GetTrackingObject = %+v, %v, %v", got, fresh, err)
+	}
+	if len(got.Events) != 2 || got.Events[0].Type != "RO" || got.Events[1].Type != "PO" || got.Events[1].Description != "Objeto postado" {
+		t.Errorf("GetTrackingObject events are not the stored ones newest first: %d events", len(got.Events))
+	}
+	if _, fresh, _ := r.GetTrackingObject(ctx, code, time.Now().Add(time.Hour)); fresh {
+		t.Errorf("GetTrackingObject is fresh after a time in the future")
+	}
+
+	events, lastID, err := r.GetTrackingEventsAfter(ctx, code, 0)
+	if err != nil || len(events) != 2 || lastID <= 0 {
+		t.Fatalf("GetTrackingEventsAfter(0) = %d events, last %d, %v", len(events), lastID, err)
+	}
+
+	// a failed refresh keeps the stored data, the known events are ignored
+	if err := r.SaveTrackingObject(ctx, &s.TrackingHeader{Object: code, Error: "Objeto nao encontrado", Events: []*s.TrackingEvents{delivered, moving, posted}}); err != nil {
+		t.Fatalf("SaveTrackingObject: %s", err.Error())
+	}
+
+	got, _, err = r.GetTrackingObject(ctx, code, before)
+	if err != nil || got.Name != "Encomenda" || got.Error != "Objeto nao encontrado" || len(got.Events) != 3 || got.Events[0].Type != "BDE" {
+		t.Errorf("GetTrackingObject after the second save = %+v, %v", got, err)
+	}
+
+	events, newLastID, err := r.GetTrackingEventsAfter(ctx, code, lastID)
+	if err != nil || len(events) != 1 || events[0].Type != "BDE" || newLastID <= lastID {
+		t.Errorf("GetTrackingEventsAfter(%d) = %d events, last %d, %v", lastID, len(events), newLastID, err)
+	}
+	events, same, err := r.GetTrackingEventsAfter(ctx, code, newLastID)
+	if err != nil || len(events) != 0 || same != newLastID {
+		t.Errorf("GetTrackingEventsAfter the last event = %d events, last %d, %v", len(events), same, err)
+	}
+
+	if got, fresh, err := r.GetTrackingObject(ctx, "PO444714029BR", before); err != nil || got.Object != "" || fresh {
+		t.Errorf("GetTrackingObject of an unknown object = %+v, %v, %v", got, fresh, err)
+	}
+}
+
+func testTrackingJobs(t *testing.T, r repo.Definition) {
+	j := &s.TrackingJob{TrackingType: "L", Language: "PT", Callback: "http://localhost/jobs", ClientID: "client", Objects: []string{"PO444714015BR", "PO444714029BR"}}
+	if err := r.InsertTrackingJob(ctx, j); err != nil {
+		t.Fatalf("InsertTrackingJob: %s", err.Error())
+	}
+	if j.JobID <= 0 || j.Status != s.JobPending {
+		t.Errorf("InsertTrackingJob set ID %d, Status %q", j.JobID, j.Status)
+	}
+
+	got, err := r.GetTrackingJobByID(ctx, j.JobID)
+	if err != nil || got.Status != s.JobPending || got.TrackingType != "L" || got.Callback != j.Callback || got.ClientID != "client" ||
+		len(got.Objects) != 2 || got.Objects[1] != "PO444714029BR" || got.Result != nil || got.CreatedAt == "" || got.FinishedAt != "" {
+		t.Fatalf("GetTrackingJobByID = %+v, %v", got, err)
+	}
+
+	j.Status = s.JobRunning
+	if err := r.UpdateTrackingJob(ctx, j); err != nil {
+		t.Fatalf("UpdateTrackingJob: %s", err.Error())
+	}
+	if got, _ := r.GetTrackingJobByID(ctx, j.JobID); got.Status != s.JobRunning || got.FinishedAt != "" {
+		t.Errorf("running job = %+v", got)
+	}
+
+	j.Status = s.JobDone
+	j.Result = &s.TrackingResponse{Items: []*s.TrackingHeader{{Object: "PO444714015BR", Name: "Encomenda"}, {Object: "PO444714029BR", Error: "Objeto nao encontrado"}}}
+	if err := r.UpdateTrackingJob(ctx, j); err != nil {
+		t.Fatalf("UpdateTrackingJob: %s", err.Error())
+	}
+
+	got, err = r.GetTrackingJobByID(ctx, j.JobID)
+	if err != nil || got.Status != s.JobDone || got.FinishedAt == "" || got.Result == nil || len(got.Result.Items) != 2 || got.Result.Items[1].Error != "Objeto nao encontrado" {
+		t.Errorf("finished job = %+v, %v", got, err)
+	}
+
+	if got, err := r.GetTrackingJobByID(ctx, j.JobID+1000); err != nil || got.JobID != 0 {
+		t.Errorf("GetTrackingJobByID of an unknown job = %d, %v", got.JobID, err)
+	}
+}
+
+func runnableTrackingJobs(t *testing.T, r repo.Definition, now time.Time) []int64 {
+	jobs, err := r.GetRunnableTrackingJobs(ctx, now, 10)
+	if err != nil {
+		t.Fatalf("GetRunnableTrackingJobs: %s", err.Error())
+	}
+
+	ids := make([]int64, 0, len(jobs))
+	for _, j := range jobs {
+		ids = append(ids, j.JobID)
+	}
+	return ids
+}
+
+func testTrackingJobLeases(t *testing.T, r repo.Definition) {
+	first := &s.TrackingJob{TrackingType: "L", Language: "PT", Objects: []string{"PO444714015BR"}}
+	second := &s.TrackingJob{TrackingType: "L", Language: "PT", Objects: []string{"PO444714029BR"}}
+	for _, j := range []*s.TrackingJob{first, second} {
+		if err := r.InsertTrackingJob(ctx, j); err != nil {
+			t.Fatalf("InsertTrackingJob: %s", err.Error())
+		}
+		if j.Attempts != 0 || j.LeaseOwner != "" {
+			t.Errorf("InsertTrackingJob set Attempts %d, LeaseOwner %q", j.Attempts, j.LeaseOwner)
+		}
+	}
+
+	now := time.Now()
+	if got := runnableTrackingJobs(t, r, now); !equal(got, []int64{first.JobID, second.JobID}) {
+		t.Errorf("runnable tracking jobs = %v", got)
+	}
+
+	if ok, err := r.ClaimTrackingJob(ctx, first, "worker-1", now.Add(time.Minute)); !ok || err != nil {
+		t.Fatalf("ClaimTrackingJob = %v, %v", ok, err)
+	}
+	if first.Status != s.JobRunning || first.Attempts != 1 || first.LeaseOwner != "worker-1" || first.LeaseUntil == "" {
+		t.Errorf("claimed tracking job = %+v", first)
+	}
+	if ok, err := r.ClaimTrackingJob(ctx, first, "worker-2", now.Add(time.Minute)); ok || err != nil {
+		t.Errorf("ClaimTrackingJob of a leased job = %v, %v", ok, err)
+	}
+	if got := runnableTrackingJobs(t, r, now); !equal(got, []int64{second.JobID}) {
+		t.Errorf("runnable tracking jobs with a leased job = %v", got)
+	}
+
+	// a lease that ended is taken by another worker
+	if ok, err := r.ClaimTrackingJob(ctx, second, "worker-1", now.Add(-time.Minute)); !ok || err != nil {
+		t.Fatalf("ClaimTrackingJob = %v, %v", ok, err)
+	}
+	if got := runnableTrackingJobs(t, r, now); !equal(got, []int64{second.JobID}) {
+		t.Errorf("runnable tracking jobs with an ended lease = %v", got)
+	}
+	if ok, err := r.ClaimTrackingJob(ctx, second, "worker-2", now.Add(time.Minute)); !ok || err != nil || second.Attempts != 2 || second.LeaseOwner != "worker-2" {
+		t.Fatalf("ClaimTrackingJob of an ended lease = %v, %v, %+v", ok, err, second)
+	}
+	if got, err := r.GetTrackingJobByID(ctx, second.JobID); err != nil || got.Attempts != 2 || got.LeaseOwner != "worker-2" || len(got.Objects) != 1 {
+		t.Errorf("GetTrackingJobByID of a claimed job = %+v, %v", got, err)
+	}
+
+	// a finished job is not runnable
+	for _, j := range []*s.TrackingJob{first, second} {
+		j.Status = s.JobDone
+		if err := r.UpdateTrackingJob(ctx, j); err != nil {
+			t.Fatalf("UpdateTrackingJob: %s", err.Error())
+		}
+	}
+	if got := runnableTrackingJobs(t, r, now.Add(time.Hour)); len(got) != 0 {
+		t.Errorf("runnable tracking jobs after they finished = %v", got)
+	}
+	if ok, err := r.ClaimTrackingJob(ctx, first, "worker-1", now.Add(time.Minute)); ok || err != nil {
+		t.Errorf("ClaimTrackingJob of a finished job = %v, %v", ok, err)
+	}
+}
+
+func runnableJobs(t *testing.T, r repo.Definition, now time.Time) []int64 {
+	jobs, err := r.GetRunnableReverseJobs(ctx, now, 10)
+	if err != nil {
+		t.Fatalf("GetRunnableReverseJobs: %s", err.Error())
+	}
+
+	ids := make([]int64, 0, len(jobs))
+	for _, j := range jobs {
+		ids = append(ids, j.ReverseJobID)
+	}
+	return ids
+}
+
+func testReverseJobs(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1001, "A"))
+	other := insert(t, r, NewRequest(1002, "B"))
+
+	create := &s.ReverseJob{RequestID: o.RequestID, Action: s.ActionCreate, Source: s.SourceAPI}
+	cancel := &s.ReverseJob{RequestID: o.RequestID, Action: s.ActionCancel, Source: s.SourceAPI}
+	retry := &s.ReverseJob{RequestID: other.RequestID, Action: s.ActionCreate, Source: s.SourceCron}
+	for _, j := range []*s.ReverseJob{create, cancel, retry} {
+		if err := r.InsertReverseJob(ctx, j); err != nil {
+			t.Fatalf("InsertReverseJob: %s", err.Error())
+		}
+		if j.ReverseJobID <= 0 || j.Status != s.JobPending || j.Attempts != 0 {
+			t.Errorf("InsertReverseJob set ID %d, Status %q, Attempts %d", j.ReverseJobID, j.Status, j.Attempts)
+		}
+	}
+
+	jobs, err := r.GetReverseJobsByRequestID(ctx, o.RequestID)
+	if err != nil || len(jobs) != 2 || jobs[0].ReverseJobID != create.ReverseJobID || jobs[1].Action != s.ActionCancel || jobs[0].Source != s.SourceAPI || jobs[0].CreatedAt == "" {
+		t.Fatalf("GetReverseJobsByRequestID = %+v, %v", jobs, err)
+	}
+
+	// the cancel waits for the create of the same request
+	now := time.Now()
+	if got := runnableJobs(t, r, now); !equal(got, []int64{create.ReverseJobID, retry.ReverseJobID}) {
+		t.Errorf("runnable jobs = %v", got)
+	}
+	if ok, err := r.ClaimReverseJob(ctx, cancel, "worker-1", now.Add(time.Minute)); ok || err != nil {
+		t.Errorf("ClaimReverseJob of a job queued after an unfinished one = %v, %v", ok, err)
+	}
+
+	if ok, err := r.ClaimReverseJob(ctx, create, "worker-1", now.Add(time.Minute)); !ok || err != nil {
+		t.Fatalf("ClaimReverseJob = %v, %v", ok, err)
+	}
+	if create.Status != s.JobRunning || create.Attempts != 1 || create.LeaseOwner != "worker-1" || create.LeaseUntil == "" {
+		t.Errorf("claimed job = %+v", create)
+	}
+	if ok, err := r.ClaimReverseJob(ctx, create, "worker-2", now.Add(time.Minute)); ok || err != nil {
+		t.Errorf("ClaimReverseJob of a leased job = %v, %v", ok, err)
+	}
+	if got := runnableJobs(t, r, now); !equal(got, []int64{retry.ReverseJobID}) {
+		t.Errorf("runnable jobs with a leased job = %v", got)
+	}
+
+	// a lease that ended is taken by another worker and the previous owner can no longer finish the job
+	expired := &s.ReverseJob{ReverseJobID: retry.ReverseJobID, RequestID: retry.RequestID}
+	if ok, err := r.ClaimReverseJob(ctx, expired, "worker-1", now.Add(-time.Minute)); !ok || err != nil {
+		t.Fatalf("ClaimReverseJob = %v, %v", ok, err)
+	}
+	if got := runnableJobs(t, r, now); !equal(got, []int64{retry.ReverseJobID}) {
+		t.Errorf("runnable jobs with an ended lease = %v", got)
+	}
+	retry.LeaseOwner = ""
+	if ok, err := r.ClaimReverseJob(ctx, retry, "worker-2", now.Add(time.Minute)); !ok || err != nil || retry.Attempts != 2 || retry.LeaseOwner != "worker-2" {
+		t.Fatalf("ClaimReverseJob of an ended lease = %v, %v, %+v", ok, err, retry)
+	}
+	expired.Status = s.JobDone
+	if err := r.FinishReverseJob(ctx, expired); err == nil {
+		t.Errorf("FinishReverseJob by the previous owner succeeded")
+	}
+	retry.Status = s.JobFailed
+	retry.LastError = "Timeout"
+	if err := r.FinishReverseJob(ctx, retry); err != nil {
+		t.Fatalf("FinishReverseJob: %s", err.Error())
+	}
+	if jobs, _ := r.GetReverseJobsByRequestID(ctx, other.RequestID); len(jobs) != 1 || jobs[0].Status != s.JobFailed || jobs[0].LastError != "Timeout" || jobs[0].Attempts != 2 {
+		t.Errorf("failed job = %+v", jobs)
+	}
+
+	// the cancel runs once the create is finished
+	create.Status = s.JobDone
+	if err := r.FinishReverseJob(ctx, create); err != nil {
+		t.Fatalf("FinishReverseJob: %s", err.Error())
+	}
+	if err := r.FinishReverseJob(ctx, create); err == nil {
+		t.Errorf("FinishReverseJob of a finished job succeeded")
+	}
+	if got := runnableJobs(t, r, now); !equal(got, []int64{cancel.ReverseJobID}) {
+		t.Errorf("runnable jobs after the create = %v", got)
+	}
+	if ok, err := r.ClaimReverseJob(ctx, cancel, "worker-1", now.Add(time.Minute)); !ok || err != nil {
+		t.Errorf("ClaimReverseJob after the create = %v, %v", ok, err)
+	}
+}
+
+func acquire(t *testing.T, r repo.Definition, name string, owner string, until time.Time) bool {
+	ok, err := r.AcquireLock(ctx, name, owner, until)
+	if err != nil {
+		t.Fatalf("AcquireLock: %s", err.Error())
+	}
+	return ok
+}
+
+func testLocks(t *testing.T, r repo.Definition) {
+	now := time.Now()
+
+	if !acquire(t, r, "cronjobs", "a", now.Add(time.Minute)) {
+		t.Fatalf("AcquireLock of a new lock failed")
+	}
+	if acquire(t, r, "cronjobs", "b", now.Add(time.Minute)) {
+		t.Errorf("AcquireLock of a held lock succeeded")
+	}
+	if !acquire(t, r, "cronjobs", "a", now.Add(time.Minute)) || !acquire(t, r, "cronjobs", "a", now.Add(2*time.Minute)) {
+		t.Errorf("AcquireLock by its owner failed")
+	}
+	if !acquire(t, r, "other", "b", now.Add(time.Minute)) {
+		t.Errorf("AcquireLock of another lock failed")
+	}
+
+	// a released lock is taken at once
+	if err := r.ReleaseLock(ctx, "cronjobs", "b"); err != nil {
+		t.Fatalf("ReleaseLock: %s", err.Error())
+	}
+	if acquire(t, r, "cronjobs", "b", now.Add(time.Minute)) {
+		t.Errorf("AcquireLock of a lock released by another owner succeeded")
+	}
+	if err := r.ReleaseLock(ctx, "cronjobs", "a"); err != nil {
+		t.Fatalf("ReleaseLock: %s", err.Error())
+	}
+	if !acquire(t, r, "cronjobs", "b", now.Add(-time.Minute)) {
+		t.Errorf("AcquireLock of a released lock failed")
+	}
+
+	// an ended lock is taken by another owner
+	if !acquire(t, r, "cronjobs", "a", now.Add(time.Minute)) {
+		t.Errorf("AcquireLock of an ended lock failed")
+	}
+	if acquire(t, r, "cronjobs", "b", now.Add(time.Minute)) {
+		t.Errorf("AcquireLock of a held lock succeeded")
+	}
+}
+
+func testPackages(t *testing.T, r repo.Definition) {
+	o := insert(t, r, NewRequest(1, "a"))
+	other := insert(t, r, NewRequest(2, "b"))
+
+	packages := []*s.RequestPackage{{ObjectID: "box-2", Description: "Shoes", Coleta: 1}, {ObjectID: "box-1", Description: "Shirts"}, {ObjectID: "box-3", Coleta: 1}}
+	if err := r.SaveRequestPackages(ctx, o.RequestID, packages); err != nil {
+		t.Fatalf("SaveRequestPackages: %s", err.Error())
+	}
+	for _, p := range packages {
+		if p.RequestPackageID <= 0 || p.FkRequestID != o.RequestID {
+			t.Errorf("SaveRequestPackages did not set the IDs of %s", p.ObjectID)
+		}
+	}
+
+	got, err := r.GetRequestPackages(ctx, o.RequestID)
+	if err != nil || len(got) != 3 {
+		t.Fatalf("GetRequestPackages returned %d packages, %v, want 3", len(got), err)
+	}
+	if got[0].ObjectID != "box-1" || got[1].ObjectID != "box-2" || got[2].ObjectID != "box-3" || got[1].Description != "Shoes" || got[1].Coleta != 1 {
+		t.Errorf("GetRequestPackages = %+v, %+v, %+v", got[0], got[1], got[2])
+	}
+
+	got[1].PostageCode = "123456789"
+	got[1].TrackingCode = "LR100000001BR"
+	if err := r.UpdateRequestPackage(ctx, got[1]); err != nil {
+		t.Fatalf("UpdateRequestPackage: %s", err.Error())
+	}
+	if found, err := r.GetRequestByPostageCode(ctx, "123456789"); err != nil || found.RequestID != o.RequestID {
+		t.Errorf("GetRequestByPostageCode of a package = %d, %v, want %d", found.RequestID, err, o.RequestID)
+	}
+	if got, _ := r.GetRequestPackages(ctx, o.RequestID); got[1].PostageCode != "123456789" || got[1].TrackingCode != "LR100000001BR" {
+		t.Errorf("UpdateRequestPackage stored %q, %q", got[1].PostageCode, got[1].TrackingCode)
+	}
+
+	// saving again replaces the packages
+	if err := r.SaveRequestPackages(ctx, o.RequestID, []*s.RequestPackage{{ObjectID: "box-9"}}); err != nil {
+		t.Fatalf("SaveRequestPackages again: %s", err.Error())
+	}
+	if got, err := r.GetRequestPackages(ctx, o.RequestID); err != nil || len(got) != 1 || got[0].ObjectID != "box-9" {
+		t.Errorf("GetRequestPackages after a replace returned %d packages, %v", len(got), err)
+	}
+	if got, err := r.GetRequestPackages(ctx, other.RequestID); err != nil || len(got) != 0 {
+		t.Errorf("GetRequestPackages of another request returned %d packages, %v", len(got), err)
+	}
+}
+
+func testAdditionalServices(t *testing.T, r repo.Definition) {
+	o := NewRequest(1, "a")
+	o.DeclaredValue = 150.25
+	o.AdditionalServices = []string{"019", "049"}
+	o.Ar = true
+	o.Checklist = "DOCUMENT"
+	o.Documents = []string{"RG", "CPF"}
+	o = insert(t, r, o)
+
+	got := get(t, r, o.RequestID)
+	if got.DeclaredValue != 150.25 || strings.Join(got.AdditionalServices, ",") != "019,049" || !got.Ar || got.Checklist != "DOCUMENT" || strings.Join(got.Documents, ",") != "RG,CPF" {
+		t.Errorf("GetRequestByID = %v %v %v %q %v", got.DeclaredValue, got.AdditionalServices, got.Ar, got.Checklist, got.Documents)
+	}
+
+	got.DeclaredValue = 0
+	got.AdditionalServices = nil
+	got.Ar = false
+	got.Checklist = ""
+	got.Documents = nil
+	if err := r.UpdateRequest(ctx, got); err != nil {
+		t.Fatalf("UpdateRequest: %s", err.Error())
+	}
+	if got := get(t, r, o.RequestID); got.DeclaredValue != 0 || len(got.AdditionalServices) != 0 || got.Ar || got.Checklist != "" || len(got.Documents) != 0 {
+		t.Errorf("UpdateRequest stored %v %v %v %q %v", got.DeclaredValue, got.AdditionalServices, got.Ar, got.Checklist, got.Documents)
+	}
+
+	products := []*s.RequestProduct{{Code: "116600063", Type: "2", Quantity: 3}, {Code: "116600055", Type: "2", Quantity: 1}}
+	if err := r.SaveRequestProducts(ctx, o.RequestID, products); err != nil {
+		t.Fatalf("SaveRequestProducts: %s", err.Error())
+	}
+	for _, p := range products {
+		if p.RequestProductID <= 0 || p.FkRequestID != o.RequestID {
+			t.Errorf("SaveRequestProducts did not set the IDs of %s", p.Code)
+		}
+	}
+	if got, err := r.GetRequestProducts(ctx, o.RequestID); err != nil || len(got) != 2 || got[0].Code != "116600063" || got[0].Quantity != 3 || got[1].Code != "116600055" {
+		t.Errorf("GetRequestProducts returned %d products, %v", len(got), err)
+	}
+
+	// saving again replaces the products
+	if err := r.SaveRequestProducts(ctx, o.RequestID, nil); err != nil {
+		t.Fatalf("SaveRequestProducts again: %s", err.Error())
+	}
+	if got, err := r.GetRequestProducts(ctx, o.RequestID); err != nil || len(got) != 0 {
+		t.Errorf("GetRequestProducts after a replace returned %d products, %v", len(got), err)
+	}
+}
+
+func testCorreiosFollow(t *testing.T, r repo.Definition) {
+	objects := []*s.RequestObject{{TrackingCode: "LR100000001BR", Status: "55", Description: "Aguardando Objeto", RealWeight: 0.3, CubicWeight: 0.5, PostageValue: 21.5, LastUpdate: "2018-01-30 10:00:00"}}
+	history := []*s.CorreiosHistory{{Status: "55", Description: "Aguardando Objeto", Date: "2018-01-30 10:00:00"}}
+	if err := r.SaveCorreiosFollow(ctx, 1, objects, history); err != nil {
+		t.Fatalf("SaveCorreiosFollow: %s", err.Error())
+	}
+	if objects[0].FkRequestID != 1 {
+		t.Errorf("SaveCorreiosFollow did not set the request of the object")
+	}
+
+	// a follow replied again updates the object and only adds the new statuses
+	objects[0].Status = "0"
+	objects[0].PostageValue = 23.75
+	history = append(history, &s.CorreiosHistory{Status: "0", Description: "Coletado", Date: "2018-01-31 09:30:00", Observation: "ok"})
+	if err := r.SaveCorreiosFollow(ctx, 1, objects, history); err != nil {
+		t.Fatalf("SaveCorreiosFollow again: %s", err.Error())
+	}
+
+	got, err := r.GetRequestObjects(ctx, 1)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("GetRequestObjects returned %d objects, %v, want 1", len(got), err)
+	}
+	if got[0].RequestObjectID <= 0 || got[0].TrackingCode != "LR100000001BR" || got[0].Status != "0" || got[0].RealWeight != 0.3 ||
+		got[0].CubicWeight != 0.5 || got[0].PostageValue != 23.75 || got[0].LastUpdate != "2018-01-30 10:00:00" {
+		t.Errorf("GetRequestObjects = %+v", got[0])
+	}
+
+	hist, err := r.GetCorreiosHistoryByRequestID(ctx, 1)
+	if err != nil || len(hist) != 2 {
+		t.Fatalf("GetCorreiosHistoryByRequestID returned %d statuses, %v, want 2", len(hist), err)
+	}
+	if hist[0].Status != "55" || hist[1].Status != "0" || hist[1].Observation != "ok" || hist[1].Date != "2018-01-31 09:30:00" {
+		t.Errorf("GetCorreiosHistoryByRequestID = %+v, %+v", hist[0], hist[1])
+	}
+
+	if got, err := r.GetRequestObjects(ctx, 2); err != nil || len(got) != 0 {
+		t.Errorf("GetRequestObjects of another request returned %d objects, %v", len(got), err)
+	}
+	if hist, err := r.GetCorreiosHistoryByRequestID(ctx, 2); err != nil || len(hist) != 0 {
+		t.Errorf("GetCorreiosHistoryByRequestID of another request returned %d statuses, %v", len(hist), err)
+	}
+}
+
+func testSyncMarks(t *testing.T, r repo.Definition) {
+	if day, err := r.GetSyncMark(ctx, "follow_C"); err != nil || day != "" {
+		t.Fatalf("GetSyncMark of a new sync = %q, %v", day, err)
+	}
+
+	for _, day := range []string{"2018-01-30", "2018-01-31"} {
+		if err := r.SetSyncMark(ctx, "follow_C", day); err != nil {
+			t.Fatalf("SetSyncMark: %s", err.Error())
+		}
+		if got, err := r.GetSyncMark(ctx, "follow_C"); err != nil || got != day {
+			t.Errorf("GetSyncMark = %q, %v, want %q", got, err, day)
+		}
+	}
+
+	if day, err := r.GetSyncMark(ctx, "follow_A"); err != nil || day != "" {
+		t.Errorf("GetSyncMark of another sync = %q, %v", day, err)
+	}
+}
+
+func testTrackingSubscriptions(t *testing.T, r repo.Definition) {
+	expires := time.Now().Add(24 * time.Hour)
+
+	first := &s.TrackingSubscription{Object: "PO444714015BR", Callback: "http://localhost/a", ClientID: "client", StopOn: s.StopOnDelivered}
+	second := &s.TrackingSubscription{Object: "PO444714029BR", Callback: "http://localhost/b"}
+	expired := &s.TrackingSubscription{Object: "PO444714032BR", Callback: "http://localhost/c"}
+
+	for _, sub := range []*s.TrackingSubscription{first, second} {
+		if err := r.InsertTrackingSubscription(ctx, sub, expires); err != nil {
+			t.Fatalf("InsertTrackingSubscription: %s", err.Error())
+		}
+	}
+	if err := r.InsertTrackingSubscription(ctx, expired, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("InsertTrackingSubscription: %s", err.Error())
+	}
+	if first.SubscriptionID <= 0 || first.Status != s.SubscriptionActive || first.ExpiresAt == "" {
+		t.Errorf("InsertTrackingSubscription set ID %d, Status %q, ExpiresAt %q", first.SubscriptionID, first.Status, first.ExpiresAt)
+	}
+
+	got, err := r.GetTrackingSubscriptionByID(ctx, first.SubscriptionID)
+	if err != nil || got.Object != first.Object || got.Callback != first.Callback || got.ClientID != "client" || got.StopOn != s.StopOnDelivered ||
+		got.Status != s.SubscriptionActive || got.LastEventID != 0 || got.ExpiresAt != first.ExpiresAt || got.CreatedAt == "" {
+		t.Fatalf("GetTrackingSubscriptionByID = %+v, %v", got, err)
+	}
+
+	active, err := r.GetActiveTrackingSubscriptions(ctx, 0, 10)
+	if err != nil || len(active) != 3 || active[0].SubscriptionID != first.SubscriptionID || active[2].SubscriptionID != expired.SubscriptionID {
+		t.Fatalf("GetActiveTrackingSubscriptions returned %d subscriptions, %v, want 3", len(active), err)
+	}
+	if active, err := r.GetActiveTrackingSubscriptions(ctx, first.SubscriptionID, 1); err != nil || len(active) != 1 || active[0].SubscriptionID != second.SubscriptionID {
+		t.Errorf("GetActiveTrackingSubscriptions after the first one returned %d subscriptions, %v", len(active), err)
+	}
+
+	ended, err := r.EndExpiredTrackingSubscriptions(ctx, time.Now())
+	if err != nil || ended != 1 {
+		t.Errorf("EndExpiredTrackingSubscriptions = %d, %v, want 1", ended, err)
+	}
+	if got, _ := r.GetTrackingSubscriptionByID(ctx, expired.SubscriptionID); got.Status != s.SubscriptionEnded || got.EndedReason != s.EndedExpired {
+		t.Errorf("expired subscription has Status %q, EndedReason %q", got.Status, got.EndedReason)
+	}
+
+	first.LastEventID = 42
+	if err := r.UpdateTrackingSubscription(ctx, first); err != nil {
+		t.Fatalf("UpdateTrackingSubscription: %s", err.Error())
+	}
+	second.Status = s.SubscriptionEnded
+	second.EndedReason = s.EndedDelivered
+	if err := r.UpdateTrackingSubscription(ctx, second); err != nil {
+		t.Fatalf("UpdateTrackingSubscription: %s", err.Error())
+	}
+
+	if got, _ := r.GetTrackingSubscriptionByID(ctx, first.SubscriptionID); got.LastEventID != 42 || got.CheckedAt == "" || got.Status != s.SubscriptionActive {
+		t.Errorf("updated subscription = %+v", got)
+	}
+	active, err = r.GetActiveTrackingSubscriptions(ctx, 0, 10)
+	if err != nil || len(active) != 1 || active[0].SubscriptionID != first.SubscriptionID {
+		t.Errorf("GetActiveTrackingSubscriptions after ending two returned %d subscriptions, %v, want 1", len(active), err)
+	}
+
+	if got, err := r.GetTrackingSubscriptionByID(ctx, expired.SubscriptionID+1000); err != nil || got.SubscriptionID != 0 {
+		t.Errorf("GetTrackingSubscriptionByID of an unknown subscription = %d, %v", got.SubscriptionID, err)
+	}
+}
+
+func testTransaction(t *testing.T, r repo.Definition) {
+	fail := errors.New("rollback")
+
+	// nothing written by a failed transaction is kept
+	o := NewRequest(1, "a")
+	err := r.Transaction(ctx, func(tx repo.Definition) error {
+		if err := tx.InsertRequest(ctx, o); err != nil {
+			return err
+		}
+		if err := tx.InsertStatusHistory(ctx, &s.StatusHistory{RequestID: o.RequestID, ToStatus: o.Status, Source: s.SourceAPI}); err != nil {
+			return err
+		}
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("Transaction returned %v, want the error of the function", err)
+	}
+	if got := get(t, r, o.RequestID); got.RequestID != 0 {
+		t.Errorf("request of a rolled back transaction was stored")
+	}
+	if list, _ := r.GetStatusHistoryByRequestID(ctx, o.RequestID); len(list) != 0 {
+		t.Errorf("history of a rolled back transaction was stored: %d", len(list))
+	}
+
+	// a transaction whose context is cancelled is not committed
+	o = NewRequest(3, "a")
+	cctx, cancel := context.WithCancel(ctx)
+	err = r.Transaction(cctx, func(tx repo.Definition) error {
+		if err := tx.InsertRequest(cctx, o); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	})
+	if err == nil {
+		t.Errorf("Transaction with a cancelled context did not fail")
+	}
+	if got := get(t, r, o.RequestID); got.RequestID != 0 {
+		t.Errorf("request of a cancelled transaction was stored")
+	}
+
+	// a transaction inside another one is committed with it
+	o = NewRequest(2, "a")
+	err = r.Transaction(ctx, func(tx repo.Definition) error {
+		if err := tx.InsertRequest(ctx, o); err != nil {
+			return err
+		}
+		return tx.Transaction(ctx, func(tx repo.Definition) error {
+			_, err := tx.UpdateRequestStatus(ctx, o, s.StatusProcessing, "")
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatalf("Transaction: %s", err.Error())
+	}
+	if got := get(t, r, o.RequestID); got.Status != s.StatusProcessing || len(got.Items) != 1 {
+		t.Errorf("committed transaction stored Status %q and %d items", got.Status, len(got.Items))
+	}
+
+	// a failed status change rolls back the history written with it
+	stale := get(t, r, o.RequestID)
+	moveTo(t, r, o, s.StatusError)
+	err = r.Transaction(ctx, func(tx repo.Definition) error {
+		if err := tx.InsertStatusHistory(ctx, &s.StatusHistory{RequestID: o.RequestID, FromStatus: stale.Status, ToStatus: s.StatusGenerated, Source: s.SourceCorreios}); err != nil {
+			return err
+		}
+		return tx.UpdateRequestPostage(ctx, stale, "123456789")
+	})
+	if err == nil {
+		t.Fatalf("Transaction with a stale status did not fail")
+	}
+	if list, _ := r.GetStatusHistoryByRequestID(ctx, o.RequestID); len(list) != 0 {
+		t.Errorf("history of a rolled back transaction was stored: %d", len(list))
+	}
+}
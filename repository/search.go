@@ -0,0 +1,326 @@
+package repository
+
+import (
+	"fmt"
+	s "github.com/pintobikez/brazilian-correios-service/api/structures"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	//DefaultOffset the default offset to be used in pagination
+	DefaultOffset = 50
+	//MaxGroupDepth max number of nested where groups
+	MaxGroupDepth = 5
+	//MaxInValues max number of values in an IN or NOT IN operator
+	MaxInValues = 1000
+	//LikeEscape escape character of the LIKE patterns
+	LikeEscape = "!"
+	//itemsPrefix prefix of the columns of the items of a request
+	itemsPrefix = "items."
+)
+
+//Field describes a column that can be used in a search
+type Field struct {
+	Column  string
+	Numeric bool
+}
+
+var (
+	//SearchFields fields that can be used in the where clauses of a search
+	SearchFields = map[string]Field{
+		"request_id":         {"o.request_id", true},
+		"order_nr":           {"o.order_nr", true},
+		"request_type":       {"o.request_type", false},
+		"request_service":    {"o.request_service", false},
+		"colect_date":        {"o.colect_date", false},
+		"slip_number":        {"o.slip_number", false},
+		"origin_nome":        {"o.origin_nome", false},
+		"origin_cep":         {"o.origin_cep", false},
+		"origin_cidade":      {"o.origin_cidade", false},
+		"origin_uf":          {"o.origin_uf", false},
+		"origin_email":       {"o.origin_email", false},
+		"destination_nome":   {"o.destination_nome", false},
+		"destination_cep":    {"o.destination_cep", false},
+		"destination_cidade": {"o.destination_cidade", false},
+		"destination_uf":     {"o.destination_uf", false},
+		"destination_email":  {"o.destination_email", false},
+		"status":             {"o.status", false},
+		"retries":            {"o.retries", true},
+		"postage_code":       {"o.postage_code", false},
+		"tracking_code":      {"o.tracking_code", false},
+		"created_at":         {"o.created_at", false},
+		"updated_at":         {"o.updated_at", false},
+		"client_id":          {"o.client_id", false},
+		"item":               {"items.item", false},
+		"product_name":       {"items.product_name", false},
+	}
+	//SortFields fields that can be used to order a search
+	SortFields = map[string]string{
+		"request_id":      "o.request_id",
+		"order_nr":        "o.order_nr",
+		"request_type":    "o.request_type",
+		"request_service": "o.request_service",
+		"status":          "o.status",
+		"retries":         "o.retries",
+		"postage_code":    "o.postage_code",
+		"tracking_code":   "o.tracking_code",
+		"created_at":      "o.created_at",
+		"updated_at":      "o.updated_at",
+	}
+	//SearchOperators operators that can be used in the where clauses of a search
+	SearchOperators = map[string]bool{"=": true, "!=": true, "<>": true, ">": true, "<": true, ">=": true, "<=": true, "LIKE": true, "NOT LIKE": true, "IN": true, "NOT IN": true}
+	//SearchJoins operators that can be used to join the conditions of a group
+	SearchJoins = map[string]bool{"AND": true, "OR": true}
+	//likeEscaper escapes the wildcards of a value searched with LIKE so it is matched as given
+	likeEscaper = strings.NewReplacer(LikeEscape, LikeEscape+LikeEscape, "%", LikeEscape+"%", "_", LikeEscape+"_")
+)
+
+//IsItem Returns true if the field is a column of the items of a request
+func (f Field) IsItem() bool {
+	return strings.HasPrefix(f.Column, itemsPrefix)
+}
+
+//SearchQuery the where and order by clauses of a search with the bound values
+type SearchQuery struct {
+	Where   string
+	OrderBy string
+	Args    []interface{}
+}
+
+//BuildSearch Builds the where and order by clauses of the search binding every value as a parameter
+func BuildSearch(req *s.Search) (*SearchQuery, error) {
+	q := &SearchQuery{Args: make([]interface{}, 0)}
+
+	where, err := buildGroup(req.Where, req.JoinBy, q, 0)
+	if err != nil {
+		return nil, err
+	}
+	if where != "" {
+		q.Where = "WHERE " + where
+	}
+
+	// set the default order field
+	if req.OrderField == "" {
+		req.OrderField = "request_id"
+	}
+	column, ok := SortFields[strings.ToLower(req.OrderField)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid order field %s", req.OrderField)
+	}
+
+	// set the default order value
+	req.OrderType = strings.ToUpper(req.OrderType)
+	if req.OrderType == "" {
+		req.OrderType = "DESC"
+	}
+	if req.OrderType != "ASC" && req.OrderType != "DESC" {
+		return nil, fmt.Errorf("Invalid order type %s", req.OrderType)
+	}
+	// the request_id keeps the order of the pages when the order field has repeated values
+	q.OrderBy = "ORDER BY " + column + " " + req.OrderType
+	if column != SortFields["request_id"] {
+		q.OrderBy += ", o.request_id"
+	}
+
+	// set the default offset
+	if req.Offset == 0 {
+		req.Offset = DefaultOffset
+	}
+
+	return q, nil
+}
+
+//buildGroup Builds the conditions of a group joined by the given operator
+func buildGroup(where []*s.SearchWhere, join string, q *SearchQuery, depth int) (string, error) {
+	if depth > MaxGroupDepth {
+		return "", fmt.Errorf("Too many nested groups, max is %d", MaxGroupDepth)
+	}
+
+	join = strings.ToUpper(join)
+	if join == "" {
+		join = "AND"
+	}
+	if !SearchJoins[join] {
+		return "", fmt.Errorf("Invalid join operator %s", join)
+	}
+
+	parts := make([]string, 0, len(where))
+	for _, e := range where {
+		if e == nil {
+			continue
+		}
+
+		var (
+			part string
+			err  error
+		)
+
+		if e.IsGroup() {
+			part, err = buildGroup(e.Where, e.JoinBy, q, depth+1)
+		} else {
+			part, err = buildCondition(e, q)
+		}
+		if err != nil {
+			return "", err
+		}
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) == 0 {
+		return "", nil
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+
+	return "(" + strings.Join(parts, " "+join+" ") + ")", nil
+}
+
+//buildCondition Builds a single condition binding its value, a condition on the items matches the requests with any item that meets it
+func buildCondition(e *s.SearchWhere, q *SearchQuery) (string, error) {
+	field, ok := SearchFields[strings.ToLower(e.Field)]
+	if !ok {
+		return "", fmt.Errorf("Invalid search field %s", e.Field)
+	}
+
+	op := strings.ToUpper(e.Operator)
+	if op == "" {
+		op = "="
+	}
+	if !SearchOperators[op] {
+		return "", fmt.Errorf("Invalid operator %s", e.Operator)
+	}
+
+	if op == "IN" || op == "NOT IN" {
+		values, err := ListValue(e.Value, field.Numeric)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", e.Field, err.Error())
+		}
+		q.Args = append(q.Args, values...)
+		return itemCondition(field, field.Column+" "+op+" ("+Placeholders(len(values))+")"), nil
+	}
+
+	value, err := ScalarValue(e.Value, field.Numeric)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", e.Field, err.Error())
+	}
+
+	// LIKE matches the values containing the given one, its wildcards are escaped
+	if op == "LIKE" || op == "NOT LIKE" {
+		q.Args = append(q.Args, "%"+likeEscaper.Replace(fmt.Sprint(value))+"%")
+		return itemCondition(field, field.Column+" "+op+" ? ESCAPE '"+LikeEscape+"'"), nil
+	}
+	q.Args = append(q.Args, value)
+
+	return itemCondition(field, field.Column+" "+op+" ?"), nil
+}
+
+//itemCondition Wraps a condition on the items in a subquery so each request is returned once with all of its items
+func itemCondition(field Field, condition string) string {
+	if !field.IsItem() {
+		return condition
+	}
+	return "EXISTS (SELECT 1 FROM request_item AS items WHERE items.fk_request_id=o.request_id AND " + condition + ")"
+}
+
+//ScalarValue Converts a json value into a value that can be bound to a query, a number given for a text column is
+//bound as its text because postgres does not compare a text column with a number
+func ScalarValue(v interface{}, numeric bool) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		if numeric {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return t, nil
+	case float64:
+		if t == float64(int64(t)) {
+			return numberValue(int64(t), numeric), nil
+		}
+		if !numeric {
+			return strconv.FormatFloat(t, 'f', -1, 64), nil
+		}
+		return t, nil
+	case int:
+		return numberValue(int64(t), numeric), nil
+	case int64:
+		return numberValue(t, numeric), nil
+	case bool:
+		if numeric {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return nil, fmt.Errorf("must be a string")
+	case nil:
+		return nil, fmt.Errorf("is empty")
+	}
+
+	return nil, fmt.Errorf("must be a string or a number")
+}
+
+//numberValue Returns the integer for a numeric column and its text for a text column
+func numberValue(n int64, numeric bool) interface{} {
+	if numeric {
+		return n
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+//ListValue Converts a json array into values that can be bound to a query
+func ListValue(v interface{}, numeric bool) ([]interface{}, error) {
+	var list []interface{}
+
+	switch t := v.(type) {
+	case []interface{}:
+		list = t
+	case []string:
+		for _, e := range t {
+			list = append(list, e)
+		}
+	default:
+		return nil, fmt.Errorf("must be an array")
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("is empty")
+	}
+	if len(list) > MaxInValues {
+		return nil, fmt.Errorf("has more than %d values", MaxInValues)
+	}
+
+	ret := make([]interface{}, 0, len(list))
+	for _, e := range list {
+		value, err := ScalarValue(e, numeric)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, value)
+	}
+
+	return ret, nil
+}
+
+//FieldNames Returns the sorted names of the given fields
+func FieldNames(fields interface{}) string {
+	names := make([]string, 0)
+
+	switch t := fields.(type) {
+	case map[string]Field:
+		for k := range t {
+			names = append(names, k)
+		}
+	case map[string]string:
+		for k := range t {
+			names = append(names, k)
+		}
+	case map[string]bool:
+		for k := range t {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,332 @@
+package sqlite
+
+import (
+	"github.com/pintobikez/brazilian-correios-service/repository/migrate"
+)
+
+//Migrations versioned changes of the sqlite schema, a new change is always a new migration
+var Migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "Requests and their items",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request (
+			  request_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  request_type TEXT NOT NULL,
+			  request_service TEXT NOT NULL,
+			  colect_date TEXT NOT NULL DEFAULT '',
+			  order_nr INTEGER NOT NULL,
+			  slip_number TEXT NOT NULL,
+			  origin_nome TEXT NOT NULL,
+			  origin_logradouro TEXT NOT NULL,
+			  origin_numero INTEGER NOT NULL,
+			  origin_complemento TEXT NOT NULL DEFAULT '',
+			  origin_cep TEXT NOT NULL,
+			  origin_bairro TEXT NOT NULL,
+			  origin_cidade TEXT NOT NULL,
+			  origin_uf TEXT NOT NULL,
+			  origin_referencia TEXT NOT NULL DEFAULT '',
+			  origin_email TEXT NOT NULL,
+			  origin_ddd TEXT NOT NULL DEFAULT '',
+			  origin_telefone TEXT NOT NULL DEFAULT '',
+			  destination_nome TEXT NOT NULL,
+			  destination_logradouro TEXT NOT NULL,
+			  destination_numero INTEGER NOT NULL,
+			  destination_complemento TEXT NOT NULL DEFAULT '',
+			  destination_cep TEXT NOT NULL,
+			  destination_bairro TEXT NOT NULL,
+			  destination_cidade TEXT NOT NULL,
+			  destination_uf TEXT NOT NULL,
+			  destination_referencia TEXT NOT NULL DEFAULT '',
+			  destination_email TEXT NOT NULL,
+			  callback TEXT NOT NULL,
+			  status TEXT NOT NULL,
+			  error_message TEXT NOT NULL DEFAULT '',
+			  retries INTEGER NOT NULL DEFAULT 0,
+			  postage_code TEXT NOT NULL DEFAULT '',
+			  tracking_code TEXT NOT NULL DEFAULT '',
+			  created_at TEXT DEFAULT (datetime('now')),
+			  updated_at TEXT DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_order_nr ON request (order_nr)`,
+			`CREATE INDEX IF NOT EXISTS request_postage_code ON request (postage_code)`,
+			`CREATE INDEX IF NOT EXISTS request_created_at ON request (created_at)`,
+			`CREATE TABLE IF NOT EXISTS request_item (
+			  order_item_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL,
+			  item TEXT NOT NULL,
+			  product_name TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_item_request_id ON request_item (fk_request_id)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_item",
+			"DROP TABLE IF EXISTS request",
+		},
+	},
+	{
+		Version:     2,
+		Description: "Clients, callbacks, status history and tracking",
+		Up: []string{
+			"ALTER TABLE request ADD COLUMN client_id TEXT NOT NULL DEFAULT ''",
+			`CREATE TABLE IF NOT EXISTS callback_delivery (
+			  callback_delivery_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL DEFAULT 0,
+			  client_id TEXT NOT NULL DEFAULT '',
+			  callback_type TEXT NOT NULL,
+			  url TEXT NOT NULL,
+			  payload TEXT NOT NULL,
+			  status TEXT NOT NULL,
+			  attempts INTEGER NOT NULL DEFAULT 0,
+			  response_code INTEGER NOT NULL DEFAULT 0,
+			  last_error TEXT NOT NULL DEFAULT '',
+			  next_attempt_at TEXT NOT NULL,
+			  delivered_at TEXT DEFAULT NULL,
+			  created_at TEXT DEFAULT (datetime('now')),
+			  updated_at TEXT DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS callback_delivery_request_id ON callback_delivery (fk_request_id)`,
+			`CREATE INDEX IF NOT EXISTS callback_delivery_status_next_attempt ON callback_delivery (status, next_attempt_at)`,
+			`CREATE TABLE IF NOT EXISTS client (
+			  client_id TEXT PRIMARY KEY,
+			  name TEXT NOT NULL,
+			  secret TEXT NOT NULL,
+			  previous_secret TEXT NOT NULL DEFAULT '',
+			  created_at TEXT DEFAULT (datetime('now')),
+			  rotated_at TEXT DEFAULT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS request_status_history (
+			  status_history_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL,
+			  from_status TEXT NOT NULL DEFAULT '',
+			  to_status TEXT NOT NULL,
+			  source TEXT NOT NULL,
+			  description TEXT NOT NULL DEFAULT '',
+			  created_at TEXT DEFAULT (datetime('now'))
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_status_history_request_id ON request_status_history (fk_request_id)`,
+			`CREATE TABLE IF NOT EXISTS tracking_object (
+			  tracking_code TEXT PRIMARY KEY,
+			  name TEXT NOT NULL DEFAULT '',
+			  category TEXT NOT NULL DEFAULT '',
+			  error TEXT NOT NULL DEFAULT '',
+			  refreshed_at TEXT NOT NULL,
+			  created_at TEXT DEFAULT (datetime('now'))
+			)`,
+			`CREATE TABLE IF NOT EXISTS tracking_event (
+			  tracking_event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  tracking_code TEXT NOT NULL,
+			  event_type TEXT NOT NULL,
+			  status_code TEXT NOT NULL,
+			  event_date TEXT NOT NULL,
+			  event_at TEXT DEFAULT NULL,
+			  description TEXT NOT NULL DEFAULT '',
+			  details TEXT NOT NULL DEFAULT '',
+			  responsible_unit TEXT NOT NULL DEFAULT '',
+			  created_at TEXT DEFAULT (datetime('now')),
+			  UNIQUE (tracking_code, event_type, status_code, event_date)
+			)`,
+			`CREATE INDEX IF NOT EXISTS tracking_event_object_event_at ON tracking_event (tracking_code, event_at)`,
+			`CREATE TABLE IF NOT EXISTS tracking_subscription (
+			  subscription_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  tracking_code TEXT NOT NULL,
+			  callback TEXT NOT NULL,
+			  client_id TEXT NOT NULL DEFAULT '',
+			  stop_on TEXT NOT NULL DEFAULT '',
+			  status TEXT NOT NULL,
+			  ended_reason TEXT NOT NULL DEFAULT '',
+			  last_event_id INTEGER NOT NULL DEFAULT 0,
+			  expires_at TEXT NOT NULL,
+			  checked_at TEXT DEFAULT NULL,
+			  created_at TEXT DEFAULT (datetime('now')),
+			  updated_at TEXT DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS tracking_subscription_status ON tracking_subscription (status, subscription_id)`,
+			`CREATE INDEX IF NOT EXISTS tracking_subscription_tracking_code ON tracking_subscription (tracking_code)`,
+			`CREATE TABLE IF NOT EXISTS tracking_job (
+			  job_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  status TEXT NOT NULL,
+			  tracking_type TEXT NOT NULL,
+			  language TEXT NOT NULL,
+			  callback TEXT NOT NULL DEFAULT '',
+			  client_id TEXT NOT NULL DEFAULT '',
+			  objects TEXT NOT NULL,
+			  result TEXT,
+			  error TEXT NOT NULL DEFAULT '',
+			  created_at TEXT DEFAULT (datetime('now')),
+			  updated_at TEXT DEFAULT NULL,
+			  finished_at TEXT DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS tracking_job_status ON tracking_job (status)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS tracking_job",
+			"DROP TABLE IF EXISTS tracking_subscription",
+			"DROP TABLE IF EXISTS tracking_event",
+			"DROP TABLE IF EXISTS tracking_object",
+			"DROP TABLE IF EXISTS request_status_history",
+			"DROP TABLE IF EXISTS client",
+			"DROP TABLE IF EXISTS callback_delivery",
+			"ALTER TABLE request DROP COLUMN client_id",
+		},
+	},
+	{
+		Version:     3,
+		Description: "Reverse job queue",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS reverse_job (
+			  reverse_job_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL,
+			  action TEXT NOT NULL,
+			  source TEXT NOT NULL,
+			  status TEXT NOT NULL,
+			  attempts INTEGER NOT NULL DEFAULT 0,
+			  lease_owner TEXT NOT NULL DEFAULT '',
+			  lease_until TEXT DEFAULT NULL,
+			  last_error TEXT NOT NULL DEFAULT '',
+			  created_at TEXT DEFAULT (datetime('now')),
+			  updated_at TEXT DEFAULT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS reverse_job_request_id ON reverse_job (fk_request_id, status)`,
+			`CREATE INDEX IF NOT EXISTS reverse_job_status ON reverse_job (status, lease_until)`,
+			// the requests left pending or processing before the queue existed are submitted again
+			`INSERT INTO reverse_job (fk_request_id, action, source, status, created_at)
+			  SELECT request_id, 'create', 'cron', 'pending', datetime('now') FROM request WHERE status IN ('pending', 'processing')`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS reverse_job",
+		},
+	},
+	{
+		Version:     4,
+		Description: "Cron locks",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS cron_lock (
+			  name TEXT PRIMARY KEY,
+			  owner TEXT NOT NULL DEFAULT '',
+			  locked_until TEXT NOT NULL,
+			  updated_at TEXT DEFAULT NULL
+			)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS cron_lock",
+		},
+	},
+	{
+		Version:     5,
+		Description: "Sync marks",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS sync_mark (
+			  name TEXT PRIMARY KEY,
+			  synced_until TEXT NOT NULL,
+			  updated_at TEXT DEFAULT NULL
+			)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS sync_mark",
+		},
+	},
+	{
+		Version:     6,
+		Description: "Request objects and Correios history",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request_object (
+			  request_object_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL,
+			  tracking_code TEXT NOT NULL DEFAULT '',
+			  client_object_id TEXT NOT NULL DEFAULT '',
+			  status TEXT NOT NULL DEFAULT '',
+			  description TEXT NOT NULL DEFAULT '',
+			  real_weight REAL NOT NULL DEFAULT 0,
+			  cubic_weight REAL NOT NULL DEFAULT 0,
+			  postage_value REAL NOT NULL DEFAULT 0,
+			  last_update TEXT NOT NULL DEFAULT '',
+			  created_at TEXT DEFAULT (datetime('now')),
+			  updated_at TEXT DEFAULT NULL,
+			  UNIQUE (fk_request_id, tracking_code)
+			)`,
+			`CREATE TABLE IF NOT EXISTS request_correios_history (
+			  correios_history_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL,
+			  status TEXT NOT NULL,
+			  description TEXT NOT NULL DEFAULT '',
+			  observation TEXT NOT NULL DEFAULT '',
+			  event_date TEXT NOT NULL,
+			  created_at TEXT DEFAULT (datetime('now')),
+			  UNIQUE (fk_request_id, status, event_date)
+			)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_correios_history",
+			"DROP TABLE IF EXISTS request_object",
+		},
+	},
+	{
+		Version:     7,
+		Description: "Request packages",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS request_package (
+			  request_package_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL,
+			  object_id TEXT NOT NULL,
+			  description TEXT NOT NULL DEFAULT '',
+			  coleta INTEGER NOT NULL DEFAULT 0,
+			  postage_code TEXT NOT NULL DEFAULT '',
+			  tracking_code TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_package_request_id ON request_package (fk_request_id)`,
+			`CREATE INDEX IF NOT EXISTS request_package_postage_code ON request_package (postage_code)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_package",
+		},
+	},
+	{
+		Version:     8,
+		Description: "Declared value, additional services, AR, checklist and products of the requests",
+		Up: []string{
+			"ALTER TABLE request ADD COLUMN declared_value REAL NOT NULL DEFAULT 0",
+			"ALTER TABLE request ADD COLUMN additional_services TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE request ADD COLUMN ar INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE request ADD COLUMN checklist TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE request ADD COLUMN documents TEXT NOT NULL DEFAULT ''",
+			`CREATE TABLE IF NOT EXISTS request_product (
+			  request_product_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			  fk_request_id INTEGER NOT NULL,
+			  code TEXT NOT NULL,
+			  type TEXT NOT NULL,
+			  quantity INTEGER NOT NULL DEFAULT 1
+			)`,
+			`CREATE INDEX IF NOT EXISTS request_product_request_id ON request_product (fk_request_id)`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS request_product",
+			"ALTER TABLE request DROP COLUMN declared_value",
+			"ALTER TABLE request DROP COLUMN additional_services",
+			"ALTER TABLE request DROP COLUMN ar",
+			"ALTER TABLE request DROP COLUMN checklist",
+			"ALTER TABLE request DROP COLUMN documents",
+		},
+	},
+	{
+		Version:     9,
+		Description: "Leases of the tracking jobs",
+		Up: []string{
+			"ALTER TABLE tracking_job ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE tracking_job ADD COLUMN lease_owner TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE tracking_job ADD COLUMN lease_until TEXT DEFAULT NULL",
+			`CREATE INDEX IF NOT EXISTS tracking_job_status_lease_until ON tracking_job (status, lease_until)`,
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS tracking_job_status_lease_until",
+			"ALTER TABLE tracking_job DROP COLUMN attempts",
+			"ALTER TABLE tracking_job DROP COLUMN lease_owner",
+			"ALTER TABLE tracking_job DROP COLUMN lease_until",
+		},
+	},
+}
+
+//Migrator Returns the migrator of the sqlite schema
+func (r *Client) Migrator() *migrate.Migrator {
+	return migrate.New(r.db, Migrations, nil, nil)
+}
@@ -0,0 +1,94 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	repo "github.com/pintobikez/brazilian-correios-service/repository"
+	"github.com/pintobikez/brazilian-correios-service/repository/repotest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//tempClient a Client whose database file is removed when it is disconnected
+type tempClient struct {
+	*Client
+	dir string
+}
+
+//Disconnect Closes the database and removes its file
+func (c *tempClient) Disconnect() {
+	c.Client.Disconnect()
+	os.RemoveAll(c.dir)
+}
+
+//TestRepository Runs the conformance suite against a new database file for each test
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repo.Definition {
+		dir, err := ioutil.TempDir("", "correios-sqlite")
+		if err != nil {
+			t.Fatalf("TempDir: %s", err.Error())
+		}
+
+		r := new(Client)
+		if err := r.Connect(filepath.Join(dir, "correios.db")); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("Connect: %s", err.Error())
+		}
+		return &tempClient{r, dir}
+	})
+}
+
+//TestMigrateFromBaseline Upgrades a database that only has the tables of the first release
+func TestMigrateFromBaseline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "correios-sqlite")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "correios.db")
+
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatalf("Open: %s", err.Error())
+	}
+	for _, stmt := range Migrations[0].Up {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Creating the baseline schema: %s", err.Error())
+		}
+	}
+	if _, err := db.Exec("INSERT INTO request (request_type, request_service, order_nr, slip_number, origin_nome, origin_logradouro, origin_numero, origin_cep, origin_bairro, origin_cidade, origin_uf, origin_email, " +
+		"destination_nome, destination_logradouro, destination_numero, destination_cep, destination_bairro, destination_cidade, destination_uf, destination_email, callback, status) " +
+		"VALUES ('POSTAGE','04677',1,'123','a','b',1,'01310100','c','d','SP','e@mail.com','f','g',2,'20040002','h','i','RJ','j@mail.com','http://localhost','pending')"); err != nil {
+		t.Fatalf("Inserting a baseline request: %s", err.Error())
+	}
+	db.Close()
+
+	r := new(Client)
+	if err := r.Connect(file); err != nil {
+		t.Fatalf("Connect: %s", err.Error())
+	}
+	defer r.Disconnect()
+
+	if err := r.Migrator().Check(); err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+
+	o, err := r.GetRequestByID(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("GetRequestByID: %s", err.Error())
+	}
+	if o.ClientID != "" || o.Status != "pending" {
+		t.Errorf("got client %q status %q, want the baseline request without client", o.ClientID, o.Status)
+	}
+
+	// the requests created before the reverse job queue are submitted again
+	jobs, err := r.GetReverseJobsByRequestID(context.Background(), 1)
+	if err != nil || len(jobs) != 1 {
+		t.Errorf("got %d reverse jobs, %v, want the job of the pending request", len(jobs), err)
+	}
+	if err := r.InsertRequest(context.Background(), repotest.NewRequest(2, "a")); err != nil {
+		t.Errorf("InsertRequest: %s", err.Error())
+	}
+}
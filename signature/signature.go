@@ -0,0 +1,147 @@
+//Package signature signs and verifies the callbacks sent by the Correios service.
+//
+//Every callback carries the header:
+//
+//	X-Correios-Signature: t=<unix timestamp>,v1=<hex hmac>[,v1=<hex hmac>]
+//
+//where each v1 is the HMAC-SHA256 of "<timestamp>.<body>" with one of the active
+//secrets of the client. While a secret is being rotated both secrets sign the body,
+//so a consumer can verify with either of them.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//Header name of the Http header that carries the signature
+	Header = "X-Correios-Signature"
+	//Scheme name of the signature scheme in the header
+	Scheme = "v1"
+	//DefaultTolerance max age of a signature accepted by Verify
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	//ErrNoSignature the header is empty
+	ErrNoSignature = errors.New("signature: no signature found")
+	//ErrInvalidHeader the header is not in the expected format
+	ErrInvalidHeader = errors.New("signature: invalid header format")
+	//ErrTooOld the timestamp of the signature is out of the tolerance
+	ErrTooOld = errors.New("signature: timestamp out of tolerance")
+	//ErrMismatch no signature matches the body with the given secrets
+	ErrMismatch = errors.New("signature: no signature matches the body")
+)
+
+//Compute Returns the hex HMAC-SHA256 of the timestamp and body with the secret
+func Compute(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Sign Returns the header value signing the body at the given time with every non empty secret
+func Sign(body []byte, at time.Time, secrets ...string) string {
+	ts := at.Unix()
+	parts := []string{"t=" + strconv.FormatInt(ts, 10)}
+
+	for _, secret := range secrets {
+		if secret != "" {
+			parts = append(parts, Scheme+"="+Compute(secret, ts, body))
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+//Parse Returns the timestamp and the signatures of a header value
+func Parse(header string) (int64, []string, error) {
+	if header == "" {
+		return 0, nil, ErrNoSignature
+	}
+
+	var (
+		ts   int64 = -1
+		sigs []string
+	)
+
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return 0, nil, ErrInvalidHeader
+		}
+
+		switch kv[0] {
+		case "t":
+			v, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return 0, nil, ErrInvalidHeader
+			}
+			ts = v
+		case Scheme:
+			sigs = append(sigs, kv[1])
+		}
+	}
+
+	if ts < 0 || len(sigs) == 0 {
+		return 0, nil, ErrInvalidHeader
+	}
+
+	return ts, sigs, nil
+}
+
+//Verify Checks that the header signs the body with one of the secrets within the tolerance, a tolerance of 0 uses DefaultTolerance
+func Verify(header string, body []byte, tolerance time.Duration, secrets ...string) error {
+	return VerifyAt(header, body, time.Now(), tolerance, secrets...)
+}
+
+//VerifyAt Checks the header as Verify does using the given time as now
+func VerifyAt(header string, body []byte, now time.Time, tolerance time.Duration, secrets ...string) error {
+	ts, sigs, err := Parse(header)
+	if err != nil {
+		return err
+	}
+
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	if math.Abs(float64(now.Unix()-ts)) > tolerance.Seconds() {
+		return ErrTooOld
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		expected := []byte(Compute(secret, ts, body))
+		for _, sig := range sigs {
+			if hmac.Equal(expected, []byte(sig)) {
+				return nil
+			}
+		}
+	}
+
+	return ErrMismatch
+}
+
+//VerifyRequest Reads the body of a callback request and checks its signature, returns the body
+func VerifyRequest(r *http.Request, tolerance time.Duration, secrets ...string) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, Verify(r.Header.Get(Header), body, tolerance, secrets...)
+}
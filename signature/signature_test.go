@@ -0,0 +1,124 @@
+package signature
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	body = []byte(`{"request_id":1,"status":"generated"}`)
+	at   = time.Unix(1500000000, 0)
+)
+
+func TestSign(t *testing.T) {
+	ts := strconv.FormatInt(at.Unix(), 10)
+
+	cases := []struct {
+		name    string
+		secrets []string
+		want    string
+	}{
+		{"one secret", []string{"new"}, "t=" + ts + ",v1=" + Compute("new", at.Unix(), body)},
+		{"rotation", []string{"new", "old"}, "t=" + ts + ",v1=" + Compute("new", at.Unix(), body) + ",v1=" + Compute("old", at.Unix(), body)},
+		{"empty previous secret", []string{"new", ""}, "t=" + ts + ",v1=" + Compute("new", at.Unix(), body)},
+		{"no secret", nil, "t=" + ts},
+	}
+
+	for _, c := range cases {
+		if got := Sign(body, at, c.secrets...); got != c.want {
+			t.Errorf("%s: Sign = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	if Compute("new", at.Unix(), body) == Compute("old", at.Unix(), body) {
+		t.Error("different secrets give the same signature")
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		ts     int64
+		sigs   int
+		err    error
+	}{
+		{"one signature", "t=10,v1=aa", 10, 1, nil},
+		{"two signatures", "t=10,v1=aa,v1=bb", 10, 2, nil},
+		{"spaces", "t=10, v1=aa", 10, 1, nil},
+		{"unknown scheme ignored", "t=10,v0=zz,v1=aa", 10, 1, nil},
+		{"empty", "", 0, 0, ErrNoSignature},
+		{"no timestamp", "v1=aa", 0, 0, ErrInvalidHeader},
+		{"no signature", "t=10", 0, 0, ErrInvalidHeader},
+		{"only unknown scheme", "t=10,v0=aa", 0, 0, ErrInvalidHeader},
+		{"timestamp not a number", "t=abc,v1=aa", 0, 0, ErrInvalidHeader},
+		{"negative timestamp", "t=-1,v1=aa", 0, 0, ErrInvalidHeader},
+		{"part without value", "t=10,v1", 0, 0, ErrInvalidHeader},
+		{"garbage", "garbage", 0, 0, ErrInvalidHeader},
+	}
+
+	for _, c := range cases {
+		ts, sigs, err := Parse(c.header)
+		if err != c.err || ts != c.ts || len(sigs) != c.sigs {
+			t.Errorf("%s: Parse(%q) = %d, %d signatures, %v, want %d, %d, %v", c.name, c.header, ts, len(sigs), err, c.ts, c.sigs, c.err)
+		}
+	}
+}
+
+func TestVerifyAt(t *testing.T) {
+	rotation := Sign(body, at, "new", "old")
+	ts := strconv.FormatInt(at.Unix(), 10)
+
+	cases := []struct {
+		name      string
+		header    string
+		body      []byte
+		now       time.Time
+		tolerance time.Duration
+		secrets   []string
+		err       error
+	}{
+		{"new secret during a rotation", rotation, body, at, 0, []string{"new"}, nil},
+		{"previous secret during a rotation", rotation, body, at, 0, []string{"old"}, nil},
+		{"consumer with both secrets", rotation, body, at, 0, []string{"other", "old"}, nil},
+		{"only the previous secret signed", Sign(body, at, "old"), body, at, 0, []string{"new", "old"}, nil},
+		{"unknown secret", rotation, body, at, 0, []string{"other"}, ErrMismatch},
+		{"empty secret", rotation, body, at, 0, []string{""}, ErrMismatch},
+		{"no secrets", rotation, body, at, 0, nil, ErrMismatch},
+		{"at the tolerance in the past", rotation, body, at.Add(DefaultTolerance), 0, []string{"new"}, nil},
+		{"past the tolerance in the past", rotation, body, at.Add(DefaultTolerance + time.Second), 0, []string{"new"}, ErrTooOld},
+		{"at the tolerance in the future", rotation, body, at.Add(-DefaultTolerance), 0, []string{"new"}, nil},
+		{"past the tolerance in the future", rotation, body, at.Add(-DefaultTolerance - time.Second), 0, []string{"new"}, ErrTooOld},
+		{"custom tolerance", rotation, body, at.Add(time.Minute + time.Second), time.Minute, []string{"new"}, ErrTooOld},
+		{"tampered body", rotation, bytes.Replace(body, []byte("generated"), []byte("canceled"), 1), at, 0, []string{"new", "old"}, ErrMismatch},
+		{"tampered timestamp", strings.Replace(rotation, "t="+ts, "t="+strconv.FormatInt(at.Unix()+1, 10), 1), body, at, 0, []string{"new", "old"}, ErrMismatch},
+		{"tampered signature", strings.Replace(rotation, "v1=", "v1=0", 1), body, at, 0, []string{"new"}, ErrMismatch},
+		{"malformed header", "t=" + ts + ";v1=aa", body, at, 0, []string{"new"}, ErrInvalidHeader},
+		{"no header", "", body, at, 0, []string{"new"}, ErrNoSignature},
+	}
+
+	for _, c := range cases {
+		if err := VerifyAt(c.header, c.body, c.now, c.tolerance, c.secrets...); err != c.err {
+			t.Errorf("%s: VerifyAt = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/callback", bytes.NewReader(body))
+	r.Header.Set(Header, Sign(body, time.Now(), "new"))
+
+	got, err := VerifyRequest(r, 0, "new")
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("VerifyRequest = %q, %v, want the body", got, err)
+	}
+
+	r = httptest.NewRequest("POST", "/callback", bytes.NewReader(body))
+	if _, err := VerifyRequest(r, 0, "new"); err != ErrNoSignature {
+		t.Errorf("VerifyRequest without header = %v, want %v", err, ErrNoSignature)
+	}
+}
@@ -0,0 +1,152 @@
+//Package trackingcode parses and validates the S10 object codes used by Correios.
+//
+//A code is formed by a two letter service prefix, an eight digit number, a mod 11
+//check digit and the two letter country, e.g. PO444714015BR.
+package trackingcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	//Length number of characters of a code
+	Length = 13
+	//Country country of the codes issued by Correios
+	Country = "BR"
+)
+
+var (
+	//ErrLength the code doesn't have 13 characters
+	ErrLength = errors.New("must have 13 characters")
+	//ErrPrefix the code doesn't start with two letters
+	ErrPrefix = errors.New("must start with two letters")
+	//ErrNumber the code doesn't have eight digits and the check digit after the prefix
+	ErrNumber = errors.New("must have nine digits after the prefix")
+	//ErrCountry the code doesn't end with BR
+	ErrCountry = errors.New("must end with " + Country)
+	//ErrCheckDigit the check digit doesn't match the number
+	ErrCheckDigit = errors.New("invalid check digit")
+
+	//weights of each digit of the number in the check digit
+	weights = []int{8, 6, 4, 2, 3, 5, 9, 7}
+
+	//Services map of the known prefixes to the name of the service
+	Services = map[string]string{
+		"LR": "Logística Reversa PAC",
+		"LS": "Logística Reversa SEDEX",
+		"LV": "Logística Reversa e-SEDEX",
+		"PO": "PAC",
+		"EC": "PAC",
+		"SS": "SEDEX",
+		"SX": "SEDEX 10",
+		"SW": "e-SEDEX",
+		"JO": "Carta Registrada",
+		"CP": "Encomenda Internacional",
+		"EA": "EMS",
+	}
+)
+
+//Code structure of a parsed object code
+type Code struct {
+	Prefix     string `json:"prefix"`
+	Number     string `json:"number"`
+	CheckDigit int    `json:"check_digit"`
+	Country    string `json:"country"`
+	Service    string `json:"service,omitempty"`
+}
+
+//String Returns the code in the S10 format
+func (c *Code) String() string {
+	return fmt.Sprintf("%s%s%d%s", c.Prefix, c.Number, c.CheckDigit, c.Country)
+}
+
+//Parse Parses and validates a code, lower case letters and surrounding spaces are accepted
+func Parse(code string) (*Code, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != Length {
+		return nil, ErrLength
+	}
+
+	if !isLetters(code[0:2]) {
+		return nil, ErrPrefix
+	}
+	if !isDigits(code[2:11]) {
+		return nil, ErrNumber
+	}
+	if code[11:] != Country {
+		return nil, ErrCountry
+	}
+
+	c := &Code{Prefix: code[0:2], Number: code[2:10], CheckDigit: int(code[10] - '0'), Country: code[11:]}
+	if dv, _ := CheckDigit(c.Number); dv != c.CheckDigit {
+		return nil, ErrCheckDigit
+	}
+	c.Service = Services[c.Prefix]
+
+	return c, nil
+}
+
+//Valid Returns true if the code is a valid S10 code
+func Valid(code string) bool {
+	_, err := Parse(code)
+	return err == nil
+}
+
+//CheckDigit Computes the mod 11 check digit of an eight digit number
+func CheckDigit(number string) (int, error) {
+	if len(number) != len(weights) || !isDigits(number) {
+		return 0, ErrNumber
+	}
+
+	sum := 0
+	for i := range number {
+		sum += int(number[i]-'0') * weights[i]
+	}
+
+	switch rest := sum % 11; rest {
+	case 0:
+		return 5, nil
+	case 1:
+		return 0, nil
+	default:
+		return 11 - rest, nil
+	}
+}
+
+//Build Returns the code of the two letter prefix and the eight digit number with its check digit
+func Build(prefix string, number int) (string, error) {
+	prefix = strings.ToUpper(prefix)
+	if len(prefix) != 2 || !isLetters(prefix) {
+		return "", ErrPrefix
+	}
+
+	digits := fmt.Sprintf("%08d", number)
+	dv, err := CheckDigit(digits)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s%d%s", prefix, digits, dv, Country), nil
+}
+
+//isLetters Returns true if every character is an upper case letter
+func isLetters(s string) bool {
+	for i := range s {
+		if s[i] < 'A' || s[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+//isDigits Returns true if every character is a digit
+func isDigits(s string) bool {
+	for i := range s {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package trackingcode
+
+import (
+	"testing"
+)
+
+func TestCheckDigit(t *testing.T) {
+	cases := []struct {
+		number string
+		want   int
+		err    error
+	}{
+		{"44471401", 5, nil},
+		// remainder 0 gives 5
+		{"00000015", 5, nil},
+		{"00000000", 5, nil},
+		// remainder 1 gives 0
+		{"00000008", 0, nil},
+		{"00000012", 0, nil},
+		// any other remainder gives 11 minus it
+		{"00000001", 4, nil},
+		{"4447140", 0, ErrNumber},
+		{"444714015", 0, ErrNumber},
+		{"4447140A", 0, ErrNumber},
+		{"", 0, ErrNumber},
+	}
+
+	for _, c := range cases {
+		if got, err := CheckDigit(c.number); got != c.want || err != c.err {
+			t.Errorf("CheckDigit(%q) = %d, %v, want %d, %v", c.number, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		code string
+		want string
+		err  error
+	}{
+		{"PO444714015BR", "PO444714015BR", nil},
+		{"po444714015br", "PO444714015BR", nil},
+		{" PO444714015BR ", "PO444714015BR", nil},
+		{"LR000000155BR", "LR000000155BR", nil},
+		{"LR000000080BR", "LR000000080BR", nil},
+		{"PO444714016BR", "", ErrCheckDigit},
+		{"PO444714025BR", "", ErrCheckDigit},
+		{"PO44471401XBR", "", ErrNumber},
+		{"PO4447140A5BR", "", ErrNumber},
+		{"P0444714015BR", "", ErrPrefix},
+		{"12444714015BR", "", ErrPrefix},
+		{"PO444714015US", "", ErrCountry},
+		{"PO444714015B1", "", ErrCountry},
+		{"PO44471401BR", "", ErrLength},
+		{"PO4447140155BR", "", ErrLength},
+		{"", "", ErrLength},
+	}
+
+	for _, c := range cases {
+		got, err := Parse(c.code)
+		if err != c.err {
+			t.Errorf("Parse(%q) error = %v, want %v", c.code, err, c.err)
+			continue
+		}
+		if err == nil && got.String() != c.want {
+			t.Errorf("Parse(%q) = %s, want %s", c.code, got.String(), c.want)
+		}
+	}
+
+	c, err := Parse("PO444714015BR")
+	if err != nil || c.Prefix != "PO" || c.Number != "44471401" || c.CheckDigit != 5 || c.Country != Country || c.Service != "PAC" {
+		t.Errorf("Parse(PO444714015BR) = %+v, %v", c, err)
+	}
+	if c, err := Parse("ZZ444714015BR"); err != nil || c.Service != "" {
+		t.Errorf("an unknown prefix got service %q, %v, want a valid code without service", c.Service, err)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	cases := []struct {
+		prefix string
+		number int
+		want   string
+		err    error
+	}{
+		{"PO", 44471401, "PO444714015BR", nil},
+		{"po", 44471401, "PO444714015BR", nil},
+		{"LR", 15, "LR000000155BR", nil},
+		{"LR", 8, "LR000000080BR", nil},
+		{"LR", 123456789, "", ErrNumber},
+		{"LR", -1, "", ErrNumber},
+		{"L", 1, "", ErrPrefix},
+		{"LRX", 1, "", ErrPrefix},
+		{"L1", 1, "", ErrPrefix},
+	}
+
+	for _, c := range cases {
+		got, err := Build(c.prefix, c.number)
+		if got != c.want || err != c.err {
+			t.Errorf("Build(%q, %d) = %q, %v, want %q, %v", c.prefix, c.number, got, err, c.want, c.err)
+		}
+		if err == nil && !Valid(got) {
+			t.Errorf("Build(%q, %d) = %s is not valid", c.prefix, c.number, got)
+		}
+	}
+}